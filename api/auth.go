@@ -0,0 +1,396 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Role grants a set of actions. Each role includes the ones before it.
+type Role string
+
+// Roles, from least to most privileged
+const (
+	RoleNone     Role = ""
+	RoleViewer   Role = "viewer"   // Read compositions, instances and files
+	RoleEditor   Role = "editor"   // Create, change, build and delete compositions
+	RoleOperator Role = "operator" // Start and stop instances and write files to real backends
+)
+
+var roleLevels = map[Role]int{RoleNone: 0, RoleViewer: 1, RoleEditor: 2, RoleOperator: 3}
+
+// Allows reports whether r includes the actions of required
+func (r Role) Allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, rejecting unknown
+// roles
+func (r *Role) UnmarshalText(text []byte) error {
+	role := Role(text)
+	if _, ok := roleLevels[role]; !ok {
+		return fmt.Errorf("unknown role %q (want viewer, editor or operator)", text)
+	}
+	*r = role
+	return nil
+}
+
+// AuthConfig configures how API requests are authenticated and what each
+// principal may do. It is read from YAML:
+//
+//	origins: [https://studio.example.com]
+//	anonymous: viewer
+//	tokens:
+//	  - name: ci
+//	    tokenEnv: FSCOMPOSER_CI_TOKEN
+//	    role: operator
+//	usersFile: users.txt   # name:bcrypt-hash:role per line
+//	jwt:
+//	  jwks: jwks.json
+//	  issuer: https://login.example.com
+//	  audience: fscomposer
+//	  roleClaim: realm_access.roles
+//	permissions:
+//	  backups:             # Only these principals may access "backups"
+//	    alice: operator
+//	    jwt:carol: editor  # JWT names carry a jwt: prefix
+//	    "*": viewer
+type AuthConfig struct {
+	Origins     []string                   `yaml:"origins"`
+	Anonymous   Role                       `yaml:"anonymous"`
+	Tokens      []TokenConfig              `yaml:"tokens"`
+	UsersFile   string                     `yaml:"usersFile"`
+	JWT         *JWTConfig                 `yaml:"jwt"`
+	Permissions map[string]map[string]Role `yaml:"permissions"`
+}
+
+// TokenConfig is a static bearer token
+type TokenConfig struct {
+	Name     string `yaml:"name"`
+	Token    string `yaml:"token"`
+	TokenEnv string `yaml:"tokenEnv"`
+	Role     Role   `yaml:"role"`
+}
+
+// LoadAuthConfig reads an auth config file. Relative usersFile and jwks
+// paths are resolved against the file's directory.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth config: %w", err)
+	}
+	var cfg AuthConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse auth config %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	if cfg.UsersFile != "" {
+		cfg.UsersFile = resolvePath(dir, cfg.UsersFile)
+	}
+	if cfg.JWT != nil && cfg.JWT.JWKS != "" {
+		cfg.JWT.JWKS = resolvePath(dir, cfg.JWT.JWKS)
+	}
+	return &cfg, nil
+}
+
+// resolvePath makes a relative path relative to dir
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Principal is an authenticated caller. Tokens and users are named as in
+// the auth config; JWT names are prefixed with "jwt:" so an issuer cannot
+// mint a token for a configured principal.
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+	Via  string `json:"via"` // token, basic, jwt or anonymous
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns the principal of an authenticated request
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Authenticator identifies callers from static tokens, a users file or
+// JWTs, and decides what they may do
+type Authenticator struct {
+	config *AuthConfig
+	tokens []TokenConfig
+	users  map[string]basicUser
+	jwt    *jwtVerifier
+}
+
+type basicUser struct {
+	hash []byte
+	role Role
+}
+
+// NewAuthenticator loads the users file and JWKS named by the config
+func NewAuthenticator(cfg *AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{config: cfg, users: make(map[string]basicUser)}
+
+	for i, t := range cfg.Tokens {
+		if t.Token == "" && t.TokenEnv != "" {
+			if t.Token = os.Getenv(t.TokenEnv); t.Token == "" {
+				return nil, fmt.Errorf("token %s: environment variable %s is not set", t.Name, t.TokenEnv)
+			}
+		}
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %d: 'token' or 'tokenEnv' is required", i)
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token-%d", i)
+		}
+		if strings.Contains(t.Name, ":") {
+			return nil, fmt.Errorf("token %s: names cannot contain ':'", t.Name)
+		}
+		a.tokens = append(a.tokens, t)
+	}
+
+	if cfg.UsersFile != "" {
+		if err := a.loadUsers(cfg.UsersFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Permissions name tokens and users alike, so one name cannot be both
+	for _, t := range a.tokens {
+		if _, ok := a.users[t.Name]; ok {
+			return nil, fmt.Errorf("token %s: a user has the same name", t.Name)
+		}
+	}
+
+	if cfg.JWT != nil {
+		v, err := newJWTVerifier(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = v
+	}
+	return a, nil
+}
+
+// loadUsers reads name:bcrypt-hash:role lines. Blank lines and lines
+// starting with # are skipped.
+func (a *Authenticator) loadUsers(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) != 3 || !strings.HasPrefix(fields[1], "$2") {
+			return fmt.Errorf("%s:%d: want name:bcrypt-hash:role", path, line)
+		}
+		var role Role
+		if err := role.UnmarshalText([]byte(fields[2])); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		a.users[fields[0]] = basicUser{hash: []byte(fields[1]), role: role}
+	}
+	return scanner.Err()
+}
+
+// errUnauthenticated is returned for requests with invalid credentials
+var errUnauthenticated = fmt.Errorf("invalid credentials")
+
+// authenticate identifies the caller from an Authorization header, or an
+// access_token query parameter for WebSockets, which cannot send headers
+// from browsers. Requests without credentials are refused unless an
+// anonymous role is configured.
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if token := r.URL.Query().Get("access_token"); header == "" && token != "" {
+		header = "Bearer " + token
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		u, known := a.users[user]
+		if !known || bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+			return nil, errUnauthenticated
+		}
+		return &Principal{Name: user, Role: u.role, Via: "basic"}, nil
+	}
+
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		token = strings.TrimSpace(token)
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return &Principal{Name: t.Name, Role: t.Role, Via: "token"}, nil
+			}
+		}
+		if a.jwt != nil && strings.Count(token, ".") == 2 {
+			p, err := a.jwt.verify(token)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errUnauthenticated, err)
+			}
+			return p, nil
+		}
+		return nil, errUnauthenticated
+	}
+
+	if header != "" || a.config.Anonymous == RoleNone {
+		return nil, errUnauthenticated
+	}
+	return &Principal{Name: "anonymous", Role: a.config.Anonymous, Via: "anonymous"}, nil
+}
+
+// roleFor returns a principal's role for a composition. Compositions
+// listed in permissions are only open to the principals listed there, or
+// to everyone else under "*"; all others use the principal's own role.
+func (a *Authenticator) roleFor(p *Principal, id string) Role {
+	if perms, ok := a.config.Permissions[id]; ok && id != "" {
+		if role, ok := perms[p.Name]; ok {
+			return role
+		}
+		return perms["*"]
+	}
+	return p.Role
+}
+
+// SetAuth turns on authentication. Without it every request is allowed.
+func (s *Server) SetAuth(a *Authenticator) {
+	s.auth = a
+}
+
+// SetAllowedOrigins sets the browser origins allowed to call the API and
+// open WebSockets. "*" allows any origin. Requests from the server's own
+// origin, and from non-browser clients, are always allowed.
+func (s *Server) SetAllowedOrigins(origins []string) {
+	s.origins = origins
+}
+
+// DefaultOrigins allow web UIs served from the local machine, such as the
+// Vite dev server
+var DefaultOrigins = []string{"http://localhost:*", "http://127.0.0.1:*", "http://[::1]:*"}
+
+// originAllowed reports whether a browser at origin may use the API
+func (s *Server) originAllowed(r *http.Request, origin string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range s.origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, ":*"); ok && u.Scheme+"://"+u.Hostname() == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware answers preflight requests and lets allowed origins read
+// responses
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && s.originAllowed(r, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, X-Author, Range")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Range, Content-Disposition")
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authMiddleware attaches the caller's principal to API requests. The
+// OpenAPI document is public.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil || !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/openapi.json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := s.auth.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fscomposer"`)
+			respondError(w, http.StatusUnauthorized, "Authentication required: "+err.Error())
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// allowed reports whether the request's principal has role for a
+// composition, or globally when id is empty
+func (s *Server) allowed(r *http.Request, id string, role Role) bool {
+	if s.auth == nil {
+		return true
+	}
+	p, ok := PrincipalFrom(r.Context())
+	return ok && s.auth.roleFor(p, id).Allows(role)
+}
+
+// authorize responds with 401 or 403 unless the request's principal has
+// role for the composition
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, id string, role Role) bool {
+	if s.allowed(r, id, role) {
+		return true
+	}
+	if p, _ := PrincipalFrom(r.Context()); p == nil || p.Via == "anonymous" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fscomposer"`)
+		respondError(w, http.StatusUnauthorized, "Authentication required")
+		return false
+	}
+	respondError(w, http.StatusForbidden, fmt.Sprintf("Requires the %s role", role))
+	return false
+}
+
+// require wraps a handler so it only runs for principals with role on the
+// composition named by the {id} route variable
+func (s *Server) require(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authorize(w, r, mux.Vars(r)["id"], role) {
+			h(w, r)
+		}
+	}
+}
+
+// handleWhoAmI returns the caller's principal
+func (s *Server) handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		respondJSON(w, http.StatusOK, p)
+		return
+	}
+	respondJSON(w, http.StatusOK, Principal{Name: "anonymous", Role: RoleOperator, Via: "anonymous"})
+}
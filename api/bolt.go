@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/absfs/fscomposer/engine"
+	bolt "go.etcd.io/bbolt"
+)
+
+// revisionsBucket holds a nested bucket per composition ID, mapping
+// big-endian revision numbers to JSON-encoded revisions
+var revisionsBucket = []byte("revisions")
+
+// legacyBucket held one spec per composition before revisions were kept;
+// it is migrated when the store opens
+var legacyBucket = []byte("compositions")
+
+// BoltStore keeps compositions in a single embedded bbolt database file.
+// Every write is its own transaction, so a crash never leaves a partial
+// composition behind.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates a database file. It fails if another
+// process already has the file open.
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("bolt store needs a database file")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store database %s: %w", path, err)
+	}
+	if err := db.Update(migrateBolt); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize store database: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// migrateBolt creates the revisions bucket and turns each spec in the
+// legacy bucket into revision 1 of its composition
+func migrateBolt(tx *bolt.Tx) error {
+	revs, err := tx.CreateBucketIfNotExists(revisionsBucket)
+	if err != nil {
+		return err
+	}
+	legacy := tx.Bucket(legacyBucket)
+	if legacy == nil {
+		return nil
+	}
+	err = legacy.ForEach(func(k, v []byte) error {
+		var spec engine.CompositionSpec
+		if err := json.Unmarshal(v, &spec); err != nil {
+			return fmt.Errorf("composition %s: %w", k, err)
+		}
+		b, err := revs.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		rev, _ := nextRevision(nil, &Revision{Message: "Imported", Spec: &spec}, AnyRevision)
+		return putBoltRevision(b, rev)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBucket(legacyBucket)
+}
+
+func revisionKey(number int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(number))
+	return key
+}
+
+func putBoltRevision(b *bolt.Bucket, rev *Revision) error {
+	data, err := json.Marshal(rev)
+	if err != nil {
+		return fmt.Errorf("failed to encode composition: %w", err)
+	}
+	return b.Put(revisionKey(rev.Number), data)
+}
+
+func decodeBoltRevision(data []byte) (*Revision, error) {
+	var rev Revision
+	if err := json.Unmarshal(data, &rev); err != nil {
+		return nil, fmt.Errorf("failed to decode revision: %w", err)
+	}
+	return &rev, nil
+}
+
+// latestBolt returns the latest revision in a composition's bucket, or
+// nil when there is none
+func latestBolt(b *bolt.Bucket) (*Revision, error) {
+	if b == nil {
+		return nil, nil
+	}
+	_, data := b.Cursor().Last()
+	if data == nil {
+		return nil, nil
+	}
+	return decodeBoltRevision(data)
+}
+
+// List implements CompositionStore. Keys are kept sorted by bbolt.
+func (s *BoltStore) List() ([]string, error) {
+	ids := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(revisionsBucket).ForEachBucket(func(k []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// Get implements CompositionStore
+func (s *BoltStore) Get(id string) (*Revision, error) {
+	var rev *Revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rev, err = latestBolt(tx.Bucket(revisionsBucket).Bucket([]byte(id)))
+		return err
+	})
+	if err == nil && rev == nil {
+		err = ErrNotFound
+	}
+	return rev, err
+}
+
+// Revision implements CompositionStore
+func (s *BoltStore) Revision(id string, number int) (*Revision, error) {
+	var rev *Revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revisionsBucket).Bucket([]byte(id))
+		if b == nil || number < 1 {
+			return ErrNotFound
+		}
+		data := b.Get(revisionKey(number))
+		if data == nil {
+			return ErrNotFound
+		}
+		var err error
+		rev, err = decodeBoltRevision(data)
+		return err
+	})
+	return rev, err
+}
+
+// Revisions implements CompositionStore
+func (s *BoltStore) Revisions(id string) ([]Revision, error) {
+	var revs []Revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revisionsBucket).Bucket([]byte(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		return b.ForEach(func(_, data []byte) error {
+			rev, err := decodeBoltRevision(data)
+			if err != nil {
+				return err
+			}
+			revs = append(revs, *rev)
+			return nil
+		})
+	})
+	return revs, err
+}
+
+// Put implements CompositionStore
+func (s *BoltStore) Put(id string, rev *Revision, match int) (*Revision, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	var next *Revision
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(revisionsBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		latest, err := latestBolt(b)
+		if err != nil {
+			return err
+		}
+		if next, err = nextRevision(latest, rev, match); err != nil {
+			return err
+		}
+		return putBoltRevision(b, next)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// Delete implements CompositionStore
+func (s *BoltStore) Delete(id string) error {
+	if id == "" {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(revisionsBucket).DeleteBucket([]byte(id))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// Close implements CompositionStore
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
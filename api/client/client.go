@@ -0,0 +1,537 @@
+// Package client is a typed Go client for the fscomposer API server, for
+// scripting against it. Its methods follow the operations in the server's
+// OpenAPI document.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/absfs/fscomposer/api"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/graph"
+)
+
+// Client talks to an API server
+type Client struct {
+	base string
+	auth func(*http.Request)
+	http *http.Client
+}
+
+// New returns a client for the server at baseURL, such as
+// "http://localhost:8080"
+func New(baseURL string) *Client {
+	return &Client{
+		base: strings.TrimSuffix(baseURL, "/"),
+		auth: func(*http.Request) {},
+		http: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// WithToken makes the client authenticate with a static token or JWT
+func (c *Client) WithToken(token string) *Client {
+	c.auth = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	return c
+}
+
+// WithBasicAuth makes the client authenticate with a user name and
+// password
+func (c *Client) WithBasicAuth(user, password string) *Client {
+	c.auth = func(req *http.Request) { req.SetBasicAuth(user, password) }
+	return c
+}
+
+// Error is a request the server refused
+type Error struct {
+	Status  int
+	Message string
+	Latest  *api.Revision // On conflicts, the composition's latest revision
+
+	// Diagnostics lists every problem of a rejected import
+	Diagnostics []engine.Diagnostic
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsNotFound reports whether err is a 404 from the server
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a failed If-Match or If-None-Match
+// precondition
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusPreconditionFailed
+}
+
+// Created is the result of creating a composition
+type Created struct {
+	ID       string                  `json:"id"`
+	Spec     *engine.CompositionSpec `json:"spec"`
+	Revision int                     `json:"revision"`
+}
+
+// Validation is the result of validating a composition
+type Validation struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// Diff compares two revisions
+type Diff struct {
+	From api.Revision `json:"from"`
+	To   api.Revision `json:"to"`
+	Plan *engine.Plan `json:"plan"`
+}
+
+// WhoAmI returns the caller as the server authenticated it
+func (c *Client) WhoAmI() (*api.Principal, error) {
+	var p api.Principal
+	if err := c.do("GET", "/api/whoami", nil, nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// OpenAPI returns the server's OpenAPI document
+func (c *Client) OpenAPI() (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := c.do("GET", "/api/openapi.json", nil, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Nodes lists the available node types
+func (c *Client) Nodes() ([]api.NodeType, error) {
+	var nodes []api.NodeType
+	if err := c.do("GET", "/api/nodes", nil, nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Node returns one node type with its config fields
+func (c *Client) Node(nodeType string) (*api.NodeType, error) {
+	var node api.NodeType
+	if err := c.do("GET", "/api/nodes/"+url.PathEscape(nodeType), nil, nil, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// Compositions lists the compositions the caller may view
+func (c *Client) Compositions() ([]api.CompositionSummary, error) {
+	var list []api.CompositionSummary
+	if err := c.do("GET", "/api/compositions", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Create stores spec as a new composition named after it, or as a new
+// revision if the composition exists
+func (c *Client) Create(spec *engine.CompositionSpec) (*Created, error) {
+	var created Created
+	if err := c.do("POST", "/api/compositions", nil, spec, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// Import stores a YAML or JSON spec file as a composition. A file that
+// does not parse or validate fails with an *Error listing its
+// Diagnostics.
+func (c *Client) Import(file io.Reader) (*Created, error) {
+	resp, err := c.request("POST", "/api/compositions/import", http.Header{"Content-Type": {"application/yaml"}}, file, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var created Created
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// Export returns a revision of a composition, or the latest when revision
+// is zero, as a YAML spec file with secret values redacted
+func (c *Client) Export(id string, revision int) ([]byte, error) {
+	p := compositionPath(id) + "/export"
+	if revision > 0 {
+		p += "?revision=" + strconv.Itoa(revision)
+	}
+	body, err := c.stream("GET", p, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// Composition returns the latest spec of a composition and its revision
+// number, for passing to Update
+func (c *Client) Composition(id string) (*engine.CompositionSpec, int, error) {
+	var spec engine.CompositionSpec
+	resp, err := c.send("GET", compositionPath(id), nil, nil, &spec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &spec, etagRevision(resp), nil
+}
+
+// Update stores spec as a new revision. With base > 0 it fails with a
+// conflict if the latest revision is no longer base.
+func (c *Client) Update(id string, spec *engine.CompositionSpec, base int) (*engine.CompositionSpec, int, error) {
+	var stored engine.CompositionSpec
+	resp, err := c.send("PUT", compositionPath(id), ifMatch(base), spec, &stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &stored, etagRevision(resp), nil
+}
+
+// Delete deletes a composition and its history
+func (c *Client) Delete(id string) error {
+	return c.do("DELETE", compositionPath(id), nil, nil, nil)
+}
+
+// Validate validates the latest spec of a composition
+func (c *Client) Validate(id string) (*Validation, error) {
+	var v Validation
+	if err := c.do("POST", compositionPath(id)+"/validate", nil, nil, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Build builds a composition in a sandbox and runs the conformance suite,
+// limited to categories when any are given
+func (c *Client) Build(id string, categories ...string) (*api.TestResult, error) {
+	p := compositionPath(id) + "/build"
+	if len(categories) > 0 {
+		p += "?only=" + url.QueryEscape(strings.Join(categories, ","))
+	}
+	var result api.TestResult
+	if err := c.do("POST", p, nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Graph returns a composition's node graph
+func (c *Client) Graph(id string) (*graph.Graph, error) {
+	var g graph.Graph
+	if err := c.do("GET", compositionPath(id)+"/graph", nil, nil, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// RenderGraph returns a composition's graph rendered in format: ascii,
+// dot, mermaid or svg
+func (c *Client) RenderGraph(id, format string) (string, error) {
+	body, err := c.stream("GET", compositionPath(id)+"/graph?format="+url.QueryEscape(format), nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	return string(data), err
+}
+
+// Revisions lists a composition's revisions, oldest first, without specs
+func (c *Client) Revisions(id string) ([]api.Revision, error) {
+	var revs []api.Revision
+	if err := c.do("GET", compositionPath(id)+"/revisions", nil, nil, &revs); err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// Revision returns one revision with its spec
+func (c *Client) Revision(id string, number int) (*api.Revision, error) {
+	var rev api.Revision
+	if err := c.do("GET", fmt.Sprintf("%s/revisions/%d", compositionPath(id), number), nil, nil, &rev); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// Diff compares two revisions; zero means the latest for to and the one
+// before to for from
+func (c *Client) Diff(id string, from, to int) (*Diff, error) {
+	query := url.Values{}
+	if from > 0 {
+		query.Set("from", strconv.Itoa(from))
+	}
+	if to > 0 {
+		query.Set("to", strconv.Itoa(to))
+	}
+	var d Diff
+	if err := c.do("GET", compositionPath(id)+"/diff?"+query.Encode(), nil, nil, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Rollback saves revision number's spec as a new revision. With base > 0
+// it fails with a conflict if the latest revision is no longer base.
+func (c *Client) Rollback(id string, number, base int) (*api.Revision, error) {
+	var rev api.Revision
+	p := fmt.Sprintf("%s/rollback?revision=%d", compositionPath(id), number)
+	if _, err := c.send("POST", p, ifMatch(base), nil, &rev); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// AllInstances lists the instances of every composition the caller may
+// view
+func (c *Client) AllInstances() ([]api.Instance, error) {
+	var list []api.Instance
+	if err := c.do("GET", "/api/instances", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Instances lists the instances of one composition
+func (c *Client) Instances(id string) ([]api.Instance, error) {
+	var list []api.Instance
+	if err := c.do("GET", compositionPath(id)+"/instances", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Start builds a revision of a composition and starts its frontend
+func (c *Client) Start(id string, req api.StartRequest) (*api.Instance, error) {
+	var in api.Instance
+	if err := c.do("POST", compositionPath(id)+"/instances", nil, req, &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// Instance returns one instance
+func (c *Client) Instance(id, instance string) (*api.Instance, error) {
+	var in api.Instance
+	if err := c.do("GET", instancePath(id, instance), nil, nil, &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// Stop stops an instance gracefully
+func (c *Client) Stop(id, instance string) (*api.Instance, error) {
+	var in api.Instance
+	if err := c.do("DELETE", instancePath(id, instance), nil, nil, &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// FileOptions selects the stack a file operation works on and pages
+// directory listings
+type FileOptions struct {
+	Instance string // Defaults to the first running instance, then a build
+	Limit    int    // Directory page size
+	After    string // Resume a listing after this name
+}
+
+func (o FileOptions) query() url.Values {
+	query := url.Values{}
+	if o.Instance != "" {
+		query.Set("instance", o.Instance)
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.After != "" {
+		query.Set("after", o.After)
+	}
+	return query
+}
+
+// ReadDir returns one page of a directory
+func (c *Client) ReadDir(id, name string, opts FileOptions) (*api.DirListing, error) {
+	var listing api.DirListing
+	if err := c.do("GET", filePath(id, name, opts.query()), nil, nil, &listing); err != nil {
+		return nil, err
+	}
+	return &listing, nil
+}
+
+// Stat describes a file or directory
+func (c *Client) Stat(id, name string, opts FileOptions) (*api.FileEntry, error) {
+	query := opts.query()
+	query.Set("stat", "")
+	var entry api.FileEntry
+	if err := c.do("GET", filePath(id, name, query), nil, nil, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Open returns a file's content; the caller closes it
+func (c *Client) Open(id, name string, opts FileOptions) (io.ReadCloser, error) {
+	return c.stream("GET", filePath(id, name, opts.query()), nil)
+}
+
+// Upload writes content to a file, creating missing parent directories
+func (c *Client) Upload(id, name string, content io.Reader, opts FileOptions) (*api.FileEntry, error) {
+	body, err := c.stream("PUT", filePath(id, name, opts.query()), content)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var entry api.FileEntry
+	if err := json.NewDecoder(body).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Mkdir creates a directory and any missing parents
+func (c *Client) Mkdir(id, name string, opts FileOptions) (*api.FileEntry, error) {
+	var entry api.FileEntry
+	p := filePath(id, strings.TrimSuffix(name, "/")+"/", opts.query())
+	if err := c.do("PUT", p, nil, nil, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Remove removes a file or empty directory, or with recursive a directory
+// and everything in it
+func (c *Client) Remove(id, name string, recursive bool, opts FileOptions) error {
+	query := opts.query()
+	if recursive {
+		query.Set("recursive", "")
+	}
+	return c.do("DELETE", filePath(id, name, query), nil, nil, nil)
+}
+
+func compositionPath(id string) string {
+	return "/api/compositions/" + url.PathEscape(id)
+}
+
+func instancePath(id, instance string) string {
+	return compositionPath(id) + "/instances/" + url.PathEscape(instance)
+}
+
+// filePath builds a file browser path, escaping each element of name
+func filePath(id, name string, query url.Values) string {
+	p := compositionPath(id) + "/fs"
+	for _, elem := range strings.Split(strings.TrimPrefix(name, "/"), "/") {
+		p += "/" + url.PathEscape(elem)
+	}
+	if len(query) > 0 {
+		p += "?" + query.Encode()
+	}
+	return p
+}
+
+// ifMatch returns the If-Match header for a base revision
+func ifMatch(base int) http.Header {
+	if base <= 0 {
+		return nil
+	}
+	return http.Header{"If-Match": {fmt.Sprintf(`"%d"`, base)}}
+}
+
+// etagRevision returns the revision number in a response's ETag
+func etagRevision(resp *http.Response) int {
+	n, _ := strconv.Atoi(strings.Trim(resp.Header.Get("ETag"), `"`))
+	return n
+}
+
+func (c *Client) do(method, path string, header http.Header, body, out interface{}) error {
+	_, err := c.send(method, path, header, body, out)
+	return err
+}
+
+// send makes a JSON request and decodes the response into out, returning
+// the response for its headers
+func (c *Client) send(method, path string, header http.Header, body, out interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	resp, err := c.request(method, path, header, reader, body != nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return resp, nil
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream makes a request with a raw body and returns the response body
+func (c *Client) stream(method, path string, body io.Reader) (io.ReadCloser, error) {
+	resp, err := c.request(method, path, nil, body, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// request sends a request, turning error responses into *Error
+func (c *Client) request(method, path string, header http.Header, body io.Reader, isJSON bool) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.auth(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("API server unreachable: %w", err)
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	apiErr := &Error{Status: resp.StatusCode}
+	var msg struct {
+		Error       string              `json:"error"`
+		Latest      *api.Revision       `json:"latest"`
+		Diagnostics []engine.Diagnostic `json:"diagnostics"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&msg) == nil && msg.Error != "" {
+		apiErr.Message, apiErr.Latest, apiErr.Diagnostics = msg.Error, msg.Latest, msg.Diagnostics
+	} else {
+		apiErr.Message = fmt.Sprintf("API request failed: %s", resp.Status)
+	}
+	return nil, apiErr
+}
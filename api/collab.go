@@ -0,0 +1,284 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/gorilla/websocket"
+)
+
+// ClientMessage is a message a WebSocket client sends. A "patch" applies
+// JSON Patch operations to the revision in Base; a "presence" says which
+// composition, and which node in it, the client is editing.
+type ClientMessage struct {
+	Type        string           `json:"type"`
+	Ref         string           `json:"ref,omitempty"` // Echoed in the reply to a patch
+	Composition string           `json:"composition"`   // Empty in presence to stop editing
+	Base        int              `json:"base,omitempty"`
+	Ops         []engine.PatchOp `json:"ops,omitempty"`
+	Message     string           `json:"message,omitempty"` // Revision message of a patch
+	Node        string           `json:"node,omitempty"`
+}
+
+// Hello is sent to each WebSocket client when it connects
+type Hello struct {
+	Client string `json:"client"` // Identifies the client in patches and presence
+	User   string `json:"user"`
+}
+
+// PatchApplied announces a patch to every client viewing the composition.
+// Clients holding revision Base apply Ops to reach Revision; others
+// reload the composition. Secret values in Ops are redacted.
+type PatchApplied struct {
+	ID       string           `json:"id"`
+	Base     int              `json:"base"`
+	Revision Revision         `json:"revision"`
+	Ops      []engine.PatchOp `json:"ops"`
+	Client   string           `json:"client"`
+	Ref      string           `json:"ref,omitempty"`
+}
+
+// PatchRejected tells the sender why its patch was not applied. Latest is
+// set when the patch was based on an old revision; rebase onto it and
+// send again.
+type PatchRejected struct {
+	ID          string              `json:"id"`
+	Ref         string              `json:"ref,omitempty"`
+	Base        int                 `json:"base"`
+	Latest      int                 `json:"latest,omitempty"`
+	Error       string              `json:"error"`
+	Diagnostics []engine.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// Presence lists the clients editing a composition
+type Presence struct {
+	ID      string   `json:"id"`
+	Editors []Editor `json:"editors"`
+}
+
+// Editor is a client editing a composition
+type Editor struct {
+	Client string `json:"client"`
+	User   string `json:"user"`
+	Node   string `json:"node,omitempty"` // The node the client has selected
+}
+
+const (
+	// writeWait bounds each write to a WebSocket client
+	writeWait = 10 * time.Second
+	// sendQueueSize is how many broadcasts may wait for a client before
+	// it is dropped as too slow
+	sendQueueSize = 64
+)
+
+// wsClient is a connected WebSocket client
+type wsClient struct {
+	conn      *websocket.Conn
+	id        string
+	user      string
+	principal *Principal
+
+	writeMu sync.Mutex   // Serializes writes to conn
+	queue   chan Message // Broadcasts waiting to be written
+	done    chan struct{}
+
+	// Presence, guarded by Server.clientsMu
+	composition string
+	node        string
+}
+
+func newWSClient(conn *websocket.Conn, id, user string, principal *Principal) *wsClient {
+	return &wsClient{
+		conn:      conn,
+		id:        id,
+		user:      user,
+		principal: principal,
+		queue:     make(chan Message, sendQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// send writes a message to the client, giving up after writeWait
+func (c *wsClient) send(msg Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(msg)
+}
+
+// enqueue queues a broadcast without waiting on the client. A client
+// whose queue is full has stopped reading and is disconnected; its read
+// loop then ends and removes it.
+func (c *wsClient) enqueue(msg Message) {
+	select {
+	case c.queue <- msg:
+	default:
+		log.Printf("WebSocket client %s is not keeping up; disconnecting", c.id)
+		c.conn.Close()
+	}
+}
+
+// writeQueued sends queued broadcasts until the client disconnects
+func (c *wsClient) writeQueued() {
+	for {
+		select {
+		case msg := <-c.queue:
+			if err := c.send(msg); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// clientAllowed reports whether a client has role for a composition
+func (s *Server) clientAllowed(c *wsClient, id string, role Role) bool {
+	return s.auth == nil || s.auth.roleFor(c.principal, id).Allows(role)
+}
+
+// handleClientMessages reads a client's messages until it disconnects
+func (s *Server) handleClientMessages(c *wsClient) {
+	c.conn.SetReadLimit(maxSpecSize)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg ClientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.send(Message{Type: "error", Data: map[string]string{"error": "Invalid JSON"}})
+			continue
+		}
+		switch msg.Type {
+		case "patch":
+			s.applyPatch(c, &msg)
+		case "presence":
+			s.setPresence(c, msg.Composition, msg.Node)
+		default:
+			c.send(Message{Type: "error", Data: map[string]string{"error": fmt.Sprintf("Unknown message type %q", msg.Type)}})
+		}
+	}
+}
+
+// applyPatch applies a client's patch to the revision it was made
+// against, stores the result as a new revision and rebroadcasts the
+// patch. Patches are sequenced by the store: one based on a revision that
+// is no longer the latest is rejected.
+func (s *Server) applyPatch(c *wsClient, msg *ClientMessage) {
+	id := msg.Composition
+	reject := func(err string, latest int, diags []engine.Diagnostic) {
+		c.send(Message{Type: "patch_rejected", Data: PatchRejected{
+			ID: id, Ref: msg.Ref, Base: msg.Base, Latest: latest, Error: err, Diagnostics: diags,
+		}})
+	}
+
+	if !s.clientAllowed(c, id, RoleEditor) {
+		reject("Forbidden: requires the editor role", 0, nil)
+		return
+	}
+	latest, err := s.store.Get(id)
+	if err != nil {
+		reject(err.Error(), 0, nil)
+		return
+	}
+	if msg.Base != latest.Number {
+		reject(fmt.Sprintf("patch is based on revision %d, the latest is %d", msg.Base, latest.Number), latest.Number, nil)
+		return
+	}
+
+	// Clients see redacted specs, so paths and tests refer to those
+	base := engine.RedactSpec(latest.Spec)
+	patched, err := engine.ApplyPatch(base, msg.Ops)
+	if err != nil {
+		reject(err.Error(), 0, nil)
+		return
+	}
+	if diags := engine.NewValidator(patched).AllowRedacted().Diagnose(); len(diags) > 0 {
+		reject("Validation error", 0, diags)
+		return
+	}
+	if err := checkName(id, patched); err != nil {
+		reject(err.Error(), 0, nil)
+		return
+	}
+	sealed, err := s.sealSecrets(id, patched, latest.Spec)
+	if err != nil {
+		reject(err.Error(), 0, nil)
+		return
+	}
+
+	message := msg.Message
+	if message == "" {
+		message = fmt.Sprintf("Patch from %s", c.user)
+	}
+	rev, err := s.store.Put(id, &Revision{Author: c.user, Message: message, Spec: sealed}, latest.Number)
+	if errors.Is(err, ErrConflict) {
+		if now, err := s.store.Get(id); err == nil {
+			reject(ErrConflict.Error(), now.Number, nil)
+			return
+		}
+	}
+	if err != nil {
+		reject(err.Error(), 0, nil)
+		return
+	}
+
+	s.stacks.forget(id)
+	s.broadcast <- Message{
+		Type: "composition_patched",
+		Data: PatchApplied{
+			ID:       id,
+			Base:     latest.Number,
+			Revision: rev.Summary(),
+			Ops:      engine.RedactPatch(base, msg.Ops),
+			Client:   c.id,
+			Ref:      msg.Ref,
+		},
+		composition: id,
+	}
+}
+
+// setPresence records what a client is editing and tells the clients
+// viewing the compositions it left and joined
+func (s *Server) setPresence(c *wsClient, id, node string) {
+	if id != "" && !s.clientAllowed(c, id, RoleViewer) {
+		c.send(Message{Type: "error", Data: map[string]string{"error": "Forbidden: requires the viewer role"}})
+		return
+	}
+
+	s.clientsMu.Lock()
+	previous := c.composition
+	c.composition, c.node = id, node
+	s.clientsMu.Unlock()
+
+	if previous != "" && previous != id {
+		s.publishPresence(previous)
+	}
+	if id != "" {
+		s.publishPresence(id)
+	}
+}
+
+// publishPresence broadcasts the editors of a composition
+func (s *Server) publishPresence(id string) {
+	presence := Presence{ID: id, Editors: []Editor{}}
+	s.clientsMu.RLock()
+	for _, c := range s.clients {
+		if c.composition == id {
+			presence.Editors = append(presence.Editors, Editor{Client: c.id, User: c.user, Node: c.node})
+		}
+	}
+	s.clientsMu.RUnlock()
+	sort.Slice(presence.Editors, func(i, j int) bool { return presence.Editors[i].Client < presence.Editors[j].Client })
+
+	s.broadcast <- Message{Type: "presence", Data: presence, composition: id}
+}
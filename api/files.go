@@ -0,0 +1,532 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/gorilla/mux"
+)
+
+// Directory listing page sizes
+const (
+	defaultPageSize = 500
+	maxPageSize     = 5000
+)
+
+// FileEntry describes a file or directory in a composition's stack
+type FileEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// DirListing is one page of a directory. Next is the cursor for the
+// following page, empty on the last one.
+type DirListing struct {
+	Path     string      `json:"path"`
+	Instance string      `json:"instance,omitempty"` // Set when browsing a running instance
+	Revision int         `json:"revision"`
+	Entries  []FileEntry `json:"entries"`
+	Next     string      `json:"next,omitempty"`
+}
+
+func newFileEntry(name string, info os.FileInfo) FileEntry {
+	return FileEntry{
+		Name:    info.Name(),
+		Path:    name,
+		Dir:     info.IsDir(),
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+	}
+}
+
+// builtStack is a revision built for browsing. ready is closed once the
+// build has finished and set fs or err.
+type builtStack struct {
+	revision int
+	ready    chan struct{}
+	builder  *engine.Builder
+	fs       absfs.FileSystem
+	err      error
+
+	// Guarded by stackCache.mu
+	refs    int  // Requests using fs
+	retired bool // No longer cached; closed once refs drops to 0
+}
+
+// close releases the stack's nodes once its build has finished, including
+// those of a build that failed part way
+func (st *builtStack) close() {
+	<-st.ready
+	if err := st.builder.Close(); err != nil {
+		log.Printf("Failed to close stack of revision %d: %v", st.revision, err)
+	}
+}
+
+// stackCache keeps the last revision of each composition built for
+// browsing, so files written to in-memory backends survive between
+// requests. Builds run outside the lock, one per composition at a time. A
+// stack that is replaced or forgotten is closed once the requests using it
+// have released it.
+type stackCache struct {
+	mu     sync.Mutex
+	stacks map[string]*builtStack
+}
+
+func newStackCache() *stackCache {
+	return &stackCache{stacks: make(map[string]*builtStack)}
+}
+
+// get returns the built stack of a revision, building it with b if the
+// cached one is for another revision. Requests for a revision being built
+// wait for that build. Call release once done with the filesystem.
+func (c *stackCache) get(id string, rev *Revision, b *engine.Builder) (fs absfs.FileSystem, release func(), err error) {
+	c.mu.Lock()
+	if st, ok := c.stacks[id]; ok && st.revision == rev.Number {
+		st.refs++
+		c.mu.Unlock()
+		<-st.ready
+		return st.fs, c.releaser(st), st.err
+	}
+	st := &builtStack{revision: rev.Number, ready: make(chan struct{}), builder: b, refs: 1}
+	c.retire(c.stacks[id])
+	c.stacks[id] = st
+	c.mu.Unlock()
+
+	st.fs, st.err = b.Build()
+	if st.err != nil {
+		st.err = fmt.Errorf("build error: %w", st.err)
+		c.mu.Lock()
+		if c.stacks[id] == st {
+			delete(c.stacks, id) // Let the next request try again
+			c.retire(st)
+		}
+		c.mu.Unlock()
+	}
+	close(st.ready)
+	return st.fs, c.releaser(st), st.err
+}
+
+// retire marks a stack that is no longer cached, closing it now if no
+// request is using it. c.mu must be held.
+func (c *stackCache) retire(st *builtStack) {
+	if st == nil || st.retired {
+		return
+	}
+	st.retired = true
+	if st.refs == 0 {
+		go st.close()
+	}
+}
+
+// releaser returns a function that drops one reference to st, closing it
+// if it was the last one on a retired stack
+func (c *stackCache) releaser(st *builtStack) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			st.refs--
+			last := st.retired && st.refs == 0
+			c.mu.Unlock()
+			if last {
+				st.close()
+			}
+		})
+	}
+}
+
+// built reports whether a revision's stack is built or being built
+func (c *stackCache) built(id string, rev *Revision) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	built, ok := c.stacks[id]
+	return ok && built.revision == rev.Number
+}
+
+// forget drops a composition's stack, closing it once unused
+func (c *stackCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retire(c.stacks[id])
+	delete(c.stacks, id)
+}
+
+// closeAll closes every cached stack that is not in use; the others are
+// closed as their requests finish
+func (c *stackCache) closeAll() {
+	c.mu.Lock()
+	var unused []*builtStack
+	for _, st := range c.stacks {
+		st.retired = true
+		if st.refs == 0 {
+			unused = append(unused, st)
+		}
+	}
+	c.stacks = make(map[string]*builtStack)
+	c.mu.Unlock()
+	for _, st := range unused {
+		st.close()
+	}
+}
+
+// browsedStack is the filesystem a file request operates on. release
+// must be called once the request is done with it.
+type browsedStack struct {
+	fs       absfs.FileSystem
+	id       string
+	instance string
+	revision int
+	release  func()
+}
+
+// browseStack picks the filesystem for a file request: the instance named
+// by ?instance=, else the composition's first running instance, else a
+// build of its latest revision. Only operators may trigger that build.
+func (s *Server) browseStack(w http.ResponseWriter, r *http.Request) (*browsedStack, bool) {
+	id := mux.Vars(r)["id"]
+
+	if iid := r.URL.Query().Get("instance"); iid != "" {
+		in, ok := s.instances.get(id, iid)
+		if !ok {
+			respondError(w, http.StatusNotFound, "Instance not found")
+			return nil, false
+		}
+		return &browsedStack{fs: in.root, id: id, instance: iid, revision: in.info.Revision, release: func() {}}, true
+	}
+	for _, info := range s.instances.list(id) {
+		if info.State != StateRunning {
+			continue
+		}
+		if in, ok := s.instances.get(id, info.ID); ok {
+			return &browsedStack{fs: in.root, id: id, instance: info.ID, revision: info.Revision, release: func() {}}, true
+		}
+	}
+
+	rev, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
+		return nil, false
+	}
+	if !s.stacks.built(id, rev) && !s.authorize(w, r, id, RoleOperator) {
+		return nil, false
+	}
+	fs, release, err := s.stacks.get(id, rev, s.newBuilder(rev.Spec, false))
+	if err != nil {
+		release()
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return nil, false
+	}
+	return &browsedStack{fs: fs, id: id, revision: rev.Number, release: release}, true
+}
+
+// filePath returns the cleaned absolute path of a file request
+func filePath(r *http.Request) string {
+	return path.Clean("/" + mux.Vars(r)["path"])
+}
+
+// handleGetFile lists a directory, or streams a file with Range support.
+// ?stat returns the entry itself as JSON for either.
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	stack, ok := s.browseStack(w, r)
+	if !ok {
+		return
+	}
+	defer stack.release()
+	name := filePath(r)
+	query := r.URL.Query()
+
+	info, err := stack.fs.Stat(name)
+	if err != nil {
+		respondFSError(w, err)
+		return
+	}
+	if _, ok := query["stat"]; ok {
+		respondJSON(w, http.StatusOK, newFileEntry(name, info))
+		return
+	}
+	if info.IsDir() {
+		s.listDir(w, r, stack, name)
+		return
+	}
+
+	f, err := stack.fs.Open(name)
+	if err != nil {
+		respondFSError(w, err)
+		return
+	}
+	defer f.Close()
+
+	if _, ok := query["download"]; ok {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name()))
+	}
+	// ServeContent handles Range, conditional requests and HEAD
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// listDir responds with one page of a directory, in name order. ?limit=
+// sets the page size and ?after= resumes after the named entry. The first
+// page reads the directory; the pages after it use the names read then.
+func (s *Server) listDir(w http.ResponseWriter, r *http.Request, stack *browsedStack, name string) {
+	query := r.URL.Query()
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", v))
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+	after := query.Get("after")
+
+	names, err := s.listings.names(stack, name, after == "")
+	if err != nil {
+		respondFSError(w, err)
+		return
+	}
+	start := sort.SearchStrings(names, after)
+	if start < len(names) && names[start] == after {
+		start++
+	}
+
+	listing := DirListing{
+		Path:     name,
+		Instance: stack.instance,
+		Revision: stack.revision,
+		Entries:  []FileEntry{},
+	}
+	for _, entry := range names[start:] {
+		if len(listing.Entries) == limit {
+			listing.Next = listing.Entries[limit-1].Name
+			break
+		}
+		p := path.Join(name, entry)
+		info, err := lstat(stack.fs, p)
+		if err != nil {
+			continue // Removed since the directory was read
+		}
+		listing.Entries = append(listing.Entries, newFileEntry(p, info))
+	}
+	respondJSON(w, http.StatusOK, listing)
+}
+
+// lstat describes name without following a final symlink where the
+// filesystem has them, as directory entries do
+func lstat(fsys absfs.FileSystem, name string) (os.FileInfo, error) {
+	if linker, ok := fsys.(absfs.SymLinker); ok {
+		return linker.Lstat(name)
+	}
+	return fsys.Stat(name)
+}
+
+// Directory listings kept for paging
+const (
+	listingTTL  = time.Minute
+	maxListings = 64
+)
+
+// dirNames is the sorted names of a directory as read for a listing
+type dirNames struct {
+	names []string
+	read  time.Time
+}
+
+// listingCache keeps the names of recently listed directories, so paging
+// through a large directory reads and sorts it once rather than for every
+// page
+type listingCache struct {
+	mu       sync.Mutex
+	listings map[string]*dirNames
+}
+
+func newListingCache() *listingCache {
+	return &listingCache{listings: make(map[string]*dirNames)}
+}
+
+// names returns the sorted names in a directory of a stack, reading it if
+// fresh is set or it was not read within listingTTL
+func (c *listingCache) names(stack *browsedStack, dir string, fresh bool) ([]string, error) {
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%s", stack.id, stack.instance, stack.revision, dir)
+	now := time.Now()
+
+	c.mu.Lock()
+	cached, ok := c.listings[key]
+	c.mu.Unlock()
+	if ok && !fresh && now.Sub(cached.read) < listingTTL {
+		return cached.names, nil
+	}
+
+	entries, err := stack.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	sort.Strings(names)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.listings) >= maxListings {
+		oldest := ""
+		for k, l := range c.listings {
+			if now.Sub(l.read) >= listingTTL {
+				delete(c.listings, k)
+			} else if oldest == "" || l.read.Before(c.listings[oldest].read) {
+				oldest = k
+			}
+		}
+		if len(c.listings) >= maxListings {
+			delete(c.listings, oldest)
+		}
+	}
+	c.listings[key] = &dirNames{names: names, read: now}
+	return names, nil
+}
+
+// forget drops the listings of a composition's stacks, after files were
+// written or removed through the API
+func (c *listingCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.listings {
+		if strings.HasPrefix(key, id+"\x00") {
+			delete(c.listings, key)
+		}
+	}
+}
+
+// handlePutFile uploads a file from the request body, creating missing
+// parent directories. A path ending in / creates a directory instead.
+func (s *Server) handlePutFile(w http.ResponseWriter, r *http.Request) {
+	stack, ok := s.browseStack(w, r)
+	if !ok {
+		return
+	}
+	defer stack.release()
+	defer s.listings.forget(stack.id)
+	name := filePath(r)
+
+	if strings.HasSuffix(mux.Vars(r)["path"], "/") || name == "/" {
+		if err := stack.fs.MkdirAll(name, 0755); err != nil {
+			respondFSError(w, err)
+			return
+		}
+		s.respondFileEntry(w, stack, name, http.StatusCreated)
+		return
+	}
+
+	status := http.StatusOK
+	if _, err := stack.fs.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		status = http.StatusCreated
+	}
+	if err := stack.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		respondFSError(w, err)
+		return
+	}
+	if err := writeStackFile(stack.fs, name, r.Body); err != nil {
+		respondFSError(w, err)
+		return
+	}
+	s.respondFileEntry(w, stack, name, status)
+}
+
+// writeStackFile writes body to a temporary file next to name and renames
+// it over name once complete, so a failed upload leaves the previous file
+// intact
+func writeStackFile(fsys absfs.FileSystem, name string, body io.Reader) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+"."+hex.EncodeToString(suffix))
+	f, err := fsys.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tmp, name)
+	}
+	if err != nil {
+		fsys.Remove(tmp)
+	}
+	return err
+}
+
+// handleDeleteFile removes a file or empty directory. ?recursive removes
+// a directory with everything in it.
+func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	stack, ok := s.browseStack(w, r)
+	if !ok {
+		return
+	}
+	defer stack.release()
+	defer s.listings.forget(stack.id)
+	name := filePath(r)
+	if name == "/" {
+		respondError(w, http.StatusBadRequest, "Cannot delete the root directory")
+		return
+	}
+	if _, err := stack.fs.Stat(name); err != nil {
+		respondFSError(w, err)
+		return
+	}
+
+	remove := stack.fs.Remove
+	if _, ok := r.URL.Query()["recursive"]; ok {
+		remove = stack.fs.RemoveAll
+	}
+	if err := remove(name); err != nil {
+		respondFSError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (s *Server) respondFileEntry(w http.ResponseWriter, stack *browsedStack, name string, status int) {
+	info, err := stack.fs.Stat(name)
+	if err != nil {
+		respondFSError(w, err)
+		return
+	}
+	respondJSON(w, status, newFileEntry(name, info))
+}
+
+// respondFSError maps filesystem errors to status codes
+func respondFSError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		respondError(w, http.StatusNotFound, "File not found")
+	case errors.Is(err, fs.ErrExist):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		respondError(w, http.StatusForbidden, err.Error())
+	default:
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+	}
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/frontend"
+	"github.com/gorilla/mux"
+)
+
+// Instance states, broadcast as they change
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateStopping = "stopping"
+	StateStopped  = "stopped" // Unmounted outside the server
+	StateFailed   = "failed"
+)
+
+// stopTimeout bounds how long a stop waits for the frontend to exit
+const stopTimeout = 10 * time.Second
+
+// Instance describes a composition the server is running
+type Instance struct {
+	ID          string    `json:"id"`
+	Composition string    `json:"composition"`
+	Revision    int       `json:"revision"`
+	MountType   string    `json:"mountType"`
+	Target      string    `json:"target"` // Mountpoint, listen address, or API path
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Started     time.Time `json:"started"`
+	Uptime      string    `json:"uptime,omitempty"`
+	Health      string    `json:"health,omitempty"`
+}
+
+// StartRequest is the optional body of a start request
+type StartRequest struct {
+	Revision   int    `json:"revision,omitempty"`   // Defaults to the latest
+	Mountpoint string `json:"mountpoint,omitempty"` // Overrides mount.path for FUSE
+}
+
+// instance is a running composition. Compositions with the api mount type
+// have no frontend; their stack is only reachable through the server.
+type instance struct {
+	mu      sync.Mutex
+	info    Instance
+	spec    *engine.CompositionSpec
+	builder *engine.Builder // Owns the stack's nodes
+	root    *frontend.SwapFS
+	mount   *frontend.Mount
+	exited  chan struct{} // Closed when the frontend exits
+}
+
+// snapshot returns the instance's current description with uptime and
+// health filled in
+func (in *instance) snapshot() Instance {
+	in.mu.Lock()
+	info := in.info
+	in.mu.Unlock()
+
+	if info.State == StateRunning {
+		info.Uptime = time.Since(info.Started).Round(time.Second).String()
+		info.Health = in.health()
+	}
+	return info
+}
+
+// health checks that the frontend is still reachable and the stack
+// answers
+func (in *instance) health() string {
+	switch in.info.MountType {
+	case engine.MountTypeAPI:
+	case engine.MountTypeFUSE:
+		if !frontend.FUSEMounted(in.info.Target) {
+			return "not mounted"
+		}
+	default:
+		conn, err := net.DialTimeout("tcp", in.info.Target, time.Second)
+		if err != nil {
+			return "unreachable"
+		}
+		conn.Close()
+	}
+	if _, err := in.root.Stat("/"); err != nil {
+		return "unhealthy: " + err.Error()
+	}
+	return "healthy"
+}
+
+// instanceManager tracks the instances the server has started
+type instanceManager struct {
+	mu        sync.Mutex
+	instances map[string]*instance
+	next      int
+}
+
+func newInstanceManager() *instanceManager {
+	return &instanceManager{instances: make(map[string]*instance)}
+}
+
+// list returns the instances of a composition, or of all compositions
+// when id is empty, ordered by start time
+func (m *instanceManager) list(id string) []Instance {
+	m.mu.Lock()
+	all := make([]*instance, 0, len(m.instances))
+	for _, in := range m.instances {
+		all = append(all, in)
+	}
+	m.mu.Unlock()
+
+	out := []Instance{}
+	for _, in := range all {
+		if info := in.snapshot(); id == "" || info.Composition == id {
+			out = append(out, info)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+func (m *instanceManager) get(compositionID, instanceID string) (*instance, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	in, ok := m.instances[instanceID]
+	if !ok || in.info.Composition != compositionID {
+		return nil, false
+	}
+	return in, true
+}
+
+// setState updates an instance and broadcasts the change
+func (s *Server) setState(in *instance, state, errMsg string) {
+	in.mu.Lock()
+	in.info.State = state
+	in.info.Error = errMsg
+	in.mu.Unlock()
+
+	s.broadcast <- Message{Type: "instance_state", Data: in.snapshot(), composition: in.info.Composition}
+}
+
+// startInstance builds a revision of a composition and serves it with
+// its mount type
+func (s *Server) startInstance(id string, rev *Revision, mountpoint string) (*instance, error) {
+	s.instances.mu.Lock()
+	s.instances.next++
+	instanceID := fmt.Sprintf("%s-%d", id, s.instances.next)
+	s.instances.mu.Unlock()
+
+	in := &instance{
+		info: Instance{
+			ID:          instanceID,
+			Composition: id,
+			Revision:    rev.Number,
+			MountType:   rev.Spec.Mount.Type,
+			Started:     time.Now(),
+		},
+		spec:   rev.Spec,
+		exited: make(chan struct{}),
+	}
+	s.setState(in, StateStarting, "")
+
+	in.builder = s.newBuilder(rev.Spec, false)
+	fs, err := in.builder.Build()
+	if err != nil {
+		in.builder.Close()
+		s.setState(in, StateFailed, err.Error())
+		return nil, fmt.Errorf("build error: %w", err)
+	}
+	in.root = frontend.NewSwapFS(fs)
+
+	if rev.Spec.Mount.Type == engine.MountTypeAPI {
+		in.info.Target = "/api/compositions/" + id + "/instances/" + instanceID
+	} else {
+		spec, err := engine.ResolveMountSecrets(rev.Spec, s.secrets.Get)
+		if err == nil {
+			in.mount, err = frontend.Start(spec, in.root, mountpoint)
+		}
+		if err != nil {
+			in.builder.Close()
+			s.setState(in, StateFailed, err.Error())
+			return nil, err
+		}
+		in.info.MountType = in.mount.Type
+		in.info.Target = in.mount.Target
+	}
+
+	in.info.Started = time.Now()
+	s.instances.mu.Lock()
+	s.instances.instances[instanceID] = in
+	s.instances.mu.Unlock()
+	s.setState(in, StateRunning, "")
+	if in.mount != nil {
+		go s.watchInstance(in, in.mount)
+	}
+	log.Printf("Started %s (%s at %s)", instanceID, in.info.MountType, in.info.Target)
+	return in, nil
+}
+
+// watchInstance records a frontend that exits without being stopped,
+// such as a FUSE mount unmounted from the shell
+func (s *Server) watchInstance(in *instance, mount *frontend.Mount) {
+	err := <-mount.Done()
+	close(in.exited)
+
+	in.mu.Lock()
+	stopping := in.info.State == StateStopping
+	in.mu.Unlock()
+	if stopping {
+		return
+	}
+	if err != nil {
+		s.setState(in, StateFailed, err.Error())
+	} else {
+		s.setState(in, StateStopped, "")
+	}
+}
+
+// stopInstance stops the frontend, waiting for it to exit, closes the
+// stack's nodes and forgets the instance. A frontend that refuses to stop, such as a busy FUSE
+// mount, leaves the instance running.
+func (s *Server) stopInstance(in *instance) error {
+	in.mu.Lock()
+	state := in.info.State
+	in.mu.Unlock()
+
+	if state == StateRunning && in.mount != nil {
+		s.setState(in, StateStopping, "")
+		if err := in.mount.Stop(); err != nil {
+			s.setState(in, StateRunning, "")
+			return err
+		}
+		select {
+		case <-in.exited:
+		case <-time.After(stopTimeout):
+			log.Printf("%s did not exit within %s", in.info.ID, stopTimeout)
+		}
+	}
+
+	s.instances.mu.Lock()
+	delete(s.instances.instances, in.info.ID)
+	s.instances.mu.Unlock()
+	if err := in.builder.Close(); err != nil {
+		log.Printf("Failed to close the nodes of %s: %v", in.info.ID, err)
+	}
+
+	in.mu.Lock()
+	in.info.State = StateStopped
+	in.mu.Unlock()
+	s.broadcast <- Message{Type: "instance_state", Data: in.snapshot(), composition: in.info.Composition}
+	log.Printf("Stopped %s", in.info.ID)
+	return nil
+}
+
+// StopInstances stops every instance the server started
+func (s *Server) StopInstances() {
+	s.instances.mu.Lock()
+	all := make([]*instance, 0, len(s.instances.instances))
+	for _, in := range s.instances.instances {
+		all = append(all, in)
+	}
+	s.instances.mu.Unlock()
+
+	for _, in := range all {
+		if err := s.stopInstance(in); err != nil {
+			log.Printf("Failed to stop %s: %v", in.info.ID, err)
+		}
+	}
+}
+
+// Close stops every instance and releases the stacks built for browsing.
+// Call it before exiting so no FUSE mount is left behind.
+func (s *Server) Close() {
+	s.StopInstances()
+	s.stacks.closeAll()
+}
+
+// handleStartInstance starts a composition as a live mount
+func (s *Server) handleStartInstance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req StartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	var rev *Revision
+	if req.Revision > 0 {
+		var ok bool
+		if rev, ok = s.lookupRevision(w, id, req.Revision); !ok {
+			return
+		}
+	} else {
+		var err error
+		if rev, err = s.store.Get(id); err != nil {
+			respondStoreError(w, err)
+			return
+		}
+	}
+
+	in, err := s.startInstance(id, rev, req.Mountpoint)
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusCreated, in.snapshot())
+}
+
+// handleListInstances lists the instances of a composition
+func (s *Server) handleListInstances(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, s.instances.list(mux.Vars(r)["id"]))
+}
+
+// handleListAllInstances lists the instances of every composition
+func (s *Server) handleListAllInstances(w http.ResponseWriter, r *http.Request) {
+	visible := []Instance{}
+	for _, info := range s.instances.list("") {
+		if s.allowed(r, info.Composition, RoleViewer) {
+			visible = append(visible, info)
+		}
+	}
+	respondJSON(w, http.StatusOK, visible)
+}
+
+// handleGetInstance returns one instance
+func (s *Server) handleGetInstance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	in, ok := s.instances.get(vars["id"], vars["instance"])
+	if !ok {
+		respondError(w, http.StatusNotFound, "Instance not found")
+		return
+	}
+	respondJSON(w, http.StatusOK, in.snapshot())
+}
+
+// handleStopInstance stops an instance gracefully
+func (s *Server) handleStopInstance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	in, ok := s.instances.get(vars["id"], vars["instance"])
+	if !ok {
+		respondError(w, http.StatusNotFound, "Instance not found")
+		return
+	}
+	if err := s.stopInstance(in); err != nil {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Failed to stop: %v", err))
+		return
+	}
+	respondJSON(w, http.StatusOK, in.snapshot())
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Hashes used by RS256, ES256 and friends
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// clockSkew is allowed when checking exp and nbf
+const clockSkew = time.Minute
+
+// jwtPrefix starts the names of JWT principals, as used in permissions
+const jwtPrefix = "jwt:"
+
+// JWTConfig verifies OIDC-style JWTs against keys in a local JWKS file
+type JWTConfig struct {
+	JWKS        string `yaml:"jwks"`        // Path to a JSON Web Key Set
+	Issuer      string `yaml:"issuer"`      // Required iss, if set
+	Audience    string `yaml:"audience"`    // Required aud, if set
+	NameClaim   string `yaml:"nameClaim"`   // Default preferred_username, then sub
+	RoleClaim   string `yaml:"roleClaim"`   // Default role; dots reach nested claims
+	DefaultRole Role   `yaml:"defaultRole"` // For tokens without a known role
+
+	// AllowNoExpiry accepts tokens without an exp claim, which are
+	// otherwise refused because they would never expire
+	AllowNoExpiry bool `yaml:"allowNoExpiry"`
+}
+
+// jwtVerifier checks JWT signatures and claims
+type jwtVerifier struct {
+	config *JWTConfig
+	keys   map[string]crypto.PublicKey // By kid
+}
+
+// jwk is a JSON Web Key; only the fields of RSA, EC and OKP keys are read
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWTVerifier(cfg *JWTConfig) (*jwtVerifier, error) {
+	if cfg.JWKS == "" {
+		return nil, fmt.Errorf("jwt: 'jwks' is required")
+	}
+	data, err := os.ReadFile(cfg.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: failed to read JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwt: failed to parse JWKS %s: %w", cfg.JWKS, err)
+	}
+
+	v := &jwtVerifier{config: cfg, keys: make(map[string]crypto.PublicKey)}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %q: %w", k.Kid, err)
+		}
+		v.keys[k.Kid] = key
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("jwt: JWKS %s has no keys", cfg.JWKS)
+	}
+	return v, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// jwtHashes maps RSA and ECDSA algorithms to their hashes
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verify checks a compact JWT's signature, expiry, issuer and audience,
+// and returns the principal it names
+func (v *jwtVerifier) verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	key, ok := v.keys[header.Kid]
+	if !ok && header.Kid == "" && len(v.keys) == 1 {
+		for _, only := range v.keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// The issuer picks these names, so they are kept apart from the
+	// tokens and users of the auth config
+	p := &Principal{Via: "jwt", Role: v.role(claims)}
+	for _, claim := range []string{v.config.NameClaim, "preferred_username", "sub"} {
+		if name, ok := claims[claim].(string); ok && claim != "" && name != "" {
+			p.Name = jwtPrefix + name
+			break
+		}
+	}
+	return p, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks sig over signed with the key, which must match
+// the algorithm; "none" and HMAC algorithms are never accepted
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[0] {
+		case 'R':
+			err = rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			err = rsa.VerifyPSS(k, hash, digest, sig, nil)
+		default:
+			err = fmt.Errorf("key does not match algorithm")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key does not match algorithm %q", alg)
+}
+
+// checkClaims validates exp, nbf, iss and aud. exp is required unless
+// AllowNoExpiry is set.
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok && !v.config.AllowNoExpiry {
+		return fmt.Errorf("token has no expiry")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token not yet valid")
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return fmt.Errorf("unexpected issuer")
+	}
+	if v.config.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == v.config.Audience
+		case []interface{}:
+			for _, a := range aud {
+				found = found || a == v.config.Audience
+			}
+		}
+		if !found {
+			return fmt.Errorf("unexpected audience")
+		}
+	}
+	return nil
+}
+
+// role reads the role claim, which may be a string or a list of strings;
+// the most privileged known role wins
+func (v *jwtVerifier) role(claims map[string]interface{}) Role {
+	path := v.config.RoleClaim
+	if path == "" {
+		path = "role"
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return v.config.DefaultRole
+		}
+		value = m[key]
+	}
+
+	var names []interface{}
+	switch val := value.(type) {
+	case string:
+		names = []interface{}{val}
+	case []interface{}:
+		names = val
+	}
+	best := RoleNone
+	for _, name := range names {
+		if s, ok := name.(string); ok {
+			if role := Role(s); role != RoleNone && roleLevels[role] > roleLevels[best] {
+				best = role
+			}
+		}
+	}
+	if best == RoleNone {
+		return v.config.DefaultRole
+	}
+	return best
+}
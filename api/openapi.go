@@ -0,0 +1,82 @@
+package api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// openAPISpec is the OpenAPI 3 description of the routes in setupRoutes.
+// Keep the two in step; TestOpenAPIDrift fails when they diverge.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// openAPIJSON converts the document once
+var openAPIJSON = sync.OnceValues(func() ([]byte, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(openAPISpec, &doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+})
+
+// OpenAPI returns the server's OpenAPI 3 document as JSON
+func OpenAPI() ([]byte, error) {
+	return openAPIJSON()
+}
+
+// handleOpenAPI serves the OpenAPI document. It needs no credentials.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	data, err := OpenAPI()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Invalid OpenAPI document: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Route is one method and path template the server handles
+type Route struct {
+	Method string
+	Path   string // With variables as {name}, as in OpenAPI
+}
+
+// routeVariable matches a mux path variable with a pattern, {rev:[0-9]+}
+var routeVariable = regexp.MustCompile(`\{([^{}:]+):[^{}]*\}`)
+
+// Routes lists the API routes the server handles, sorted by path. Routes
+// without a method restriction, such as the WebSocket, are listed as GET.
+func (s *Server) Routes() []Route {
+	var routes []Route
+	s.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/") {
+			return nil
+		}
+		tpl = routeVariable.ReplaceAllString(tpl, "{$1}")
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		for _, m := range methods {
+			routes = append(routes, Route{Method: m, Path: tpl})
+		}
+		return nil
+	})
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/gorilla/mux"
+)
+
+// handleListRevisions lists a composition's revisions, oldest first,
+// without their specs
+func (s *Server) handleListRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	revs, err := s.store.Revisions(id)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	summaries := make([]Revision, len(revs))
+	for i := range revs {
+		summaries[i] = revs[i].Summary()
+	}
+	respond(w, r, http.StatusOK, summaries)
+}
+
+// handleGetRevision returns one revision with its spec
+func (s *Server) handleGetRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	number, _ := strconv.Atoi(vars["rev"])
+
+	rev, ok := s.lookupRevision(w, vars["id"], number)
+	if !ok {
+		return
+	}
+	w.Header().Set("ETag", rev.ETag())
+	respond(w, r, http.StatusOK, redactedRevision(rev))
+}
+
+// handleDiffRevisions compares two revisions with engine.Diff. ?to=
+// defaults to the latest revision and ?from= to the one before it.
+func (s *Server) handleDiffRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	latest, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	to, err := queryRevision(query.Get("to"), latest.Number)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := queryRevision(query.Get("from"), to-1)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	toRev, ok := s.lookupRevision(w, id, to)
+	if !ok {
+		return
+	}
+	fromRev, ok := s.lookupRevision(w, id, from)
+	if !ok {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"from": fromRev.Summary(),
+		"to":   toRev.Summary(),
+		"plan": engine.Diff(fromRev.Spec, toRev.Spec),
+	})
+}
+
+// handleRollback restores an earlier revision by saving its spec as a new
+// revision, so the history itself is never rewritten. The revision comes
+// from ?revision= or a {"revision": n} body; If-Match is honoured as for
+// updates.
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	number, err := queryRevision(r.URL.Query().Get("revision"), 0)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if number == 0 {
+		var body struct {
+			Revision int `json:"revision"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Revision < 1 {
+			respondError(w, http.StatusBadRequest, "Specify the revision to roll back to")
+			return
+		}
+		number = body.Revision
+	}
+
+	target, ok := s.lookupRevision(w, id, number)
+	if !ok {
+		return
+	}
+	match, err := revisionPrecondition(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sealed, ok := s.sealLatest(w, id, target.Spec)
+	if !ok {
+		return
+	}
+	rev, err := s.store.Put(id, &Revision{
+		Author:  requestAuthor(r),
+		Message: fmt.Sprintf("Rollback to revision %d", number),
+		Spec:    sealed,
+	}, match)
+	if err != nil {
+		s.respondPutError(w, id, err)
+		return
+	}
+
+	s.publishRevision("composition_rolled_back", id, rev)
+
+	w.Header().Set("ETag", rev.ETag())
+	respond(w, r, http.StatusOK, redactedRevision(rev))
+}
+
+// lookupRevision fetches a revision, responding with 404 if it is missing
+func (s *Server) lookupRevision(w http.ResponseWriter, id string, number int) (*Revision, bool) {
+	rev, err := s.store.Revision(id, number)
+	if errors.Is(err, ErrNotFound) {
+		if _, err := s.store.Get(id); err != nil {
+			respondStoreError(w, err)
+		} else {
+			respondError(w, http.StatusNotFound, fmt.Sprintf("Revision %d not found", number))
+		}
+		return nil, false
+	}
+	if err != nil {
+		respondStoreError(w, err)
+		return nil, false
+	}
+	return rev, true
+}
+
+// publishRevision tells WebSocket clients about a new revision. The spec
+// is included, redacted, so editors can refresh without another request.
+// The stack built for browsing the previous revision is closed once no
+// request is using it.
+func (s *Server) publishRevision(msgType, id string, rev *Revision) {
+	s.stacks.forget(id)
+	s.broadcast <- Message{
+		Type: msgType,
+		Data: map[string]interface{}{
+			"id":       id,
+			"spec":     engine.RedactSpec(rev.Spec),
+			"revision": rev.Summary(),
+		},
+		composition: id,
+	}
+}
+
+// respondPutError reports a failed write. A conflict includes the latest
+// revision so the client can show what changed and retry.
+func (s *Server) respondPutError(w http.ResponseWriter, id string, err error) {
+	if !errors.Is(err, ErrConflict) {
+		respondStoreError(w, err)
+		return
+	}
+	body := map[string]interface{}{"error": err.Error()}
+	if latest, err := s.store.Get(id); err == nil {
+		w.Header().Set("ETag", latest.ETag())
+		body["latest"] = latest.Summary()
+	} else {
+		body["error"] = "Composition already exists"
+	}
+	respondJSON(w, http.StatusPreconditionFailed, body)
+}
+
+// revisionPrecondition turns If-Match and If-None-Match headers into the
+// match argument of CompositionStore.Put
+func revisionPrecondition(r *http.Request) (int, error) {
+	if r.Header.Get("If-None-Match") == "*" {
+		return NoRevision, nil
+	}
+	etag := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch etag {
+	case "":
+		return AnyRevision, nil
+	case "*":
+		return ExistingRevision, nil
+	}
+	number, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`))
+	if err != nil || number < 1 {
+		return 0, fmt.Errorf("invalid If-Match header %q; use the ETag of a revision", etag)
+	}
+	return number, nil
+}
+
+// queryRevision parses a revision number query parameter, returning def
+// when it is empty
+func queryRevision(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return 0, fmt.Errorf("invalid revision %q", value)
+	}
+	return number, nil
+}
+
+// requestAuthor names who made a change: the authenticated principal, or
+// without authentication the X-Author header or basic auth user name
+func requestAuthor(r *http.Request) string {
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		return p.Name
+	}
+	if author := strings.TrimSpace(r.Header.Get("X-Author")); author != "" {
+		return author
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "anonymous"
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/internal/atomicfile"
+)
+
+// SecretKeyEnv names the environment variable holding a base64 secret
+// store key, used instead of a key file when set
+const SecretKeyEnv = "FSCOMPOSER_SECRET_KEY"
+
+// SecretStore holds the values of secret fields and credential-like mount
+// options outside the composition store. Secrets are named
+// "<composition>/<node>.<field>#<version>" or
+// "<composition>/mount.options.<path>#<version>"; a new value gets a new
+// version so older revisions keep theirs.
+type SecretStore struct {
+	mu     sync.Mutex
+	path   string // Empty for an in-memory store
+	aead   cipher.AEAD
+	values map[string]string
+}
+
+// NewMemorySecretStore creates a secret store that is lost on exit
+func NewMemorySecretStore() *SecretStore {
+	return &SecretStore{values: make(map[string]string)}
+}
+
+// OpenSecretStore opens or creates a secret file encrypted with AES-256-GCM
+// under key, which must be 32 bytes
+func OpenSecretStore(path string, key []byte) (*SecretStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secret store key must be 32 bytes")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &SecretStore{path: path, aead: aead, values: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret store: %w", err)
+	}
+	size := aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("secret store %s is corrupt", path)
+	}
+	plain, err := aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret store %s; is the key right?", path)
+	}
+	if err := json.Unmarshal(plain, &s.values); err != nil {
+		return nil, fmt.Errorf("secret store %s is corrupt: %w", path, err)
+	}
+	return s, nil
+}
+
+// LoadSecretKey returns the key from $FSCOMPOSER_SECRET_KEY, or from the
+// key file at path, creating the file with a random key if it is missing
+func LoadSecretKey(path string) ([]byte, error) {
+	if env := os.Getenv(SecretKeyEnv); env != "" {
+		key, err := base64.StdEncoding.DecodeString(env)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s must be 32 base64-encoded bytes", SecretKeyEnv)
+		}
+		return key, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("secret key file %s must hold 32 base64-encoded bytes", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read secret key: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create secret key directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write secret key: %w", err)
+	}
+	return key, nil
+}
+
+// Get returns a secret's value. It implements engine.SecretResolver.
+func (s *SecretStore) Get(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", name)
+	}
+	return value, nil
+}
+
+// put stores a new value under a fresh version of base and returns its
+// name
+func (s *SecretStore) put(base, value string) (string, error) {
+	version := make([]byte, 4)
+	if _, err := rand.Read(version); err != nil {
+		return "", err
+	}
+	name := base + "#" + hex.EncodeToString(version)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+	if err := s.save(); err != nil {
+		delete(s.values, name)
+		return "", err
+	}
+	return name, nil
+}
+
+// deleteComposition removes every secret of a composition
+func (s *SecretStore) deleteComposition(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.values {
+		if strings.HasPrefix(name, id+"/") {
+			delete(s.values, name)
+		}
+	}
+	return s.save()
+}
+
+// save encrypts and writes the secrets; the caller holds s.mu
+func (s *SecretStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	plain, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(s.path, s.aead.Seal(nonce, nonce, plain, nil)); err != nil {
+		return fmt.Errorf("failed to write secret store: %w", err)
+	}
+	return nil
+}
+
+// SetSecrets sets where secret field values are kept. Servers start with
+// an in-memory secret store.
+func (s *Server) SetSecrets(secrets *SecretStore) {
+	s.secrets = secrets
+}
+
+// sealSecrets prepares a spec for storing. Redacted values sent back by
+// clients are restored from previous, every plain value RedactSpec would
+// redact moves into the secret store and is replaced by a reference, and
+// references to other compositions' secrets are rejected.
+func (s *Server) sealSecrets(id string, spec, previous *engine.CompositionSpec) (*engine.CompositionSpec, error) {
+	restored, missing := engine.RestoreRedacted(spec, previous)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s: redacted values can only be kept when the composition already has them", strings.Join(missing, ", "))
+	}
+
+	return engine.MapSecrets(restored, func(place string, v interface{}) (interface{}, error) {
+		if name, ok := engine.ParseSecretRef(v); ok {
+			if !strings.HasPrefix(name, id+"/") {
+				return nil, fmt.Errorf("%s refers to a secret of another composition", place)
+			}
+			if _, err := s.secrets.Get(name); err != nil {
+				return nil, fmt.Errorf("%s: %w", place, err)
+			}
+			return v, nil
+		}
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: secret values must be strings", place)
+		}
+		name, err := s.secrets.put(id+"/"+place, value)
+		if err != nil {
+			return nil, err
+		}
+		return engine.SecretRef(name), nil
+	})
+}
+
+// SealStored moves plain secret values out of the latest revision of
+// every stored composition, such as ones written into a dir store file by
+// hand or stored by earlier versions, recording the sealed spec as a new
+// revision; earlier revisions keep what they were stored with. Call it
+// after SetSecrets.
+func (s *Server) SealStored() error {
+	ids, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		latest, err := s.store.Get(id)
+		if err != nil {
+			return err
+		}
+		sealed, err := s.sealSecrets(id, latest.Spec, latest.Spec)
+		if err != nil {
+			return fmt.Errorf("composition %s: %w", id, err)
+		}
+		if reflect.DeepEqual(sealed, latest.Spec) {
+			continue
+		}
+		rev := &Revision{Author: "fscomposer", Message: "Moved secrets into the secret store", Spec: sealed}
+		if _, err := s.store.Put(id, rev, latest.Number); err != nil {
+			return fmt.Errorf("composition %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// sealLatest seals a spec against the composition's latest revision,
+// responding with an error if it cannot be stored
+func (s *Server) sealLatest(w http.ResponseWriter, id string, spec *engine.CompositionSpec) (*engine.CompositionSpec, bool) {
+	var previous *engine.CompositionSpec
+	latest, err := s.store.Get(id)
+	switch {
+	case err == nil:
+		previous = latest.Spec
+	case !errors.Is(err, ErrNotFound):
+		respondStoreError(w, err)
+		return nil, false
+	}
+	sealed, err := s.sealSecrets(id, spec, previous)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return sealed, true
+}
+
+// newBuilder creates a builder that resolves the server's secrets
+func (s *Server) newBuilder(spec *engine.CompositionSpec, sandbox bool) *engine.Builder {
+	b := engine.NewBuilder(spec)
+	if sandbox {
+		b = engine.NewSandboxBuilder(spec)
+	}
+	b.ResolveSecrets(s.secrets.Get)
+	return b
+}
+
+// redactedRevision returns a copy of a revision safe to send to clients
+func redactedRevision(rev *Revision) *Revision {
+	out := *rev
+	out.Spec = engine.RedactSpec(rev.Spec)
+	return &out
+}
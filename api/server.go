@@ -2,14 +2,21 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/conformance"
 	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/graph"
 	"github.com/absfs/fscomposer/registry"
+	"github.com/absfs/fscomposer/web"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
@@ -17,42 +24,46 @@ import (
 // Server represents the API server
 type Server struct {
 	router    *mux.Router
-	store     *CompositionStore
+	store     CompositionStore
+	instances *instanceManager
+	stacks    *stackCache
+	listings  *listingCache
+	auth      *Authenticator
+	secrets   *SecretStore
+	origins   []string
+	ui        http.Handler
 	upgrader  websocket.Upgrader
-	clients   map[*websocket.Conn]bool
+	clients   map[*websocket.Conn]*wsClient
 	clientsMu sync.RWMutex
+	clientSeq atomic.Uint64
 	broadcast chan Message
 }
 
-// CompositionStore manages compositions
-type CompositionStore struct {
-	compositions map[string]*engine.CompositionSpec
-	mu           sync.RWMutex
-}
-
 // Message represents a WebSocket message
 type Message struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
-}
 
-// NewServer creates a new API server
-func NewServer() *Server {
-	store := &CompositionStore{
-		compositions: make(map[string]*engine.CompositionSpec),
-	}
+	composition string // Only sent to clients allowed to view it
+}
 
+// NewServer creates a new API server that keeps compositions in store
+func NewServer(store CompositionStore) *Server {
 	s := &Server{
-		router: mux.NewRouter(),
-		store:  store,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins for development
-			},
-		},
-		clients:   make(map[*websocket.Conn]bool),
+		router:    mux.NewRouter(),
+		store:     store,
+		instances: newInstanceManager(),
+		stacks:    newStackCache(),
+		listings:  newListingCache(),
+		secrets:   NewMemorySecretStore(),
+		origins:   DefaultOrigins,
+		ui:        web.Handler(web.Embedded(), false),
+		clients:   make(map[*websocket.Conn]*wsClient),
 		broadcast: make(chan Message, 256),
 	}
+	s.upgrader.CheckOrigin = func(r *http.Request) bool {
+		return s.originAllowed(r, r.Header.Get("Origin"))
+	}
 
 	s.setupRoutes()
 	go s.handleBroadcasts()
@@ -62,27 +73,66 @@ func NewServer() *Server {
 
 // setupRoutes configures API routes
 func (s *Server) setupRoutes() {
-	// Enable CORS
-	s.router.Use(corsMiddleware)
+	// Enable CORS and authentication
+	s.router.Use(s.corsMiddleware, s.authMiddleware)
+	s.router.HandleFunc("/api/openapi.json", s.handleOpenAPI).Methods("GET")
+	s.router.HandleFunc("/api/whoami", s.handleWhoAmI).Methods("GET")
 
 	// Node type endpoints
-	s.router.HandleFunc("/api/nodes", s.handleListNodes).Methods("GET")
-	s.router.HandleFunc("/api/nodes/{type}", s.handleGetNode).Methods("GET")
+	s.router.HandleFunc("/api/nodes", s.require(RoleViewer, s.handleListNodes)).Methods("GET")
+	s.router.HandleFunc("/api/nodes/{type}", s.require(RoleViewer, s.handleGetNode)).Methods("GET")
 
-	// Composition endpoints
+	// Composition endpoints. Listing, creating and importing check each
+	// composition themselves.
 	s.router.HandleFunc("/api/compositions", s.handleListCompositions).Methods("GET")
 	s.router.HandleFunc("/api/compositions", s.handleCreateComposition).Methods("POST")
-	s.router.HandleFunc("/api/compositions/{id}", s.handleGetComposition).Methods("GET")
-	s.router.HandleFunc("/api/compositions/{id}", s.handleUpdateComposition).Methods("PUT")
-	s.router.HandleFunc("/api/compositions/{id}", s.handleDeleteComposition).Methods("DELETE")
-	s.router.HandleFunc("/api/compositions/{id}/validate", s.handleValidateComposition).Methods("POST")
-	s.router.HandleFunc("/api/compositions/{id}/build", s.handleBuildComposition).Methods("POST")
+	s.router.HandleFunc("/api/compositions/import", s.handleImportComposition).Methods("POST")
+	s.router.HandleFunc("/api/compositions/{id}", s.require(RoleViewer, s.handleGetComposition)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}", s.require(RoleEditor, s.handleUpdateComposition)).Methods("PUT")
+	s.router.HandleFunc("/api/compositions/{id}", s.require(RoleEditor, s.handleDeleteComposition)).Methods("DELETE")
+	s.router.HandleFunc("/api/compositions/{id}/validate", s.require(RoleViewer, s.handleValidateComposition)).Methods("POST")
+	s.router.HandleFunc("/api/compositions/{id}/build", s.require(RoleEditor, s.handleBuildComposition)).Methods("POST")
+	s.router.HandleFunc("/api/compositions/{id}/export", s.require(RoleViewer, s.handleExportComposition)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/graph", s.require(RoleViewer, s.handleGraphComposition)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/revisions", s.require(RoleViewer, s.handleListRevisions)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/revisions/{rev:[0-9]+}", s.require(RoleViewer, s.handleGetRevision)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/diff", s.require(RoleViewer, s.handleDiffRevisions)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/rollback", s.require(RoleEditor, s.handleRollback)).Methods("POST")
+
+	// Live instance endpoints
+	s.router.HandleFunc("/api/instances", s.handleListAllInstances).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/instances", s.require(RoleViewer, s.handleListInstances)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/instances", s.require(RoleOperator, s.handleStartInstance)).Methods("POST")
+	s.router.HandleFunc("/api/compositions/{id}/instances/{instance}", s.require(RoleViewer, s.handleGetInstance)).Methods("GET")
+	s.router.HandleFunc("/api/compositions/{id}/instances/{instance}", s.require(RoleOperator, s.handleStopInstance)).Methods("DELETE")
+
+	// File browser endpoints. Reading a stack that is not built yet needs
+	// the operator role, since building touches real backends.
+	for _, p := range []string{"/api/compositions/{id}/fs", "/api/compositions/{id}/fs/{path:.*}"} {
+		s.router.HandleFunc(p, s.require(RoleViewer, s.handleGetFile)).Methods("GET", "HEAD")
+		s.router.HandleFunc(p, s.require(RoleOperator, s.handlePutFile)).Methods("PUT")
+		s.router.HandleFunc(p, s.require(RoleOperator, s.handleDeleteFile)).Methods("DELETE")
+	}
 
 	// WebSocket endpoint
-	s.router.HandleFunc("/api/ws", s.handleWebSocket)
+	s.router.HandleFunc("/api/ws", s.require(RoleViewer, s.handleWebSocket))
+
+	// Serve the web UI
+	s.router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ui.ServeHTTP(w, r)
+	})
+}
+
+// SetWebUI replaces the handler serving the web UI, which defaults to the
+// copy embedded in the binary
+func (s *Server) SetWebUI(ui http.Handler) {
+	s.ui = ui
+}
 
-	// Serve static files
-	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/dist")))
+// Handler returns the server's HTTP handler, for embedding the API in
+// another server or testing it
+func (s *Server) Handler() http.Handler {
+	return s.router
 }
 
 // Start starts the HTTP server
@@ -91,23 +141,46 @@ func (s *Server) Start(addr string) error {
 	return http.ListenAndServe(addr, s.router)
 }
 
+// NodeType describes a node type and its config fields
+type NodeType struct {
+	Type        string                 `json:"type"`
+	Description string                 `json:"description"`
+	Category    string                 `json:"category"`
+	Fields      []registry.SchemaField `json:"fields"`
+}
+
+func newNodeType(schema registry.NodeSchema) NodeType {
+	return NodeType{
+		Type:        schema.Type,
+		Description: schema.Description,
+		Category:    getNodeCategory(schema.Type),
+		Fields:      schema.Fields,
+	}
+}
+
+// CompositionSummary describes the latest revision of a composition
+type CompositionSummary struct {
+	ID          string    `json:"id" yaml:"id"`
+	Name        string    `json:"name" yaml:"name"`
+	Description string    `json:"description" yaml:"description"`
+	Version     string    `json:"version" yaml:"version"`
+	NodeCount   int       `json:"nodeCount" yaml:"nodeCount"`
+	Revision    int       `json:"revision" yaml:"revision"`
+	Updated     time.Time `json:"updated" yaml:"updated"`
+	Author      string    `json:"author" yaml:"author"`
+}
+
 // handleListNodes returns all available node types
 func (s *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
 	types := registry.ListTypes()
-	nodes := make([]map[string]interface{}, 0, len(types))
+	nodes := make([]NodeType, 0, len(types))
 
 	for _, t := range types {
 		schema, err := registry.GetSchema(t)
 		if err != nil {
 			continue
 		}
-
-		nodes = append(nodes, map[string]interface{}{
-			"type":        schema.Type,
-			"description": schema.Description,
-			"category":    getNodeCategory(t),
-			"fields":      schema.Fields,
-		})
+		nodes = append(nodes, newNodeType(schema))
 	}
 
 	respondJSON(w, http.StatusOK, nodes)
@@ -124,128 +197,192 @@ func (s *Server) handleGetNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"type":        schema.Type,
-		"description": schema.Description,
-		"category":    getNodeCategory(nodeType),
-		"fields":      schema.Fields,
-	})
+	respondJSON(w, http.StatusOK, newNodeType(schema))
 }
 
 // handleListCompositions returns all compositions
 func (s *Server) handleListCompositions(w http.ResponseWriter, r *http.Request) {
-	s.store.mu.RLock()
-	defer s.store.mu.RUnlock()
-
-	compositions := make([]map[string]interface{}, 0, len(s.store.compositions))
-	for id, spec := range s.store.compositions {
-		compositions = append(compositions, map[string]interface{}{
-			"id":          id,
-			"name":        spec.Name,
-			"description": spec.Description,
-			"version":     spec.Version,
-			"nodeCount":   len(spec.Nodes),
+	ids, err := s.store.List()
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+
+	compositions := make([]CompositionSummary, 0, len(ids))
+	for _, id := range ids {
+		if !s.allowed(r, id, RoleViewer) {
+			continue
+		}
+		rev, err := s.store.Get(id)
+		if err != nil {
+			continue // Deleted since List
+		}
+		spec := rev.Spec
+		compositions = append(compositions, CompositionSummary{
+			ID:          id,
+			Name:        spec.Name,
+			Description: spec.Description,
+			Version:     spec.Version,
+			NodeCount:   len(spec.Nodes),
+			Revision:    rev.Number,
+			Updated:     rev.Time,
+			Author:      rev.Author,
 		})
 	}
 
-	respondJSON(w, http.StatusOK, compositions)
+	respond(w, r, http.StatusOK, compositions)
 }
 
-// handleCreateComposition creates a new composition
+// handleCreateComposition creates a composition, or adds a revision if
+// one with the same name exists. Send If-None-Match: * to fail instead.
 func (s *Server) handleCreateComposition(w http.ResponseWriter, r *http.Request) {
-	var spec engine.CompositionSpec
-	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid JSON")
+	spec, err := decodeSpec(w, r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	// Validate the composition
-	validator := engine.NewValidator(&spec)
+	validator := engine.NewValidator(spec).AllowRedacted()
 	if err := validator.ValidateAll(); err != nil {
 		respondError(w, http.StatusBadRequest, fmt.Sprintf("Validation error: %v", err))
 		return
 	}
+	s.putComposition(w, r, spec)
+}
+
+// checkName refuses a spec for composition id that names another one.
+// Compositions are stored under their name, so renaming means creating a
+// new composition.
+func checkName(id string, spec *engine.CompositionSpec) error {
+	if spec.Name != id {
+		return fmt.Errorf("spec is named %q but belongs to composition %q; create a new composition to rename it", spec.Name, id)
+	}
+	return nil
+}
 
+// putComposition stores a validated spec as the composition named after
+// it, honouring If-None-Match and If-Match
+func (s *Server) putComposition(w http.ResponseWriter, r *http.Request, spec *engine.CompositionSpec) {
 	// Generate ID from name
 	id := spec.Name
+	if !s.authorize(w, r, id, RoleEditor) {
+		return
+	}
 
-	s.store.mu.Lock()
-	s.store.compositions[id] = &spec
-	s.store.mu.Unlock()
+	match, err := revisionPrecondition(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sealed, ok := s.sealLatest(w, id, spec)
+	if !ok {
+		return
+	}
+	rev, err := s.store.Put(id, &Revision{Author: requestAuthor(r), Spec: sealed}, match)
+	if err != nil {
+		s.respondPutError(w, id, err)
+		return
+	}
 
-	// Broadcast update
-	s.broadcast <- Message{
-		Type: "composition_created",
-		Data: map[string]interface{}{"id": id, "spec": spec},
+	msgType, status := "composition_created", http.StatusCreated
+	if rev.Number > 1 {
+		msgType, status = "composition_updated", http.StatusOK
 	}
+	s.publishRevision(msgType, id, rev)
 
-	respondJSON(w, http.StatusCreated, map[string]interface{}{
-		"id":   id,
-		"spec": spec,
+	w.Header().Set("ETag", rev.ETag())
+	respond(w, r, status, map[string]interface{}{
+		"id":       id,
+		"spec":     engine.RedactSpec(rev.Spec),
+		"revision": rev.Number,
 	})
 }
 
-// handleGetComposition returns a specific composition
+// handleGetComposition returns the latest revision of a composition
 func (s *Server) handleGetComposition(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	s.store.mu.RLock()
-	spec, exists := s.store.compositions[id]
-	s.store.mu.RUnlock()
-
-	if !exists {
-		respondError(w, http.StatusNotFound, "Composition not found")
+	rev, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
 		return
 	}
 
-	respondJSON(w, http.StatusOK, spec)
+	w.Header().Set("ETag", rev.ETag())
+	if r.Header.Get("If-None-Match") == rev.ETag() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respond(w, r, http.StatusOK, engine.RedactSpec(rev.Spec))
 }
 
-// handleUpdateComposition updates a composition
+// handleUpdateComposition stores a new revision of a composition. With
+// If-Match it only succeeds if the composition has not changed since the
+// client read it.
 func (s *Server) handleUpdateComposition(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	var spec engine.CompositionSpec
-	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid JSON")
+	spec, err := decodeSpec(w, r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	// Validate the composition
-	validator := engine.NewValidator(&spec)
+	validator := engine.NewValidator(spec).AllowRedacted()
 	if err := validator.ValidateAll(); err != nil {
 		respondError(w, http.StatusBadRequest, fmt.Sprintf("Validation error: %v", err))
 		return
 	}
+	if err := checkName(id, spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	s.store.mu.Lock()
-	s.store.compositions[id] = &spec
-	s.store.mu.Unlock()
-
-	// Broadcast update
-	s.broadcast <- Message{
-		Type: "composition_updated",
-		Data: map[string]interface{}{"id": id, "spec": spec},
+	match, err := revisionPrecondition(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sealed, ok := s.sealLatest(w, id, spec)
+	if !ok {
+		return
+	}
+	rev, err := s.store.Put(id, &Revision{Author: requestAuthor(r), Spec: sealed}, match)
+	if err != nil {
+		s.respondPutError(w, id, err)
+		return
 	}
 
-	respondJSON(w, http.StatusOK, spec)
+	s.publishRevision("composition_updated", id, rev)
+
+	w.Header().Set("ETag", rev.ETag())
+	respond(w, r, http.StatusOK, engine.RedactSpec(rev.Spec))
 }
 
-// handleDeleteComposition deletes a composition
+// handleDeleteComposition deletes a composition and its history
 func (s *Server) handleDeleteComposition(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	s.store.mu.Lock()
-	delete(s.store.compositions, id)
-	s.store.mu.Unlock()
+	if err := s.store.Delete(id); err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	s.stacks.forget(id)
+	s.listings.forget(id)
+	if err := s.secrets.deleteComposition(id); err != nil {
+		log.Printf("Failed to delete secrets of %s: %v", id, err)
+	}
 
 	// Broadcast update
 	s.broadcast <- Message{
-		Type: "composition_deleted",
-		Data: map[string]interface{}{"id": id},
+		Type:        "composition_deleted",
+		Data:        map[string]interface{}{"id": id},
+		composition: id,
 	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
@@ -256,17 +393,15 @@ func (s *Server) handleValidateComposition(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	s.store.mu.RLock()
-	spec, exists := s.store.compositions[id]
-	s.store.mu.RUnlock()
-
-	if !exists {
-		respondError(w, http.StatusNotFound, "Composition not found")
+	rev, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
 		return
 	}
+	spec := rev.Spec
 
 	validator := engine.NewValidator(spec)
-	err := validator.ValidateAll()
+	err = validator.ValidateAll()
 
 	if err != nil {
 		respondJSON(w, http.StatusOK, map[string]interface{}{
@@ -286,16 +421,16 @@ func (s *Server) handleBuildComposition(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	s.store.mu.RLock()
-	spec, exists := s.store.compositions[id]
-	s.store.mu.RUnlock()
-
-	if !exists {
-		respondError(w, http.StatusNotFound, "Composition not found")
+	rev, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
 		return
 	}
+	spec := rev.Spec
 
-	builder := engine.NewBuilder(spec)
+	// Test builds run sandboxed so they never write to real backends
+	builder := s.newBuilder(spec, true)
+	defer builder.Close()
 	fs, err := builder.Build()
 
 	if err != nil {
@@ -306,17 +441,60 @@ func (s *Server) handleBuildComposition(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Test basic operations
-	testResult := testFilesystem(fs)
+	// Run the conformance suite, optionally limited with ?only=seek,rename
+	opts := conformance.Options{}
+	if only := r.URL.Query().Get("only"); only != "" {
+		opts.Categories = strings.Split(only, ",")
+	}
+	testResult := testFilesystem(fs, opts)
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"success": testResult.Success,
 		"tests":   testResult.Tests,
 		"error":   testResult.Error,
+		"report":  testResult.Report,
 	})
 }
 
-// handleWebSocket handles WebSocket connections
+// graphContentTypes maps graph formats to response content types
+var graphContentTypes = map[string]string{
+	graph.FormatASCII:   "text/plain; charset=utf-8",
+	graph.FormatDOT:     "text/vnd.graphviz; charset=utf-8",
+	graph.FormatMermaid: "text/plain; charset=utf-8",
+	graph.FormatSVG:     "image/svg+xml",
+}
+
+// handleGraphComposition renders a composition's node graph. Without
+// ?format= it returns the graph as JSON.
+func (s *Server) handleGraphComposition(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	rev, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	spec := rev.Spec
+
+	g := graph.New(spec)
+	format := r.URL.Query().Get("format")
+	if format == "" || format == "json" {
+		respondJSON(w, http.StatusOK, g)
+		return
+	}
+
+	out, err := g.Render(format)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", graphContentTypes[format])
+	w.Write([]byte(out))
+}
+
+// handleWebSocket handles WebSocket connections. Clients receive change
+// notifications and may send patches and presence; see collab.go.
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -324,90 +502,86 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	p, _ := PrincipalFrom(r.Context())
+	c := newWSClient(conn, fmt.Sprintf("c%d", s.clientSeq.Add(1)), requestAuthor(r), p)
 	s.clientsMu.Lock()
-	s.clients[conn] = true
+	s.clients[conn] = c
 	s.clientsMu.Unlock()
 
 	defer func() {
 		s.clientsMu.Lock()
 		delete(s.clients, conn)
+		left := c.composition
 		s.clientsMu.Unlock()
+		close(c.done)
 		conn.Close()
+		if left != "" {
+			s.publishPresence(left)
+		}
 	}()
 
-	// Keep connection alive
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			break
-		}
+	if err := c.send(Message{Type: "hello", Data: Hello{Client: c.id, User: c.user}}); err != nil {
+		return
 	}
+	go c.writeQueued()
+	s.handleClientMessages(c)
 }
 
-// handleBroadcasts sends messages to all connected clients
+// handleBroadcasts queues messages for all connected clients. Each
+// client's own goroutine writes them, so a client that stops reading
+// delays no one else.
 func (s *Server) handleBroadcasts() {
 	for msg := range s.broadcast {
+		var recipients []*wsClient
 		s.clientsMu.RLock()
-		for client := range s.clients {
-			err := client.WriteJSON(msg)
-			if err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				client.Close()
-				delete(s.clients, client)
+		for _, client := range s.clients {
+			if msg.composition != "" && !s.clientAllowed(client, msg.composition, RoleViewer) {
+				continue
 			}
+			recipients = append(recipients, client)
 		}
 		s.clientsMu.RUnlock()
+
+		for _, client := range recipients {
+			client.enqueue(msg)
+		}
 	}
 }
 
 // TestResult represents filesystem test results
 type TestResult struct {
-	Success bool                   `json:"success"`
-	Tests   []string               `json:"tests"`
-	Error   string                 `json:"error,omitempty"`
+	Success bool                `json:"success"`
+	Tests   []string            `json:"tests"`
+	Error   string              `json:"error,omitempty"`
+	Report  *conformance.Report `json:"report,omitempty"`
 }
 
-// testFilesystem performs basic filesystem tests
-func testFilesystem(fs absfs.FileSystem) TestResult {
-	tests := []string{}
-
-	// Test: Create file
-	f, err := fs.Create("test.txt")
-	if err != nil {
-		return TestResult{Success: false, Error: err.Error()}
-	}
-	tests = append(tests, "✓ Create file")
-
-	// Test: Write data
-	data := []byte("Hello from fscomposer!")
-	_, err = f.Write(data)
+// testFilesystem runs the conformance suite and summarizes it as one line
+// per check
+func testFilesystem(fs absfs.FileSystem, opts conformance.Options) TestResult {
+	report, err := conformance.Run(fs, opts)
 	if err != nil {
-		f.Close()
 		return TestResult{Success: false, Error: err.Error()}
 	}
-	f.Close()
-	tests = append(tests, "✓ Write data")
 
-	// Test: Read data
-	f, err = fs.Open("test.txt")
-	if err != nil {
-		return TestResult{Success: false, Error: err.Error()}
-	}
-	readData := make([]byte, len(data))
-	_, err = f.Read(readData)
-	f.Close()
-	if err != nil {
-		return TestResult{Success: false, Error: err.Error()}
+	tests := []string{}
+	for _, res := range report.Results {
+		name := res.Category + ": " + res.Name
+		switch res.Status {
+		case conformance.StatusPass:
+			tests = append(tests, "✓ "+name)
+		case conformance.StatusFail:
+			tests = append(tests, "✗ "+name+": "+res.Error)
+		case conformance.StatusUnsupported:
+			tests = append(tests, "- "+name+": unsupported")
+		}
 	}
-	tests = append(tests, "✓ Read data")
 
-	// Test: Verify data
-	if string(readData) != string(data) {
-		return TestResult{Success: false, Error: "data mismatch"}
+	result := TestResult{Success: report.OK(), Tests: tests, Report: report}
+	if !report.OK() {
+		result.Error = fmt.Sprintf("%d of %d checks failed", report.Failed, len(report.Results))
 	}
-	tests = append(tests, "✓ Verify data")
-
-	return TestResult{Success: true, Tests: tests}
+	return result
 }
 
 // Helper functions
@@ -419,21 +593,6 @@ func getNodeCategory(nodeType string) string {
 	return "wrapper"
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -443,3 +602,18 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 func respondError(w http.ResponseWriter, status int, message string) {
 	respondJSON(w, status, map[string]string{"error": message})
 }
+
+// respondStoreError maps store errors to status codes
+func respondStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		respondError(w, http.StatusNotFound, "Composition not found")
+	case errors.Is(err, ErrConflict):
+		respondError(w, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, errInvalidID):
+		respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("Store error: %v", err)
+		respondError(w, http.StatusInternalServerError, "Failed to access composition store")
+	}
+}
@@ -0,0 +1,425 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/internal/atomicfile"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrNotFound is returned for compositions and revisions that are not in
+// the store
+var ErrNotFound = errors.New("composition not found")
+
+// ErrConflict is returned when a write names a revision that is no longer
+// the latest
+var ErrConflict = errors.New("composition was changed by someone else")
+
+// errInvalidID is wrapped by errors for IDs a store cannot hold
+var errInvalidID = errors.New("invalid composition ID")
+
+// Revision conditions for CompositionStore.Put besides a revision number
+const (
+	AnyRevision      = -1 // Write unconditionally
+	ExistingRevision = -2 // The composition must exist (If-Match: *)
+	NoRevision       = 0  // The composition must not exist (If-None-Match: *)
+)
+
+// Revision is one saved version of a composition. Revisions are numbered
+// from 1 and never change once written; a rollback adds a new revision
+// with an older spec.
+type Revision struct {
+	Number  int                     `json:"revision" yaml:"revision"`
+	Author  string                  `json:"author" yaml:"author"`
+	Time    time.Time               `json:"time" yaml:"time"`
+	Message string                  `json:"message,omitempty" yaml:"message,omitempty"`
+	Spec    *engine.CompositionSpec `json:"spec,omitempty" yaml:"spec,omitempty"`
+}
+
+// ETag returns the entity tag of the revision for HTTP caching and
+// If-Match
+func (r *Revision) ETag() string {
+	return `"` + strconv.Itoa(r.Number) + `"`
+}
+
+// Summary returns the revision without its spec
+func (r *Revision) Summary() Revision {
+	s := *r
+	s.Spec = nil
+	return s
+}
+
+// CompositionStore keeps the compositions the server manages along with
+// every revision of each. Stores are safe for concurrent use.
+type CompositionStore interface {
+	// List returns the IDs of all compositions, sorted
+	List() ([]string, error)
+	// Get returns the latest revision of a composition or ErrNotFound
+	Get(id string) (*Revision, error)
+	// Revision returns one revision of a composition or ErrNotFound
+	Revision(id string, number int) (*Revision, error)
+	// Revisions returns every revision of a composition, oldest first
+	Revisions(id string) ([]Revision, error)
+	// Put saves rev.Spec as the next revision, filling in its number and
+	// time. It fails with ErrConflict unless match is the number of the
+	// latest revision or one of AnyRevision, ExistingRevision and
+	// NoRevision holds.
+	Put(id string, rev *Revision, match int) (*Revision, error)
+	// Delete removes a composition and its history; deleting a missing
+	// one is not an error
+	Delete(id string) error
+	// Close releases the store's resources
+	Close() error
+}
+
+// Store types accepted by OpenStore
+const (
+	StoreMemory = "memory"
+	StoreDir    = "dir"
+	StoreBolt   = "bolt"
+)
+
+// OpenStore opens a store by type. Path is the directory for dir stores
+// and the database file for bolt stores; memory stores ignore it.
+func OpenStore(storeType, path string) (CompositionStore, error) {
+	switch storeType {
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreDir:
+		return NewDirStore(path)
+	case StoreBolt:
+		return NewBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store type %q (use %s, %s or %s)", storeType, StoreMemory, StoreDir, StoreBolt)
+	}
+}
+
+// validateID rejects IDs that cannot be used as file names or keys
+func validateID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("%w %q", errInvalidID, id)
+	}
+	return nil
+}
+
+// nextRevision checks match against the latest revision, which is nil
+// for a new composition, and returns the revision to write after it
+func nextRevision(latest, rev *Revision, match int) (*Revision, error) {
+	current := 0
+	if latest != nil {
+		current = latest.Number
+	}
+	switch {
+	case match == AnyRevision:
+	case match == ExistingRevision && current == 0:
+		return nil, ErrConflict
+	case match >= 0 && match != current:
+		return nil, ErrConflict
+	}
+
+	next := *rev
+	next.Number = current + 1
+	next.Time = time.Now().UTC().Truncate(time.Millisecond)
+	return &next, nil
+}
+
+// MemoryStore keeps compositions in memory only; they are lost when the
+// server exits
+type MemoryStore struct {
+	revisions map[string][]*Revision
+	mu        sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{revisions: make(map[string][]*Revision)}
+}
+
+// List implements CompositionStore
+func (m *MemoryStore) List() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.revisions))
+	for id := range m.revisions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Get implements CompositionStore
+func (m *MemoryStore) Get(id string) (*Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revs := m.revisions[id]
+	if len(revs) == 0 {
+		return nil, ErrNotFound
+	}
+	return revs[len(revs)-1], nil
+}
+
+// Revision implements CompositionStore
+func (m *MemoryStore) Revision(id string, number int) (*Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revs := m.revisions[id]
+	if number < 1 || number > len(revs) {
+		return nil, ErrNotFound
+	}
+	return revs[number-1], nil
+}
+
+// Revisions implements CompositionStore
+func (m *MemoryStore) Revisions(id string) ([]Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revs := m.revisions[id]
+	if len(revs) == 0 {
+		return nil, ErrNotFound
+	}
+	out := make([]Revision, len(revs))
+	for i, rev := range revs {
+		out[i] = *rev
+	}
+	return out, nil
+}
+
+// Put implements CompositionStore
+func (m *MemoryStore) Put(id string, rev *Revision, match int) (*Revision, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, err := nextRevision(m.latest(id), rev, match)
+	if err != nil {
+		return nil, err
+	}
+	m.revisions[id] = append(m.revisions[id], next)
+	return next, nil
+}
+
+// latest returns the latest revision or nil; the caller holds the lock
+func (m *MemoryStore) latest(id string) *Revision {
+	revs := m.revisions[id]
+	if len(revs) == 0 {
+		return nil
+	}
+	return revs[len(revs)-1]
+}
+
+// Delete implements CompositionStore
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.revisions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+// Close implements CompositionStore
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// DirStore keeps each composition as <id>.yaml in a directory, so specs
+// can be edited, versioned and used with the CLI directly. Revisions are
+// kept under .history/<id>/<n>.yaml. The directory is read once when the
+// store opens; writes replace files atomically.
+type DirStore struct {
+	dir   string
+	cache *MemoryStore
+	mu    sync.Mutex // Serializes writes
+}
+
+// NewDirStore opens a directory store, creating the directory if needed
+// and loading the compositions already in it. Files that fail to parse
+// are logged and skipped rather than failing the server. A composition
+// file that was edited on disk since its latest revision is recorded as a
+// new revision.
+func NewDirStore(dir string) (*DirStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("dir store needs a directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	d := &DirStore{dir: dir, cache: NewMemoryStore()}
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".yaml")
+		if validateID(id) != nil {
+			continue
+		}
+		if err := d.load(id); err != nil {
+			log.Printf("Skipping %s: %v", file, err)
+		}
+	}
+	return d, nil
+}
+
+// load reads a composition and its history into the cache
+func (d *DirStore) load(id string) error {
+	spec, err := engine.ParseFile(d.path(id))
+	if err != nil {
+		return err
+	}
+
+	files, _ := filepath.Glob(filepath.Join(d.historyDir(id), "*.yaml"))
+	var revs []*Revision
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var rev Revision
+		if err := yaml.Unmarshal(data, &rev); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		revs = append(revs, &rev)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Number < revs[j].Number })
+	for i, rev := range revs {
+		if rev.Number != i+1 || rev.Spec == nil {
+			return fmt.Errorf("history of %s is damaged at revision %d", id, i+1)
+		}
+	}
+	d.cache.revisions[id] = revs
+
+	latest := d.cache.latest(id)
+	if latest != nil && engine.Diff(latest.Spec, spec).Empty() {
+		return nil
+	}
+	message := "Edited on disk"
+	if latest == nil {
+		message = "Imported from " + filepath.Base(d.path(id))
+	}
+	_, err = d.put(id, &Revision{Message: message, Spec: spec}, AnyRevision)
+	return err
+}
+
+func (d *DirStore) path(id string) string {
+	return filepath.Join(d.dir, id+".yaml")
+}
+
+func (d *DirStore) historyDir(id string) string {
+	return filepath.Join(d.dir, ".history", id)
+}
+
+// List implements CompositionStore
+func (d *DirStore) List() ([]string, error) {
+	return d.cache.List()
+}
+
+// Get implements CompositionStore
+func (d *DirStore) Get(id string) (*Revision, error) {
+	return d.cache.Get(id)
+}
+
+// Revision implements CompositionStore
+func (d *DirStore) Revision(id string, number int) (*Revision, error) {
+	return d.cache.Revision(id, number)
+}
+
+// Revisions implements CompositionStore
+func (d *DirStore) Revisions(id string) ([]Revision, error) {
+	return d.cache.Revisions(id)
+}
+
+// Put implements CompositionStore
+func (d *DirStore) Put(id string, rev *Revision, match int) (*Revision, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.put(id, rev, match)
+}
+
+// put writes the revision file, then the composition file, then updates
+// the cache. A crash between the two writes is repaired by load, which
+// records the composition file as a new revision if it differs.
+func (d *DirStore) put(id string, rev *Revision, match int) (*Revision, error) {
+	d.cache.mu.RLock()
+	latest := d.cache.latest(id)
+	d.cache.mu.RUnlock()
+	next, err := nextRevision(latest, rev, match)
+	if err != nil {
+		return nil, err
+	}
+
+	revData, err := marshalYAML(next)
+	if err != nil {
+		return nil, err
+	}
+	specData, err := marshalYAML(next.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(d.historyDir(id), 0755); err != nil {
+		return nil, fmt.Errorf("failed to save composition %s: %w", id, err)
+	}
+	revFile := filepath.Join(d.historyDir(id), fmt.Sprintf("%06d.yaml", next.Number))
+	if err := atomicfile.WriteFile(revFile, revData); err != nil {
+		return nil, fmt.Errorf("failed to save composition %s: %w", id, err)
+	}
+	if err := atomicfile.WriteFile(d.path(id), specData); err != nil {
+		return nil, fmt.Errorf("failed to save composition %s: %w", id, err)
+	}
+
+	d.cache.mu.Lock()
+	d.cache.revisions[id] = append(d.cache.revisions[id], next)
+	d.cache.mu.Unlock()
+	return next, nil
+}
+
+// Delete implements CompositionStore
+func (d *DirStore) Delete(id string) error {
+	if validateID(id) != nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete composition %s: %w", id, err)
+	}
+	if err := os.RemoveAll(d.historyDir(id)); err != nil {
+		return fmt.Errorf("failed to delete history of %s: %w", id, err)
+	}
+	return d.cache.Delete(id)
+}
+
+// Close implements CompositionStore
+func (d *DirStore) Close() error {
+	return nil
+}
+
+// marshalYAML encodes a value as YAML with the 2-space indent used by the
+// examples
+func marshalYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("failed to encode composition: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/gorilla/mux"
+)
+
+// maxSpecSize limits uploaded spec files
+const maxSpecSize = 4 << 20
+
+// yamlContentType is sent with YAML responses
+const yamlContentType = "application/yaml"
+
+// isYAML reports whether a media type is one of the names YAML goes by
+func isYAML(mediaType string) bool {
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+	return false
+}
+
+// wantsYAML reports whether the Accept header prefers YAML to JSON
+func wantsYAML(r *http.Request) bool {
+	var yamlQ, jsonQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case isYAML(mediaType):
+			yamlQ = max(yamlQ, q)
+		case mediaType == "application/json":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return yamlQ > 0 && yamlQ > jsonQ
+}
+
+// respond writes v as YAML if the client asked for it, else as JSON
+func respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if !wantsYAML(r) {
+		respondJSON(w, status, v)
+		return
+	}
+	data, err := marshalYAML(v)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", yamlContentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// decodeSpec reads a spec from the request body, as YAML when the
+// Content-Type says so and as JSON otherwise
+func decodeSpec(w http.ResponseWriter, r *http.Request) (*engine.CompositionSpec, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !isYAML(mediaType) {
+		var spec engine.CompositionSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			return nil, errors.New("Invalid JSON")
+		}
+		return &spec, nil
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSpecSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec: %w", err)
+	}
+	return engine.Parse(data)
+}
+
+// importError reports why an uploaded spec was rejected
+type importError struct {
+	Error       string              `json:"error" yaml:"error"`
+	Diagnostics []engine.Diagnostic `json:"diagnostics" yaml:"diagnostics"`
+}
+
+// handleImportComposition stores an uploaded spec file, YAML or JSON, as
+// a composition. The file is the request body or the "file" field of a
+// multipart form. A spec that does not parse or validate is rejected with
+// every problem found, like fscomposer validate reports them.
+func (s *Server) handleImportComposition(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSpecSize)
+	body := io.Reader(r.Body)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Upload the spec as the \"file\" field")
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Failed to read spec: %v", err))
+		return
+	}
+
+	// YAML is a superset of JSON, so Parse reads both
+	spec, err := engine.Parse(data)
+	if err != nil {
+		respond(w, r, http.StatusUnprocessableEntity, importError{
+			Error:       "Parse error",
+			Diagnostics: []engine.Diagnostic{{Check: "parse", Message: err.Error()}},
+		})
+		return
+	}
+	if diags := engine.NewValidator(spec).AllowRedacted().Diagnose(); len(diags) > 0 {
+		respond(w, r, http.StatusUnprocessableEntity, importError{
+			Error:       "Validation error",
+			Diagnostics: diags,
+		})
+		return
+	}
+	s.putComposition(w, r, spec)
+}
+
+// handleExportComposition returns the latest revision, or the one in
+// ?revision=, as a YAML spec file that fscomposer and engine.ParseFile
+// read. Secret values are redacted.
+func (s *Server) handleExportComposition(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	rev, err := s.store.Get(id)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	number, err := queryRevision(r.URL.Query().Get("revision"), rev.Number)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if number != rev.Number {
+		var ok bool
+		if rev, ok = s.lookupRevision(w, id, number); !ok {
+			return
+		}
+	}
+
+	data, err := marshalYAML(engine.RedactSpec(rev.Spec))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	header := fmt.Sprintf("# Exported from fscomposer: %s revision %d\n", id, rev.Number)
+
+	w.Header().Set("Content-Type", yamlContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".yaml"))
+	w.Header().Set("ETag", rev.ETag())
+	w.Write(append([]byte(header), data...))
+}
@@ -0,0 +1,444 @@
+// Package bench runs synthetic workloads against a composed filesystem and
+// measures throughput, latency and the time spent in each node
+package bench
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// Workload names
+const (
+	SeqWrite   = "seq-write"
+	SeqRead    = "seq-read"
+	RandRead   = "rand-read"
+	RandWrite  = "rand-write"
+	SmallFiles = "small-files"
+	Metadata   = "metadata"
+	Mixed      = "mixed"
+)
+
+// Workloads lists every workload in the order they run
+var Workloads = []string{SeqWrite, SeqRead, RandRead, RandWrite, SmallFiles, Metadata, Mixed}
+
+// Defaults used when Options leaves a field unset
+const (
+	DefaultDirPrefix     = "/.fscomposer-bench-"
+	DefaultDuration      = 3 * time.Second
+	DefaultConcurrency   = 4
+	DefaultFileSize      = 8 << 20
+	DefaultBlockSize     = 64 << 10
+	DefaultSmallFileSize = 4 << 10
+)
+
+// Options controls a benchmark run
+type Options struct {
+	Workloads     []string      // Workloads to run; all when empty
+	Duration      time.Duration // How long each workload runs
+	Concurrency   int
+	FileSize      int64 // Size of the files used by the read and write workloads
+	BlockSize     int   // Size of each read or write
+	SmallFileSize int   // Size of the files created by small-files
+	Dir           string
+	Probe         *Probe // Adds a per-node breakdown when set
+}
+
+// Result is the outcome of one workload
+type Result struct {
+	Workload   string        `json:"workload"`
+	Ops        int64         `json:"ops"`
+	Errors     int64         `json:"errors"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+	OpsPerSec  float64       `json:"opsPerSec"`
+	Throughput float64       `json:"throughput"` // Bytes per second
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+	FirstError string        `json:"firstError,omitempty"`
+	Layers     []LayerTime   `json:"layers,omitempty"`
+}
+
+// Run executes each workload against fs inside a scratch directory that is
+// removed afterwards
+func Run(fs absfs.FileSystem, opts Options) ([]Result, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultDuration
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.FileSize <= 0 {
+		opts.FileSize = DefaultFileSize
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if int64(opts.BlockSize) > opts.FileSize {
+		opts.BlockSize = int(opts.FileSize)
+	}
+	if opts.SmallFileSize <= 0 {
+		opts.SmallFileSize = DefaultSmallFileSize
+	}
+	if len(opts.Workloads) == 0 {
+		opts.Workloads = Workloads
+	}
+	for _, w := range opts.Workloads {
+		if _, ok := workloads[w]; !ok {
+			return nil, fmt.Errorf("unknown workload %q (available: %s)", w, strings.Join(Workloads, ", "))
+		}
+	}
+	if opts.Dir == "" {
+		opts.Dir = fmt.Sprintf("%s%d", DefaultDirPrefix, time.Now().UnixNano())
+	}
+
+	if err := fs.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory %s: %w", opts.Dir, err)
+	}
+	defer fs.RemoveAll(opts.Dir)
+
+	var results []Result
+	for i, name := range opts.Workloads {
+		dir := path.Join(opts.Dir, fmt.Sprintf("%d-%s", i, name))
+		result, err := runWorkload(fs, name, dir, opts)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", name, err)
+		}
+		results = append(results, *result)
+		fs.RemoveAll(dir)
+	}
+	return results, nil
+}
+
+// op performs one operation and returns the bytes it moved
+type op func() (int64, error)
+
+// workload prepares a worker's files and returns its operation
+type workload func(w *worker) (op, error)
+
+var workloads = map[string]workload{
+	SeqWrite:   seqWrite,
+	SeqRead:    seqRead,
+	RandRead:   randRead,
+	RandWrite:  randWrite,
+	SmallFiles: smallFiles,
+	Metadata:   metadata,
+	Mixed:      mixed,
+}
+
+// worker is one goroutine of a workload, working in its own directory
+type worker struct {
+	fs    absfs.FileSystem
+	dir   string
+	opts  Options
+	rng   *rand.Rand
+	buf   []byte
+	files []absfs.File // Closed when the workload ends
+}
+
+func (w *worker) open(name string, flag int) (absfs.File, error) {
+	f, err := w.fs.OpenFile(path.Join(w.dir, name), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.files = append(w.files, f)
+	return f, nil
+}
+
+// prepare writes a file of the configured size for the read workloads
+func (w *worker) prepare(name string) error {
+	f, err := w.fs.OpenFile(path.Join(w.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for written := int64(0); written < w.opts.FileSize; {
+		n := int64(len(w.buf))
+		if rem := w.opts.FileSize - written; n > rem {
+			n = rem
+		}
+		if _, err := f.Write(w.buf[:n]); err != nil {
+			f.Close()
+			return err
+		}
+		written += n
+	}
+	return f.Close()
+}
+
+func (w *worker) randomOffset() int64 {
+	blocks := w.opts.FileSize / int64(w.opts.BlockSize)
+	if blocks <= 1 {
+		return 0
+	}
+	return w.rng.Int63n(blocks) * int64(w.opts.BlockSize)
+}
+
+func runWorkload(fs absfs.FileSystem, name, dir string, opts Options) (*Result, error) {
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	workers := make([]*worker, opts.Concurrency)
+	ops := make([]op, opts.Concurrency)
+	for i := range workers {
+		w := &worker{
+			fs:   fs,
+			dir:  path.Join(dir, fmt.Sprintf("w%d", i)),
+			opts: opts,
+			rng:  rand.New(rand.NewSource(int64(i) + 1)),
+			buf:  make([]byte, opts.BlockSize),
+		}
+		w.rng.Read(w.buf)
+		if err := fs.Mkdir(w.dir, 0755); err != nil {
+			return nil, err
+		}
+		op, err := workloads[name](w)
+		if err != nil {
+			return nil, fmt.Errorf("prepare: %w", err)
+		}
+		workers[i], ops[i] = w, op
+	}
+	defer func() {
+		for _, w := range workers {
+			for _, f := range w.files {
+				f.Close()
+			}
+		}
+	}()
+
+	var before snapshot
+	if opts.Probe != nil {
+		before = opts.Probe.snapshot()
+	}
+
+	type stats struct {
+		latencies []time.Duration
+		bytes     int64
+		errors    int64
+		firstErr  error
+	}
+	results := make([]stats, opts.Concurrency)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+	for i := range workers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := &results[i]
+			for time.Now().Before(deadline) {
+				opStart := time.Now()
+				n, err := ops[i]()
+				s.latencies = append(s.latencies, time.Since(opStart))
+				if err != nil {
+					s.errors++
+					if s.firstErr == nil {
+						s.firstErr = err
+					}
+					continue
+				}
+				s.bytes += n
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	result := &Result{Workload: name, Duration: elapsed}
+	var latencies []time.Duration
+	for _, s := range results {
+		latencies = append(latencies, s.latencies...)
+		result.Bytes += s.bytes
+		result.Errors += s.errors
+		if s.firstErr != nil && result.FirstError == "" {
+			result.FirstError = s.firstErr.Error()
+		}
+	}
+	result.Ops = int64(len(latencies))
+	result.OpsPerSec = float64(result.Ops) / elapsed.Seconds()
+	result.Throughput = float64(result.Bytes) / elapsed.Seconds()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.P50 = percentile(latencies, 50)
+	result.P90 = percentile(latencies, 90)
+	result.P99 = percentile(latencies, 99)
+	if len(latencies) > 0 {
+		result.Max = latencies[len(latencies)-1]
+	}
+
+	if opts.Probe != nil {
+		result.Layers = opts.Probe.layers(before, opts.Probe.snapshot())
+	}
+	return result, nil
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// Workloads
+
+func seqWrite(w *worker) (op, error) {
+	f, err := w.open("data", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	var written int64
+	return func() (int64, error) {
+		// Start over once the file has reached its size
+		if written >= w.opts.FileSize {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			written = 0
+		}
+		n, err := f.Write(w.buf)
+		written += int64(n)
+		return int64(n), err
+	}, nil
+}
+
+func seqRead(w *worker) (op, error) {
+	if err := w.prepare("data"); err != nil {
+		return nil, err
+	}
+	f, err := w.open("data", os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return func() (int64, error) {
+		n, err := f.Read(w.buf)
+		if err == io.EOF {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		return int64(n), err
+	}, nil
+}
+
+func randRead(w *worker) (op, error) {
+	if err := w.prepare("data"); err != nil {
+		return nil, err
+	}
+	f, err := w.open("data", os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return func() (int64, error) {
+		n, err := f.ReadAt(w.buf, w.randomOffset())
+		if err == io.EOF {
+			err = nil
+		}
+		return int64(n), err
+	}, nil
+}
+
+func randWrite(w *worker) (op, error) {
+	if err := w.prepare("data"); err != nil {
+		return nil, err
+	}
+	f, err := w.open("data", os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	return func() (int64, error) {
+		n, err := f.WriteAt(w.buf, w.randomOffset())
+		return int64(n), err
+	}, nil
+}
+
+// smallFiles creates, writes and closes a new file per operation
+func smallFiles(w *worker) (op, error) {
+	data := make([]byte, w.opts.SmallFileSize)
+	w.rng.Read(data)
+	i := 0
+	return func() (int64, error) {
+		f, err := w.fs.Create(path.Join(w.dir, fmt.Sprintf("f%06d", i)))
+		i++
+		if err != nil {
+			return 0, err
+		}
+		n, err := f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return int64(n), err
+	}, nil
+}
+
+// metadata cycles through stat, readdir, chmod and rename over a small set
+// of files
+func metadata(w *worker) (op, error) {
+	const files = 32
+	for i := 0; i < files; i++ {
+		f, err := w.fs.Create(path.Join(w.dir, fmt.Sprintf("m%02d", i)))
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	i := 0
+	return func() (int64, error) {
+		name := path.Join(w.dir, fmt.Sprintf("m%02d", i%files))
+		kind := i % 4
+		i++
+		switch kind {
+		case 0:
+			_, err := w.fs.Stat(name)
+			return 0, err
+		case 1:
+			_, err := w.fs.ReadDir(w.dir)
+			return 0, err
+		case 2:
+			return 0, w.fs.Chmod(name, os.FileMode(0600+(i%2)*0044))
+		default:
+			// Rename there and back so the file set stays the same
+			tmp := name + ".tmp"
+			if err := w.fs.Rename(name, tmp); err != nil {
+				return 0, err
+			}
+			return 0, w.fs.Rename(tmp, name)
+		}
+	}, nil
+}
+
+// mixed is 70% random reads, 20% random writes and 10% stats on one file
+func mixed(w *worker) (op, error) {
+	if err := w.prepare("data"); err != nil {
+		return nil, err
+	}
+	f, err := w.open("data", os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Join(w.dir, "data")
+	return func() (int64, error) {
+		switch r := w.rng.Intn(10); {
+		case r < 7:
+			n, err := f.ReadAt(w.buf, w.randomOffset())
+			if err == io.EOF {
+				err = nil
+			}
+			return int64(n), err
+		case r < 9:
+			n, err := f.WriteAt(w.buf, w.randomOffset())
+			return int64(n), err
+		default:
+			_, err := w.fs.Stat(name)
+			return 0, err
+		}
+	}, nil
+}
@@ -0,0 +1,258 @@
+package bench
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+)
+
+// Probe measures the time spent in each node of a stack. Pass its Wrap
+// method to Builder.Instrument before building.
+type Probe struct {
+	spec  *engine.CompositionSpec
+	nodes map[string]*counter
+	order []string
+}
+
+type counter struct {
+	nodeType string
+	calls    atomic.Int64
+	nanos    atomic.Int64
+}
+
+// LayerTime is the time spent in one node. Total includes the nodes below
+// it; Self excludes them.
+type LayerTime struct {
+	Node    string        `json:"node"`
+	Type    string        `json:"type"`
+	Calls   int64         `json:"calls"`
+	Total   time.Duration `json:"total"`
+	Self    time.Duration `json:"self"`
+	Percent float64       `json:"percent"` // Share of the root's total time
+}
+
+type snapshot map[string][2]int64 // Node ID to calls and nanoseconds
+
+// NewProbe creates a probe for a stack built from spec
+func NewProbe(spec *engine.CompositionSpec) *Probe {
+	return &Probe{spec: spec, nodes: make(map[string]*counter)}
+}
+
+// Wrap instruments one built node
+func (p *Probe) Wrap(node *engine.Node, fs absfs.FileSystem) absfs.FileSystem {
+	c := &counter{nodeType: node.Type}
+	p.nodes[node.ID] = c
+	p.order = append(p.order, node.ID)
+	return &timedFS{fs: fs, c: c}
+}
+
+func (p *Probe) snapshot() snapshot {
+	s := make(snapshot, len(p.nodes))
+	for id, c := range p.nodes {
+		s[id] = [2]int64{c.calls.Load(), c.nanos.Load()}
+	}
+	return s
+}
+
+// layers returns the time spent in each node between two snapshots, from
+// the root of the stack down
+func (p *Probe) layers(before, after snapshot) []LayerTime {
+	total := func(id string) int64 { return after[id][1] - before[id][1] }
+
+	var layers []LayerTime
+	var rootTotal int64
+	if root, ok := after[p.spec.Mount.Root]; ok {
+		rootTotal = root[1] - before[p.spec.Mount.Root][1]
+	}
+	for _, id := range p.order {
+		self := total(id)
+		for _, conn := range p.spec.GetIncomingConnections(id) {
+			if _, ok := p.nodes[conn.From]; ok {
+				self -= total(conn.From)
+			}
+		}
+		if self < 0 {
+			self = 0
+		}
+		layer := LayerTime{
+			Node:  id,
+			Type:  p.nodes[id].nodeType,
+			Calls: after[id][0] - before[id][0],
+			Total: time.Duration(total(id)),
+			Self:  time.Duration(self),
+		}
+		if rootTotal > 0 {
+			layer.Percent = float64(self) / float64(rootTotal) * 100
+		}
+		layers = append(layers, layer)
+	}
+
+	// Nodes are built bottom-up; report the root first
+	sort.SliceStable(layers, func(i, j int) bool { return layers[i].Total > layers[j].Total })
+	return layers
+}
+
+// timedFS counts calls into a node and the time they take
+type timedFS struct {
+	fs absfs.FileSystem
+	c  *counter
+}
+
+func (t *timedFS) record(start time.Time) {
+	t.c.calls.Add(1)
+	t.c.nanos.Add(int64(time.Since(start)))
+}
+
+func (t *timedFS) file(f absfs.File, err error) (absfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &timedFile{File: f, t: t}, nil
+}
+
+func (t *timedFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	defer t.record(time.Now())
+	return t.file(t.fs.OpenFile(name, flag, perm))
+}
+
+func (t *timedFS) Open(name string) (absfs.File, error) {
+	defer t.record(time.Now())
+	return t.file(t.fs.Open(name))
+}
+
+func (t *timedFS) Create(name string) (absfs.File, error) {
+	defer t.record(time.Now())
+	return t.file(t.fs.Create(name))
+}
+
+func (t *timedFS) Mkdir(name string, perm os.FileMode) error {
+	defer t.record(time.Now())
+	return t.fs.Mkdir(name, perm)
+}
+
+func (t *timedFS) MkdirAll(name string, perm os.FileMode) error {
+	defer t.record(time.Now())
+	return t.fs.MkdirAll(name, perm)
+}
+
+func (t *timedFS) Remove(name string) error {
+	defer t.record(time.Now())
+	return t.fs.Remove(name)
+}
+
+func (t *timedFS) RemoveAll(name string) error {
+	defer t.record(time.Now())
+	return t.fs.RemoveAll(name)
+}
+
+func (t *timedFS) Rename(oldpath, newpath string) error {
+	defer t.record(time.Now())
+	return t.fs.Rename(oldpath, newpath)
+}
+
+func (t *timedFS) Stat(name string) (os.FileInfo, error) {
+	defer t.record(time.Now())
+	return t.fs.Stat(name)
+}
+
+func (t *timedFS) Chmod(name string, mode os.FileMode) error {
+	defer t.record(time.Now())
+	return t.fs.Chmod(name, mode)
+}
+
+func (t *timedFS) Chtimes(name string, atime, mtime time.Time) error {
+	defer t.record(time.Now())
+	return t.fs.Chtimes(name, atime, mtime)
+}
+
+func (t *timedFS) Chown(name string, uid, gid int) error {
+	defer t.record(time.Now())
+	return t.fs.Chown(name, uid, gid)
+}
+
+func (t *timedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	defer t.record(time.Now())
+	return t.fs.ReadDir(name)
+}
+
+func (t *timedFS) ReadFile(name string) ([]byte, error) {
+	defer t.record(time.Now())
+	return t.fs.ReadFile(name)
+}
+
+func (t *timedFS) Truncate(name string, size int64) error {
+	defer t.record(time.Now())
+	return t.fs.Truncate(name, size)
+}
+
+func (t *timedFS) Sub(dir string) (fs.FS, error) {
+	return t.fs.Sub(dir)
+}
+
+func (t *timedFS) Chdir(dir string) error {
+	return t.fs.Chdir(dir)
+}
+
+func (t *timedFS) Getwd() (string, error) {
+	return t.fs.Getwd()
+}
+
+func (t *timedFS) TempDir() string {
+	return t.fs.TempDir()
+}
+
+// timedFile counts IO on files opened through a timedFS
+type timedFile struct {
+	absfs.File
+	t *timedFS
+}
+
+func (f *timedFile) Read(b []byte) (int, error) {
+	defer f.t.record(time.Now())
+	return f.File.Read(b)
+}
+
+func (f *timedFile) Write(b []byte) (int, error) {
+	defer f.t.record(time.Now())
+	return f.File.Write(b)
+}
+
+func (f *timedFile) ReadAt(b []byte, off int64) (int, error) {
+	defer f.t.record(time.Now())
+	return f.File.ReadAt(b, off)
+}
+
+func (f *timedFile) WriteAt(b []byte, off int64) (int, error) {
+	defer f.t.record(time.Now())
+	return f.File.WriteAt(b, off)
+}
+
+func (f *timedFile) WriteString(s string) (int, error) {
+	defer f.t.record(time.Now())
+	return f.File.WriteString(s)
+}
+
+func (f *timedFile) Seek(offset int64, whence int) (int64, error) {
+	defer f.t.record(time.Now())
+	return f.File.Seek(offset, whence)
+}
+
+func (f *timedFile) Truncate(size int64) error {
+	defer f.t.record(time.Now())
+	return f.File.Truncate(size)
+}
+
+func (f *timedFile) Sync() error {
+	defer f.t.record(time.Now())
+	return f.File.Sync()
+}
+
+func (f *timedFile) Close() error {
+	defer f.t.record(time.Now())
+	return f.File.Close()
+}
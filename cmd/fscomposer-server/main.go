@@ -3,14 +3,130 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/absfs/fscomposer/api"
+	"github.com/absfs/fscomposer/web"
 )
 
 func main() {
 	addr := flag.String("addr", ":8080", "HTTP server address")
+	storeType := flag.String("store", api.StoreDir, "Composition store: memory, dir (one YAML file per composition) or bolt (embedded database)")
+	data := flag.String("data", "", "Store directory for -store dir, or database file for -store bolt (default under ~/.fscomposer)")
+	authFile := flag.String("auth", "", "Auth config file with tokens, users, JWT keys, permissions and origins (default: no authentication)")
+	secretKey := flag.String("secret-key", "", "Key file encrypting stored secrets, created if missing (default ~/.fscomposer/secret.key; $FSCOMPOSER_SECRET_KEY overrides)")
+	origins := flag.String("origins", "", "Comma-separated browser origins allowed to use the API, or * for any (default: localhost)")
+	webDir := flag.String("web", "", "Serve the web UI from this directory, such as web/dist, instead of the embedded copy (for development)")
 	flag.Parse()
 
-	server := api.NewServer()
-	log.Fatal(server.Start(*addr))
+	path := *data
+	if path == "" && *storeType != api.StoreMemory {
+		path = defaultDataPath(*storeType)
+	}
+
+	store, err := api.OpenStore(*storeType, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if path != "" {
+		log.Printf("Storing compositions in %s (%s)", path, *storeType)
+	}
+
+	server := api.NewServer(store)
+	if path != "" {
+		keyFile := *secretKey
+		if keyFile == "" {
+			keyFile = filepath.Join(filepath.Dir(defaultDataPath(api.StoreDir)), "secret.key")
+		}
+		key, err := api.LoadSecretKey(keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		secrets, err := api.OpenSecretStore(secretsPath(*storeType, path), key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.SetSecrets(secrets)
+		if err := server.SealStored(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	allowed := api.DefaultOrigins
+	if *authFile != "" {
+		cfg, err := api.LoadAuthConfig(*authFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth, err := api.NewAuthenticator(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.SetAuth(auth)
+		if len(cfg.Origins) > 0 {
+			allowed = cfg.Origins
+		}
+		log.Printf("Authenticating requests with %s", *authFile)
+	} else {
+		log.Printf("WARNING: authentication is off; anyone who can reach %s can mount and write files. Pass -auth to require credentials.", *addr)
+	}
+	if *origins != "" {
+		allowed = strings.Split(*origins, ",")
+	}
+	server.SetAllowedOrigins(allowed)
+	if *webDir != "" {
+		server.SetWebUI(web.Handler(os.DirFS(*webDir), true))
+		log.Printf("Serving the web UI from %s", *webDir)
+	} else if web.Embedded() == nil {
+		// Compiled before the UI was built; use a build made since, as
+		// when running from a checkout
+		if _, err := os.Stat(filepath.Join("web", "dist", "index.html")); err == nil {
+			server.SetWebUI(web.Handler(os.DirFS(filepath.Join("web", "dist")), true))
+			log.Printf("No web UI embedded; serving it from web/dist")
+		} else {
+			log.Printf("No web UI embedded; run npm run build in web/ and recompile the server")
+		}
+	}
+
+	// Unmount live instances on Ctrl+C or SIGTERM
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Printf("Stopping instances...")
+		server.Close()
+		store.Close()
+		os.Exit(0)
+	}()
+
+	err = server.Start(*addr)
+	server.Close()
+	store.Close()
+	log.Fatal(err)
+}
+
+// defaultDataPath returns ~/.fscomposer/compositions, with a .db suffix
+// for the bolt store
+func defaultDataPath(storeType string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatalf("Failed to locate home directory, pass -data: %v", err)
+	}
+	path := filepath.Join(home, ".fscomposer", "compositions")
+	if storeType == api.StoreBolt {
+		path += ".db"
+	}
+	return path
+}
+
+// secretsPath returns where the encrypted secrets of a store are kept:
+// inside a store directory, or next to a database file
+func secretsPath(storeType, path string) string {
+	if storeType == api.StoreDir {
+		return filepath.Join(path, ".secrets")
+	}
+	return path + ".secrets"
 }
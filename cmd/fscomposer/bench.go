@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/absfs/fscomposer/bench"
+	"github.com/absfs/fscomposer/engine"
+)
+
+// benchResult is the structured output of bench
+type benchResult struct {
+	File        string         `json:"file"`
+	Name        string         `json:"name"`
+	Sandboxed   bool           `json:"sandboxed"`
+	Concurrency int            `json:"concurrency"`
+	FileSize    int64          `json:"fileSize"`
+	BlockSize   int            `json:"blockSize"`
+	Results     []bench.Result `json:"results"`
+}
+
+// benchCommand runs workloads against a composition and reports where the
+// time goes
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	workloads := flags.String("workload", "", "Comma-separated workloads (default: all)")
+	duration := flags.Duration("duration", bench.DefaultDuration, "How long each workload runs")
+	concurrency := flags.Int("concurrency", bench.DefaultConcurrency, "Parallel workers")
+	fileSize := flags.String("file-size", "8MiB", "Size of the files read and written")
+	blockSize := flags.String("block-size", "64KiB", "Size of each read or write")
+	smallSize := flags.String("small-size", "4KiB", "Size of the files created by small-files")
+	sandboxed := flags.Bool("sandbox", false, "Benchmark against a copy-on-write overlay instead of the real backends")
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("usage: fscomposer bench [--workload seq-read,...] [--duration 3s] [--concurrency N] [--file-size 8MiB] [--block-size 64KiB] [--sandbox] <spec.yaml>\n\nWorkloads: %s",
+			strings.Join(bench.Workloads, ", "))
+	}
+
+	opts := bench.Options{
+		Duration:    *duration,
+		Concurrency: *concurrency,
+	}
+	if *workloads != "" {
+		opts.Workloads = strings.Split(*workloads, ",")
+	}
+	if opts.FileSize, err = parseSize(*fileSize); err != nil {
+		return fmt.Errorf("--file-size: %w", err)
+	}
+	size, err := parseSize(*blockSize)
+	if err != nil {
+		return fmt.Errorf("--block-size: %w", err)
+	}
+	opts.BlockSize = int(size)
+	if size, err = parseSize(*smallSize); err != nil {
+		return fmt.Errorf("--small-size: %w", err)
+	}
+	opts.SmallFileSize = int(size)
+
+	filename := positional[0]
+	textf("Benchmarking: %s\n", filename)
+
+	spec, err := engine.ParseFile(filename)
+	if err != nil {
+		return withExit(exitParse, fmt.Errorf("parse error: %w", err))
+	}
+
+	// Every node is wrapped so time can be attributed to each layer
+	builder := engine.NewBuilder(spec)
+	if *sandboxed {
+		builder = engine.NewSandboxBuilder(spec)
+	}
+	opts.Probe = bench.NewProbe(spec)
+	builder.Instrument(opts.Probe.Wrap)
+
+	fs, err := builder.Build()
+	if err != nil {
+		return withExit(exitBuild, fmt.Errorf("build error: %w", err))
+	}
+	textf("✓ Filesystem stack built and instrumented\n")
+	if !*sandboxed {
+		textf("  Scratch files are written to the real backends and removed afterwards\n")
+	}
+	textf("  %d workers, %s per workload, %s files, %s blocks\n\n",
+		opts.Concurrency, opts.Duration, formatBytes(opts.FileSize), formatBytes(int64(opts.BlockSize)))
+
+	results, err := bench.Run(fs, opts)
+	if structured() {
+		if results == nil {
+			results = []bench.Result{}
+		}
+		return emitResult(benchResult{
+			File:        filename,
+			Name:        spec.Name,
+			Sandboxed:   *sandboxed,
+			Concurrency: opts.Concurrency,
+			FileSize:    opts.FileSize,
+			BlockSize:   opts.BlockSize,
+			Results:     results,
+		}, err)
+	}
+	if len(results) > 0 {
+		printBenchResults(results)
+	}
+	return err
+}
+
+func printBenchResults(results []bench.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKLOAD\tOPS/S\tTHROUGHPUT\tP50\tP90\tP99\tMAX\tERRORS")
+	for _, r := range results {
+		throughput := "-"
+		if r.Bytes > 0 {
+			throughput = formatBytes(int64(r.Throughput)) + "/s"
+		}
+		fmt.Fprintf(w, "%s\t%.0f\t%s\t%s\t%s\t%s\t%s\t%d\n", r.Workload, r.OpsPerSec, throughput,
+			formatLatency(r.P50), formatLatency(r.P90), formatLatency(r.P99), formatLatency(r.Max), r.Errors)
+	}
+	w.Flush()
+
+	for _, r := range results {
+		if r.FirstError != "" {
+			fmt.Printf("\n%s: first error: %s\n", r.Workload, r.FirstError)
+		}
+	}
+
+	fmt.Println("\nTime per layer (self time, share of total):")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		var parts []string
+		for _, l := range r.Layers {
+			parts = append(parts, fmt.Sprintf("%s %.0f%%", l.Node, l.Percent))
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", r.Workload, strings.Join(parts, "\t"))
+	}
+	w.Flush()
+}
+
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	default:
+		return fmt.Sprintf("%.1fµs", float64(d)/float64(time.Microsecond))
+	}
+}
+
+// parseSize parses sizes such as 4096, 64KiB, 8M or 1GB (binary units)
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s, mult = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
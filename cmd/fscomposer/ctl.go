@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/absfs/fscomposer/control"
+	"github.com/absfs/fscomposer/instance"
+	"gopkg.in/yaml.v3"
+)
+
+const ctlUsage = `usage: fscomposer ctl <name|path> <command> [arguments]
+
+Commands:
+  status                     Show the mount process status
+  graph                      Dump the live graph with resolved config
+  stats [node]               Show per-node statistics
+  flush [node]               Flush cachefs nodes to their backends
+  invalidate [node [prefix]] Drop cached entries (node "all" for every cache)
+  log-level [level]          Show or set the log level (debug, info, warn, error)
+  reload                     Re-read the spec and hot-swap the composition`
+
+// ctlCommand sends a command to the control socket of a running mount
+func ctlCommand(args []string) error {
+	if len(args) < 2 {
+		return usageErrorf("%s", ctlUsage)
+	}
+
+	rec, err := instance.Find(args[0])
+	if err != nil {
+		return err
+	}
+	if rec.Control == "" {
+		return fmt.Errorf("composition %s has no control socket", rec.Name)
+	}
+	client := control.NewClient(rec.Control)
+
+	command, rest := args[1], args[2:]
+	arg := func(i int) string {
+		if i < len(rest) {
+			return rest[i]
+		}
+		return ""
+	}
+
+	switch command {
+	case "status":
+		status, err := client.Status()
+		if err != nil {
+			return err
+		}
+		if structured() {
+			return emit(status)
+		}
+		fmt.Printf("Name:       %s\n", status.Name)
+		fmt.Printf("PID:        %d\n", status.PID)
+		fmt.Printf("Mount type: %s\n", status.MountType)
+		fmt.Printf("Root:       %s\n", status.Root)
+		fmt.Printf("Uptime:     %s\n", status.Uptime)
+		fmt.Printf("Log level:  %s\n", status.LogLevel)
+
+	case "graph":
+		graph, err := client.Graph()
+		if err != nil {
+			return err
+		}
+		if structured() {
+			return emit(graph)
+		}
+		return printYAML(graph)
+
+	case "stats":
+		stats, err := client.Stats(arg(0))
+		if err != nil {
+			return err
+		}
+		if structured() {
+			return emit(stats)
+		}
+		if len(stats) == 0 {
+			fmt.Println("No nodes report statistics")
+		}
+		for _, node := range stats {
+			fmt.Printf("%s (%s)\n", node.ID, node.Type)
+			keys := make([]string, 0, len(node.Stats))
+			for k := range node.Stats {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("  %-40s %v\n", k, node.Stats[k])
+			}
+		}
+
+	case "flush":
+		result, err := client.Flush(cacheNode(arg(0)))
+		if err != nil {
+			return err
+		}
+		if structured() {
+			return emit(result)
+		}
+		printCacheResult("Flushed", result)
+
+	case "invalidate":
+		result, err := client.Invalidate(cacheNode(arg(0)), arg(1))
+		if err != nil {
+			return err
+		}
+		if structured() {
+			return emit(result)
+		}
+		printCacheResult("Invalidated", result)
+
+	case "log-level":
+		var level string
+		if arg(0) == "" {
+			level, err = client.LogLevel()
+		} else {
+			level, err = client.SetLogLevel(arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		if structured() {
+			return emit(map[string]string{"level": level})
+		}
+		fmt.Printf("Log level: %s\n", level)
+
+	case "reload":
+		graph, err := client.Reload()
+		if err != nil {
+			return fmt.Errorf("reload failed: %w", err)
+		}
+		if structured() {
+			return emit(graph)
+		}
+		fmt.Printf("✓ Reloaded %s (%d nodes, root %s)\n", graph.Name, len(graph.Nodes), graph.Root)
+
+	default:
+		return usageErrorf("unknown ctl command: %s\n\n%s", command, ctlUsage)
+	}
+
+	return nil
+}
+
+// cacheNode maps the "all" keyword to an empty node selection
+func cacheNode(node string) string {
+	if node == "all" {
+		return ""
+	}
+	return node
+}
+
+func printCacheResult(action string, result *control.CacheResult) {
+	if len(result.Nodes) == 0 {
+		fmt.Println("No cache nodes in this composition")
+		return
+	}
+	fmt.Printf("✓ %s %s\n", action, strings.Join(result.Nodes, ", "))
+}
+
+func printYAML(v interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(data))
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach starts cmd in a new session so it survives the terminal closing
+func detach(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return nil
+}
+
+// forceUnmount detaches a FUSE mount left behind by a dead process
+func forceUnmount(mountpoint string) error {
+	if path, err := exec.LookPath("fusermount3"); err == nil {
+		return exec.Command(path, "-u", mountpoint).Run()
+	}
+	if path, err := exec.LookPath("fusermount"); err == nil {
+		return exec.Command(path, "-u", mountpoint).Run()
+	}
+	return exec.Command("umount", mountpoint).Run()
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// detach is not supported on Windows
+func detach(cmd *exec.Cmd) error {
+	return fmt.Errorf("--daemon is not supported on Windows")
+}
+
+// forceUnmount is not supported on Windows
+func forceUnmount(mountpoint string) error {
+	return fmt.Errorf("fuse mounts are not supported on Windows")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/absfs/fscomposer/control"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/instance"
+)
+
+// diffResult is the structured output of diff and plan
+type diffResult struct {
+	Old    string       `json:"old"`
+	New    string       `json:"new"`
+	Plan   *engine.Plan `json:"plan"`
+	Reload bool         `json:"reload"` // Applies to a running mount with a hot reload
+}
+
+// diffCommand compares two spec files semantically
+func diffCommand(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageErrorf("usage: fscomposer diff <old.yaml> <new.yaml>")
+	}
+
+	old, err := parseSpecFile(positional[0])
+	if err != nil {
+		return err
+	}
+	new, err := parseSpecFile(positional[1])
+	if err != nil {
+		return err
+	}
+
+	plan := engine.Diff(old, new)
+	if structured() {
+		return emit(diffResult{Old: positional[0], New: positional[1], Plan: plan, Reload: !hasRemount(plan)})
+	}
+
+	fmt.Printf("Comparing %s → %s\n\n", positional[0], positional[1])
+	printChanges(plan)
+	return nil
+}
+
+// planCommand shows what applying a spec to a running mount would change,
+// and fails when the change would put stored data at risk
+func planCommand(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	against := flags.String("against", "", "Running mount (name or mountpoint) or spec file to compare with (default: the mount named in the spec)")
+	allow := flags.Bool("allow-destructive", false, "Succeed even when changes put stored data at risk")
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("usage: fscomposer plan [--against <name|path|old.yaml>] [--allow-destructive] <new.yaml>")
+	}
+
+	new, err := parseSpecFile(positional[0])
+	if err != nil {
+		return err
+	}
+
+	var old *engine.CompositionSpec
+	var oldLabel, mountName string
+	if *against != "" && isSpecFile(*against) {
+		if old, err = parseSpecFile(*against); err != nil {
+			return err
+		}
+		oldLabel = *against
+	} else {
+		target := *against
+		if target == "" {
+			target = new.Name
+		}
+		rec, err := instance.Find(target)
+		if err != nil {
+			return fmt.Errorf("%w (use --against old.yaml to compare with a file)", err)
+		}
+		if rec.Control == "" {
+			return fmt.Errorf("composition %s has no control socket", rec.Name)
+		}
+		if old, err = control.NewClient(rec.Control).Spec(); err != nil {
+			return fmt.Errorf("failed to read the running spec: %w", err)
+		}
+		oldLabel = fmt.Sprintf("%s (running, pid %d)", rec.Name, rec.PID)
+		mountName = rec.Name
+	}
+
+	plan := engine.Diff(old, new)
+	destructive := plan.Destructive()
+	if len(destructive) > 0 && !*allow {
+		err = withExit(exitDestructive, fmt.Errorf("%d destructive change(s) planned; review them and pass --allow-destructive to proceed", len(destructive)))
+	}
+
+	if structured() {
+		return emitResult(diffResult{Old: oldLabel, New: positional[0], Plan: plan, Reload: !hasRemount(plan)}, err)
+	}
+
+	fmt.Printf("Planning %s → %s\n\n", oldLabel, positional[0])
+	printChanges(plan)
+	if plan.Empty() {
+		return nil
+	}
+
+	fmt.Println()
+	switch {
+	case hasRemount(plan):
+		fmt.Println("Apply: mount settings changed; unmount and mount again")
+	case mountName != "":
+		fmt.Printf("Apply: fscomposer ctl %s reload (or save the spec under --watch)\n", mountName)
+	default:
+		fmt.Println("Apply: hot reload of the running mount")
+	}
+	fmt.Printf("  Rebuilt: %s\n", listOrNone(plan.Rebuilt))
+	fmt.Printf("  Reused:  %s\n", listOrNone(plan.Reused))
+
+	if len(destructive) > 0 {
+		fmt.Fprintf(os.Stderr, "\nWarning: %d change(s) put stored data at risk:\n", len(destructive))
+		for _, c := range destructive {
+			fmt.Fprintf(os.Stderr, "  ! %s\n    %s\n", c, c.Reason)
+		}
+	}
+	return err
+}
+
+// printChanges lists changes with +, - and ~ marks and their risk
+func printChanges(plan *engine.Plan) {
+	if plan.Empty() {
+		fmt.Println("No changes.")
+		return
+	}
+	for _, c := range plan.Changes {
+		mark := "~"
+		switch c.Kind {
+		case engine.ChangeAdded:
+			mark = "+"
+		case engine.ChangeRemoved:
+			mark = "-"
+		}
+		risk := ""
+		if c.Risk != engine.RiskSafe {
+			risk = fmt.Sprintf(" [%s]", c.Risk)
+		}
+		fmt.Printf("  %s %s%s\n", mark, c, risk)
+		if c.Reason != "" {
+			fmt.Printf("      %s\n", c.Reason)
+		}
+	}
+	fmt.Printf("\n%d change(s); highest risk: %s\n", len(plan.Changes), plan.Risk)
+}
+
+func hasRemount(plan *engine.Plan) bool {
+	for _, c := range plan.Changes {
+		if c.Risk == engine.RiskRemount {
+			return true
+		}
+	}
+	return false
+}
+
+func listOrNone(ids []string) string {
+	if len(ids) == 0 {
+		return "(none)"
+	}
+	return strings.Join(ids, ", ")
+}
+
+func parseSpecFile(filename string) (*engine.CompositionSpec, error) {
+	spec, err := engine.ParseFile(filename)
+	if err != nil {
+		return nil, withExit(exitParse, fmt.Errorf("parse error: %s: %w", filename, err))
+	}
+	return spec, nil
+}
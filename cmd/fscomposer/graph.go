@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/graph"
+)
+
+// graphCommand renders a composition's node graph
+func graphCommand(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	format := flags.String("format", graph.FormatASCII, "Diagram format: "+strings.Join(graph.Formats, ", "))
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("usage: fscomposer graph [--format %s] <spec.yaml>", strings.Join(graph.Formats, "|"))
+	}
+
+	spec, err := engine.ParseFile(positional[0])
+	if err != nil {
+		return withExit(exitParse, fmt.Errorf("parse error: %w", err))
+	}
+
+	g := graph.New(spec)
+	if structured() {
+		return emit(g)
+	}
+
+	out, err := g.Render(*format)
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+	fmt.Print(out)
+	return nil
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/frontend"
+	"github.com/absfs/fscomposer/registry"
+	"gopkg.in/yaml.v3"
+)
+
+// initMountTypes are the frontends init can scaffold
+var initMountTypes = []string{engine.MountTypeFUSE, engine.MountTypeSFTP, engine.MountTypeS3, engine.MountTypeWebDAV, engine.MountTypeAPI}
+
+// setFlags collects repeated --set node.field=value flags
+type setFlags map[string]map[string]string
+
+func (s setFlags) String() string { return "" }
+
+func (s setFlags) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	node, field, ok2 := strings.Cut(key, ".")
+	if !ok || !ok2 || node == "" || field == "" {
+		return fmt.Errorf("expected node.field=value, got %q", v)
+	}
+	if s[node] == nil {
+		s[node] = make(map[string]string)
+	}
+	s[node][field] = value
+	return nil
+}
+
+// initCommand scaffolds a new composition spec, either from flags or by
+// asking for each choice
+func initCommand(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	name := flags.String("name", "", "Composition name")
+	description := flags.String("description", "", "Composition description")
+	backend := flags.String("backend", "", "Backend node type (default osfs)")
+	wrappers := flags.String("wrappers", "", "Comma-separated wrapper node types, bottom to top")
+	mountType := flags.String("mount", "", "Mount type: "+strings.Join(initMountTypes, ", "))
+	mountPath := flags.String("path", "", "Mount point for fuse mounts")
+	port := flags.Int("port", 0, "Listen port for sftp, s3 and webdav mounts")
+	interactive := flags.Bool("i", false, "Ask for every choice (default when no flags are given on a terminal)")
+	force := flags.Bool("force", false, "Overwrite an existing file")
+	values := setFlags{}
+	flags.Var(values, "set", "Node config value as <node>.<field>=<value>; repeatable")
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return usageErrorf("usage: fscomposer init [-i] [--name N] [--backend T] [--wrappers T,...] [--mount T] [--set node.field=value] [file.yaml|-]")
+	}
+
+	if !*interactive && flags.NFlag() == 0 && isTerminal(os.Stdin) {
+		*interactive = true
+	}
+
+	in := &initializer{values: values}
+	if *interactive {
+		// Keep stdout for the structured result
+		out := os.Stdout
+		if structured() {
+			out = os.Stderr
+		}
+		in.prompt = &prompter{in: bufio.NewReader(os.Stdin), out: out}
+	}
+
+	spec, err := in.build(initChoices{
+		name:        *name,
+		description: *description,
+		backend:     *backend,
+		wrappers:    *wrappers,
+		mountType:   *mountType,
+		mountPath:   *mountPath,
+		port:        *port,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := engine.NewValidator(spec).ValidateAll(); err != nil {
+		return withExit(exitInvalid, fmt.Errorf("generated spec is invalid: %w", err))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by fscomposer init\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(spec); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	file := spec.Name + ".yaml"
+	if len(positional) == 1 {
+		file = positional[0]
+	}
+	if file == "-" {
+		if structured() {
+			return emit(spec)
+		}
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if _, err := os.Stat(file); err == nil && !*force {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", file)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return err
+	}
+
+	if structured() {
+		return emit(struct {
+			File string                  `json:"file"`
+			Spec *engine.CompositionSpec `json:"spec"`
+		}{file, spec})
+	}
+
+	fmt.Printf("\n✓ Wrote %s\n", file)
+	fmt.Println("\nStack composition:")
+	printNodeChain(spec)
+	fmt.Println("\nNext steps:")
+	fmt.Printf("  fscomposer test %s\n", file)
+	fmt.Printf("  fscomposer mount %s\n", file)
+	return nil
+}
+
+// initChoices are the answers given as flags
+type initChoices struct {
+	name, description    string
+	backend, wrappers    string
+	mountType, mountPath string
+	port                 int
+}
+
+// initializer turns choices into a spec, asking for what is missing when
+// prompt is set and using defaults otherwise
+type initializer struct {
+	prompt *prompter
+	values setFlags
+}
+
+func (in *initializer) ask(question, def string, options []string) (string, error) {
+	if in.prompt == nil {
+		return def, nil
+	}
+	return in.prompt.ask(question, def, options)
+}
+
+func (in *initializer) build(c initChoices) (*engine.CompositionSpec, error) {
+	var backends, wrappers []string
+	for _, t := range registry.ListTypes() {
+		if engine.IsBackendNode(t) {
+			backends = append(backends, t)
+		} else {
+			wrappers = append(wrappers, t)
+		}
+	}
+	sort.Strings(backends)
+	sort.Strings(wrappers)
+
+	var err error
+	if c.name == "" {
+		if c.name, err = in.ask("Composition name", "my-composition", nil); err != nil {
+			return nil, err
+		}
+	}
+	if c.description == "" && in.prompt != nil {
+		if c.description, err = in.ask("Description", "", nil); err != nil {
+			return nil, err
+		}
+	}
+	if c.backend == "" {
+		if c.backend, err = in.ask("Backend", engine.NodeTypeOSFS, backends); err != nil {
+			return nil, err
+		}
+	}
+	if !contains(backends, c.backend) {
+		return nil, fmt.Errorf("unknown backend %q (available: %s)", c.backend, strings.Join(backends, ", "))
+	}
+	if c.wrappers == "" && in.prompt != nil {
+		question := fmt.Sprintf("Wrappers, bottom to top, comma-separated (%s)", strings.Join(wrappers, ", "))
+		if c.wrappers, err = in.ask(question, "", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := &engine.CompositionSpec{
+		Version:     "1.0",
+		Name:        c.name,
+		Description: c.description,
+	}
+
+	types := []string{c.backend}
+	for _, w := range strings.Split(c.wrappers, ",") {
+		if w = strings.TrimSpace(w); w == "" {
+			continue
+		}
+		if !contains(wrappers, w) {
+			return nil, fmt.Errorf("unknown wrapper %q (available: %s)", w, strings.Join(wrappers, ", "))
+		}
+		types = append(types, w)
+	}
+
+	// Nodes are chained in order: each wraps the one before it
+	for i, t := range types {
+		id := nodeID(spec, t, i == 0)
+		config, err := in.configure(id, t)
+		if err != nil {
+			return nil, err
+		}
+		spec.Nodes = append(spec.Nodes, engine.Node{ID: id, Type: t, Config: config})
+		if i > 0 {
+			spec.Connections = append(spec.Connections, engine.Connection{From: spec.Nodes[i-1].ID, To: id})
+		}
+	}
+	for node := range in.values {
+		if spec.GetNode(node) == nil && !contains(types, node) {
+			return nil, fmt.Errorf("--set refers to unknown node %q", node)
+		}
+	}
+
+	mount, err := in.mount(c, spec.Nodes[len(spec.Nodes)-1].ID)
+	if err != nil {
+		return nil, err
+	}
+	spec.Mount = mount
+	return spec, nil
+}
+
+// nodeID names a node after its role, avoiding IDs already in use
+func nodeID(spec *engine.CompositionSpec, nodeType string, backend bool) string {
+	base := strings.TrimSuffix(nodeType, "fs")
+	if backend {
+		base = "storage"
+	}
+	id := base
+	for n := 2; spec.GetNode(id) != nil; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id
+}
+
+// configure fills a node's config from --set values or prompts. Only
+// required fields and values that differ from the schema default are
+// written.
+func (in *initializer) configure(id, nodeType string) (map[string]interface{}, error) {
+	schema, err := registry.GetSchema(nodeType)
+	if err != nil {
+		return nil, err
+	}
+
+	// --set accepts the node ID or its type
+	set := make(map[string]string)
+	for _, key := range []string{nodeType, id} {
+		for field, value := range in.values[key] {
+			set[field] = value
+		}
+	}
+	for field := range set {
+		if !schemaHasField(schema, field) {
+			return nil, fmt.Errorf("node %s: %s has no field %q", id, nodeType, field)
+		}
+	}
+
+	if in.prompt != nil && len(schema.Fields) > 0 {
+		fmt.Fprintf(in.prompt.out, "\n%s (%s): %s\n", id, nodeType, schema.Description)
+	}
+
+	config := make(map[string]interface{})
+	for _, field := range schema.Fields {
+		def := ""
+		if field.Default != nil {
+			def = fmt.Sprint(field.Default)
+		}
+
+		raw, ok := set[field.Name]
+		if !ok {
+			question := field.Name
+			if field.Description != "" {
+				question = fmt.Sprintf("%s - %s", field.Name, field.Description)
+			}
+			for {
+				if raw, err = in.ask(question, def, field.Options); err != nil {
+					return nil, err
+				}
+				if raw != "" || !field.Required || in.prompt == nil {
+					break
+				}
+				fmt.Fprintf(in.prompt.out, "  %s is required\n", field.Name)
+			}
+		}
+
+		if raw == "" {
+			if field.Required {
+				return nil, fmt.Errorf("node %s: %s is required (use --set %s.%s=<value>)", id, field.Name, id, field.Name)
+			}
+			continue
+		}
+		if raw == def && !field.Required {
+			continue
+		}
+		value, err := convertField(field, raw)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", id, err)
+		}
+		config[field.Name] = value
+	}
+
+	if len(config) == 0 {
+		return nil, nil
+	}
+	return config, nil
+}
+
+func schemaHasField(schema registry.NodeSchema, name string) bool {
+	for _, f := range schema.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// convertField parses a raw answer into the type the schema declares
+func convertField(field registry.SchemaField, raw string) (interface{}, error) {
+	switch field.Type {
+	case "int":
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an integer, got %q", field.Name, raw)
+		}
+		return n, nil
+	case "bool":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false, got %q", field.Name, raw)
+		}
+		return b, nil
+	case "select":
+		if !contains(field.Options, raw) {
+			return nil, fmt.Errorf("%s must be one of %s, got %q", field.Name, strings.Join(field.Options, ", "), raw)
+		}
+		return raw, nil
+	default:
+		return raw, nil
+	}
+}
+
+// mount builds the mount section, including the options each network
+// frontend needs to start
+func (in *initializer) mount(c initChoices, root string) (engine.MountConfig, error) {
+	var err error
+	if c.mountType == "" {
+		if in.prompt != nil {
+			fmt.Fprintln(in.prompt.out)
+		}
+		if c.mountType, err = in.ask("Mount type", engine.MountTypeFUSE, initMountTypes); err != nil {
+			return engine.MountConfig{}, err
+		}
+	}
+	if !contains(initMountTypes, c.mountType) {
+		return engine.MountConfig{}, fmt.Errorf("unknown mount type %q (available: %s)", c.mountType, strings.Join(initMountTypes, ", "))
+	}
+
+	mount := engine.MountConfig{Type: c.mountType, Root: root, Path: c.mountPath, Port: c.port}
+	askPort := func(def int) error {
+		if mount.Port != 0 {
+			return nil
+		}
+		answer, err := in.ask("Port", strconv.Itoa(def), nil)
+		if err != nil {
+			return err
+		}
+		if mount.Port, err = strconv.Atoi(answer); err != nil {
+			return fmt.Errorf("port must be an integer, got %q", answer)
+		}
+		return nil
+	}
+
+	switch c.mountType {
+	case engine.MountTypeFUSE:
+		if mount.Path == "" {
+			if mount.Path, err = in.ask("Mount point", "/mnt/"+c.name, nil); err != nil {
+				return mount, err
+			}
+		}
+	case engine.MountTypeSFTP:
+		if err := askPort(frontend.DefaultSFTPPort); err != nil {
+			return mount, err
+		}
+		user, err := in.ask("SFTP user name", "admin", nil)
+		if err != nil {
+			return mount, err
+		}
+		mount.Options = map[string]interface{}{
+			"hostKey": "./ssh_host_ed25519_key",
+			"users": []map[string]interface{}{{
+				"username":    user,
+				"passwordEnv": strings.ToUpper(user) + "_PASSWORD",
+				"root":        "/",
+			}},
+		}
+	case engine.MountTypeS3:
+		if err := askPort(frontend.DefaultS3Port); err != nil {
+			return mount, err
+		}
+		accessKey, err := in.ask("S3 access key", "fscomposer", nil)
+		if err != nil {
+			return mount, err
+		}
+		mount.Options = map[string]interface{}{
+			"region": "us-east-1",
+			"credentials": []map[string]interface{}{{
+				"accessKey":    accessKey,
+				"secretKeyEnv": "S3_SECRET_KEY",
+			}},
+		}
+	case engine.MountTypeWebDAV:
+		if err := askPort(frontend.DefaultWebDAVPort); err != nil {
+			return mount, err
+		}
+		user, err := in.ask("WebDAV user name", "admin", nil)
+		if err != nil {
+			return mount, err
+		}
+		mount.Options = map[string]interface{}{
+			"users": []map[string]interface{}{{
+				"username":    user,
+				"passwordEnv": strings.ToUpper(user) + "_PASSWORD",
+			}},
+		}
+	}
+	return mount, nil
+}
+
+// prompter asks questions on a terminal or any line-oriented input
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints a question and returns the answer, or def for an empty line.
+// With options the answer may also be given as the option's number.
+func (p *prompter) ask(question, def string, options []string) (string, error) {
+	if len(options) > 0 {
+		fmt.Fprintf(p.out, "%s:\n", question)
+		for i, o := range options {
+			fmt.Fprintf(p.out, "  %d) %s\n", i+1, o)
+		}
+		question = "Choice"
+	}
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+
+		line, err := p.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return "", fmt.Errorf("input ended before all questions were answered")
+			}
+			return "", err
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if len(options) == 0 || answer == "" {
+			return answer, nil
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+			return options[n-1], nil
+		}
+		if contains(options, answer) {
+			return answer, nil
+		}
+		fmt.Fprintf(p.out, "  Please pick one of the listed options\n")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
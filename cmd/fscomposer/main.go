@@ -13,45 +13,110 @@ import (
 const version = "0.1.0-poc"
 
 func main() {
-	if len(os.Args) < 2 {
+	args, err := extractOutputFlag(os.Args[1:])
+	if err != nil {
+		fail(err)
+	}
+	if len(args) < 1 {
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	command := os.Args[1]
+	command, args := args[0], args[1:]
 
 	switch command {
+	case "init":
+		if err := initCommand(args); err != nil {
+			fail(err)
+		}
+
 	case "validate":
-		if err := validateCommand(os.Args[2:]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		if err := validateCommand(args); err != nil {
+			fail(err)
 		}
 
 	case "build":
-		if err := buildCommand(os.Args[2:]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		if err := buildCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "test":
+		if err := testCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "bench":
+		if err := benchCommand(args); err != nil {
+			fail(err)
 		}
 
 	case "mount":
-		if err := mountCommand(os.Args[2:]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		if err := mountCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "unmount":
+		if err := unmountCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "status":
+		if err := statusCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "ctl":
+		if err := ctlCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "shell":
+		if err := shellCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "cp":
+		if err := cpCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "sync":
+		if err := syncCommand(args); err != nil {
+			fail(err)
 		}
 
 	case "nodes":
-		if err := nodesCommand(os.Args[2:]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		if err := nodesCommand(args); err != nil {
+			fail(err)
 		}
 
 	case "info":
-		if err := infoCommand(os.Args[2:]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+		if err := infoCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "diff":
+		if err := diffCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "plan":
+		if err := planCommand(args); err != nil {
+			fail(err)
+		}
+
+	case "graph":
+		if err := graphCommand(args); err != nil {
+			fail(err)
 		}
 
 	case "version":
+		if structured() {
+			if err := emit(map[string]string{"version": version}); err != nil {
+				fail(err)
+			}
+			break
+		}
 		fmt.Printf("fscomposer version %s (POC)\n", version)
 
 	case "help", "--help", "-h":
@@ -60,7 +125,7 @@ func main() {
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", command)
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 }
 
@@ -68,47 +133,140 @@ func printUsage() {
 	fmt.Println("fscomposer - Visual Filesystem Composition Studio")
 	fmt.Printf("Version: %s\n\n", version)
 	fmt.Println("Usage:")
-	fmt.Println("  fscomposer <command> [arguments]")
+	fmt.Println("  fscomposer [--output text|json|yaml] <command> [arguments]")
+	fmt.Println()
+	fmt.Println("Global options:")
+	fmt.Println("  --output <format>          text (default), or a single json or yaml document on stdout")
 	fmt.Println()
 	fmt.Println("Commands:")
+	fmt.Println("  init [file.yaml|-]         Scaffold a new composition spec")
+	fmt.Println("    -i                       Ask for every choice (default on a terminal)")
+	fmt.Println("    --backend, --wrappers    Node types, wrappers in order from the backend up")
+	fmt.Println("    --mount <type>           fuse, sftp, s3, webdav or api")
+	fmt.Println("    --set <node.field=value> Node config value; repeatable")
 	fmt.Println("  validate <spec.yaml>       Validate a composition spec")
 	fmt.Println("  build <spec.yaml>          Build and test a composition")
-	fmt.Println("  mount <spec.yaml> <path>   Mount a composition via FUSE")
+	fmt.Println("  test <spec.yaml>           Run the POSIX conformance suite against a composition")
+	fmt.Println("    --only <categories>      Run only these categories (files, seek, rename, ...)")
+	fmt.Println("    --live                   Test the real backends instead of a sandbox")
+	fmt.Println("    -v                       List every check")
+	fmt.Println("  bench <spec.yaml>          Benchmark a composition with per-layer timing")
+	fmt.Println("    --workload <names>       seq-write, seq-read, rand-read, rand-write, small-files, metadata, mixed")
+	fmt.Println("    --duration <d>           Time per workload (default 3s)")
+	fmt.Println("    --concurrency <n>        Parallel workers (default 4)")
+	fmt.Println("    --file-size, --block-size  File and IO sizes (default 8MiB, 64KiB)")
+	fmt.Println("  mount <spec.yaml> [path]   Mount a composition (FUSE, SFTP, S3, WebDAV)")
+	fmt.Println("    --daemon                 Run in the background")
+	fmt.Println("    --watch                  Hot-reload when the spec changes (also on SIGHUP)")
+	fmt.Println("    --name <name>            Instance name (default: spec name)")
+	fmt.Println("    --pid-file <file>        Pidfile location")
+	fmt.Println("    --log-file <file>        Log file for --daemon")
+	fmt.Println("  unmount <path|name>        Stop a running composition")
+	fmt.Println("  status                     List running compositions")
+	fmt.Println("  ctl <name|path> <command>  Control a running mount (stats, flush, reload, ...)")
+	fmt.Println("  shell <spec.yaml>          Explore a composition without mounting")
+	fmt.Println("    -c <commands>            Run ';'-separated commands and exit")
+	fmt.Println("  cp <src> <dst>             Copy between compositions (<spec.yaml>[:path]) or local paths")
+	fmt.Println("  sync <src> <dst>           Copy only changed files")
+	fmt.Println("    --delete                 Delete destination files missing from the source")
+	fmt.Println("    --checksum               Compare contents instead of size and mtime")
+	fmt.Println("    --workers <n>            Parallel copies (default 4)")
+	fmt.Println("    --dry-run                Show what would change")
 	fmt.Println("  nodes [list|<type>]        Show available node types or details")
 	fmt.Println("  info <spec.yaml>           Show composition information")
+	fmt.Println("  diff <old.yaml> <new.yaml> Compare two specs and flag risky changes")
+	fmt.Println("  plan <new.yaml>            Show what applying a spec to a running mount changes")
+	fmt.Println("    --against <name|file>    Mount or spec to compare with (default: spec name)")
+	fmt.Println("    --allow-destructive      Do not fail on changes that put stored data at risk")
+	fmt.Println("  graph <spec.yaml>          Draw the composition graph")
+	fmt.Println("    --format <format>        ascii (default), dot, mermaid or svg")
 	fmt.Println("  version                    Show version information")
 	fmt.Println("  help                       Show this help message")
 	fmt.Println()
+	fmt.Println("Exit codes:")
+	fmt.Println("  0 success, 1 other error, 2 usage, 3 parse, 4 validation, 5 build, 6 test failure,")
+	fmt.Println("  7 destructive plan")
+	fmt.Println()
 	fmt.Println("Examples:")
+	fmt.Println("  fscomposer init")
+	fmt.Println("  fscomposer init --name vault --wrappers encryptfs,cachefs --set encrypt.password=secret --mount sftp")
 	fmt.Println("  fscomposer validate examples/encrypted-s3.yaml")
+	fmt.Println("  fscomposer validate --output json examples/encrypted-s3.yaml")
 	fmt.Println("  fscomposer build examples/encrypted-s3.yaml")
+	fmt.Println("  fscomposer test --only seek,truncate examples/memory-cache.yaml")
+	fmt.Println("  fscomposer bench --workload rand-read,mixed --concurrency 8 examples/memory-cache.yaml")
 	fmt.Println("  fscomposer mount examples/simple-cache.yaml /mnt/myfs")
+	fmt.Println("  fscomposer mount examples/encrypted-cache-metrics.yaml")
+	fmt.Println("  fscomposer mount examples/sftp-server.yaml")
+	fmt.Println("  fscomposer mount --daemon examples/s3-gateway.yaml")
+	fmt.Println("  fscomposer unmount /mnt/myfs")
+	fmt.Println("  fscomposer ctl s3-gateway stats")
+	fmt.Println("  fscomposer shell -c 'mkdir -p /a; put notes.txt /a; tree' examples/memory-cache.yaml")
+	fmt.Println("  fscomposer sync --delete /srv/data examples/encrypted-s3.yaml:/backup")
+	fmt.Println("  fscomposer plan --against vault vault.yaml")
+	fmt.Println("  fscomposer graph --format svg examples/tiered-storage.yaml > tiered.svg")
 	fmt.Println("  fscomposer nodes list")
 	fmt.Println("  fscomposer nodes cachefs")
 }
 
+// validateResult is the structured output of validate
+type validateResult struct {
+	File        string              `json:"file"`
+	Valid       bool                `json:"valid"`
+	Name        string              `json:"name,omitempty"`
+	Nodes       int                 `json:"nodes"`
+	Connections int                 `json:"connections"`
+	Mount       *engine.MountConfig `json:"mount,omitempty"`
+	Diagnostics []engine.Diagnostic `json:"diagnostics"`
+}
+
 // validateCommand validates a composition spec
 func validateCommand(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: fscomposer validate <spec.yaml>")
+		return usageErrorf("usage: fscomposer validate <spec.yaml>")
 	}
 
 	filename := args[0]
+	result := validateResult{File: filename, Diagnostics: []engine.Diagnostic{}}
 
-	fmt.Printf("Validating: %s\n", filename)
+	textf("Validating: %s\n", filename)
 
 	// Parse the spec
 	spec, err := engine.ParseFile(filename)
 	if err != nil {
-		return fmt.Errorf("parse error: %w", err)
+		err = withExit(exitParse, fmt.Errorf("parse error: %w", err))
+		if structured() {
+			result.Diagnostics = append(result.Diagnostics, engine.Diagnostic{Check: "parse", Message: err.Error()})
+			return emitResult(result, err)
+		}
+		return err
 	}
 
-	fmt.Printf("✓ Spec format valid\n")
+	textf("✓ Spec format valid\n")
+
+	result.Name = spec.Name
+	result.Nodes = len(spec.Nodes)
+	result.Connections = len(spec.Connections)
+	result.Mount = &engine.RedactSpec(spec).Mount // Without credentials, as info shows it
 
-	// Validate
-	validator := engine.NewValidator(spec)
-	if err := validator.ValidateAll(); err != nil {
-		return fmt.Errorf("validation error: %w", err)
+	// Validate, collecting every failed check
+	diags := engine.NewValidator(spec).Diagnose()
+	result.Diagnostics = append(result.Diagnostics, diags...)
+	result.Valid = len(diags) == 0
+
+	if len(diags) > 0 {
+		messages := make([]string, len(diags))
+		for i, d := range diags {
+			messages[i] = d.Message
+		}
+		err := withExit(exitInvalid, fmt.Errorf("validation error: %s", strings.Join(messages, "; ")))
+		if structured() {
+			return emitResult(result, err)
+		}
+		return err
+	}
+	if structured() {
+		return emit(result)
 	}
 
 	fmt.Printf("✓ All node types registered\n")
@@ -124,74 +282,130 @@ func validateCommand(args []string) error {
 	return nil
 }
 
+// buildResult is the structured output of build
+type buildResult struct {
+	File      string       `json:"file"`
+	Name      string       `json:"name,omitempty"`
+	Sandboxed bool         `json:"sandboxed"`
+	Built     bool         `json:"built"`
+	Checks    []buildCheck `json:"checks"`
+	Passed    bool         `json:"passed"`
+	Error     string       `json:"error,omitempty"`
+}
+
+type buildCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
 // buildCommand builds and tests a composition
 func buildCommand(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: fscomposer build <spec.yaml>")
+		return usageErrorf("usage: fscomposer build <spec.yaml>")
 	}
 
 	filename := args[0]
+	result := buildResult{File: filename, Sandboxed: true, Checks: []buildCheck{}}
+	finish := func(err error) error {
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if structured() {
+			return emitResult(result, err)
+		}
+		return err
+	}
+	check := func(name string, err error) error {
+		c := buildCheck{Name: name, Passed: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+			err = withExit(exitTestFailed, err)
+		}
+		result.Checks = append(result.Checks, c)
+		return err
+	}
 
-	fmt.Printf("Building: %s\n", filename)
+	textf("Building: %s\n", filename)
 
 	// Parse the spec
 	spec, err := engine.ParseFile(filename)
 	if err != nil {
-		return fmt.Errorf("parse error: %w", err)
+		return finish(withExit(exitParse, fmt.Errorf("parse error: %w", err)))
 	}
+	result.Name = spec.Name
 
-	fmt.Printf("✓ Spec parsed\n")
+	textf("✓ Spec parsed\n")
 
-	// Build the filesystem stack
-	builder := engine.NewBuilder(spec)
+	// Build the filesystem stack in a sandbox so the test write below never
+	// reaches real storage
+	builder := engine.NewSandboxBuilder(spec)
 	fs, err := builder.Build()
 	if err != nil {
-		return fmt.Errorf("build error: %w", err)
+		return finish(withExit(exitBuild, fmt.Errorf("build error: %w", err)))
 	}
+	result.Built = true
 
-	fmt.Printf("✓ Filesystem stack built\n")
+	textf("✓ Filesystem stack built (sandboxed, backends are not modified)\n")
 
 	// Test basic operations
-	fmt.Println("\nTesting basic operations...")
+	textf("\nTesting basic operations...\n")
 
 	// Test: Create a test file
 	testFile := "test.txt"
 	testData := []byte("Hello from fscomposer POC!")
 
-	f, err := fs.Create(testFile)
-	if err != nil {
-		return fmt.Errorf("failed to create test file: %w", err)
-	}
-
-	n, err := f.Write(testData)
-	if err != nil {
-		f.Close()
-		return fmt.Errorf("failed to write test file: %w", err)
+	n, err := func() (int, error) {
+		f, err := fs.Create(testFile)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create test file: %w", err)
+		}
+		defer f.Close()
+		n, err := f.Write(testData)
+		if err != nil {
+			return n, fmt.Errorf("failed to write test file: %w", err)
+		}
+		return n, nil
+	}()
+	if err := check("write", err); err != nil {
+		return finish(err)
 	}
-	f.Close()
 
-	fmt.Printf("✓ Created and wrote %d bytes to %s\n", n, testFile)
+	textf("✓ Created and wrote %d bytes to %s\n", n, testFile)
 
 	// Test: Read the file back
-	f, err = fs.Open(testFile)
-	if err != nil {
-		return fmt.Errorf("failed to open test file: %w", err)
-	}
-
 	readData := make([]byte, len(testData))
-	n, err = f.Read(readData)
-	f.Close()
-	if err != nil {
-		return fmt.Errorf("failed to read test file: %w", err)
+	n, err = func() (int, error) {
+		f, err := fs.Open(testFile)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open test file: %w", err)
+		}
+		defer f.Close()
+		n, err := f.Read(readData)
+		if err != nil {
+			return n, fmt.Errorf("failed to read test file: %w", err)
+		}
+		return n, nil
+	}()
+	if err := check("read", err); err != nil {
+		return finish(err)
 	}
 
-	fmt.Printf("✓ Read %d bytes from %s\n", n, testFile)
+	textf("✓ Read %d bytes from %s\n", n, testFile)
 
 	if string(readData[:n]) != string(testData) {
-		return fmt.Errorf("data mismatch: got %q, want %q", readData[:n], testData)
+		err = fmt.Errorf("data mismatch: got %q, want %q", readData[:n], testData)
 	}
+	if err := check("integrity", err); err != nil {
+		return finish(err)
+	}
+
+	textf("✓ Data integrity verified\n")
 
-	fmt.Printf("✓ Data integrity verified\n")
+	result.Passed = true
+	if structured() {
+		return finish(nil)
+	}
 
 	fmt.Println()
 	fmt.Printf("✓ All tests passed!\n")
@@ -201,9 +415,43 @@ func buildCommand(args []string) error {
 	// Print the node chain
 	printNodeChain(spec)
 
+	fmt.Println("\nRun 'fscomposer test' for the full conformance suite.")
 	return nil
 }
 
+// nodeInfo is the structured output of nodes
+type nodeInfo struct {
+	Type        string      `json:"type"`
+	Category    string      `json:"category"`
+	Description string      `json:"description"`
+	Fields      []fieldInfo `json:"fields"`
+}
+
+type fieldInfo struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Options     []string    `json:"options,omitempty"`
+}
+
+func newNodeInfo(schema registry.NodeSchema) nodeInfo {
+	info := nodeInfo{
+		Type:        schema.Type,
+		Category:    "wrapper",
+		Description: schema.Description,
+		Fields:      []fieldInfo{},
+	}
+	if engine.IsBackendNode(schema.Type) {
+		info.Category = "backend"
+	}
+	for _, f := range schema.Fields {
+		info.Fields = append(info.Fields, fieldInfo{f.Name, f.Type, f.Required, f.Default, f.Description, f.Options})
+	}
+	return info
+}
+
 // nodesCommand lists available node types or shows details
 func nodesCommand(args []string) error {
 	if len(args) == 0 || args[0] == "list" {
@@ -211,6 +459,18 @@ func nodesCommand(args []string) error {
 		types := registry.ListTypes()
 		sort.Strings(types)
 
+		if structured() {
+			nodes := make([]nodeInfo, 0, len(types))
+			for _, t := range types {
+				schema, err := registry.GetSchema(t)
+				if err != nil {
+					return err
+				}
+				nodes = append(nodes, newNodeInfo(schema))
+			}
+			return emit(nodes)
+		}
+
 		fmt.Println("Available node types:")
 		fmt.Println()
 
@@ -253,6 +513,10 @@ func nodesCommand(args []string) error {
 		return err
 	}
 
+	if structured() {
+		return emit(newNodeInfo(schema))
+	}
+
 	fmt.Printf("Node Type: %s\n", schema.Type)
 	fmt.Printf("Description: %s\n", schema.Description)
 	fmt.Println()
@@ -260,11 +524,18 @@ func nodesCommand(args []string) error {
 	if len(schema.Fields) > 0 {
 		fmt.Println("Configuration Fields:")
 		for _, field := range schema.Fields {
-			required := ""
+			var flags []string
 			if field.Required {
-				required = " (required)"
+				flags = append(flags, "required")
+			}
+			if field.Secret {
+				flags = append(flags, "secret")
+			}
+			suffix := ""
+			if len(flags) > 0 {
+				suffix = " (" + strings.Join(flags, ", ") + ")"
 			}
-			fmt.Printf("  %s: %s%s\n", field.Name, field.Type, required)
+			fmt.Printf("  %s: %s%s\n", field.Name, field.Type, suffix)
 			if field.Description != "" {
 				fmt.Printf("    %s\n", field.Description)
 			}
@@ -285,7 +556,7 @@ func nodesCommand(args []string) error {
 // infoCommand shows information about a composition
 func infoCommand(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("usage: fscomposer info <spec.yaml>")
+		return usageErrorf("usage: fscomposer info <spec.yaml>")
 	}
 
 	filename := args[0]
@@ -293,7 +564,14 @@ func infoCommand(args []string) error {
 	// Parse the spec
 	spec, err := engine.ParseFile(filename)
 	if err != nil {
-		return fmt.Errorf("parse error: %w", err)
+		return withExit(exitParse, fmt.Errorf("parse error: %w", err))
+	}
+
+	if structured() {
+		return emit(struct {
+			File string `json:"file"`
+			*engine.CompositionSpec
+		}{filename, engine.RedactSpec(spec)})
 	}
 
 	fmt.Printf("Composition: %s\n", spec.Name)
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/absfs/fscomposer/control"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/frontend"
+	"github.com/absfs/fscomposer/graph"
+	"github.com/absfs/fscomposer/instance"
+)
+
+// daemonEnv marks a process started by mount --daemon
+const daemonEnv = "FSCOMPOSER_DAEMON"
+
+// mountCommand builds a composition and serves it using its mount type
+func mountCommand(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ContinueOnError)
+	daemon := flags.Bool("daemon", false, "Detach and run in the background")
+	name := flags.String("name", "", "Instance name (defaults to the spec name)")
+	pidFile := flags.String("pid-file", "", "Pidfile path (defaults to the state directory)")
+	logFile := flags.String("log-file", "", "Log file for --daemon (defaults to the state directory)")
+	watch := flags.Bool("watch", false, "Reload the composition when the spec file changes")
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 {
+		return usageErrorf("usage: fscomposer mount [--daemon] [--watch] [--name NAME] [--pid-file FILE] [--log-file FILE] <spec.yaml> [mountpoint]")
+	}
+
+	specFile := positional[0]
+	mountpoint := ""
+	if len(positional) > 1 {
+		mountpoint = positional[1]
+	}
+
+	// Parse the spec
+	spec, err := engine.ParseFile(specFile)
+	if err != nil {
+		return withExit(exitParse, fmt.Errorf("parse error: %w", err))
+	}
+
+	textf("✓ Spec parsed: %s\n", spec.Name)
+
+	if *name == "" {
+		*name = instanceName(spec.Name)
+	} else if err := instance.ValidName(*name); err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	if *daemon && os.Getenv(daemonEnv) == "" {
+		if pid, ok := instance.Owner(*name); ok {
+			return fmt.Errorf("composition %s is already running (pid %d); use --name to run another instance", *name, pid)
+		}
+		return startDaemon(specFile, mountpoint, *name, *pidFile, *logFile, *watch)
+	}
+
+	// Claim the name before mounting so a second mount with it fails
+	// instead of mounting too
+	if err := instance.Claim(*name, os.Getpid()); err != nil {
+		return fmt.Errorf("%w; use --name to run another instance", err)
+	}
+	defer instance.Release(*name, os.Getpid())
+
+	// Build the filesystem stack
+	builder := engine.NewBuilder(spec)
+	fs, err := builder.Build()
+	if err != nil {
+		builder.Close()
+		return withExit(exitBuild, fmt.Errorf("build error: %w", err))
+	}
+
+	if !structured() {
+		fmt.Printf("✓ Filesystem stack built\n")
+		fmt.Println("\nStack composition:")
+		printNodeChain(spec)
+		fmt.Println()
+	}
+
+	// Frontends serve a swappable root so the stack can be hot-reloaded
+	root := frontend.NewSwapFS(fs)
+	reload := newReloader(specFile, spec, builder, root)
+	defer reload.close()
+
+	running, err := frontend.Start(spec, root, mountpoint)
+	if err != nil {
+		return err
+	}
+	printMounted(running)
+
+	// Control API for 'fscomposer ctl'
+	socket, err := instance.ControlSocket(*name)
+	if err != nil {
+		running.Stop()
+		return err
+	}
+	logLevel := new(slog.LevelVar)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	ctl, err := control.Listen(socket, reload, logLevel, logger)
+	if err != nil {
+		running.Stop()
+		return err
+	}
+	defer ctl.Close()
+
+	absSpec, _ := filepath.Abs(specFile)
+	rec := &instance.Record{
+		Name:      *name,
+		PID:       os.Getpid(),
+		SpecFile:  absSpec,
+		MountType: running.Type,
+		Target:    running.Target,
+		PIDFile:   *pidFile,
+		Control:   socket,
+		Started:   time.Now(),
+	}
+	if os.Getenv(daemonEnv) != "" {
+		rec.LogFile = *logFile
+	}
+	if err := instance.Register(rec); err != nil {
+		running.Stop()
+		return err
+	}
+	defer instance.Unregister(rec)
+
+	// Structured output is one document, written once the mount is up
+	if structured() {
+		if err := emit(rec); err != nil {
+			running.Stop()
+			return err
+		}
+	}
+
+	if *watch {
+		stop := make(chan struct{})
+		defer close(stop)
+		go reload.watch(time.Second, stop)
+		textf("Watching %s for changes\n", specFile)
+	}
+
+	return waitForShutdown(running, reload)
+}
+
+// waitForShutdown serves until Ctrl+C or SIGTERM, or until the frontend
+// exits. SIGHUP reloads the composition.
+func waitForShutdown(running *frontend.Mount, reload *reloader) error {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	for shutdown := false; !shutdown; {
+		select {
+		case err := <-running.Done():
+			if err != nil {
+				return fmt.Errorf("%s mount at %s failed: %w", running.Type, running.Target, err)
+			}
+			textf("✓ %s unmounted externally\n", running.Target)
+			return nil
+		case sig := <-sigChan:
+			if sig != syscall.SIGHUP {
+				shutdown = true
+				continue
+			}
+			textf("Received SIGHUP, reloading...\n")
+			if err := reload.reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "Reload failed, keeping current composition: %v\n", err)
+			}
+		}
+	}
+
+	textf("\nStopping...\n")
+	if err := running.Stop(); err != nil {
+		return fmt.Errorf("failed to stop: %w", err)
+	}
+
+	textf("✓ Stopped\n")
+	return nil
+}
+
+// frontendNames are the names printed for network frontends
+var frontendNames = map[string]string{
+	engine.MountTypeSFTP:   "SFTP server",
+	engine.MountTypeS3:     "S3 gateway",
+	engine.MountTypeWebDAV: "WebDAV server",
+}
+
+// printMounted tells the user where the composition is being served
+func printMounted(running *frontend.Mount) {
+	if structured() {
+		return
+	}
+	if name, ok := frontendNames[running.Type]; ok {
+		fmt.Printf("✓ %s listening on %s\n", name, running.Target)
+		fmt.Println("\nPress Ctrl+C or run 'fscomposer unmount' to stop.")
+		return
+	}
+	fmt.Printf("✓ Mounted successfully at %s\n", running.Target)
+	fmt.Println("\nFilesystem is now available. Press Ctrl+C or run 'fscomposer unmount' to unmount.")
+}
+
+// startDaemon re-runs the mount command detached from the terminal and waits
+// until the child has registered itself
+func startDaemon(specFile, mountpoint, name, pidFile, logFile string, watch bool) error {
+	var err error
+	if pidFile == "" {
+		if pidFile, err = instance.DefaultPIDFile(name); err != nil {
+			return err
+		}
+	}
+	if logFile == "" {
+		if logFile, err = instance.DefaultLogFile(name); err != nil {
+			return err
+		}
+	}
+	if pidFile, err = filepath.Abs(pidFile); err != nil {
+		return err
+	}
+	if logFile, err = filepath.Abs(logFile); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	log, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer log.Close()
+
+	if specFile, err = filepath.Abs(specFile); err != nil {
+		return err
+	}
+
+	childArgs := []string{"mount", "--daemon", "--name", name, "--pid-file", pidFile, "--log-file", logFile}
+	if watch {
+		childArgs = append(childArgs, "--watch")
+	}
+	childArgs = append(childArgs, specFile)
+	if mountpoint != "" {
+		childArgs = append(childArgs, mountpoint)
+	}
+
+	cmd := exec.Command(exe, childArgs...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := detach(cmd); err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	deadline := time.After(30 * time.Second)
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("daemon exited during startup (%v); see %s", err, logFile)
+		case <-deadline:
+			return fmt.Errorf("daemon (pid %d) did not come up within 30s; see %s", cmd.Process.Pid, logFile)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if rec, err := instance.Get(name); err == nil && rec.PID == cmd.Process.Pid {
+			if structured() {
+				return emit(rec)
+			}
+			fmt.Printf("✓ Started %s in the background (pid %d)\n", name, rec.PID)
+			fmt.Printf("  Target:  %s\n", rec.Target)
+			fmt.Printf("  Pidfile: %s\n", rec.PIDFile)
+			fmt.Printf("  Log:     %s\n", logFile)
+			return nil
+		}
+	}
+}
+
+// instanceName turns a spec name into a name usable for state files
+func instanceName(specName string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return '-'
+		}
+	}, specName)
+	name = strings.Trim(name, "-.")
+	if name == "" {
+		return "composition"
+	}
+	return name
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, withExit(exitUsage, err)
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// printNodeChain prints the composition as a tree hanging from the mount
+func printNodeChain(spec *engine.CompositionSpec) {
+	for _, line := range strings.Split(strings.TrimRight(graph.New(spec).ASCII(), "\n"), "\n") {
+		fmt.Printf("  %s\n", line)
+	}
+}
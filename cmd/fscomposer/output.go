@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats selected with the global --output flag
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// Exit codes, so scripts can tell failures apart without parsing messages
+const (
+	exitOK          = 0
+	exitError       = 1 // Any other failure
+	exitUsage       = 2 // Bad arguments or flags
+	exitParse       = 3 // Spec file missing or not valid YAML
+	exitInvalid     = 4 // Spec parsed but failed validation
+	exitBuild       = 5 // Filesystem stack could not be built
+	exitTestFailed  = 6 // Conformance or smoke checks failed
+	exitDestructive = 7 // A plan puts stored data at risk
+)
+
+// output is the format chosen with --output
+var output = outputText
+
+// structured reports whether commands should print a single JSON or YAML
+// document instead of human-friendly text
+func structured() bool {
+	return output != outputText
+}
+
+// textf prints progress lines in text mode only
+func textf(format string, args ...interface{}) {
+	if !structured() {
+		fmt.Printf(format, args...)
+	}
+}
+
+// extractOutputFlag removes --output (or -output) from the arguments,
+// wherever it appears before a "--" terminator
+func extractOutputFlag(args []string) ([]string, error) {
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "output" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, usageErrorf("--output requires a value: text, json or yaml")
+			}
+			i++
+			value = args[i]
+		}
+		switch value {
+		case outputText, outputJSON, outputYAML:
+			output = value
+		default:
+			return nil, usageErrorf("unknown output format %q (use text, json or yaml)", value)
+		}
+	}
+	return rest, nil
+}
+
+// codedError carries the exit code for an error. reported is set once the
+// error has been written as part of a structured result.
+type codedError struct {
+	code     int
+	err      error
+	reported bool
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withExit attaches an exit code to err
+func withExit(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return withExit(exitUsage, fmt.Errorf(format, args...))
+}
+
+// exitCode returns the exit code for an error returned by a command
+func exitCode(err error) int {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return exitError
+}
+
+// fail reports a command error and exits. In structured mode the error is
+// also written to stdout as a document unless the command's result
+// already included it.
+func fail(err error) {
+	code := exitCode(err)
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+
+	var coded *codedError
+	if structured() && !(errors.As(err, &coded) && coded.reported) {
+		emit(struct {
+			Error    string `json:"error"`
+			ExitCode int    `json:"exitCode"`
+		}{err.Error(), code})
+	}
+	os.Exit(code)
+}
+
+// emit writes v as a JSON or YAML document. YAML uses the JSON field names
+// so both formats have the same keys.
+func emit(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if output == outputJSON {
+		_, err = fmt.Printf("%s\n", data)
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	blockStyle(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+// blockStyle clears the flow collections and quoted strings that JSON
+// input leaves behind, so YAML output reads like a spec file
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// emitResult writes a command's structured result and marks err as
+// reported, so fail does not print a second document
+func emitResult(v interface{}, err error) error {
+	if emitErr := emit(v); emitErr != nil {
+		return emitErr
+	}
+	if err == nil {
+		return nil
+	}
+	var coded *codedError
+	if !errors.As(err, &coded) {
+		coded = &codedError{code: exitError, err: err}
+		err = coded
+	}
+	coded.reported = true
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/frontend"
+)
+
+// reloader rebuilds a running composition from its spec file and swaps the
+// new stack in under the mounted frontend
+type reloader struct {
+	specFile string
+	root     *frontend.SwapFS
+
+	mu      sync.Mutex
+	spec    *engine.CompositionSpec
+	builder *engine.Builder
+	data    []byte // Spec file contents last loaded or attempted
+}
+
+func newReloader(specFile string, spec *engine.CompositionSpec, builder *engine.Builder, root *frontend.SwapFS) *reloader {
+	data, _ := os.ReadFile(specFile)
+	return &reloader{
+		specFile: specFile,
+		root:     root,
+		spec:     spec,
+		builder:  builder,
+		data:     data,
+	}
+}
+
+// reload re-parses the spec and swaps in a stack where only changed nodes
+// are rebuilt. On any error the running stack is left untouched.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.specFile)
+	if err != nil {
+		return fmt.Errorf("failed to read spec: %w", err)
+	}
+
+	spec, err := engine.Parse(data)
+	if err != nil {
+		return fmt.Errorf("parse error: %w", err)
+	}
+
+	if err := mountChanged(r.spec.Mount, spec.Mount); err != nil {
+		return err
+	}
+
+	builder := engine.NewBuilderFrom(spec, r.builder)
+	fs, err := builder.Build()
+	if err != nil {
+		builder.Close()
+		return fmt.Errorf("build error: %w", err)
+	}
+
+	sameRoot := spec.Mount.Root == r.spec.Mount.Root
+	closeReplaced := r.builder.Retire(builder)
+	r.spec = spec
+	r.builder = builder
+	r.data = data
+
+	rebuilt := builder.Rebuilt()
+	if len(rebuilt) == 0 && sameRoot {
+		// Any node not reused was not part of the served stack
+		closeReplaced()
+		textf("✓ Reloaded: no node changes\n")
+		return nil
+	}
+
+	drained := r.root.Swap(fs)
+	textf("✓ Reloaded: rebuilt [%s], reused [%s]\n",
+		strings.Join(rebuilt, ", "), strings.Join(builder.Reused(), ", "))
+
+	go func() {
+		<-drained
+		if err := closeReplaced(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to close replaced nodes: %v\n", err)
+		}
+		textf("✓ Previous stack drained\n")
+	}()
+	return nil
+}
+
+// close releases the nodes of the running build once it is unmounted
+func (r *reloader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.builder.Close()
+}
+
+// Spec returns the spec of the running build
+func (r *reloader) Spec() *engine.CompositionSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.spec
+}
+
+// Node returns a node of the running build
+func (r *reloader) Node(id string) (absfs.FileSystem, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.builder.GetBuiltNode(id)
+}
+
+// Reload implements control.Composition
+func (r *reloader) Reload() error {
+	return r.reload()
+}
+
+// mountChanged rejects changes to the mount section other than its root;
+// those need the frontend to be restarted
+func mountChanged(old, new engine.MountConfig) error {
+	old.Root, new.Root = "", ""
+	if !reflect.DeepEqual(old, new) {
+		return fmt.Errorf("mount settings changed; unmount and mount again to apply them")
+	}
+	return nil
+}
+
+// watch polls the spec file and reloads whenever its contents change
+func (r *reloader) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(r.specFile)
+		if err != nil {
+			continue // Editors may briefly remove the file while saving
+		}
+
+		r.mu.Lock()
+		changed := !bytes.Equal(data, r.data)
+		r.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		textf("Spec %s changed, reloading...\n", r.specFile)
+		if err := r.reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "Reload failed, keeping current composition: %v\n", err)
+			// Don't retry the same broken contents on every tick
+			r.mu.Lock()
+			r.data = data
+			r.mu.Unlock()
+		}
+	}
+}
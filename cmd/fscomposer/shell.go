@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+)
+
+const shellHelp = `Commands:
+  ls [-l] [path]           List a directory
+  cd [path]                Change directory (default /)
+  pwd                      Print the working directory
+  cat <file>...            Print file contents
+  put <local> [remote]     Copy a local file into the composition
+  get <remote> [local]     Copy a file out of the composition
+  rm [-r] <path>...        Remove files or directories
+  mkdir [-p] <dir>...      Create directories
+  mv <src> <dst>           Rename or move
+  stat <path>...           Show file information
+  tree [path]              Show a directory tree
+  help                     Show this help
+  exit                     Leave the shell`
+
+// shellCommand builds a composition and opens a shell on its root
+func shellCommand(args []string) error {
+	flags := flag.NewFlagSet("shell", flag.ContinueOnError)
+	script := flags.String("c", "", "Run commands (separated by ';' or newlines) and exit")
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 {
+		return usageErrorf("usage: fscomposer shell [-c \"commands\"] <spec.yaml>")
+	}
+
+	spec, err := engine.ParseFile(positional[0])
+	if err != nil {
+		return withExit(exitParse, fmt.Errorf("parse error: %w", err))
+	}
+
+	builder := engine.NewBuilder(spec)
+	defer builder.Close()
+	fs, err := builder.Build()
+	if err != nil {
+		return withExit(exitBuild, fmt.Errorf("build error: %w", err))
+	}
+
+	sh := &shell{fs: fs, cwd: "/", out: os.Stdout}
+
+	if *script != "" {
+		commands, err := splitCommands(*script)
+		if err != nil {
+			return err
+		}
+		for _, argv := range commands {
+			if err := sh.exec(argv); err != nil {
+				if errors.Is(err, errShellExit) {
+					return nil
+				}
+				return fmt.Errorf("%s: %w", argv[0], err)
+			}
+		}
+		return nil
+	}
+
+	interactive := isTerminal(os.Stdin)
+	if interactive {
+		fmt.Printf("✓ Built %s. Type 'help' for commands.\n", spec.Name)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		if interactive {
+			fmt.Printf("%s:%s> ", spec.Name, sh.cwd)
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		commands, err := splitCommands(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		for _, argv := range commands {
+			if err := sh.exec(argv); err != nil {
+				if errors.Is(err, errShellExit) {
+					return nil
+				}
+				fmt.Fprintf(os.Stderr, "%s: %v\n", argv[0], err)
+			}
+		}
+	}
+	if interactive {
+		fmt.Println()
+	}
+	return scanner.Err()
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+var errShellExit = errors.New("exit")
+
+// shell runs file commands against a composed filesystem
+type shell struct {
+	fs  absfs.FileSystem
+	cwd string
+	out io.Writer
+}
+
+// resolve makes p absolute relative to the working directory
+func (sh *shell) resolve(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(sh.cwd, p)
+	}
+	return path.Clean(p)
+}
+
+// exec runs one command
+func (sh *shell) exec(argv []string) error {
+	cmd, args := argv[0], argv[1:]
+	switch cmd {
+	case "ls":
+		return sh.ls(args)
+	case "cd":
+		return sh.cd(args)
+	case "pwd":
+		fmt.Fprintln(sh.out, sh.cwd)
+		return nil
+	case "cat":
+		return sh.cat(args)
+	case "put":
+		return sh.put(args)
+	case "get":
+		return sh.get(args)
+	case "rm":
+		return sh.rm(args)
+	case "mkdir":
+		return sh.mkdir(args)
+	case "mv":
+		return sh.mv(args)
+	case "stat":
+		return sh.stat(args)
+	case "tree":
+		return sh.tree(args)
+	case "help", "?":
+		fmt.Fprintln(sh.out, shellHelp)
+		return nil
+	case "exit", "quit":
+		return errShellExit
+	default:
+		return fmt.Errorf("unknown command (type 'help' for a list)")
+	}
+}
+
+// splitFlags separates leading single-letter flags from the arguments
+func splitFlags(args []string, allowed string) (map[rune]bool, []string, error) {
+	flags := make(map[rune]bool)
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, r := range args[0][1:] {
+			if !strings.ContainsRune(allowed, r) {
+				return nil, nil, fmt.Errorf("unknown flag -%c", r)
+			}
+			flags[r] = true
+		}
+		args = args[1:]
+	}
+	return flags, args, nil
+}
+
+func (sh *shell) ls(args []string) error {
+	flags, args, err := splitFlags(args, "l")
+	if err != nil {
+		return err
+	}
+	target := sh.cwd
+	if len(args) > 0 {
+		target = sh.resolve(args[0])
+	}
+
+	info, err := sh.fs.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		sh.printEntry(info, flags['l'])
+		return nil
+	}
+
+	entries, err := sh.fs.ReadDir(target)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			fmt.Fprintln(sh.out, entry.Name())
+			continue
+		}
+		sh.printEntry(info, flags['l'])
+	}
+	return nil
+}
+
+func (sh *shell) printEntry(info os.FileInfo, long bool) {
+	name := info.Name()
+	if info.IsDir() {
+		name += "/"
+	}
+	if !long {
+		fmt.Fprintln(sh.out, name)
+		return
+	}
+	fmt.Fprintf(sh.out, "%s %10d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), name)
+}
+
+func (sh *shell) cd(args []string) error {
+	target := "/"
+	if len(args) > 0 {
+		target = sh.resolve(args[0])
+	}
+	info, err := sh.fs.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", target)
+	}
+	sh.cwd = target
+	return nil
+}
+
+func (sh *shell) cat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: cat <file>...")
+	}
+	for _, arg := range args {
+		f, err := sh.fs.Open(sh.resolve(arg))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(sh.out, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) put(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: put <local> [remote]")
+	}
+	remote := filepath.Base(args[0])
+	if len(args) == 2 {
+		remote = args[1]
+	}
+	remote = sh.resolve(remote)
+	if info, err := sh.fs.Stat(remote); err == nil && info.IsDir() {
+		remote = path.Join(remote, filepath.Base(args[0]))
+	}
+
+	src, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := sh.fs.Create(remote)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "✓ %s → %s (%d bytes)\n", args[0], remote, n)
+	return nil
+}
+
+func (sh *shell) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: get <remote> [local]")
+	}
+	remote := sh.resolve(args[0])
+	local := path.Base(remote)
+	if len(args) == 2 {
+		local = args[1]
+	}
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+
+	src, err := sh.fs.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "✓ %s → %s (%d bytes)\n", remote, local, n)
+	return nil
+}
+
+func (sh *shell) rm(args []string) error {
+	flags, args, err := splitFlags(args, "rf")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: rm [-r] <path>...")
+	}
+	for _, arg := range args {
+		target := sh.resolve(arg)
+		if target == "/" {
+			return fmt.Errorf("refusing to remove /")
+		}
+		if flags['r'] {
+			err = sh.fs.RemoveAll(target)
+		} else {
+			err = sh.fs.Remove(target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) mkdir(args []string) error {
+	flags, args, err := splitFlags(args, "p")
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mkdir [-p] <dir>...")
+	}
+	for _, arg := range args {
+		if flags['p'] {
+			err = sh.fs.MkdirAll(sh.resolve(arg), 0755)
+		} else {
+			err = sh.fs.Mkdir(sh.resolve(arg), 0755)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sh *shell) mv(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: mv <src> <dst>")
+	}
+	src, dst := sh.resolve(args[0]), sh.resolve(args[1])
+	if info, err := sh.fs.Stat(dst); err == nil && info.IsDir() {
+		dst = path.Join(dst, path.Base(src))
+	}
+	return sh.fs.Rename(src, dst)
+}
+
+func (sh *shell) stat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: stat <path>...")
+	}
+	for _, arg := range args {
+		target := sh.resolve(arg)
+		info, err := sh.fs.Stat(target)
+		if err != nil {
+			return err
+		}
+		kind := "file"
+		if info.IsDir() {
+			kind = "directory"
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			kind = "symlink"
+		}
+		fmt.Fprintf(sh.out, "  Path:     %s\n", target)
+		fmt.Fprintf(sh.out, "  Type:     %s\n", kind)
+		fmt.Fprintf(sh.out, "  Size:     %d\n", info.Size())
+		fmt.Fprintf(sh.out, "  Mode:     %s (%04o)\n", info.Mode(), info.Mode().Perm())
+		fmt.Fprintf(sh.out, "  Modified: %s\n", info.ModTime().Format("2006-01-02 15:04:05 MST"))
+	}
+	return nil
+}
+
+func (sh *shell) tree(args []string) error {
+	root := sh.cwd
+	if len(args) > 0 {
+		root = sh.resolve(args[0])
+	}
+	fmt.Fprintln(sh.out, root)
+
+	var dirs, files int
+	var walk func(dir, prefix string) error
+	walk = func(dir, prefix string) error {
+		entries, err := sh.fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		for i, entry := range entries {
+			branch, indent := "├── ", "│   "
+			if i == len(entries)-1 {
+				branch, indent = "└── ", "    "
+			}
+			fmt.Fprintln(sh.out, prefix+branch+entry.Name())
+			if entry.IsDir() {
+				dirs++
+				if err := walk(path.Join(dir, entry.Name()), prefix+indent); err != nil {
+					return err
+				}
+			} else {
+				files++
+			}
+		}
+		return nil
+	}
+	if err := walk(root, ""); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sh.out, "\n%d directories, %d files\n", dirs, files)
+	return nil
+}
+
+// splitCommands tokenizes a command line into commands separated by ';' or
+// newlines. Single and double quotes group words; backslash escapes the next
+// character outside single quotes.
+func splitCommands(line string) ([][]string, error) {
+	var commands [][]string
+	var argv []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	endWord := func() {
+		if inWord {
+			argv = append(argv, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(argv) > 0 {
+			commands = append(commands, argv)
+			argv = nil
+		}
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' && i+1 < len(runes) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && i+1 < len(runes):
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case r == ';' || r == '\n':
+			endCommand()
+		case r == ' ' || r == '\t' || r == '\r':
+			endWord()
+		case r == '#' && !inWord:
+			// Comment to end of line
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	endCommand()
+	return commands, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/frontend"
+	"github.com/absfs/fscomposer/instance"
+)
+
+// unmountCommand stops a running composition by name or mountpoint
+func unmountCommand(args []string) error {
+	if len(args) < 1 {
+		return usageErrorf("usage: fscomposer unmount <path|name>")
+	}
+
+	rec, err := instance.Find(args[0])
+	if err != nil {
+		return err
+	}
+
+	stale := !instance.ProcessAlive(rec.PID)
+	if !stale {
+		textf("Stopping %s (pid %d)...\n", rec.Name, rec.PID)
+		if err := instance.Terminate(rec.PID); err != nil {
+			return fmt.Errorf("failed to signal pid %d: %w", rec.PID, err)
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for instance.ProcessAlive(rec.PID) {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("pid %d did not exit within 10s", rec.PID)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	} else {
+		textf("Process %d for %s is gone, cleaning up stale state\n", rec.PID, rec.Name)
+		if rec.MountType == engine.MountTypeFUSE && frontend.FUSEMounted(rec.Target) {
+			if err := forceUnmount(rec.Target); err != nil {
+				return fmt.Errorf("failed to unmount stale mount at %s: %w", rec.Target, err)
+			}
+		}
+	}
+
+	if err := instance.Unregister(rec); err != nil {
+		return err
+	}
+
+	if structured() {
+		return emit(struct {
+			Name   string `json:"name"`
+			PID    int    `json:"pid"`
+			Target string `json:"target"`
+			Stale  bool   `json:"stale"` // The process had already exited
+		}{rec.Name, rec.PID, rec.Target, stale})
+	}
+	fmt.Printf("✓ Unmounted %s\n", rec.Target)
+	return nil
+}
+
+// statusCommand lists the compositions running on this host
+func statusCommand(args []string) error {
+	records, err := instance.List()
+	if err != nil {
+		return err
+	}
+
+	if structured() {
+		type statusEntry struct {
+			*instance.Record
+			Uptime string `json:"uptime"`
+			Health string `json:"health"`
+		}
+		entries := make([]statusEntry, 0, len(records))
+		for _, rec := range records {
+			entries = append(entries, statusEntry{rec, rec.Uptime().String(), health(rec)})
+		}
+		return emit(entries)
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No running compositions")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPID\tTYPE\tTARGET\tUPTIME\tHEALTH\tSPEC")
+	for _, rec := range records {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			rec.Name, rec.PID, rec.MountType, rec.Target, rec.Uptime(), health(rec), rec.SpecFile)
+	}
+	return w.Flush()
+}
+
+// health checks that an instance's process is alive and its frontend is
+// still reachable
+func health(rec *instance.Record) string {
+	if !instance.ProcessAlive(rec.PID) {
+		return "dead"
+	}
+
+	switch rec.MountType {
+	case engine.MountTypeFUSE:
+		if !frontend.FUSEMounted(rec.Target) {
+			return "not mounted"
+		}
+	default:
+		conn, err := net.DialTimeout("tcp", rec.Target, time.Second)
+		if err != nil {
+			return "unreachable"
+		}
+		conn.Close()
+	}
+	return "healthy"
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/absfs/fscomposer/conformance"
+	"github.com/absfs/fscomposer/engine"
+)
+
+// testResult is the structured output of test
+type testResult struct {
+	File    string                        `json:"file"`
+	Name    string                        `json:"name"`
+	Live    bool                          `json:"live"`
+	Passed  bool                          `json:"passed"`
+	Summary []conformance.CategorySummary `json:"summary"`
+	Report  *conformance.Report           `json:"report"`
+}
+
+// testCommand runs the conformance suite against a composition's root
+func testCommand(args []string) error {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	only := flags.String("only", "", "Comma-separated categories to run (default: all)")
+	largeSize := flags.Int64("large-size", conformance.DefaultLargeFileSize, "Size in bytes of the large file test")
+	concurrency := flags.Int("concurrency", conformance.DefaultConcurrency, "Workers in the concurrency tests")
+	verbose := flags.Bool("v", false, "List every check, not only failures")
+	live := flags.Bool("live", false, "Test the real backends in a scratch directory instead of a sandbox")
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("usage: fscomposer test [--only files,seek,...] [--large-size N] [--concurrency N] [--live] [-v] <spec.yaml>\n\nCategories: %s",
+			strings.Join(conformance.Categories, ", "))
+	}
+
+	filename := positional[0]
+	textf("Testing: %s\n", filename)
+
+	spec, err := engine.ParseFile(filename)
+	if err != nil {
+		return withExit(exitParse, fmt.Errorf("parse error: %w", err))
+	}
+	// By default persistent backends sit under a copy-on-write memory
+	// overlay, so the suite reads nothing but writes nowhere real
+	builder := engine.NewSandboxBuilder(spec)
+	if *live {
+		builder = engine.NewBuilder(spec)
+	}
+	fs, err := builder.Build()
+	if err != nil {
+		return withExit(exitBuild, fmt.Errorf("build error: %w", err))
+	}
+	if *live {
+		textf("✓ Filesystem stack built (live: checks run in a scratch directory on the real backends)\n\n")
+	} else {
+		textf("✓ Filesystem stack built (sandboxed, backends are not modified)\n\n")
+	}
+
+	opts := conformance.Options{
+		LargeFileSize: *largeSize,
+		Concurrency:   *concurrency,
+	}
+	if *only != "" {
+		opts.Categories = strings.Split(*only, ",")
+	}
+
+	report, err := conformance.Run(fs, opts)
+	if err != nil {
+		return err
+	}
+
+	if !report.OK() {
+		err = withExit(exitTestFailed, fmt.Errorf("%d of %d checks failed", report.Failed, len(report.Results)))
+	}
+	if structured() {
+		return emitResult(testResult{
+			File:    filename,
+			Name:    spec.Name,
+			Live:    *live,
+			Passed:  report.OK(),
+			Summary: report.Summary(),
+			Report:  report,
+		}, err)
+	}
+
+	printReport(report, *verbose)
+	if report.Leftover != "" {
+		fmt.Printf("Warning: could not remove scratch directory %s\n", report.Leftover)
+	}
+
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nComposition '%s' passed the conformance suite.\n", spec.Name)
+	return nil
+}
+
+// printReport lists results per category, followed by a support summary
+func printReport(report *conformance.Report, verbose bool) {
+	category := ""
+	for _, res := range report.Results {
+		if !verbose && res.Status == conformance.StatusPass {
+			continue
+		}
+		if res.Category != category {
+			category = res.Category
+			fmt.Printf("%s:\n", category)
+		}
+		switch res.Status {
+		case conformance.StatusPass:
+			fmt.Printf("  ✓ %s\n", res.Name)
+		case conformance.StatusFail:
+			fmt.Printf("  ✗ %s: %s\n", res.Name, res.Error)
+		case conformance.StatusUnsupported:
+			fmt.Printf("  - %s: unsupported\n", res.Name)
+		}
+	}
+	if category != "" {
+		fmt.Println()
+	}
+
+	fmt.Println("Operation support:")
+	for _, c := range report.Summary() {
+		total := c.Passed + c.Failed + c.Unsupported
+		mark := "✓"
+		switch {
+		case c.Failed > 0:
+			mark = "✗"
+		case c.Passed == 0:
+			mark = "-"
+		case c.Unsupported > 0:
+			mark = "~"
+		}
+		fmt.Printf("  %s %-12s %d/%d\n", mark, c.Category, c.Passed, total)
+	}
+
+	fmt.Printf("\n%d passed, %d failed, %d unsupported in %s\n",
+		report.Passed, report.Failed, report.Unsupported, report.Duration.Round(1e6))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/transfer"
+	"github.com/absfs/osfs"
+)
+
+// cpCommand copies files between compositions or local directories
+func cpCommand(args []string) error {
+	return transferCommand("cp", args)
+}
+
+// syncCommand makes a destination tree match a source tree, copying only
+// what changed
+func syncCommand(args []string) error {
+	return transferCommand("sync", args)
+}
+
+func transferCommand(name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	checksum := flags.Bool("checksum", false, "Compare file contents instead of size and mtime (use with encryptfs)")
+	workers := flags.Int("workers", transfer.DefaultWorkers, "Number of parallel file copies")
+	dryRun := flags.Bool("dry-run", false, "Show what would be done without writing")
+	quiet := flags.Bool("quiet", false, "Only print the summary")
+	var del *bool
+	if name == "sync" {
+		del = flags.Bool("delete", false, "Delete destination files missing from the source")
+	}
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		usage := "usage: fscomposer cp [--checksum] [--workers N] [--dry-run] [--quiet] <src> <dst>"
+		if name == "sync" {
+			usage = "usage: fscomposer sync [--delete] [--checksum] [--workers N] [--dry-run] [--quiet] <src> <dst>"
+		}
+		return usageErrorf("%s\n\nEndpoints are <spec.yaml>[:path] or a local path", usage)
+	}
+
+	srcFS, srcPath, srcLabel, err := openEndpoint(positional[0])
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	dstFS, dstPath, dstLabel, err := openEndpoint(positional[1])
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+
+	opts := transfer.Options{
+		SkipUnchanged: name == "sync",
+		Checksum:      *checksum,
+		DryRun:        *dryRun,
+		Workers:       *workers,
+	}
+	if del != nil {
+		opts.Delete = *del
+	}
+	if !*quiet && !structured() {
+		opts.Progress = printTransferEvent
+	}
+
+	prefix := ""
+	if *dryRun {
+		prefix = "(dry run) "
+	}
+	textf("%s%s %s → %s\n", prefix, name, srcLabel, dstLabel)
+
+	stats, err := transfer.Run(srcFS, srcPath, dstFS, dstPath, opts)
+	if structured() && stats != nil {
+		return emitResult(struct {
+			Source      string `json:"source"`
+			Destination string `json:"destination"`
+			DryRun      bool   `json:"dryRun"`
+			*transfer.Stats
+		}{srcLabel, dstLabel, *dryRun, stats}, err)
+	}
+	if stats != nil {
+		rate := ""
+		if secs := stats.Duration.Seconds(); secs > 0 && stats.Bytes > 0 {
+			rate = fmt.Sprintf(", %s/s", formatBytes(int64(float64(stats.Bytes)/secs)))
+		}
+		fmt.Printf("\n%s%d copied (%s%s), %d unchanged, %d directories created, %d deleted, %d errors in %s\n",
+			prefix, stats.Copied, formatBytes(stats.Bytes), rate, stats.Skipped, stats.Dirs, stats.Deleted,
+			stats.Errors, stats.Duration.Round(1e6))
+	}
+	return err
+}
+
+func printTransferEvent(ev transfer.Event) {
+	switch ev.Action {
+	case transfer.ActionCopy:
+		fmt.Printf("  copy    %s (%s)\n", ev.Path, formatBytes(ev.Bytes))
+	case transfer.ActionMkdir:
+		fmt.Printf("  mkdir   %s\n", ev.Path)
+	case transfer.ActionDelete:
+		fmt.Printf("  delete  %s\n", ev.Path)
+	case transfer.ActionError:
+		fmt.Fprintf(os.Stderr, "  error   %s: %v\n", ev.Path, ev.Err)
+	}
+}
+
+// openEndpoint resolves <spec.yaml>[:path] to a built composition, or any
+// other argument to a local path
+func openEndpoint(arg string) (absfs.FileSystem, string, string, error) {
+	specFile, p := arg, "/"
+	if i := strings.LastIndex(arg, ":"); i > 0 && isSpecFile(arg[:i]) {
+		specFile, p = arg[:i], arg[i+1:]
+	}
+
+	if isSpecFile(specFile) {
+		if _, err := os.Stat(specFile); err == nil {
+			spec, err := engine.ParseFile(specFile)
+			if err != nil {
+				return nil, "", "", withExit(exitParse, fmt.Errorf("parse error: %w", err))
+			}
+			fs, err := engine.NewBuilder(spec).Build()
+			if err != nil {
+				return nil, "", "", withExit(exitBuild, fmt.Errorf("build error: %w", err))
+			}
+			if p == "" {
+				p = "/"
+			}
+			return fs, p, spec.Name + ":" + p, nil
+		}
+	}
+
+	abs, err := filepath.Abs(arg)
+	if err != nil {
+		return nil, "", "", err
+	}
+	fs, err := osfs.NewFS()
+	if err != nil {
+		return nil, "", "", err
+	}
+	return fs, filepath.ToSlash(abs), abs, nil
+}
+
+func isSpecFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,791 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+var checks = []check{
+	// Files
+	{"files", "create write read", checkCreateWriteRead},
+	{"files", "stat size", checkStatSize},
+	{"files", "open missing", checkOpenMissing},
+	{"files", "exclusive create", checkExclusiveCreate},
+	{"files", "overwrite truncates", checkOverwrite},
+	{"files", "remove", checkRemove},
+
+	// Seeks and positioned IO
+	{"seek", "seek and read", checkSeekRead},
+	{"seek", "seek and write", checkSeekWrite},
+	{"seek", "read at", checkReadAt},
+	{"seek", "write at", checkWriteAt},
+	{"seek", "write past end", checkSparse},
+
+	// Truncation
+	{"truncate", "shrink", checkTruncateShrink},
+	{"truncate", "extend", checkTruncateExtend},
+	{"truncate", "open file", checkFileTruncate},
+
+	// Append
+	{"append", "append mode", checkAppend},
+	{"append", "append ignores seek", checkAppendSeek},
+
+	// Directories
+	{"directories", "mkdir", checkMkdir},
+	{"directories", "mkdir existing", checkMkdirExisting},
+	{"directories", "mkdir all", checkMkdirAll},
+	{"directories", "read dir", checkReadDir},
+	{"directories", "remove non-empty", checkRemoveNonEmpty},
+	{"directories", "remove all", checkRemoveAll},
+
+	// Rename
+	{"rename", "rename file", checkRenameFile},
+	{"rename", "rename over existing", checkRenameReplace},
+	{"rename", "rename directory", checkRenameDir},
+	{"rename", "rename missing", checkRenameMissing},
+
+	// Permissions and times
+	{"permissions", "create mode", checkCreateMode},
+	{"permissions", "chmod", checkChmod},
+	{"permissions", "chtimes", checkChtimes},
+
+	// Symlinks
+	{"symlinks", "symlink and readlink", checkSymlink},
+	{"symlinks", "lstat", checkLstat},
+
+	// Large files
+	{"large", "large file", checkLargeFile},
+
+	// Concurrency
+	{"concurrency", "parallel writers", checkParallelWriters},
+	{"concurrency", "parallel readers", checkParallelReaders},
+}
+
+var sample = []byte("The quick brown fox jumps over the lazy dog")
+
+func checkCreateWriteRead(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	return s.expectContent(name, sample)
+}
+
+func checkStatSize(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || !info.Mode().IsRegular() {
+		return fmt.Errorf("stat reports mode %v for a regular file", info.Mode())
+	}
+	if info.Size() != int64(len(sample)) {
+		return fmt.Errorf("stat reports %d bytes, wrote %d", info.Size(), len(sample))
+	}
+	return nil
+}
+
+func checkOpenMissing(s *suite, dir string) error {
+	f, err := s.fs.Open(path.Join(dir, "missing.txt"))
+	if err == nil {
+		f.Close()
+		return fmt.Errorf("opening a missing file succeeded")
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("expected a not-exist error, got %v", err)
+	}
+	return nil
+}
+
+func checkExclusiveCreate(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	f, err := s.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	f, err = s.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		f.Close()
+		return fmt.Errorf("O_EXCL create of an existing file succeeded")
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("expected an exists error, got %v", err)
+	}
+	return nil
+}
+
+func checkOverwrite(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	if err := s.writeFile(name, []byte("short")); err != nil {
+		return err
+	}
+	return s.expectContent(name, []byte("short"))
+}
+
+func checkRemove(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	if err := s.fs.Remove(name); err != nil {
+		return err
+	}
+	if err := s.expectMissing(name); err != nil {
+		return err
+	}
+	if err := s.fs.Remove(name); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing a missing file: expected a not-exist error, got %v", err)
+	}
+	return nil
+}
+
+func checkSeekRead(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{4, io.SeekStart, 4},
+		{6, io.SeekCurrent, 10},
+		{-8, io.SeekEnd, int64(len(sample)) - 8},
+	} {
+		pos, err := f.Seek(tc.offset, tc.whence)
+		if err != nil {
+			return err
+		}
+		if pos != tc.want {
+			return fmt.Errorf("seek(%d, %d) returned %d, want %d", tc.offset, tc.whence, pos, tc.want)
+		}
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return err
+	}
+	if want := sample[len(sample)-8 : len(sample)-4]; !bytes.Equal(buf, want) {
+		return fmt.Errorf("read after seek returned %q, want %q", buf, want)
+	}
+	return nil
+}
+
+func checkSeekWrite(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, []byte("0123456789")); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(3, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write([]byte("abc")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.expectContent(name, []byte("012abc6789"))
+}
+
+func checkReadAt(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 5)
+	if _, err := f.ReadAt(buf, 10); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, sample[10:15]) {
+		return fmt.Errorf("ReadAt returned %q, want %q", buf, sample[10:15])
+	}
+
+	// ReadAt must not move the file offset
+	first := make([]byte, 3)
+	if _, err := io.ReadFull(f, first); err != nil {
+		return err
+	}
+	if !bytes.Equal(first, sample[:3]) {
+		return fmt.Errorf("ReadAt moved the offset: read %q", first)
+	}
+	return nil
+}
+
+func checkWriteAt(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, []byte("0123456789")); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte("XY"), 7); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.expectContent(name, []byte("0123456XY9"))
+}
+
+func checkSparse(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	f, err := s.fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("ab")); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write([]byte("cd")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.expectContent(name, []byte("ab\x00\x00\x00\x00cd"))
+}
+
+func checkTruncateShrink(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	if err := s.fs.Truncate(name, 9); err != nil {
+		return err
+	}
+	return s.expectContent(name, sample[:9])
+}
+
+func checkTruncateExtend(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, []byte("abc")); err != nil {
+		return err
+	}
+	if err := s.fs.Truncate(name, 6); err != nil {
+		return err
+	}
+	return s.expectContent(name, []byte("abc\x00\x00\x00"))
+}
+
+func checkFileTruncate(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(3); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.expectContent(name, sample[:3])
+}
+
+func checkAppend(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, []byte("one\n")); err != nil {
+		return err
+	}
+	for _, line := range []string{"two\n", "three\n"} {
+		f, err := s.fs.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte(line)); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return s.expectContent(name, []byte("one\ntwo\nthree\n"))
+}
+
+func checkAppendSeek(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, []byte("head")); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(name, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write([]byte("tail")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.expectContent(name, []byte("headtail"))
+}
+
+func checkMkdir(s *suite, dir string) error {
+	name := path.Join(dir, "sub")
+	if err := s.fs.Mkdir(name, 0755); err != nil {
+		return err
+	}
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("stat reports mode %v for a directory", info.Mode())
+	}
+	return nil
+}
+
+func checkMkdirExisting(s *suite, dir string) error {
+	name := path.Join(dir, "sub")
+	if err := s.fs.Mkdir(name, 0755); err != nil {
+		return err
+	}
+	err := s.fs.Mkdir(name, 0755)
+	if err == nil {
+		return fmt.Errorf("creating an existing directory succeeded")
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("expected an exists error, got %v", err)
+	}
+	return nil
+}
+
+func checkMkdirAll(s *suite, dir string) error {
+	name := path.Join(dir, "a", "b", "c")
+	if err := s.fs.MkdirAll(name, 0755); err != nil {
+		return err
+	}
+	if info, err := s.fs.Stat(name); err != nil || !info.IsDir() {
+		return fmt.Errorf("nested directory not created: %v", err)
+	}
+	// Already existing is not an error
+	return s.fs.MkdirAll(name, 0755)
+}
+
+func checkReadDir(s *suite, dir string) error {
+	for _, name := range []string{"b.txt", "a.txt"} {
+		if err := s.writeFile(path.Join(dir, name), sample); err != nil {
+			return err
+		}
+	}
+	if err := s.fs.Mkdir(path.Join(dir, "c"), 0755); err != nil {
+		return err
+	}
+
+	entries, err := s.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var got []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		got = append(got, name)
+	}
+	if strings.Join(got, " ") != "a.txt b.txt c/" {
+		return fmt.Errorf("ReadDir returned [%s], want sorted [a.txt b.txt c/]", strings.Join(got, " "))
+	}
+	return nil
+}
+
+func checkRemoveNonEmpty(s *suite, dir string) error {
+	sub := path.Join(dir, "sub")
+	if err := s.fs.Mkdir(sub, 0755); err != nil {
+		return err
+	}
+	if err := s.writeFile(path.Join(sub, "file.txt"), sample); err != nil {
+		return err
+	}
+	if err := s.fs.Remove(sub); err == nil {
+		return fmt.Errorf("removing a non-empty directory succeeded")
+	}
+	if err := s.fs.Remove(path.Join(sub, "file.txt")); err != nil {
+		return err
+	}
+	if err := s.fs.Remove(sub); err != nil {
+		return fmt.Errorf("removing an empty directory: %w", err)
+	}
+	return s.expectMissing(sub)
+}
+
+func checkRemoveAll(s *suite, dir string) error {
+	sub := path.Join(dir, "tree")
+	if err := s.fs.MkdirAll(path.Join(sub, "x", "y"), 0755); err != nil {
+		return err
+	}
+	if err := s.writeFile(path.Join(sub, "x", "y", "file.txt"), sample); err != nil {
+		return err
+	}
+	if err := s.fs.RemoveAll(sub); err != nil {
+		return err
+	}
+	if err := s.expectMissing(sub); err != nil {
+		return err
+	}
+	// Removing something that does not exist is not an error
+	if err := s.fs.RemoveAll(sub); err != nil {
+		return fmt.Errorf("removing a missing path: %w", err)
+	}
+	return nil
+}
+
+func checkRenameFile(s *suite, dir string) error {
+	oldName, newName := path.Join(dir, "old.txt"), path.Join(dir, "new.txt")
+	if err := s.writeFile(oldName, sample); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	if err := s.expectMissing(oldName); err != nil {
+		return err
+	}
+	return s.expectContent(newName, sample)
+}
+
+func checkRenameReplace(s *suite, dir string) error {
+	oldName, newName := path.Join(dir, "old.txt"), path.Join(dir, "new.txt")
+	if err := s.writeFile(oldName, []byte("replacement")); err != nil {
+		return err
+	}
+	if err := s.writeFile(newName, sample); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	if err := s.expectMissing(oldName); err != nil {
+		return err
+	}
+	return s.expectContent(newName, []byte("replacement"))
+}
+
+func checkRenameDir(s *suite, dir string) error {
+	oldDir, newDir := path.Join(dir, "old"), path.Join(dir, "new")
+	if err := s.fs.MkdirAll(path.Join(oldDir, "sub"), 0755); err != nil {
+		return err
+	}
+	if err := s.writeFile(path.Join(oldDir, "sub", "file.txt"), sample); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(oldDir, newDir); err != nil {
+		return err
+	}
+	if err := s.expectMissing(oldDir); err != nil {
+		return err
+	}
+	return s.expectContent(path.Join(newDir, "sub", "file.txt"), sample)
+}
+
+func checkRenameMissing(s *suite, dir string) error {
+	err := s.fs.Rename(path.Join(dir, "missing.txt"), path.Join(dir, "new.txt"))
+	if err == nil {
+		return fmt.Errorf("renaming a missing file succeeded")
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("expected a not-exist error, got %v", err)
+	}
+	return nil
+}
+
+func checkCreateMode(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	f, err := s.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	// The umask may only remove bits, so nothing beyond 0600 may appear
+	if perm := info.Mode().Perm(); perm&^0600 != 0 || perm&0400 == 0 {
+		return fmt.Errorf("created with 0600, stat reports %v", perm)
+	}
+	return nil
+}
+
+func checkChmod(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	for _, mode := range []os.FileMode{0600, 0640} {
+		if err := s.fs.Chmod(name, mode); err != nil {
+			return err
+		}
+		info, err := s.fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm() != mode {
+			return fmt.Errorf("chmod %v, stat reports %v", mode, info.Mode().Perm())
+		}
+	}
+	return nil
+}
+
+func checkChtimes(s *suite, dir string) error {
+	name := path.Join(dir, "file.txt")
+	if err := s.writeFile(name, sample); err != nil {
+		return err
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := s.fs.Chtimes(name, mtime, mtime); err != nil {
+		return err
+	}
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().Equal(mtime) {
+		return fmt.Errorf("chtimes %v, stat reports %v", mtime, info.ModTime().UTC())
+	}
+	return nil
+}
+
+func (s *suite) symlinker() (absfs.SymLinker, error) {
+	linker, ok := s.fs.(absfs.SymLinker)
+	if !ok {
+		return nil, fmt.Errorf("stack has no symlink support: %w", errUnsupported)
+	}
+	return linker, nil
+}
+
+func checkSymlink(s *suite, dir string) error {
+	linker, err := s.symlinker()
+	if err != nil {
+		return err
+	}
+	target, link := path.Join(dir, "target.txt"), path.Join(dir, "link")
+	if err := s.writeFile(target, sample); err != nil {
+		return err
+	}
+	if err := linker.Symlink(target, link); err != nil {
+		return err
+	}
+	got, err := linker.Readlink(link)
+	if err != nil {
+		return err
+	}
+	if got != target {
+		return fmt.Errorf("readlink returned %q, want %q", got, target)
+	}
+	return s.expectContent(link, sample)
+}
+
+func checkLstat(s *suite, dir string) error {
+	linker, err := s.symlinker()
+	if err != nil {
+		return err
+	}
+	target, link := path.Join(dir, "target.txt"), path.Join(dir, "link")
+	if err := s.writeFile(target, sample); err != nil {
+		return err
+	}
+	if err := linker.Symlink(target, link); err != nil {
+		return err
+	}
+	info, err := linker.Lstat(link)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("lstat reports mode %v for a symlink", info.Mode())
+	}
+	if info, err = s.fs.Stat(link); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("stat does not follow the symlink: %v", err)
+	}
+	return nil
+}
+
+// pattern produces deterministic data that differs between blocks, so
+// misplaced chunks are caught
+type pattern struct {
+	off, size int64
+}
+
+func (p *pattern) Read(b []byte) (int, error) {
+	if p.off >= p.size {
+		return 0, io.EOF
+	}
+	if rem := p.size - p.off; int64(len(b)) > rem {
+		b = b[:rem]
+	}
+	for i := range b {
+		pos := p.off + int64(i)
+		b[i] = byte(pos ^ pos>>8 ^ pos>>16)
+	}
+	p.off += int64(len(b))
+	return len(b), nil
+}
+
+func checkLargeFile(s *suite, dir string) error {
+	name := path.Join(dir, "large.bin")
+	size := s.opts.LargeFileSize
+
+	want, err := digest(&pattern{size: size})
+	if err != nil {
+		return err
+	}
+
+	f, err := s.fs.Create(name)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, &pattern{size: size})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("wrote %d of %d bytes", n, size)
+	}
+
+	f, err = s.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	got, err := digest(f)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%d byte file read back with different contents", size)
+	}
+
+	// Spot-check a block in the middle through ReadAt
+	block := make([]byte, 4096)
+	off := size / 2
+	if off+int64(len(block)) > size {
+		return nil
+	}
+	if _, err := f.ReadAt(block, off); err != nil {
+		return err
+	}
+	expect := make([]byte, len(block))
+	(&pattern{off: off, size: size}).Read(expect)
+	if !bytes.Equal(block, expect) {
+		return fmt.Errorf("ReadAt(%d) returned the wrong block", off)
+	}
+	return nil
+}
+
+// parallel runs fn for each worker and returns the first error
+func (s *suite) parallel(fn func(i int) error) error {
+	errs := make(chan error, s.opts.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < s.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				errs <- fmt.Errorf("worker %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func checkParallelWriters(s *suite, dir string) error {
+	content := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("worker %d;", i)), 512)
+	}
+	err := s.parallel(func(i int) error {
+		return s.writeFile(path.Join(dir, fmt.Sprintf("file-%d", i)), content(i))
+	})
+	if err != nil {
+		return err
+	}
+
+	names, err := s.listDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) != s.opts.Concurrency {
+		return fmt.Errorf("%d workers wrote %d files", s.opts.Concurrency, len(names))
+	}
+	for i := 0; i < s.opts.Concurrency; i++ {
+		if err := s.expectContent(path.Join(dir, fmt.Sprintf("file-%d", i)), content(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkParallelReaders(s *suite, dir string) error {
+	name := path.Join(dir, "shared.txt")
+	data := bytes.Repeat(sample, 256)
+	if err := s.writeFile(name, data); err != nil {
+		return err
+	}
+	return s.parallel(func(i int) error {
+		return s.expectContent(name, data)
+	})
+}
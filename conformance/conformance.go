@@ -0,0 +1,301 @@
+// Package conformance checks how closely a composed filesystem follows POSIX
+// file semantics and reports which operations a stack supports
+package conformance
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// Defaults used when Options leaves a field unset. The scratch directory
+// gets a unique suffix so an interrupted run never blocks the next one.
+const (
+	DefaultDirPrefix     = "/.fscomposer-test-"
+	DefaultLargeFileSize = 8 << 20
+	DefaultConcurrency   = 8
+)
+
+// Categories lists the test groups in the order they run
+var Categories = []string{
+	"files", "seek", "truncate", "append", "directories",
+	"rename", "permissions", "symlinks", "large", "concurrency",
+}
+
+// Status is the outcome of a single check
+type Status string
+
+const (
+	StatusPass        Status = "pass"
+	StatusFail        Status = "fail"
+	StatusUnsupported Status = "unsupported"
+)
+
+// Options controls a conformance run
+type Options struct {
+	Dir           string   // Scratch directory, created for the run and removed afterwards
+	Categories    []string // Only run these categories; all when empty
+	LargeFileSize int64
+	Concurrency   int
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Category string        `json:"category"`
+	Name     string        `json:"name"`
+	Status   Status        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report collects the results of a run
+type Report struct {
+	Results     []Result      `json:"results"`
+	Passed      int           `json:"passed"`
+	Failed      int           `json:"failed"`
+	Unsupported int           `json:"unsupported"`
+	Duration    time.Duration `json:"duration"`
+	Leftover    string        `json:"leftover,omitempty"` // Scratch directory that could not be removed
+}
+
+// OK reports whether no check failed. Unsupported operations are not
+// failures; they describe what the stack can do.
+func (r *Report) OK() bool {
+	return r.Failed == 0
+}
+
+// CategorySummary counts the outcomes within one category
+type CategorySummary struct {
+	Category    string `json:"category"`
+	Passed      int    `json:"passed"`
+	Failed      int    `json:"failed"`
+	Unsupported int    `json:"unsupported"`
+}
+
+// Supported reports whether every check in the category passed
+func (c CategorySummary) Supported() bool {
+	return c.Failed == 0 && c.Unsupported == 0
+}
+
+// Summary groups the results by category, in run order
+func (r *Report) Summary() []CategorySummary {
+	var summary []CategorySummary
+	index := make(map[string]int)
+	for _, res := range r.Results {
+		i, ok := index[res.Category]
+		if !ok {
+			i = len(summary)
+			index[res.Category] = i
+			summary = append(summary, CategorySummary{Category: res.Category})
+		}
+		switch res.Status {
+		case StatusPass:
+			summary[i].Passed++
+		case StatusFail:
+			summary[i].Failed++
+		case StatusUnsupported:
+			summary[i].Unsupported++
+		}
+	}
+	return summary
+}
+
+// errUnsupported marks a check the stack cannot perform
+var errUnsupported = errors.New("operation not supported")
+
+// check is a single conformance test. It runs inside its own directory.
+type check struct {
+	category string
+	name     string
+	run      func(s *suite, dir string) error
+}
+
+type suite struct {
+	fs   absfs.FileSystem
+	opts Options
+}
+
+// Run executes the suite against fs inside opts.Dir. It only returns an
+// error when the scratch directory cannot be set up; individual failures are
+// recorded in the report.
+func Run(fs absfs.FileSystem, opts Options) (*Report, error) {
+	if opts.Dir == "" {
+		opts.Dir = fmt.Sprintf("%s%d", DefaultDirPrefix, time.Now().UnixNano())
+	}
+	if opts.LargeFileSize <= 0 {
+		opts.LargeFileSize = DefaultLargeFileSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	for _, c := range opts.Categories {
+		if !contains(Categories, c) {
+			return nil, fmt.Errorf("unknown category %q (available: %s)", c, strings.Join(Categories, ", "))
+		}
+	}
+
+	s := &suite{fs: fs, opts: opts}
+	if _, err := fs.Stat(opts.Dir); err == nil {
+		return nil, fmt.Errorf("scratch directory %s already exists", opts.Dir)
+	}
+	if err := fs.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory %s: %w", opts.Dir, err)
+	}
+
+	report := &Report{}
+	defer func() {
+		if err := fs.RemoveAll(opts.Dir); err != nil {
+			report.Leftover = opts.Dir
+		}
+	}()
+
+	start := time.Now()
+	for i, c := range checks {
+		if len(opts.Categories) > 0 && !contains(opts.Categories, c.category) {
+			continue
+		}
+		report.add(s.runCheck(i, c))
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+func (r *Report) add(res Result) {
+	r.Results = append(r.Results, res)
+	switch res.Status {
+	case StatusPass:
+		r.Passed++
+	case StatusFail:
+		r.Failed++
+	case StatusUnsupported:
+		r.Unsupported++
+	}
+}
+
+// runCheck runs c in a fresh directory and recovers from panicking stacks
+func (s *suite) runCheck(i int, c check) (res Result) {
+	res = Result{Category: c.category, Name: c.name}
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			res.Status, res.Error = StatusFail, fmt.Sprintf("panic: %v", p)
+		}
+		res.Duration = time.Since(start)
+	}()
+
+	dir := path.Join(s.opts.Dir, fmt.Sprintf("%02d-%s", i, strings.ReplaceAll(c.name, " ", "-")))
+	if err := s.fs.Mkdir(dir, 0755); err != nil {
+		res.Status, res.Error = StatusFail, fmt.Sprintf("setup: %v", err)
+		return res
+	}
+	defer s.fs.RemoveAll(dir)
+
+	err := c.run(s, dir)
+	switch {
+	case err == nil:
+		res.Status = StatusPass
+	case isUnsupported(err):
+		res.Status, res.Error = StatusUnsupported, err.Error()
+	default:
+		res.Status, res.Error = StatusFail, err.Error()
+	}
+	return res
+}
+
+// isUnsupported recognizes the ways stacks report missing operations
+func isUnsupported(err error) bool {
+	if errors.Is(err, errUnsupported) || errors.Is(err, errors.ErrUnsupported) ||
+		errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOSYS) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not supported") || strings.Contains(msg, "not implemented")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Helpers shared by the checks
+
+func (s *suite) writeFile(name string, data []byte) error {
+	f, err := s.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *suite) readFile(name string) ([]byte, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (s *suite) expectContent(name string, want []byte) error {
+	got, err := s.readFile(name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s contains %s, want %s", path.Base(name), preview(got), preview(want))
+	}
+	return nil
+}
+
+func (s *suite) expectMissing(name string) error {
+	if _, err := s.fs.Stat(name); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s still exists (stat error: %v)", path.Base(name), err)
+	}
+	return nil
+}
+
+func (s *suite) listDir(dir string) ([]string, error) {
+	entries, err := s.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func preview(b []byte) string {
+	if len(b) > 32 {
+		return fmt.Sprintf("%q... (%d bytes)", b[:32], len(b))
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
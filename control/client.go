@@ -0,0 +1,160 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/absfs/fscomposer/engine"
+)
+
+// Client talks to the control socket of a running mount
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the control socket at path
+func NewClient(path string) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: 60 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the state of the mount process
+func (c *Client) Status() (*Status, error) {
+	var status Status
+	if err := c.do("GET", "/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Graph returns the live composition graph
+func (c *Client) Graph() (*Graph, error) {
+	var graph Graph
+	if err := c.do("GET", "/graph", nil, &graph); err != nil {
+		return nil, err
+	}
+	return &graph, nil
+}
+
+// Spec returns the spec the composition is running
+func (c *Client) Spec() (*engine.CompositionSpec, error) {
+	var spec engine.CompositionSpec
+	if err := c.do("GET", "/spec", nil, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// Stats returns the statistics of one node, or of every node reporting
+// statistics when node is empty
+func (c *Client) Stats(node string) ([]NodeStats, error) {
+	var stats []NodeStats
+	p := "/stats"
+	if node != "" {
+		p += "/" + url.PathEscape(node)
+	}
+	if err := c.do("GET", p, nil, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Flush writes cached data of the selected cache nodes to their underlying
+// filesystems
+func (c *Client) Flush(node string) (*CacheResult, error) {
+	var result CacheResult
+	if err := c.do("POST", "/cache/flush", CacheRequest{Node: node}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Invalidate drops cached entries under prefix (everything when empty)
+func (c *Client) Invalidate(node, prefix string) (*CacheResult, error) {
+	var result CacheResult
+	if err := c.do("POST", "/cache/invalidate", CacheRequest{Node: node, Prefix: prefix}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// LogLevel returns the current log level
+func (c *Client) LogLevel() (string, error) {
+	var level LogLevel
+	if err := c.do("GET", "/log-level", nil, &level); err != nil {
+		return "", err
+	}
+	return level.Level, nil
+}
+
+// SetLogLevel changes the log level of the mount process
+func (c *Client) SetLogLevel(level string) (string, error) {
+	var result LogLevel
+	if err := c.do("PUT", "/log-level", LogLevel{Level: level}, &result); err != nil {
+		return "", err
+	}
+	return result.Level, nil
+}
+
+// Reload re-reads the spec and hot-swaps the composition, returning the new
+// graph
+func (c *Client) Reload() (*Graph, error) {
+	var graph Graph
+	if err := c.do("POST", "/reload", nil, &graph); err != nil {
+		return nil, err
+	}
+	return &graph, nil
+}
+
+func (c *Client) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://control"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("control socket unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s", apiErr.Error)
+		}
+		return fmt.Errorf("control request failed: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
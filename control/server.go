@@ -0,0 +1,390 @@
+// Package control exposes a running composition over a local Unix socket so
+// it can be inspected and managed without restarting the mount
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/registry"
+	"github.com/gorilla/mux"
+)
+
+// Composition is the running composition a control server manages
+type Composition interface {
+	Spec() *engine.CompositionSpec
+	Node(id string) (absfs.FileSystem, bool)
+	Reload() error
+}
+
+// Server serves the control API on a Unix socket
+type Server struct {
+	comp    Composition
+	level   *slog.LevelVar
+	logger  *slog.Logger
+	started time.Time
+	path    string
+	router  *mux.Router
+	http    *http.Server
+}
+
+// Status describes the mount process
+type Status struct {
+	Name      string    `json:"name"`
+	PID       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Uptime    string    `json:"uptime"`
+	MountType string    `json:"mountType"`
+	Root      string    `json:"root"`
+	LogLevel  string    `json:"logLevel"`
+}
+
+// Graph is the live composition graph
+type Graph struct {
+	Name        string              `json:"name" yaml:"name"`
+	MountType   string              `json:"mountType" yaml:"mountType"`
+	Root        string              `json:"root" yaml:"root"`
+	Nodes       []NodeInfo          `json:"nodes" yaml:"nodes"`
+	Connections []engine.Connection `json:"connections" yaml:"connections"`
+}
+
+// NodeInfo describes a node of the live graph
+type NodeInfo struct {
+	ID           string                 `json:"id" yaml:"id"`
+	Type         string                 `json:"type" yaml:"type"`
+	Config       map[string]interface{} `json:"config,omitempty" yaml:"config,omitempty"` // With schema defaults applied
+	Built        bool                   `json:"built" yaml:"built"`
+	Capabilities []string               `json:"capabilities,omitempty" yaml:"capabilities,omitempty"`
+}
+
+// NodeStats holds the runtime statistics of a node
+type NodeStats struct {
+	ID    string                 `json:"id"`
+	Type  string                 `json:"type"`
+	Stats map[string]interface{} `json:"stats"`
+}
+
+// CacheRequest selects the cache nodes to flush or invalidate. An empty node
+// selects every cache in the composition.
+type CacheRequest struct {
+	Node   string `json:"node,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// CacheResult lists the nodes a cache operation was applied to
+type CacheResult struct {
+	Nodes []string `json:"nodes"`
+}
+
+// LogLevel is the body of log level requests
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// Listen starts a control server on the Unix socket at path. level is the
+// process log level changed through the API.
+func Listen(path string, comp Composition, level *slog.LevelVar, logger *slog.Logger) (*Server, error) {
+	// A socket left behind by a crashed process would block Listen
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	s := &Server{
+		comp:    comp,
+		level:   level,
+		logger:  logger,
+		started: time.Now(),
+		path:    path,
+		router:  mux.NewRouter(),
+	}
+	s.setupRoutes()
+	s.http = &http.Server{Handler: s.router}
+
+	go s.http.Serve(l)
+	return s, nil
+}
+
+// Path returns the socket path
+func (s *Server) Path() string {
+	return s.path
+}
+
+// Close stops the server and removes the socket
+func (s *Server) Close() error {
+	err := s.http.Close()
+	os.Remove(s.path)
+	return err
+}
+
+func (s *Server) setupRoutes() {
+	s.router.Use(s.logRequests)
+
+	s.router.HandleFunc("/status", s.handleStatus).Methods("GET")
+	s.router.HandleFunc("/graph", s.handleGraph).Methods("GET")
+	s.router.HandleFunc("/spec", s.handleSpec).Methods("GET")
+	s.router.HandleFunc("/stats", s.handleStats).Methods("GET")
+	s.router.HandleFunc("/stats/{id}", s.handleStats).Methods("GET")
+	s.router.HandleFunc("/cache/flush", s.handleFlush).Methods("POST")
+	s.router.HandleFunc("/cache/invalidate", s.handleInvalidate).Methods("POST")
+	s.router.HandleFunc("/log-level", s.handleGetLogLevel).Methods("GET")
+	s.router.HandleFunc("/log-level", s.handleSetLogLevel).Methods("PUT")
+	s.router.HandleFunc("/reload", s.handleReload).Methods("POST")
+}
+
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Debug("control request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	spec := s.comp.Spec()
+	respondJSON(w, http.StatusOK, Status{
+		Name:      spec.Name,
+		PID:       os.Getpid(),
+		Started:   s.started,
+		Uptime:    time.Since(s.started).Round(time.Second).String(),
+		MountType: spec.Mount.Type,
+		Root:      spec.Mount.Root,
+		LogLevel:  strings.ToLower(s.level.Level().String()),
+	})
+}
+
+func (s *Server) handleGraph(w http.ResponseWriter, r *http.Request) {
+	spec := s.comp.Spec()
+	graph := Graph{
+		Name:        spec.Name,
+		MountType:   spec.Mount.Type,
+		Root:        spec.Mount.Root,
+		Connections: spec.Connections,
+	}
+
+	for _, node := range spec.Nodes {
+		config, err := registry.ResolveConfig(node.Type, node.Config)
+		if err != nil {
+			config = node.Config
+		}
+		info := NodeInfo{ID: node.ID, Type: node.Type, Config: config}
+		if fs, ok := s.comp.Node(node.ID); ok {
+			info.Built = true
+			info.Capabilities = capabilities(fs)
+		}
+		graph.Nodes = append(graph.Nodes, info)
+	}
+
+	respondJSON(w, http.StatusOK, graph)
+}
+
+// handleSpec returns the spec of the running build as it was written,
+// without defaults applied, so it can be compared with a spec file.
+// Secrets are redacted; engine.Diff treats them as unchanged.
+func (s *Server) handleSpec(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, engine.RedactSpec(s.comp.Spec()))
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	spec := s.comp.Spec()
+	id := mux.Vars(r)["id"]
+	if id != "" && spec.GetNode(id) == nil {
+		respondError(w, http.StatusNotFound, fmt.Sprintf("node %s not found", id))
+		return
+	}
+
+	stats := []NodeStats{}
+	for _, node := range spec.Nodes {
+		if id != "" && node.ID != id {
+			continue
+		}
+		fs, ok := s.comp.Node(node.ID)
+		if !ok {
+			continue
+		}
+		reporter, ok := fs.(registry.StatsReporter)
+		if !ok {
+			if id != "" {
+				respondError(w, http.StatusBadRequest, fmt.Sprintf("node %s (%s) does not report statistics", id, node.Type))
+				return
+			}
+			continue
+		}
+		stats = append(stats, NodeStats{ID: node.ID, Type: node.Type, Stats: reporter.NodeStats()})
+	}
+
+	respondJSON(w, http.StatusOK, stats)
+}
+
+// caches returns the cache nodes selected by req
+func (s *Server) caches(req CacheRequest) (map[string]registry.CacheController, error) {
+	spec := s.comp.Spec()
+	if req.Node != "" && spec.GetNode(req.Node) == nil {
+		return nil, fmt.Errorf("node %s not found", req.Node)
+	}
+
+	caches := make(map[string]registry.CacheController)
+	for _, node := range spec.Nodes {
+		if req.Node != "" && node.ID != req.Node {
+			continue
+		}
+		fs, _ := s.comp.Node(node.ID)
+		if cache, ok := fs.(registry.CacheController); ok {
+			caches[node.ID] = cache
+		} else if req.Node != "" {
+			return nil, fmt.Errorf("node %s (%s) has no cache", node.ID, node.Type)
+		}
+	}
+	return caches, nil
+}
+
+func (s *Server) handleFlush(w http.ResponseWriter, r *http.Request) {
+	var req CacheRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	caches, err := s.caches(req)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := CacheResult{Nodes: []string{}}
+	for _, id := range sortedKeys(caches) {
+		if err := caches[id].FlushCache(); err != nil {
+			respondError(w, http.StatusInternalServerError, fmt.Sprintf("node %s: flush failed: %v", id, err))
+			return
+		}
+		result.Nodes = append(result.Nodes, id)
+	}
+	s.logger.Info("flushed caches", "nodes", result.Nodes)
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleInvalidate(w http.ResponseWriter, r *http.Request) {
+	var req CacheRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	caches, err := s.caches(req)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := CacheResult{Nodes: []string{}}
+	for _, id := range sortedKeys(caches) {
+		caches[id].InvalidateCache(req.Prefix)
+		result.Nodes = append(result.Nodes, id)
+	}
+	s.logger.Info("invalidated caches", "nodes", result.Nodes, "prefix", req.Prefix)
+
+	respondJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, LogLevel{Level: strings.ToLower(s.level.Level().String())})
+}
+
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req LogLevel
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("invalid log level %q (use debug, info, warn or error)", req.Level))
+		return
+	}
+	s.level.Set(level)
+
+	// Nodes with their own logging follow the process level
+	spec := s.comp.Spec()
+	for _, node := range spec.Nodes {
+		fs, _ := s.comp.Node(node.ID)
+		if leveler, ok := fs.(registry.LogLeveler); ok {
+			if err := leveler.SetLogLevel(strings.ToLower(level.String())); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Sprintf("node %s: %v", node.ID, err))
+				return
+			}
+		}
+	}
+	s.logger.Info("log level changed", "level", level)
+
+	respondJSON(w, http.StatusOK, LogLevel{Level: strings.ToLower(level.String())})
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.comp.Reload(); err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	s.handleGraph(w, r)
+}
+
+// capabilities lists the control operations a built node supports
+func capabilities(fs absfs.FileSystem) []string {
+	var caps []string
+	if _, ok := fs.(registry.StatsReporter); ok {
+		caps = append(caps, "stats")
+	}
+	if _, ok := fs.(registry.CacheController); ok {
+		caps = append(caps, "cache")
+	}
+	if _, ok := fs.(registry.LogLeveler); ok {
+		caps = append(caps, "log-level")
+	}
+	return caps
+}
+
+func sortedKeys(m map[string]registry.CacheController) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodeBody decodes an optional JSON body, responding with an error if it
+// is malformed
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
+
+func respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func respondError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, map[string]string{"error": message})
+}
@@ -2,9 +2,13 @@ package engine
 
 import (
 	"fmt"
+	"io"
+	"reflect"
+	"sync"
 
 	"github.com/absfs/absfs"
 	"github.com/absfs/fscomposer/registry"
+	"github.com/absfs/fscomposer/sandbox"
 )
 
 // Builder constructs filesystem stacks from composition specs
@@ -12,6 +16,20 @@ type Builder struct {
 	spec     *CompositionSpec
 	registry *registry.Registry
 	built    map[string]absfs.FileSystem // Cache of built nodes
+	previous *Builder                    // Earlier build whose unchanged nodes are reused
+	reused   map[string]bool             // Nodes taken from the previous build
+	sandbox  bool                        // Wrap persistent backends in copy-on-write overlays
+	wrap     func(node *Node, fs absfs.FileSystem) absfs.FileSystem
+	secrets  SecretResolver // Resolves secret references in secret fields
+
+	mu      sync.Mutex   // Guards closers
+	closers []nodeCloser // Nodes owned by this build that hold resources, in build order
+}
+
+// nodeCloser is a node that holds resources, such as a cachefs flusher
+type nodeCloser struct {
+	id string
+	io.Closer
 }
 
 // NewBuilder creates a new builder for the given spec
@@ -20,9 +38,37 @@ func NewBuilder(spec *CompositionSpec) *Builder {
 		spec:     spec,
 		registry: registry.DefaultRegistry,
 		built:    make(map[string]absfs.FileSystem),
+		reused:   make(map[string]bool),
 	}
 }
 
+// NewBuilderFrom creates a builder that reuses the nodes of a previous build
+// whose type, config and inputs are unchanged. Used to hot-reload a running
+// composition without rebuilding (and losing the state of) every node.
+func NewBuilderFrom(spec *CompositionSpec, previous *Builder) *Builder {
+	b := NewBuilder(spec)
+	b.previous = previous
+	b.secrets = previous.secrets
+	return b
+}
+
+// NewSandboxBuilder creates a builder whose persistent backends are wrapped
+// in copy-on-write memory overlays. The stack reads their existing data but
+// nothing written through it reaches them, so specs pointing at production
+// storage can be test-built safely.
+func NewSandboxBuilder(spec *CompositionSpec) *Builder {
+	b := NewBuilder(spec)
+	b.sandbox = true
+	return b
+}
+
+// Instrument registers fn to wrap every node as it is built. Nodes above it
+// receive the wrapped filesystem as their input, so fn sees all traffic
+// between layers.
+func (b *Builder) Instrument(fn func(node *Node, fs absfs.FileSystem) absfs.FileSystem) {
+	b.wrap = fn
+}
+
 // Build constructs the complete filesystem stack
 // Returns the root filesystem (the one specified in mount.root)
 func (b *Builder) Build() (absfs.FileSystem, error) {
@@ -99,11 +145,38 @@ func (b *Builder) buildNode(nodeID string) (absfs.FileSystem, error) {
 		}
 	}
 
+	// Reuse the node from the previous build if nothing it depends on changed
+	if fs, ok := b.reusable(node); ok {
+		b.built[nodeID] = fs
+		b.reused[nodeID] = true
+		return fs, nil
+	}
+
 	// Construct the filesystem
-	fs, err := constructor(node.Config, underlying)
+	config, err := b.nodeConfig(node)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := constructor(config, underlying)
 	if err != nil {
 		return nil, fmt.Errorf("failed to construct node %s (%s): %w", nodeID, node.Type, err)
 	}
+	if c, ok := fs.(io.Closer); ok {
+		b.mu.Lock()
+		b.closers = append(b.closers, nodeCloser{id: nodeID, Closer: c})
+		b.mu.Unlock()
+	}
+
+	if b.sandbox && IsBackendNode(node.Type) && node.Type != NodeTypeMemFS {
+		fs, err = sandbox.New(fs)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", nodeID, err)
+		}
+	}
+
+	if b.wrap != nil {
+		fs = b.wrap(node, fs)
+	}
 
 	// Cache the built filesystem
 	b.built[nodeID] = fs
@@ -111,6 +184,99 @@ func (b *Builder) buildNode(nodeID string) (absfs.FileSystem, error) {
 	return fs, nil
 }
 
+// reusable returns the previously built filesystem for node if its type,
+// config and input are unchanged and its input was itself reused
+func (b *Builder) reusable(node *Node) (absfs.FileSystem, bool) {
+	if b.previous == nil || IsMultiplexerNode(node.Type) {
+		return nil, false
+	}
+
+	old := b.previous.spec.GetNode(node.ID)
+	fs, built := b.previous.built[node.ID]
+	if old == nil || !built || old.Type != node.Type || !reflect.DeepEqual(old.Config, node.Config) {
+		return nil, false
+	}
+
+	incoming := b.spec.GetIncomingConnections(node.ID)
+	oldIncoming := b.previous.spec.GetIncomingConnections(node.ID)
+	if len(incoming) != len(oldIncoming) {
+		return nil, false
+	}
+	for i := range incoming {
+		if incoming[i].From != oldIncoming[i].From || !b.reused[incoming[i].From] {
+			return nil, false
+		}
+	}
+
+	return fs, true
+}
+
+// Close releases the resources of the nodes this builder owns, top of the
+// stack first: the nodes it constructed and those handed over by Retire.
+// After a failed build it closes the nodes constructed so far.
+func (b *Builder) Close() error {
+	b.mu.Lock()
+	closers := b.closers
+	b.closers = nil
+	b.mu.Unlock()
+	return closeAll(closers)
+}
+
+// Retire hands the nodes next reused from b over to next and returns a
+// function closing the rest. Call it once next is serving, and the
+// function once b's stack is no longer in use.
+func (b *Builder) Retire(next *Builder) func() error {
+	b.mu.Lock()
+	var replaced, kept []nodeCloser
+	for _, c := range b.closers {
+		if next.reused[c.id] {
+			kept = append(kept, c)
+		} else {
+			replaced = append(replaced, c)
+		}
+	}
+	b.closers = nil
+	b.mu.Unlock()
+
+	next.mu.Lock()
+	next.closers = append(kept, next.closers...)
+	next.mu.Unlock()
+	return func() error { return closeAll(replaced) }
+}
+
+// closeAll closes nodes in reverse build order, returning the first error
+func closeAll(closers []nodeCloser) error {
+	var first error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Reused returns the IDs of nodes taken unchanged from the previous build
+func (b *Builder) Reused() []string {
+	var ids []string
+	for _, node := range b.spec.Nodes {
+		if b.reused[node.ID] {
+			ids = append(ids, node.ID)
+		}
+	}
+	return ids
+}
+
+// Rebuilt returns the IDs of nodes constructed by this build
+func (b *Builder) Rebuilt() []string {
+	var ids []string
+	for _, node := range b.spec.Nodes {
+		if _, ok := b.built[node.ID]; ok && !b.reused[node.ID] {
+			ids = append(ids, node.ID)
+		}
+	}
+	return ids
+}
+
 // GetBuiltNode returns a previously built node by ID
 func (b *Builder) GetBuiltNode(nodeID string) (absfs.FileSystem, bool) {
 	fs, ok := b.built[nodeID]
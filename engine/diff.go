@@ -0,0 +1,551 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/absfs/fscomposer/registry"
+)
+
+// Risk grades what applying a change does to a running mount and its data
+type Risk int
+
+const (
+	RiskSafe        Risk = iota // Nothing is rebuilt
+	RiskRebuild                 // Nodes are rebuilt on reload; caches start cold
+	RiskRemount                 // The frontend must be unmounted and mounted again
+	RiskDestructive             // Stored data becomes unreadable or is lost
+)
+
+var riskNames = []string{"safe", "rebuild", "remount", "destructive"}
+
+func (r Risk) String() string {
+	if int(r) < len(riskNames) {
+		return riskNames[r]
+	}
+	return fmt.Sprintf("risk(%d)", int(r))
+}
+
+// MarshalText encodes the risk by name
+func (r Risk) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes a risk name
+func (r *Risk) UnmarshalText(text []byte) error {
+	for i, name := range riskNames {
+		if name == string(text) {
+			*r = Risk(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown risk %q", text)
+}
+
+// ChangeKind says whether something was added, removed or changed
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "added"
+	ChangeRemoved ChangeKind = "removed"
+	ChangeChanged ChangeKind = "changed"
+)
+
+// Change is one semantic difference between two specs
+type Change struct {
+	Kind   ChangeKind  `json:"kind"`
+	Target string      `json:"target"` // spec, node, config, connection or mount
+	Node   string      `json:"node,omitempty"`
+	Field  string      `json:"field,omitempty"`
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+	Risk   Risk        `json:"risk"`
+	Reason string      `json:"reason,omitempty"` // Why the change is risky
+}
+
+// String describes the change on one line
+func (c Change) String() string {
+	switch c.Target {
+	case "node":
+		if c.Kind == ChangeChanged {
+			return fmt.Sprintf("node %s: type %v → %v", c.Node, c.Old, c.New)
+		}
+		typ := c.New
+		if c.Kind == ChangeRemoved {
+			typ = c.Old
+		}
+		return fmt.Sprintf("node %s (%v) %s", c.Node, typ, c.Kind)
+	case "config":
+		switch c.Kind {
+		case ChangeAdded:
+			return fmt.Sprintf("node %s: %s set to %s", c.Node, c.Field, formatValue(c.New))
+		case ChangeRemoved:
+			return fmt.Sprintf("node %s: %s unset (was %s)", c.Node, c.Field, formatValue(c.Old))
+		}
+		return fmt.Sprintf("node %s: %s %s → %s", c.Node, c.Field, formatValue(c.Old), formatValue(c.New))
+	case "connection":
+		return fmt.Sprintf("connection %s %s", c.Field, c.Kind)
+	case "mount", "spec":
+		return fmt.Sprintf("%s %s: %s → %s", c.Target, c.Field, formatValue(c.Old), formatValue(c.New))
+	}
+	return fmt.Sprintf("%s %s", c.Target, c.Kind)
+}
+
+// Plan lists the changes between two specs and what applying them takes
+type Plan struct {
+	Changes []Change `json:"changes"`
+	Rebuilt []string `json:"rebuilt"` // Nodes a hot reload rebuilds
+	Reused  []string `json:"reused"`  // Nodes a hot reload keeps
+	Risk    Risk     `json:"risk"`    // Highest risk of any change
+}
+
+// Empty reports whether the specs are equivalent
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// Destructive returns the changes that put stored data at risk
+func (p *Plan) Destructive() []Change {
+	var out []Change
+	for _, c := range p.Changes {
+		if c.Risk == RiskDestructive {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// formatFields are the config fields of data-transforming nodes that
+// decide how stored bytes are encoded. Changing any of them leaves data
+// written before the change unreadable.
+var formatFields = map[string][]string{
+	NodeTypeEncryptFS:  {"cipher", "algorithm", "password", "key", "keySource", "keyEnv", "kdfMemory", "kdfIterations", "encryptNames", "salt"},
+	NodeTypeCompressFS: {"algorithm"},
+}
+
+// locationFields are the config fields that choose where a backend keeps
+// its data
+var locationFields = map[string][]string{
+	NodeTypeOSFS:     {"root"},
+	NodeTypeS3FS:     {"bucket", "region", "endpoint", "prefix"},
+	NodeTypeSFTPFS:   {"host", "port", "root"},
+	NodeTypeWebDAVFS: {"url", "root"},
+	NodeTypeBoltFS:   {"path", "bucket"},
+	NodeTypeHTTPFS:   {"url"},
+}
+
+// transforms reports whether a node type changes the bytes it stores
+func transforms(nodeType string) bool {
+	_, ok := formatFields[nodeType]
+	return ok
+}
+
+// Diff compares two specs semantically. Node configs are compared with
+// schema defaults applied, so spelling out a default is not a change.
+func Diff(old, new *CompositionSpec) *Plan {
+	// A redacted side, such as the spec of a running composition, takes
+	// the other side's secrets so they do not show up as changes
+	old, _ = RestoreRedacted(old, new)
+	new, _ = RestoreRedacted(new, old)
+
+	plan := &Plan{Changes: []Change{}, Rebuilt: []string{}, Reused: []string{}}
+	add := func(c Change) {
+		plan.Changes = append(plan.Changes, c)
+		if c.Risk > plan.Risk {
+			plan.Risk = c.Risk
+		}
+	}
+
+	if old.Name != new.Name {
+		add(Change{Kind: ChangeChanged, Target: "spec", Field: "name", Old: old.Name, New: new.Name})
+	}
+	if old.Description != new.Description {
+		add(Change{Kind: ChangeChanged, Target: "spec", Field: "description", Old: old.Description, New: new.Description})
+	}
+
+	// Nodes present only in the old spec
+	for _, n := range old.Nodes {
+		if new.GetNode(n.ID) != nil {
+			continue
+		}
+		c := Change{Kind: ChangeRemoved, Target: "node", Node: n.ID, Old: n.Type, Risk: RiskRebuild}
+		switch {
+		case transforms(n.Type) && persistentBelow(old, n.ID):
+			c.Risk = RiskDestructive
+			c.Reason = fmt.Sprintf("data stored through %s is %s; without it existing files read as raw bytes", n.ID, transformVerb(n.Type))
+		case n.Type == NodeTypeMemFS:
+			c.Risk = RiskDestructive
+			c.Reason = "memfs contents are lost"
+		}
+		add(c)
+	}
+
+	// Nodes added or changed
+	for _, n := range new.Nodes {
+		prev := old.GetNode(n.ID)
+		if prev == nil {
+			c := Change{Kind: ChangeAdded, Target: "node", Node: n.ID, New: n.Type, Risk: RiskRebuild}
+			if transforms(n.Type) && persistentBelow(new, n.ID) && existedBelow(old, new, n.ID) {
+				c.Risk = RiskDestructive
+				c.Reason = fmt.Sprintf("files already stored below %s are not %s and will fail to read through it", n.ID, transformVerb(n.Type))
+			}
+			add(c)
+			continue
+		}
+
+		if prev.Type != n.Type {
+			c := Change{Kind: ChangeChanged, Target: "node", Node: n.ID, Old: prev.Type, New: n.Type, Risk: RiskRebuild}
+			switch {
+			case (transforms(prev.Type) || transforms(n.Type)) && persistentBelow(new, n.ID):
+				c.Risk = RiskDestructive
+				c.Reason = "stored data was written in a different format"
+			case prev.Type == NodeTypeMemFS:
+				c.Risk = RiskDestructive
+				c.Reason = "memfs contents are lost"
+			case IsBackendNode(prev.Type) || IsBackendNode(n.Type):
+				c.Reason = fmt.Sprintf("data stored in %s is no longer visible through the mount", prev.Type)
+			}
+			add(c)
+			continue
+		}
+
+		for _, c := range diffConfig(new, prev, &n) {
+			add(c)
+		}
+	}
+
+	// Edges, including the backends multiplexers reference in config
+	oldEdges, newEdges := edgeSet(old), edgeSet(new)
+	for _, key := range sortedKeys(oldEdges) {
+		if _, ok := newEdges[key]; !ok {
+			add(edgeChange(ChangeRemoved, old, new, oldEdges[key]))
+		}
+	}
+	for _, key := range sortedKeys(newEdges) {
+		if _, ok := oldEdges[key]; !ok {
+			add(edgeChange(ChangeAdded, old, new, newEdges[key]))
+		}
+	}
+
+	diffMount(old.Mount, new.Mount, add)
+
+	plan.Rebuilt, plan.Reused = reloadPlan(old, new)
+	return plan
+}
+
+// diffConfig compares the resolved config of a node present in both specs
+func diffConfig(newSpec *CompositionSpec, old, new *Node) []Change {
+	oldConfig := resolvedConfig(old)
+	newConfig := resolvedConfig(new)
+
+	keys := make(map[string]bool)
+	for k := range oldConfig {
+		keys[k] = true
+	}
+	for k := range newConfig {
+		keys[k] = true
+	}
+
+	var changes []Change
+	for _, k := range sortedKeys(keys) {
+		ov, inOld := oldConfig[k]
+		nv, inNew := newConfig[k]
+		if inOld && inNew && reflect.DeepEqual(normalize(ov), normalize(nv)) {
+			continue
+		}
+
+		c := Change{Kind: ChangeChanged, Target: "config", Node: new.ID, Field: k, Old: ov, New: nv, Risk: RiskRebuild}
+		switch {
+		case !inOld:
+			c.Kind = ChangeAdded
+		case !inNew:
+			c.Kind = ChangeRemoved
+		}
+
+		if IsSecretField(new.Type, k) {
+			c.Old, c.New = redact(ov, inOld), redact(nv, inNew)
+		}
+
+		switch {
+		case new.Type == NodeTypeMemFS:
+			c.Risk = RiskDestructive
+			c.Reason = "memfs is rebuilt empty"
+		case contains(formatFields[new.Type], k) && persistentBelow(newSpec, new.ID):
+			c.Risk = RiskDestructive
+			c.Reason = fmt.Sprintf("data already stored through %s cannot be read with the new %s", new.ID, k)
+		case contains(locationFields[new.Type], k):
+			c.Reason = fmt.Sprintf("data stored at the old %s is no longer visible through the mount", k)
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// edgeChange describes an added or removed edge. Putting a transforming
+// node over a different persistent input is destructive: the data there
+// was not written through it.
+func edgeChange(kind ChangeKind, old, new *CompositionSpec, e Edge) Change {
+	field := e.From + " → " + e.To
+	if e.Label != "" {
+		field += " [" + e.Label + "]"
+	}
+	c := Change{Kind: kind, Target: "connection", Node: e.To, Field: field, Risk: RiskRebuild}
+	if kind == ChangeAdded {
+		to := new.GetNode(e.To)
+		if to != nil && transforms(to.Type) && old.GetNode(e.To) != nil && persistentBelow(new, e.To) {
+			c.Risk = RiskDestructive
+			c.Reason = fmt.Sprintf("%s now reads data that was not %s by it", e.To, transformVerb(to.Type))
+		}
+	}
+	return c
+}
+
+// diffMount reports changes to the mount section. Only the root can change
+// on a running mount.
+func diffMount(old, new MountConfig, add func(Change)) {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"type", old.Type, new.Type},
+		{"path", old.Path, new.Path},
+		{"port", old.Port, new.Port},
+		{"export", old.Export, new.Export},
+		{"options", normalize(toInterfaceMap(old.Options)), normalize(toInterfaceMap(new.Options))},
+	}
+	display := map[string][2]interface{}{
+		"options": {redactOptions(copyValue(old.Options)), redactOptions(copyValue(new.Options))},
+	}
+	if old.Root != new.Root {
+		add(Change{Kind: ChangeChanged, Target: "mount", Field: "root", Old: old.Root, New: new.Root, Risk: RiskRebuild})
+	}
+	for _, f := range fields {
+		if reflect.DeepEqual(f.old, f.new) {
+			continue
+		}
+		c := Change{Kind: ChangeChanged, Target: "mount", Field: f.name, Old: f.old, New: f.new, Risk: RiskRemount,
+			Reason: "mount settings other than the root need an unmount and mount"}
+		if d, ok := display[f.name]; ok {
+			c.Old, c.New = d[0], d[1]
+		}
+		add(c)
+	}
+}
+
+// reloadPlan predicts which nodes a hot reload rebuilds, following the
+// same rules as NewBuilderFrom: a node is reused when its type, config and
+// inputs are unchanged and its inputs are reused; multiplexers are always
+// rebuilt.
+func reloadPlan(old, new *CompositionSpec) (rebuilt, reused []string) {
+	state := make(map[string]bool) // Node ID to reused
+	var visit func(id string, seen map[string]bool) bool
+	visit = func(id string, seen map[string]bool) bool {
+		if r, ok := state[id]; ok {
+			return r
+		}
+		if seen[id] {
+			return false
+		}
+		seen[id] = true
+
+		n, prev := new.GetNode(id), old.GetNode(id)
+		reuse := n != nil && prev != nil && !IsMultiplexerNode(n.Type) &&
+			prev.Type == n.Type && reflect.DeepEqual(prev.Config, n.Config)
+
+		incoming := new.GetIncomingConnections(id)
+		oldIncoming := old.GetIncomingConnections(id)
+		if len(incoming) != len(oldIncoming) {
+			reuse = false
+		}
+		for i, conn := range incoming {
+			inputReused := visit(conn.From, seen)
+			if !reuse {
+				continue
+			}
+			if conn.From != oldIncoming[i].From || !inputReused {
+				reuse = false
+			}
+		}
+		state[id] = reuse
+		return reuse
+	}
+
+	rebuilt, reused = []string{}, []string{}
+	for _, n := range new.Nodes {
+		if visit(n.ID, make(map[string]bool)) {
+			reused = append(reused, n.ID)
+		} else {
+			rebuilt = append(rebuilt, n.ID)
+		}
+	}
+	return rebuilt, reused
+}
+
+// persistentBelow reports whether a node sits, directly or through other
+// nodes, on a backend that keeps data across restarts
+func persistentBelow(spec *CompositionSpec, id string) bool {
+	seen := make(map[string]bool)
+	var walk func(id string) bool
+	walk = func(id string) bool {
+		if seen[id] {
+			return false
+		}
+		seen[id] = true
+		n := spec.GetNode(id)
+		if n == nil {
+			return false
+		}
+		if IsBackendNode(n.Type) {
+			return n.Type != NodeTypeMemFS
+		}
+		for _, e := range spec.Edges() {
+			if e.To == id && walk(e.From) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(id)
+}
+
+// existedBelow reports whether any node a newly added node reads from was
+// already part of the old spec, so it may hold data
+func existedBelow(old, new *CompositionSpec, id string) bool {
+	for _, e := range new.Edges() {
+		if e.To == id && old.GetNode(e.From) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func transformVerb(nodeType string) string {
+	if nodeType == NodeTypeCompressFS {
+		return "compressed"
+	}
+	return "encrypted"
+}
+
+// resolvedConfig returns a node's config with schema defaults applied, or
+// the raw config for types without a schema
+func resolvedConfig(n *Node) map[string]interface{} {
+	config, err := registry.ResolveConfig(n.Type, n.Config)
+	if err != nil {
+		config = n.Config
+	}
+	if config == nil {
+		config = map[string]interface{}{}
+	}
+	return config
+}
+
+// sensitive reports whether a config field holds a credential whose value
+// must not be printed
+func sensitive(field string) bool {
+	f := strings.ToLower(field)
+	if strings.HasSuffix(f, "env") {
+		return false
+	}
+	return strings.Contains(f, "password") || strings.Contains(f, "secret") || strings.Contains(f, "token") || f == "key"
+}
+
+func redact(v interface{}, present bool) interface{} {
+	if !present {
+		return nil
+	}
+	return "(redacted)"
+}
+
+// edgeSet keys the edges of a spec by endpoints and label
+func edgeSet(spec *CompositionSpec) map[string]Edge {
+	set := make(map[string]Edge)
+	for _, e := range spec.Edges() {
+		set[e.From+"\x00"+e.To+"\x00"+e.Label] = e
+	}
+	return set
+}
+
+// normalize makes values decoded from YAML and JSON comparable: whole
+// floats become ints and nested maps get string keys
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[k] = normalize(val)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[fmt.Sprint(k)] = normalize(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = normalize(val)
+		}
+		return out
+	}
+	return v
+}
+
+// toInterfaceMap treats a nil map as empty, so an absent section and an
+// empty one compare equal
+func toInterfaceMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "(unset)"
+	case string:
+		if v == "" {
+			return `""`
+		}
+		return v
+	case map[string]interface{}, []interface{}:
+		s := fmt.Sprintf("%v", v)
+		if len(s) > 60 {
+			s = s[:57] + "..."
+		}
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
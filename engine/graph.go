@@ -0,0 +1,68 @@
+package engine
+
+import "fmt"
+
+// Edge is a data flow edge between two nodes: To reads and writes through
+// From. Connections become plain edges; the backends a multiplexer names
+// in its config become edges marked Config.
+type Edge struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Label  string `json:"label,omitempty"`  // Route pattern or layer for config edges
+	Config bool   `json:"config,omitempty"` // Referenced in config rather than connected
+}
+
+// Edges returns every edge of the composition graph: the connections in
+// spec order followed by the config references of multiplexer nodes
+func (spec *CompositionSpec) Edges() []Edge {
+	edges := make([]Edge, 0, len(spec.Connections))
+	for _, conn := range spec.Connections {
+		edges = append(edges, Edge{From: conn.From, To: conn.To})
+	}
+	for _, node := range spec.Nodes {
+		edges = append(edges, spec.ConfigReferences(node.ID)...)
+	}
+	return edges
+}
+
+// ConfigReferences returns the edges from the nodes a multiplexer
+// references in its config: switchfs routes and default, unionfs layers.
+// References to unknown nodes are left to the validator.
+func (spec *CompositionSpec) ConfigReferences(nodeID string) []Edge {
+	node := spec.GetNode(nodeID)
+	if node == nil || !IsMultiplexerNode(node.Type) || node.Config == nil {
+		return nil
+	}
+
+	var edges []Edge
+	add := func(target interface{}, label string) {
+		if id, ok := target.(string); ok && id != "" {
+			edges = append(edges, Edge{From: id, To: nodeID, Label: label, Config: true})
+		}
+	}
+
+	switch node.Type {
+	case NodeTypeSwitchFS:
+		routes, _ := node.Config["routes"].([]interface{})
+		for _, route := range routes {
+			if m, ok := route.(map[string]interface{}); ok {
+				pattern, _ := m["pattern"].(string)
+				add(m["target"], pattern)
+			}
+		}
+		add(node.Config["default"], "default")
+	case NodeTypeUnionFS:
+		layers, _ := node.Config["layers"].([]interface{})
+		for i, layer := range layers {
+			label := fmt.Sprintf("layer %d", i)
+			if m, ok := layer.(map[string]interface{}); ok {
+				if mode, ok := m["mode"].(string); ok {
+					label = fmt.Sprintf("%s (%s)", label, mode)
+				}
+				layer = m["target"]
+			}
+			add(layer, label)
+		}
+	}
+	return edges
+}
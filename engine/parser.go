@@ -2,6 +2,7 @@ package engine
 
 import (
 	"fmt"
+	"math"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -27,6 +28,39 @@ func Parse(data []byte) (*CompositionSpec, error) {
 	return &spec, nil
 }
 
+// MarshalYAML writes whole numbers decoded from JSON as float64 as
+// integers, so specs created through the API format like hand-written
+// ones and Parse reads them back as it would a file
+func (spec CompositionSpec) MarshalYAML() (interface{}, error) {
+	type plain CompositionSpec // Without this method
+	out := copySpec(&spec)
+	for i := range out.Nodes {
+		out.Nodes[i].Config, _ = wholeNumbers(out.Nodes[i].Config).(map[string]interface{})
+	}
+	out.Mount.Options, _ = wholeNumbers(out.Mount.Options).(map[string]interface{})
+	return plain(*out), nil
+}
+
+// wholeNumbers converts integral float64 values in a copied config value
+// to int
+func wholeNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case float64:
+		if val == math.Trunc(val) && math.Abs(val) <= 1<<53 {
+			return int(val)
+		}
+	case map[string]interface{}:
+		for k, child := range val {
+			val[k] = wholeNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range val {
+			val[i] = wholeNumbers(child)
+		}
+	}
+	return v
+}
+
 // Validate performs basic validation on the spec
 func (spec *CompositionSpec) Validate() error {
 	if spec.Version == "" {
@@ -0,0 +1,319 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is one JSON Patch (RFC 6902) operation on a spec, such as
+// {"op": "replace", "path": "/nodes/1/config/maxBytes", "value": 1024}
+type PatchOp struct {
+	Op    string      `json:"op" yaml:"op"` // add, remove, replace, move, copy or test
+	Path  string      `json:"path" yaml:"path"`
+	From  string      `json:"from,omitempty" yaml:"from,omitempty"` // Source of move and copy
+	Value interface{} `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+// ApplyPatch applies ops to a copy of spec in order. Either every
+// operation applies or an error names the first that failed. Paths refer
+// to the spec's JSON form, and the result must still decode as a spec.
+func ApplyPatch(spec *CompositionSpec, ops []PatchOp) (*CompositionSpec, error) {
+	doc, err := specDoc(spec)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if doc, err = applyOp(doc, op); err != nil {
+			return nil, fmt.Errorf("op %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return docSpec(doc, true)
+}
+
+// RedactPatch returns ops with every value that sets a secret field
+// replaced by Redacted, as they appear to clients shown redacted specs.
+// spec is the spec the ops were applied to.
+func RedactPatch(spec *CompositionSpec, ops []PatchOp) []PatchOp {
+	out := make([]PatchOp, len(ops))
+	doc, err := specDoc(spec)
+	for i, op := range ops {
+		out[i] = op
+		if err == nil {
+			doc, err = applyOp(doc, op)
+		}
+		if op.Op != "add" && op.Op != "replace" {
+			continue
+		}
+		// Take the value from a redacted copy of the spec as it stood
+		// after the op
+		out[i].Value = Redacted
+		if err != nil {
+			continue
+		}
+		applied, derr := docSpec(doc, false)
+		if derr != nil {
+			continue
+		}
+		redacted, derr := specDoc(RedactSpec(applied))
+		if derr != nil {
+			continue
+		}
+		if v, gerr := docGet(redacted, appliedPath(doc, op.Path)); gerr == nil {
+			out[i].Value = v
+		}
+	}
+	return out
+}
+
+// specDoc converts a spec to its generic JSON form
+func specDoc(spec *CompositionSpec) (interface{}, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	return doc, json.Unmarshal(data, &doc)
+}
+
+// docSpec converts a generic JSON document back to a spec. Strict
+// decoding rejects fields a spec does not have.
+func docSpec(doc interface{}, strict bool) (*CompositionSpec, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	var spec CompositionSpec
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("patched spec is malformed: %w", err)
+	}
+	return &spec, nil
+}
+
+func applyOp(doc interface{}, op PatchOp) (interface{}, error) {
+	switch op.Op {
+	case "add":
+		return docAdd(doc, op.Path, copyValue(op.Value))
+	case "remove":
+		_, doc, err := docRemove(doc, op.Path)
+		return doc, err
+	case "replace":
+		if _, err := docGet(doc, op.Path); err != nil {
+			return nil, err
+		}
+		if op.Path == "" {
+			return copyValue(op.Value), nil
+		}
+		return docUpdate(doc, op.Path, func(parent interface{}, key string) (interface{}, error) {
+			switch p := parent.(type) {
+			case map[string]interface{}:
+				p[key] = copyValue(op.Value)
+			case []interface{}:
+				i, _ := arrayIndex(key, len(p), false)
+				p[i] = copyValue(op.Value)
+			}
+			return parent, nil
+		})
+	case "move":
+		if op.Path == op.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("cannot move %s into itself", op.From)
+		}
+		v, doc, err := docRemove(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return docAdd(doc, op.Path, v)
+	case "copy":
+		v, err := docGet(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		return docAdd(doc, op.Path, copyValue(v))
+	case "test":
+		v, err := docGet(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(v, op.Value) {
+			return nil, fmt.Errorf("test failed: value is %v", v)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// pointer splits a JSON pointer into unescaped reference tokens
+func pointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token. "-" and len are only valid
+// when adding.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > length || (i == length && !adding) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+func docGet(doc interface{}, path string) (interface{}, error) {
+	tokens, err := pointer(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", path)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("%s does not exist", path)
+		}
+	}
+	return doc, nil
+}
+
+// docUpdate calls fn with the container holding the last token of path
+// and the token, and returns doc with the container fn returns in its
+// place
+func docUpdate(doc interface{}, path string, fn func(parent interface{}, key string) (interface{}, error)) (interface{}, error) {
+	tokens, err := pointer(path)
+	if err != nil {
+		return nil, err
+	}
+	var walk func(node interface{}, tokens []string) (interface{}, error)
+	walk = func(node interface{}, tokens []string) (interface{}, error) {
+		if len(tokens) == 1 {
+			return fn(node, tokens[0])
+		}
+		switch c := node.(type) {
+		case map[string]interface{}:
+			child, ok := c[tokens[0]]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", path)
+			}
+			updated, err := walk(child, tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			c[tokens[0]] = updated
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(tokens[0], len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			updated, err := walk(c[i], tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			c[i] = updated
+			return c, nil
+		}
+		return nil, fmt.Errorf("%s does not exist", path)
+	}
+	return walk(doc, tokens)
+}
+
+func docAdd(doc interface{}, path string, value interface{}) (interface{}, error) {
+	if path == "" {
+		return value, nil
+	}
+	return docUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[key] = value
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("parent of %s is not an object or array", path)
+	})
+}
+
+// docRemove removes the value at path and returns it
+func docRemove(doc interface{}, path string) (interface{}, interface{}, error) {
+	if path == "" {
+		return nil, nil, fmt.Errorf("cannot remove the whole spec")
+	}
+	var removed interface{}
+	doc, err := docUpdate(doc, path, func(parent interface{}, key string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			v, ok := p[key]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", path)
+			}
+			removed = v
+			delete(p, key)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%s does not exist", path)
+	})
+	return removed, doc, err
+}
+
+// appliedPath resolves a trailing "-" in an add path to the index the
+// value was appended at
+func appliedPath(doc interface{}, path string) string {
+	if !strings.HasSuffix(path, "/-") {
+		return path
+	}
+	parent := strings.TrimSuffix(path, "/-")
+	if arr, err := docGet(doc, parent); err == nil {
+		if a, ok := arr.([]interface{}); ok {
+			return parent + "/" + strconv.Itoa(len(a)-1)
+		}
+	}
+	return path
+}
@@ -0,0 +1,269 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/absfs/fscomposer/registry"
+)
+
+// Redacted replaces secret values in specs shown to users. Sending it back
+// in place of a value keeps the value the composition already had.
+const Redacted = "********"
+
+// SecretRefPrefix marks a config value that names a secret kept outside
+// the spec, such as "secret:vault/encrypt.password#3f2a"
+const SecretRefPrefix = "secret:"
+
+// SecretResolver returns the value of a named secret
+type SecretResolver func(name string) (string, error)
+
+// SecretRef returns the config value referring to a named secret
+func SecretRef(name string) string {
+	return SecretRefPrefix + name
+}
+
+// ParseSecretRef returns the secret a config value refers to
+func ParseSecretRef(v interface{}) (string, bool) {
+	s, ok := v.(string)
+	if !ok || !strings.HasPrefix(s, SecretRefPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(s, SecretRefPrefix), true
+}
+
+// IsSecretField reports whether a node config field holds a secret: the
+// node type's schema marks it secret, or its name looks like a credential
+func IsSecretField(nodeType, field string) bool {
+	return registry.IsSecret(nodeType, field) || sensitive(field)
+}
+
+// RedactSpec returns a copy of spec with the values of secret node fields
+// and credential-like mount options replaced by Redacted
+func RedactSpec(spec *CompositionSpec) *CompositionSpec {
+	if spec == nil {
+		return nil
+	}
+	out, _ := MapSecrets(spec, redactValue)
+	return out
+}
+
+func redactValue(string, interface{}) (interface{}, error) {
+	return Redacted, nil
+}
+
+// redactOptions replaces credential-like values in nested mount options
+func redactOptions(v interface{}) interface{} {
+	v, _ = mapOptions(v, "mount.options", redactValue)
+	return v
+}
+
+// MapSecrets returns a copy of spec in which every value RedactSpec
+// redacts, secret node fields and credential-like mount options, is
+// replaced by what fn returns for it. place names the value, such as
+// "encrypt.password" or "mount.options.users[0].password".
+func MapSecrets(spec *CompositionSpec, fn func(place string, v interface{}) (interface{}, error)) (*CompositionSpec, error) {
+	out := copySpec(spec)
+	for i := range out.Nodes {
+		node := &out.Nodes[i]
+		for k, v := range node.Config {
+			if v == nil || v == "" || !IsSecretField(node.Type, k) {
+				continue
+			}
+			mapped, err := fn(node.ID+"."+k, v)
+			if err != nil {
+				return nil, err
+			}
+			node.Config[k] = mapped
+		}
+	}
+	options, err := mapOptions(out.Mount.Options, "mount.options", fn)
+	if err != nil {
+		return nil, err
+	}
+	out.Mount.Options, _ = options.(map[string]interface{})
+	return out, nil
+}
+
+// mapOptions applies fn to the credential-like values in nested mount
+// options
+func mapOptions(v interface{}, place string, fn func(string, interface{}) (interface{}, error)) (interface{}, error) {
+	var err error
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if child != nil && child != "" && sensitive(k) {
+				val[k], err = fn(place+"."+k, child)
+			} else {
+				val[k], err = mapOptions(child, place+"."+k, fn)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, child := range val {
+			if val[i], err = mapOptions(child, fmt.Sprintf("%s[%d]", place, i), fn); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// ResolveMountSecrets returns a copy of spec whose mount options hold the
+// values of the secrets they refer to, for starting its frontend
+func ResolveMountSecrets(spec *CompositionSpec, fn SecretResolver) (*CompositionSpec, error) {
+	out := copySpec(spec)
+	options, err := mapOptions(out.Mount.Options, "mount.options", func(place string, v interface{}) (interface{}, error) {
+		name, ok := ParseSecretRef(v)
+		if !ok {
+			return v, nil
+		}
+		if fn == nil {
+			return nil, fmt.Errorf("%s refers to a secret but no secret store is available", place)
+		}
+		value, err := fn(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", place, err)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Mount.Options, _ = options.(map[string]interface{})
+	return out, nil
+}
+
+// RestoreRedacted returns a copy of spec in which every Redacted value is
+// replaced by the value at the same place in from, the spec it was shown
+// from. It also returns the places it could not restore.
+func RestoreRedacted(spec, from *CompositionSpec) (*CompositionSpec, []string) {
+	out := copySpec(spec)
+	var missing []string
+
+	for i := range out.Nodes {
+		node := &out.Nodes[i]
+		var prev map[string]interface{}
+		if from != nil {
+			if n := from.GetNode(node.ID); n != nil && n.Type == node.Type {
+				prev = n.Config
+			}
+		}
+		for k, v := range node.Config {
+			if v != Redacted {
+				continue
+			}
+			if old, ok := prev[k]; ok && old != Redacted {
+				node.Config[k] = old
+			} else {
+				missing = append(missing, fmt.Sprintf("node %s: %s", node.ID, k))
+			}
+		}
+	}
+
+	var prevOptions interface{}
+	if from != nil {
+		prevOptions = from.Mount.Options
+	}
+	restored := restoreOptions(out.Mount.Options, prevOptions, "mount.options", &missing)
+	out.Mount.Options, _ = restored.(map[string]interface{})
+	return out, missing
+}
+
+func restoreOptions(v, prev interface{}, path string, missing *[]string) interface{} {
+	switch val := v.(type) {
+	case string:
+		if val != Redacted {
+			return val
+		}
+		if prev != nil && prev != Redacted {
+			return prev
+		}
+		*missing = append(*missing, path)
+	case map[string]interface{}:
+		p, _ := prev.(map[string]interface{})
+		for k, child := range val {
+			val[k] = restoreOptions(child, p[k], path+"."+k, missing)
+		}
+	case []interface{}:
+		p, _ := prev.([]interface{})
+		for i, child := range val {
+			var pc interface{}
+			if i < len(p) {
+				pc = p[i]
+			}
+			val[i] = restoreOptions(child, pc, fmt.Sprintf("%s[%d]", path, i), missing)
+		}
+	}
+	return v
+}
+
+// ResolveSecrets makes the builder replace secret references in secret
+// fields with their values as nodes are constructed. The values are
+// never written back to the spec.
+func (b *Builder) ResolveSecrets(fn SecretResolver) {
+	b.secrets = fn
+}
+
+// nodeConfig returns the config a node is constructed with, with secret
+// references resolved
+func (b *Builder) nodeConfig(node *Node) (map[string]interface{}, error) {
+	config, copied := node.Config, false
+	for k, v := range node.Config {
+		name, ok := ParseSecretRef(v)
+		if !ok || !IsSecretField(node.Type, k) {
+			continue
+		}
+		if b.secrets == nil {
+			return nil, fmt.Errorf("node %s: %s refers to a secret but no secret store is available", node.ID, k)
+		}
+		value, err := b.secrets(name)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %s: %w", node.ID, k, err)
+		}
+		if !copied {
+			config, copied = make(map[string]interface{}, len(node.Config)), true
+			for ck, cv := range node.Config {
+				config[ck] = cv
+			}
+		}
+		config[k] = value
+	}
+	return config, nil
+}
+
+// copySpec deep-copies a spec's nodes and mount options
+func copySpec(spec *CompositionSpec) *CompositionSpec {
+	out := *spec
+	out.Nodes = make([]Node, len(spec.Nodes))
+	for i, n := range spec.Nodes {
+		n.Config, _ = copyValue(n.Config).(map[string]interface{})
+		out.Nodes[i] = n
+	}
+	out.Connections = append([]Connection(nil), spec.Connections...)
+	out.Mount.Options, _ = copyValue(spec.Mount.Options).(map[string]interface{})
+	return &out
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if val == nil {
+			return val
+		}
+		m := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			m[k] = copyValue(child)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(val))
+		for i, child := range val {
+			s[i] = copyValue(child)
+		}
+		return s
+	}
+	return v
+}
@@ -27,7 +27,7 @@ type Connection struct {
 
 // MountConfig specifies how the composed filesystem should be mounted
 type MountConfig struct {
-	Type    string                 `yaml:"type" json:"type"` // fuse, webdav, nfs, api
+	Type    string                 `yaml:"type" json:"type"` // fuse, webdav, nfs, api, sftp, s3
 	Path    string                 `yaml:"path,omitempty" json:"path,omitempty"`
 	Port    int                    `yaml:"port,omitempty" json:"port,omitempty"`
 	Root    string                 `yaml:"root" json:"root"` // Node ID to mount
@@ -59,6 +59,16 @@ const (
 	NodeTypeLogFS     = "logfs"
 )
 
+// MountType constants for the supported mount frontends
+const (
+	MountTypeFUSE   = "fuse"
+	MountTypeWebDAV = "webdav"
+	MountTypeNFS    = "nfs"
+	MountTypeAPI    = "api"
+	MountTypeSFTP   = "sftp"
+	MountTypeS3     = "s3"
+)
+
 // IsBackendNode returns true if the node type is a backend (data source)
 func IsBackendNode(nodeType string) bool {
 	backends := []string{
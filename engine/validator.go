@@ -2,11 +2,14 @@ package engine
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 )
 
 // Validator performs advanced validation on composition specs
 type Validator struct {
-	spec *CompositionSpec
+	spec          *CompositionSpec
+	allowRedacted bool
 }
 
 // NewValidator creates a new validator for the given spec
@@ -14,6 +17,14 @@ func NewValidator(spec *CompositionSpec) *Validator {
 	return &Validator{spec: spec}
 }
 
+// AllowRedacted accepts Redacted in place of secret values, for specs
+// sent back to the server, which restores them from the stored
+// composition before anything is built
+func (v *Validator) AllowRedacted() *Validator {
+	v.allowRedacted = true
+	return v
+}
+
 // ValidateAll performs all validation checks
 func (v *Validator) ValidateAll() error {
 	// Basic validation first
@@ -36,9 +47,61 @@ func (v *Validator) ValidateAll() error {
 		return err
 	}
 
+	// Redacted secrets would be used as the secrets themselves
+	if err := v.ValidateSecrets(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// Diagnostic is one problem found by Diagnose
+type Diagnostic struct {
+	Check   string `json:"check" yaml:"check"` // spec, cycles, connections, config or secrets
+	Message string `json:"message" yaml:"message"`
+}
+
+// Diagnose runs every validation check and reports each failure, instead
+// of stopping at the first one like ValidateAll. The later checks assume
+// the spec is well formed, so they only run when the basic check passes.
+func (v *Validator) Diagnose() []Diagnostic {
+	if err := v.spec.Validate(); err != nil {
+		return []Diagnostic{{Check: "spec", Message: err.Error()}}
+	}
+
+	var diags []Diagnostic
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"cycles", v.DetectCycles},
+		{"connections", v.ValidateConnectionTypes},
+		{"config", v.ValidateNodeConfigs},
+		{"secrets", v.ValidateSecrets},
+	}
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			diags = append(diags, Diagnostic{Check: c.name, Message: err.Error()})
+		}
+	}
+	return diags
+}
+
+// ValidateSecrets checks that no value is the Redacted placeholder, as in
+// a spec exported from the server. Building such a spec would, for
+// example, encrypt data with "********" as the password.
+func (v *Validator) ValidateSecrets() error {
+	if v.allowRedacted {
+		return nil
+	}
+	_, redacted := RestoreRedacted(v.spec, nil)
+	if len(redacted) == 0 {
+		return nil
+	}
+	sort.Strings(redacted)
+	return fmt.Errorf("%s: redacted secret values must be filled in", strings.Join(redacted, ", "))
+}
+
 // DetectCycles checks for cycles in the connection graph
 func (v *Validator) DetectCycles() error {
 	visited := make(map[string]bool)
@@ -0,0 +1,362 @@
+package frontend
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+)
+
+// FUSEConfig configures a FUSE mount
+type FUSEConfig struct {
+	Mountpoint         string
+	FSName             string // Name shown in the mount table
+	ReadOnly           bool
+	AllowOther         bool // Requires user_allow_other in /etc/fuse.conf
+	AllowRoot          bool
+	DefaultPermissions bool // Let the kernel enforce permission bits
+	UID                uint32
+	GID                uint32
+	Umask              os.FileMode
+	AttrTimeout        time.Duration // Kernel attribute cache timeout
+	EntryTimeout       time.Duration // Kernel directory entry cache timeout
+	AttrCacheTTL       time.Duration // User-space attribute cache
+	DirCacheTTL        time.Duration // User-space directory listing cache
+	DirectIO           bool
+	MaxReadahead       uint32
+	MaxWrite           uint32
+	Debug              bool     // Log every FUSE request
+	Options            []string // Extra raw FUSE mount options
+}
+
+// FUSEConfigFromSpec reads the FUSE mount configuration from a spec. The
+// mountpoint argument overrides mount.path when not empty.
+//
+//	mount:
+//	  type: fuse
+//	  path: /mnt/data
+//	  root: cache
+//	  options:
+//	    allowOther: true
+//	    readOnly: false
+//	    uid: 1000
+//	    gid: 1000
+//	    umask: "0022"
+//	    attrTimeout: 5      # seconds, or a duration such as "500ms"
+//	    entryTimeout: 5
+//	    debug: false
+func FUSEConfigFromSpec(spec *engine.CompositionSpec, mountpoint string) (*FUSEConfig, error) {
+	opts := spec.Mount.Options
+	if opts == nil {
+		opts = map[string]interface{}{}
+	}
+
+	if mountpoint == "" {
+		mountpoint = spec.Mount.Path
+	}
+	if mountpoint == "" {
+		return nil, fmt.Errorf("no mountpoint given and mount.path is not set")
+	}
+
+	fsName := spec.Name
+	if spec.Description != "" {
+		fsName = spec.Name + " - " + spec.Description
+	}
+
+	// Defaults match fusefs.DefaultMountOptions
+	cfg := &FUSEConfig{
+		Mountpoint:         mountpoint,
+		FSName:             fsName,
+		DefaultPermissions: true,
+		AttrTimeout:        time.Second,
+		EntryTimeout:       time.Second,
+		AttrCacheTTL:       5 * time.Second,
+		DirCacheTTL:        5 * time.Second,
+		MaxReadahead:       128 * 1024,
+		MaxWrite:           128 * 1024,
+	}
+
+	name, err := optString(opts, "fsName")
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		cfg.FSName = name
+	}
+
+	bools := []struct {
+		key string
+		dst *bool
+	}{
+		{"readOnly", &cfg.ReadOnly},
+		{"allowOther", &cfg.AllowOther},
+		{"allowRoot", &cfg.AllowRoot},
+		{"defaultPermissions", &cfg.DefaultPermissions},
+		{"directIO", &cfg.DirectIO},
+		{"debug", &cfg.Debug},
+	}
+	for _, b := range bools {
+		if *b.dst, err = optBool(opts, b.key, *b.dst); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AllowOther && cfg.AllowRoot {
+		return nil, fmt.Errorf("options 'allowOther' and 'allowRoot' are mutually exclusive")
+	}
+
+	uints := []struct {
+		key string
+		dst *uint32
+	}{
+		{"uid", &cfg.UID},
+		{"gid", &cfg.GID},
+		{"maxReadahead", &cfg.MaxReadahead},
+		{"maxWrite", &cfg.MaxWrite},
+	}
+	for _, u := range uints {
+		n, err := optInt(opts, u.key, int(*u.dst))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("option '%s' must not be negative", u.key)
+		}
+		*u.dst = uint32(n)
+	}
+
+	durations := []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"attrTimeout", &cfg.AttrTimeout},
+		{"entryTimeout", &cfg.EntryTimeout},
+		{"attrCacheTTL", &cfg.AttrCacheTTL},
+		{"dirCacheTTL", &cfg.DirCacheTTL},
+	}
+	for _, d := range durations {
+		if *d.dst, err = optDuration(opts, d.key, *d.dst); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Umask, err = optUmask(opts, "umask"); err != nil {
+		return nil, err
+	}
+
+	if raw, ok := opts["options"]; ok {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("option 'options' must be a list of strings")
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("option 'options' must be a list of strings")
+			}
+			cfg.Options = append(cfg.Options, s)
+		}
+	}
+
+	return cfg, nil
+}
+
+// optDuration reads a duration given in seconds or as a Go duration string
+func optDuration(opts map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	v, ok := opts[key]
+	if !ok || v == nil {
+		return def, nil
+	}
+	switch d := v.(type) {
+	case int:
+		return time.Duration(d) * time.Second, nil
+	case float64:
+		return time.Duration(d * float64(time.Second)), nil
+	case string:
+		parsed, err := time.ParseDuration(d)
+		if err != nil {
+			return 0, fmt.Errorf("option '%s': %w", key, err)
+		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("option '%s' must be a number of seconds or a duration", key)
+	}
+}
+
+// optUmask reads a permission mask given as an octal string ("0022") or a
+// number. YAML reads 0022 as octal already; JSON numbers are taken as-is.
+func optUmask(opts map[string]interface{}, key string) (os.FileMode, error) {
+	v, ok := opts[key]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	var mask uint64
+	switch m := v.(type) {
+	case int:
+		mask = uint64(m)
+	case float64:
+		mask = uint64(m)
+	case string:
+		parsed, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("option '%s' must be an octal mask such as \"0022\"", key)
+		}
+		mask = parsed
+	default:
+		return 0, fmt.Errorf("option '%s' must be an octal mask such as \"0022\"", key)
+	}
+	if mask > 0777 {
+		return 0, fmt.Errorf("option '%s' must be between 0000 and 0777", key)
+	}
+	return os.FileMode(mask), nil
+}
+
+// ============================================================================
+// Umask
+// ============================================================================
+
+// WithUmask wraps fs so the masked permission bits are cleared from
+// reported modes, including directory listings, and from the permissions
+// of new files and directories. FUSE mounts apply the umask option with it.
+func WithUmask(fs absfs.FileSystem, mask os.FileMode) absfs.FileSystem {
+	if mask == 0 {
+		return fs
+	}
+	ufs := &umaskFS{FileSystem: fs, mask: mask}
+	if linker, ok := fs.(absfs.SymLinker); ok {
+		return &umaskSymlinkFS{umaskFS: ufs, linker: linker}
+	}
+	return ufs
+}
+
+type umaskFS struct {
+	absfs.FileSystem
+	mask os.FileMode
+}
+
+func (u *umaskFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := u.FileSystem.OpenFile(name, flag, perm&^u.mask)
+	if err != nil {
+		return nil, err
+	}
+	return &maskedFile{File: f, mask: u.mask}, nil
+}
+
+func (u *umaskFS) Open(name string) (absfs.File, error) {
+	return u.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (u *umaskFS) Create(name string) (absfs.File, error) {
+	return u.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (u *umaskFS) Mkdir(name string, perm os.FileMode) error {
+	return u.FileSystem.Mkdir(name, perm&^u.mask)
+}
+
+func (u *umaskFS) MkdirAll(name string, perm os.FileMode) error {
+	return u.FileSystem.MkdirAll(name, perm&^u.mask)
+}
+
+func (u *umaskFS) Chmod(name string, mode os.FileMode) error {
+	return u.FileSystem.Chmod(name, mode&^u.mask)
+}
+
+func (u *umaskFS) Stat(name string) (os.FileInfo, error) {
+	info, err := u.FileSystem.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return maskedInfo{info, u.mask}, nil
+}
+
+func (u *umaskFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := u.FileSystem.ReadDir(name)
+	for i, e := range entries {
+		entries[i] = maskedEntry{e, u.mask}
+	}
+	return entries, err
+}
+
+type umaskSymlinkFS struct {
+	*umaskFS
+	linker absfs.SymLinker
+}
+
+func (u *umaskSymlinkFS) Lstat(name string) (os.FileInfo, error) {
+	info, err := u.linker.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return maskedInfo{info, u.mask}, nil
+}
+
+func (u *umaskSymlinkFS) Lchown(name string, uid, gid int) error {
+	return u.linker.Lchown(name, uid, gid)
+}
+
+func (u *umaskSymlinkFS) Readlink(name string) (string, error) {
+	return u.linker.Readlink(name)
+}
+
+func (u *umaskSymlinkFS) Symlink(oldname, newname string) error {
+	return u.linker.Symlink(oldname, newname)
+}
+
+// maskedInfo reports a file's mode with the umask applied
+type maskedInfo struct {
+	fs.FileInfo
+	mask os.FileMode
+}
+
+func (m maskedInfo) Mode() os.FileMode {
+	return m.FileInfo.Mode() &^ m.mask
+}
+
+// maskedEntry reports a directory entry's info with the umask applied
+type maskedEntry struct {
+	fs.DirEntry
+	mask os.FileMode
+}
+
+func (m maskedEntry) Info() (fs.FileInfo, error) {
+	info, err := m.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return maskedInfo{info, m.mask}, nil
+}
+
+// maskedFile applies the umask to the modes a file handle reports,
+// including those of the entries of a directory
+type maskedFile struct {
+	absfs.File
+	mask os.FileMode
+}
+
+func (f *maskedFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return maskedInfo{info, f.mask}, nil
+}
+
+func (f *maskedFile) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(n)
+	for i, info := range infos {
+		infos[i] = maskedInfo{info, f.mask}
+	}
+	return infos, err
+}
+
+func (f *maskedFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.File.ReadDir(n)
+	for i, e := range entries {
+		entries[i] = maskedEntry{e, f.mask}
+	}
+	return entries, err
+}
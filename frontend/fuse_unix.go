@@ -0,0 +1,58 @@
+//go:build !windows
+
+package frontend
+
+import (
+	"github.com/absfs/absfs"
+	"github.com/absfs/fusefs"
+)
+
+// FUSEMount is a composition mounted through FUSE
+type FUSEMount struct {
+	fuse   *fusefs.FuseFS
+	config *FUSEConfig
+}
+
+// MountFUSE mounts fs at the configured mountpoint
+func MountFUSE(fs absfs.FileSystem, cfg *FUSEConfig) (*FUSEMount, error) {
+	opts := fusefs.DefaultMountOptions(cfg.Mountpoint)
+	opts.FSName = cfg.FSName
+	opts.ReadOnly = cfg.ReadOnly
+	opts.AllowOther = cfg.AllowOther
+	opts.AllowRoot = cfg.AllowRoot
+	opts.DefaultPermissions = cfg.DefaultPermissions
+	opts.UID = cfg.UID
+	opts.GID = cfg.GID
+	opts.AttrTimeout = cfg.AttrTimeout
+	opts.EntryTimeout = cfg.EntryTimeout
+	opts.AttrCacheTTL = cfg.AttrCacheTTL
+	opts.DirCacheTTL = cfg.DirCacheTTL
+	opts.DirectIO = cfg.DirectIO
+	opts.MaxReadahead = cfg.MaxReadahead
+	opts.MaxWrite = cfg.MaxWrite
+	opts.Debug = cfg.Debug
+	opts.Options = cfg.Options
+
+	fuseFS, err := fusefs.Mount(WithUmask(fs, cfg.Umask), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FUSEMount{fuse: fuseFS, config: cfg}, nil
+}
+
+// Unmount unmounts the filesystem
+func (m *FUSEMount) Unmount() error {
+	return m.fuse.Unmount()
+}
+
+// Wait blocks until the filesystem is unmounted
+func (m *FUSEMount) Wait() error {
+	return m.fuse.Wait()
+}
+
+// FUSEMounted reports whether a filesystem is mounted at mountpoint
+func FUSEMounted(mountpoint string) bool {
+	mounted, err := fusefs.IsMounted(mountpoint)
+	return err == nil && mounted
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package frontend
+
+import (
+	"fmt"
+
+	"github.com/absfs/absfs"
+)
+
+// FUSEMount is a composition mounted through FUSE
+type FUSEMount struct{}
+
+// MountFUSE is not supported on Windows
+func MountFUSE(fs absfs.FileSystem, cfg *FUSEConfig) (*FUSEMount, error) {
+	return nil, fmt.Errorf("fuse mounts are not supported on Windows (FUSE is Unix-only)")
+}
+
+// Unmount is not supported on Windows
+func (m *FUSEMount) Unmount() error {
+	return fmt.Errorf("fuse mounts are not supported on Windows")
+}
+
+// Wait is not supported on Windows
+func (m *FUSEMount) Wait() error {
+	return fmt.Errorf("fuse mounts are not supported on Windows")
+}
+
+// FUSEMounted always reports false on Windows
+func FUSEMounted(mountpoint string) bool {
+	return false
+}
@@ -0,0 +1,132 @@
+package frontend
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+)
+
+// Mount is a composition being served by one of the frontends
+type Mount struct {
+	Type   string // Mount type actually served
+	Target string // Mountpoint or listen address
+	stop   func() error
+	done   chan error
+}
+
+// Stop unmounts the filesystem or shuts the server down
+func (m *Mount) Stop() error {
+	return m.stop()
+}
+
+// Done receives once when the frontend exits, with nil after a clean
+// unmount or Stop
+func (m *Mount) Done() <-chan error {
+	return m.done
+}
+
+// networkServer is a frontend that serves a composition over the network
+type networkServer interface {
+	Serve(l net.Listener) error
+	Close() error
+}
+
+// Start serves fs with the frontend named by the spec's mount type. SFTP,
+// S3 and WebDAV servers are listening when Start returns, so address
+// errors are reported here; FUSE mounts at mountpoint, or at mount.path
+// when mountpoint is empty. Other types are refused.
+func Start(spec *engine.CompositionSpec, fs absfs.FileSystem, mountpoint string) (*Mount, error) {
+	switch spec.Mount.Type {
+	case engine.MountTypeSFTP:
+		cfg, err := SFTPConfigFromMount(spec.Mount)
+		if err != nil {
+			return nil, fmt.Errorf("sftp config error: %w", err)
+		}
+		server, err := NewSFTPServer(fs, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start sftp server: %w", err)
+		}
+		return serveNetwork(engine.MountTypeSFTP, cfg.Addr, server)
+
+	case engine.MountTypeS3:
+		cfg, err := S3ConfigFromMount(spec.Mount)
+		if err != nil {
+			return nil, fmt.Errorf("s3 config error: %w", err)
+		}
+		server, err := NewS3Server(fs, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start s3 gateway: %w", err)
+		}
+		return serveNetwork(engine.MountTypeS3, cfg.Addr, server)
+
+	case engine.MountTypeWebDAV:
+		cfg, err := WebDAVConfigFromMount(spec.Mount)
+		if err != nil {
+			return nil, fmt.Errorf("webdav config error: %w", err)
+		}
+		server, err := NewWebDAVServer(fs, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start webdav server: %w", err)
+		}
+		return serveNetwork(engine.MountTypeWebDAV, cfg.Addr, server)
+
+	case engine.MountTypeFUSE:
+		return startFUSE(spec, fs, mountpoint)
+
+	case engine.MountTypeAPI:
+		return nil, fmt.Errorf("api compositions are served by fscomposer-server, not mounted")
+
+	default:
+		return nil, fmt.Errorf("unsupported mount type %q", spec.Mount.Type)
+	}
+}
+
+// serveNetwork listens on addr and serves in the background
+func serveNetwork(mountType, addr string, server networkServer) (*Mount, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+
+	return &Mount{
+		Type:   mountType,
+		Target: l.Addr().String(),
+		stop:   server.Close,
+		done:   done,
+	}, nil
+}
+
+func startFUSE(spec *engine.CompositionSpec, fs absfs.FileSystem, mountpoint string) (*Mount, error) {
+	cfg, err := FUSEConfigFromSpec(spec, mountpoint)
+	if err != nil {
+		return nil, fmt.Errorf("fuse config error: %w", err)
+	}
+	if abs, err := filepath.Abs(cfg.Mountpoint); err == nil {
+		cfg.Mountpoint = abs
+	}
+
+	mount, err := MountFUSE(fs, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount at %s: %w", cfg.Mountpoint, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mount.Wait()
+	}()
+
+	return &Mount{
+		Type:   engine.MountTypeFUSE,
+		Target: cfg.Mountpoint,
+		stop:   mount.Unmount,
+		done:   done,
+	}, nil
+}
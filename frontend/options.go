@@ -0,0 +1,88 @@
+// Package frontend exposes composed filesystems over network protocols
+package frontend
+
+import (
+	"fmt"
+	"os"
+)
+
+// Helpers for reading mount.options values. YAML decodes numbers as int
+// while JSON decodes them as float64, so both are accepted.
+
+func optString(opts map[string]interface{}, key string) (string, error) {
+	v, ok := opts[key]
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("option '%s' must be a string", key)
+	}
+	return s, nil
+}
+
+func optInt(opts map[string]interface{}, key string, def int) (int, error) {
+	v, ok := opts[key]
+	if !ok || v == nil {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("option '%s' must be a number", key)
+	}
+}
+
+func optBool(opts map[string]interface{}, key string, def bool) (bool, error) {
+	v, ok := opts[key]
+	if !ok || v == nil {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("option '%s' must be a boolean", key)
+	}
+	return b, nil
+}
+
+// optList returns a list of maps, such as the users of an auth section
+func optList(opts map[string]interface{}, key string) ([]map[string]interface{}, error) {
+	v, ok := opts[key]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("option '%s' must be a list", key)
+	}
+	items := make([]map[string]interface{}, 0, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("option '%s' entry %d is not a valid map", key, i)
+		}
+		items = append(items, m)
+	}
+	return items, nil
+}
+
+// optSecret reads a secret that may be given inline as key or indirectly
+// through an environment variable named by keyEnv
+func optSecret(opts map[string]interface{}, key string) (string, error) {
+	value, err := optString(opts, key)
+	if err != nil || value != "" {
+		return value, err
+	}
+	env, err := optString(opts, key+"Env")
+	if err != nil || env == "" {
+		return "", err
+	}
+	value = os.Getenv(env)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", env)
+	}
+	return value, nil
+}
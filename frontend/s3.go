@@ -0,0 +1,1001 @@
+package frontend
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+)
+
+// DefaultS3Port is used when the mount config does not specify a port
+const DefaultS3Port = 9000
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// S3Config configures the S3-compatible gateway
+type S3Config struct {
+	Addr        string         // Listen address (host:port)
+	Region      string         // Region clients must sign requests for
+	Credentials []S3Credential // Access keys allowed to use the gateway
+}
+
+// S3Credential is an access key pair accepted by the gateway
+type S3Credential struct {
+	AccessKey string
+	SecretKey string
+}
+
+// S3ConfigFromMount reads the S3 gateway configuration from a mount spec
+//
+//	mount:
+//	  type: s3
+//	  port: 9000
+//	  root: encrypt
+//	  options:
+//	    region: us-east-1
+//	    credentials:
+//	      - accessKey: fscomposer
+//	        secretKeyEnv: S3_SECRET_KEY
+func S3ConfigFromMount(mount engine.MountConfig) (*S3Config, error) {
+	opts := mount.Options
+	if opts == nil {
+		opts = map[string]interface{}{}
+	}
+
+	port := mount.Port
+	if port == 0 {
+		port = DefaultS3Port
+	}
+	host, err := optString(opts, "host")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &S3Config{Addr: net.JoinHostPort(host, fmt.Sprint(port))}
+
+	if cfg.Region, err = optString(opts, "region"); err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	creds, err := optList(opts, "credentials")
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range creds {
+		var cred S3Credential
+		if cred.AccessKey, err = optString(c, "accessKey"); err != nil {
+			return nil, fmt.Errorf("credential %d: %w", i, err)
+		}
+		if cred.AccessKey == "" {
+			return nil, fmt.Errorf("credential %d: 'accessKey' is required", i)
+		}
+		if cred.SecretKey, err = optSecret(c, "secretKey"); err != nil {
+			return nil, fmt.Errorf("credential %s: %w", cred.AccessKey, err)
+		}
+		if cred.SecretKey == "" {
+			return nil, fmt.Errorf("credential %s: 'secretKey' is required", cred.AccessKey)
+		}
+		cfg.Credentials = append(cfg.Credentials, cred)
+	}
+
+	if len(cfg.Credentials) == 0 {
+		return nil, fmt.Errorf("s3 mount requires 'credentials' in options")
+	}
+
+	return cfg, nil
+}
+
+// S3Server serves a filesystem through an S3-compatible HTTP API. Top-level
+// directories are buckets and the paths below them are object keys. Only
+// path-style addressing (http://host:port/bucket/key) is supported.
+type S3Server struct {
+	fs          absfs.FileSystem
+	config      *S3Config
+	credentials map[string]string
+	server      *http.Server
+}
+
+// NewS3Server creates an S3 gateway for the given filesystem
+func NewS3Server(fs absfs.FileSystem, config *S3Config) (*S3Server, error) {
+	s := &S3Server{
+		fs:          fs,
+		config:      config,
+		credentials: make(map[string]string),
+	}
+
+	for _, cred := range config.Credentials {
+		if _, dup := s.credentials[cred.AccessKey]; dup {
+			return nil, fmt.Errorf("duplicate s3 access key: %s", cred.AccessKey)
+		}
+		s.credentials[cred.AccessKey] = cred.SecretKey
+	}
+
+	s.server = &http.Server{
+		Addr:              config.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	return s, nil
+}
+
+// ListenAndServe listens on the configured address and serves requests
+func (s *S3Server) ListenAndServe() error {
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Serve accepts connections on the listener until Close is called
+func (s *S3Server) Serve(l net.Listener) error {
+	if err := s.server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops the gateway and closes all connections
+func (s *S3Server) Close() error {
+	return s.server.Close()
+}
+
+// ServeHTTP authenticates and dispatches an S3 request
+func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, serr := s.authenticate(r); serr != nil {
+		s.writeError(w, r, serr)
+		return
+	}
+
+	bucket, key := splitBucketKey(r.URL.Path)
+	query := r.URL.Query()
+
+	var serr *s3Error
+	switch {
+	case bucket == "":
+		if r.Method == http.MethodGet {
+			serr = s.listBuckets(w)
+		} else {
+			serr = errMethodNotAllowed
+		}
+
+	case key == "":
+		serr = s.handleBucket(w, r, bucket, query)
+
+	default:
+		serr = s.handleObject(w, r, bucket, key, query)
+	}
+
+	if serr != nil {
+		s.writeError(w, r, serr)
+	}
+}
+
+func (s *S3Server) handleBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) *s3Error {
+	if !validBucketName(bucket) {
+		return errInvalidBucketName
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := query["uploads"]; ok {
+			return errNotImplemented
+		}
+		if _, ok := query["location"]; ok {
+			return s.writeXML(w, http.StatusOK, locationConstraint{Region: s.config.Region})
+		}
+		return s.listObjectsV2(w, r, bucket)
+	case http.MethodHead:
+		if err := s.checkBucket(bucket); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodPut:
+		return s.createBucket(w, bucket)
+	case http.MethodDelete:
+		return s.deleteBucket(w, bucket)
+	case http.MethodPost:
+		if _, ok := query["delete"]; ok {
+			return s.deleteObjects(w, r, bucket)
+		}
+	}
+	return errMethodNotAllowed
+}
+
+func (s *S3Server) handleObject(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) *s3Error {
+	if !validBucketName(bucket) {
+		return errInvalidBucketName
+	}
+	if !validObjectKey(key) {
+		return errInvalidObjectName
+	}
+	if err := s.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" {
+			return s.listParts(w, bucket, key, uploadID)
+		}
+		return s.getObject(w, r, bucket, key)
+	case http.MethodPut:
+		if uploadID != "" {
+			return s.uploadPart(w, r, bucket, key, uploadID)
+		}
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s.copyObject(w, r, bucket, key)
+		}
+		return s.putObject(w, r, bucket, key)
+	case http.MethodPost:
+		if uploads {
+			return s.createMultipartUpload(w, bucket, key)
+		}
+		if uploadID != "" {
+			return s.completeMultipartUpload(w, r, bucket, key, uploadID)
+		}
+	case http.MethodDelete:
+		if uploadID != "" {
+			return s.abortMultipartUpload(w, bucket, key, uploadID)
+		}
+		return s.deleteObject(w, bucket, key)
+	}
+	return errMethodNotAllowed
+}
+
+// ============================================================================
+// Buckets
+// ============================================================================
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Region  string   `xml:",chardata"`
+}
+
+func (s *S3Server) listBuckets(w http.ResponseWriter) *s3Error {
+	entries, err := s.fs.ReadDir("/")
+	if err != nil {
+		return s3InternalError(err)
+	}
+
+	result := listAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: "fscomposer", DisplayName: "fscomposer"},
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validBucketName(entry.Name()) {
+			continue
+		}
+		created := time.Time{}
+		if info, err := entry.Info(); err == nil {
+			created = info.ModTime()
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         entry.Name(),
+			CreationDate: formatS3Time(created),
+		})
+	}
+
+	return s.writeXML(w, http.StatusOK, result)
+}
+
+func (s *S3Server) checkBucket(bucket string) *s3Error {
+	info, err := s.fs.Stat("/" + bucket)
+	if err != nil || !info.IsDir() {
+		return errNoSuchBucket
+	}
+	return nil
+}
+
+func (s *S3Server) createBucket(w http.ResponseWriter, bucket string) *s3Error {
+	if s.checkBucket(bucket) == nil {
+		return errBucketAlreadyOwnedByYou
+	}
+	if err := s.fs.Mkdir("/"+bucket, 0755); err != nil {
+		return s3InternalError(err)
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *S3Server) deleteBucket(w http.ResponseWriter, bucket string) *s3Error {
+	if err := s.checkBucket(bucket); err != nil {
+		return err
+	}
+	entries, err := s.fs.ReadDir("/" + bucket)
+	if err != nil {
+		return s3InternalError(err)
+	}
+	if len(entries) > 0 {
+		return errBucketNotEmpty
+	}
+	if err := s.fs.Remove("/" + bucket); err != nil {
+		return s3InternalError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ============================================================================
+// ListObjectsV2
+// ============================================================================
+
+type listBucketResultV2 struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int              `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listEntry is an object or common prefix in a listing, sorted by key
+type listEntry struct {
+	key    string
+	info   os.FileInfo
+	prefix bool
+}
+
+func (s *S3Server) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) *s3Error {
+	if err := s.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		return errNotImplemented
+	}
+
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	maxKeys := 1000
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	marker := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return errInvalidArgument
+		}
+		marker = string(decoded)
+	}
+
+	entries, err := s.collectKeys(bucket, prefix, delimiter)
+	if err != nil {
+		return s3InternalError(err)
+	}
+
+	result := listBucketResultV2{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           maxKeys,
+		EncodingType:      q.Get("encoding-type"),
+	}
+
+	encode := func(key string) string {
+		if result.EncodingType == "url" {
+			return awsURIEncode(key, false)
+		}
+		return key
+	}
+
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].key > marker })
+	for _, entry := range entries[start:] {
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if entry.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry.key)})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(entry.key),
+				LastModified: formatS3Time(entry.info.ModTime()),
+				ETag:         fileETag(entry.info),
+				Size:         entry.info.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		if result.KeyCount == maxKeys {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(entry.key))
+		}
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	return s.writeXML(w, http.StatusOK, result)
+}
+
+// collectKeys returns the sorted objects and common prefixes in bucket
+// matching prefix, rolled up at the first delimiter after the prefix
+func (s *S3Server) collectKeys(bucket, prefix, delimiter string) ([]listEntry, error) {
+	bucketPath := "/" + bucket
+
+	// Only the directory containing the prefix needs to be walked
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+
+	var entries []listEntry
+	seenPrefixes := make(map[string]bool)
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		children, err := s.fs.ReadDir(path.Join(bucketPath, rel))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		for _, child := range children {
+			if strings.HasPrefix(child.Name(), uploadPrefix) {
+				continue // Upload in progress
+			}
+			key := child.Name()
+			if rel != "" {
+				key = rel + "/" + child.Name()
+			}
+
+			if child.IsDir() {
+				// A directory can only contain matches if it and the
+				// prefix agree up to the shorter of the two
+				dirKey := key + "/"
+				if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+					continue
+				}
+				if delimiter == "/" && strings.HasPrefix(dirKey, prefix) {
+					// Roll the whole directory up without walking it
+					if !seenPrefixes[dirKey] {
+						seenPrefixes[dirKey] = true
+						entries = append(entries, listEntry{key: dirKey, prefix: true})
+					}
+					continue
+				}
+				if err := walk(key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					common := key[:len(prefix)+i+len(delimiter)]
+					if !seenPrefixes[common] {
+						seenPrefixes[common] = true
+						entries = append(entries, listEntry{key: common, prefix: true})
+					}
+					continue
+				}
+			}
+			info, err := child.Info()
+			if err != nil {
+				continue // Removed while listing
+			}
+			entries = append(entries, listEntry{key: key, info: info})
+		}
+		return nil
+	}
+
+	if err := walk(dir); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// ============================================================================
+// Objects
+// ============================================================================
+
+func (s *S3Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) *s3Error {
+	name := objectPath(bucket, key)
+
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return errNoSuchKey
+	}
+	// Directories are only visible as zero-byte "folder/" marker objects
+	if info.IsDir() != strings.HasSuffix(key, "/") {
+		return errNoSuchKey
+	}
+
+	w.Header().Set("ETag", fileETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if info.IsDir() {
+		w.Header().Set("Content-Type", "application/x-directory")
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return s3InternalError(err)
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	// ServeContent handles Range, conditional requests and HEAD
+	http.ServeContent(w, r, path.Base(key), info.ModTime(), f)
+	return nil
+}
+
+func (s *S3Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) *s3Error {
+	name := objectPath(bucket, key)
+
+	if strings.HasSuffix(key, "/") {
+		// Folder marker
+		if err := s.fs.MkdirAll(name, 0755); err != nil {
+			return s3InternalError(err)
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	sum, serr := s.writeObject(name, r.Body, r.Header.Get("Content-Md5"))
+	if serr != nil {
+		return serr
+	}
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// writeObject stores body at name, creating parent directories, and returns
+// its MD5. The object is only replaced if the payload passes verification.
+func (s *S3Server) writeObject(name string, body io.Reader, contentMD5 string) ([]byte, *s3Error) {
+	h := md5.New()
+	serr := s.storeObject(name, func(f io.Writer) *s3Error {
+		if _, err := io.Copy(io.MultiWriter(f, h), body); err != nil {
+			return bodyError(err)
+		}
+		if contentMD5 != "" && base64.StdEncoding.EncodeToString(h.Sum(nil)) != contentMD5 {
+			return errBadDigest
+		}
+		return nil
+	})
+	if serr != nil {
+		return nil, serr
+	}
+	return h.Sum(nil), nil
+}
+
+// uploadPrefix names the temporary files objects are written to before
+// they replace the stored object. They never show up in listings.
+const uploadPrefix = ".fscomposer-upload-"
+
+// storeObject writes an object at name, creating parent directories. write
+// fills a temporary file next to name that is only renamed over it when
+// write succeeds, so a failed or interrupted upload leaves the previous
+// object intact.
+func (s *S3Server) storeObject(name string, write func(io.Writer) *s3Error) *s3Error {
+	if info, err := s.fs.Stat(name); err == nil && info.IsDir() {
+		return errInvalidObjectName
+	}
+	if err := s.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return s3InternalError(err)
+	}
+
+	tmp := path.Join(path.Dir(name), uploadPrefix+randomID())
+	f, err := s.fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return s3InternalError(err)
+	}
+
+	serr := write(f)
+	if err := f.Close(); err != nil && serr == nil {
+		serr = s3InternalError(err)
+	}
+	if serr == nil {
+		if err := s.fs.Rename(tmp, name); err != nil {
+			serr = s3InternalError(err)
+		}
+	}
+	if serr != nil {
+		s.fs.Remove(tmp)
+	}
+	return serr
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+func (s *S3Server) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) *s3Error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return errInvalidArgument
+	}
+	source, _, _ = strings.Cut(source, "?versionId=")
+	srcBucket, srcKey := splitBucketKey(source)
+	if !validBucketName(srcBucket) || !validObjectKey(srcKey) {
+		return errInvalidArgument
+	}
+
+	srcName := objectPath(srcBucket, srcKey)
+	info, err := s.fs.Stat(srcName)
+	if err != nil || info.IsDir() {
+		return errNoSuchKey
+	}
+
+	src, err := s.fs.Open(srcName)
+	if err != nil {
+		return s3InternalError(err)
+	}
+	defer src.Close()
+
+	name := objectPath(bucket, key)
+	if name == srcName {
+		// Copying onto itself only refreshes metadata, which is not stored
+		return s.writeXML(w, http.StatusOK, copyObjectResult{
+			Xmlns:        s3Namespace,
+			LastModified: formatS3Time(info.ModTime()),
+			ETag:         fileETag(info),
+		})
+	}
+
+	sum, serr := s.writeObject(name, src, "")
+	if serr != nil {
+		return serr
+	}
+
+	return s.writeXML(w, http.StatusOK, copyObjectResult{
+		Xmlns:        s3Namespace,
+		LastModified: formatS3Time(time.Now()),
+		ETag:         `"` + hex.EncodeToString(sum) + `"`,
+	})
+}
+
+func (s *S3Server) deleteObject(w http.ResponseWriter, bucket, key string) *s3Error {
+	if err := s.removeObject(bucket, key); err != nil {
+		return s3InternalError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeObject deletes an object and prunes directories it leaves empty, so
+// prefixes disappear with their last object as they do in S3. Deleting a
+// missing object is not an error.
+func (s *S3Server) removeObject(bucket, key string) error {
+	name := objectPath(bucket, key)
+
+	info, err := s.fs.Stat(name)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(key, "/") {
+			return nil
+		}
+		if entries, err := s.fs.ReadDir(name); err != nil || len(entries) > 0 {
+			return nil // Folder marker for a prefix that still has objects
+		}
+	}
+	if err := s.fs.Remove(name); err != nil {
+		return err
+	}
+
+	bucketPath := "/" + bucket
+	for dir := path.Dir(name); dir != bucketPath && dir != "/"; dir = path.Dir(dir) {
+		entries, err := s.fs.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			break
+		}
+		if s.fs.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *S3Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) *s3Error {
+	if err := s.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	var req deleteRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil {
+		return errMalformedXML
+	}
+	if len(req.Objects) > 1000 {
+		return errMalformedXML
+	}
+
+	result := deleteResult{Xmlns: s3Namespace}
+	for _, obj := range req.Objects {
+		var err error
+		if !validObjectKey(obj.Key) {
+			err = fmt.Errorf("invalid object name")
+		} else {
+			err = s.removeObject(bucket, obj.Key)
+		}
+
+		if err != nil {
+			result.Errors = append(result.Errors, deleteError{
+				Key: obj.Key, Code: "InternalError", Message: err.Error(),
+			})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, deletedObject{Key: obj.Key})
+		}
+	}
+
+	return s.writeXML(w, http.StatusOK, result)
+}
+
+// ============================================================================
+// Helpers
+// ============================================================================
+
+var bucketNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// validBucketName reports whether name is a valid S3 bucket name. Hidden
+// directories (such as the multipart staging area) never qualify.
+func validBucketName(name string) bool {
+	return bucketNameRe.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// validObjectKey rejects keys that do not map onto a unique path
+func validObjectKey(key string) bool {
+	if key == "" || len(key) > 1024 || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// splitBucketKey splits /bucket/some/key into its bucket and key
+func splitBucketKey(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	bucket, key, _ := strings.Cut(p, "/")
+	return bucket, key
+}
+
+func objectPath(bucket, key string) string {
+	return "/" + bucket + "/" + strings.TrimSuffix(key, "/")
+}
+
+// fileETag derives a stable ETag from size and modification time, since the
+// content hash of existing files is not known without reading them
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func formatS3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// randomID returns a random hex identifier for uploads and requests
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *S3Server) writeXML(w http.ResponseWriter, status int, v interface{}) *s3Error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return s3InternalError(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+	return nil
+}
+
+// ============================================================================
+// Errors
+// ============================================================================
+
+// s3Error is an S3 error response
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied                 = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errAuthorizationHeaderMalformed = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	errBadDigest                    = &s3Error{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errBucketAlreadyOwnedByYou      = &s3Error{"BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it", http.StatusConflict}
+	errBucketNotEmpty               = &s3Error{"BucketNotEmpty", "The bucket you tried to delete is not empty", http.StatusConflict}
+	errEntityTooSmall               = &s3Error{"EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size", http.StatusBadRequest}
+	errExpiredToken                 = &s3Error{"AccessDenied", "Request has expired", http.StatusForbidden}
+	errIncompleteBody               = &s3Error{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header", http.StatusBadRequest}
+	errInvalidAccessKeyID           = &s3Error{"InvalidAccessKeyId", "The AWS access key ID you provided does not exist in our records", http.StatusForbidden}
+	errInvalidArgument              = &s3Error{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+	errInvalidBucketName            = &s3Error{"InvalidBucketName", "The specified bucket is not valid", http.StatusBadRequest}
+	errInvalidContentSHA256         = &s3Error{"InvalidArgument", "x-amz-content-sha256 must be set to a valid payload hash", http.StatusBadRequest}
+	errInvalidObjectName            = &s3Error{"InvalidArgument", "The specified key is not valid", http.StatusBadRequest}
+	errInvalidPart                  = &s3Error{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errInvalidPartOrder             = &s3Error{"InvalidPartOrder", "The list of parts was not in ascending order", http.StatusBadRequest}
+	errMalformedXML                 = &s3Error{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errMethodNotAllowed             = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errNoSuchBucket                 = &s3Error{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey                    = &s3Error{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload                 = &s3Error{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errNotImplemented               = &s3Error{"NotImplemented", "A header or query you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errRequestTimeTooSkewed         = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errSignatureDoesNotMatch        = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errXAmzContentSHA256Mismatch    = &s3Error{"XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed", http.StatusBadRequest}
+)
+
+func s3InternalError(err error) *s3Error {
+	log.Printf("s3: %v", err)
+	return &s3Error{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+}
+
+// bodyError maps errors from reading a request body to S3 errors
+func bodyError(err error) *s3Error {
+	var serr *s3Error
+	switch {
+	case errors.As(err, &serr):
+		return serr
+	case errors.Is(err, errPayloadMismatch):
+		return errXAmzContentSHA256Mismatch
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errIncompleteBody
+	default:
+		return s3InternalError(err)
+	}
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func (s *S3Server) writeError(w http.ResponseWriter, r *http.Request, serr *s3Error) {
+	if r.Method == http.MethodHead {
+		// HEAD responses carry no body
+		w.WriteHeader(serr.Status)
+		return
+	}
+	data, _ := xml.Marshal(s3ErrorResponse{
+		Code:      serr.Code,
+		Message:   serr.Message,
+		Resource:  r.URL.Path,
+		RequestID: randomID(),
+	})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(serr.Status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
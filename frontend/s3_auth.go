@@ -0,0 +1,408 @@
+package frontend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 verification for the S3 gateway
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4MaxSkew     = 15 * time.Minute
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingSigned  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// sigV4Request holds the parsed signature fields of an authenticated request
+type sigV4Request struct {
+	accessKey     string
+	date          string // yyyymmdd
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+func (sr *sigV4Request) scope() string {
+	return strings.Join([]string{sr.date, sr.region, sr.service, "aws4_request"}, "/")
+}
+
+// authenticate verifies the SigV4 signature of r and returns the parsed
+// request, replacing r.Body with a reader that verifies the payload
+func (s *S3Server) authenticate(r *http.Request) (*sigV4Request, *s3Error) {
+	var sr *sigV4Request
+	var serr *s3Error
+
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		sr, serr = parsePresigned(r)
+	} else if auth := r.Header.Get("Authorization"); auth != "" {
+		sr, serr = parseAuthorizationHeader(r, auth)
+	} else {
+		return nil, errAccessDenied
+	}
+	if serr != nil {
+		return nil, serr
+	}
+
+	secret, ok := s.credentials[sr.accessKey]
+	if !ok {
+		return nil, errInvalidAccessKeyID
+	}
+	if sr.service != "s3" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	key := signingKey(secret, sr.date, sr.region, sr.service)
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign(sr, canonicalRequest(r, sr))))
+	if !hmac.Equal([]byte(expected), []byte(sr.signature)) {
+		return nil, errSignatureDoesNotMatch
+	}
+
+	switch {
+	case sr.presigned || sr.payloadHash == unsignedPayload:
+		// Payload is not covered by the signature
+	case sr.payloadHash == streamingSigned:
+		r.Body = newChunkedReader(r.Body, &chunkSigner{key: key, request: sr, prev: sr.signature})
+	case sr.payloadHash == streamingTrailer:
+		r.Body = newChunkedReader(r.Body, nil)
+	case strings.HasPrefix(sr.payloadHash, "STREAMING-"):
+		return nil, errNotImplemented
+	default:
+		if _, err := hex.DecodeString(sr.payloadHash); err != nil || len(sr.payloadHash) != 64 {
+			return nil, errInvalidContentSHA256
+		}
+		r.Body = &hashingReader{r: r.Body, h: sha256.New(), want: sr.payloadHash}
+	}
+
+	return sr, nil
+}
+
+// parseAuthorizationHeader parses
+// AWS4-HMAC-SHA256 Credential=AK/20240101/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-date, Signature=abcd
+func parseAuthorizationHeader(r *http.Request, auth string) (*sigV4Request, *s3Error) {
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, errAuthorizationHeaderMalformed
+		}
+		fields[kv[0]] = kv[1]
+	}
+
+	sr, serr := parseCredential(fields["Credential"])
+	if serr != nil {
+		return nil, serr
+	}
+	sr.signature = fields["Signature"]
+	sr.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	if sr.signature == "" || fields["SignedHeaders"] == "" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = r.Header.Get("Date")
+	}
+	t, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	if d := time.Since(t); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	sr.amzDate = t
+
+	sr.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if sr.payloadHash == "" {
+		return nil, errInvalidContentSHA256
+	}
+
+	return sr, nil
+}
+
+// parsePresigned parses the signature fields of a presigned URL
+func parsePresigned(r *http.Request) (*sigV4Request, *s3Error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	sr, serr := parseCredential(q.Get("X-Amz-Credential"))
+	if serr != nil {
+		return nil, serr
+	}
+	sr.presigned = true
+	sr.signature = q.Get("X-Amz-Signature")
+	sr.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	sr.payloadHash = unsignedPayload
+
+	t, err := time.Parse(sigV4TimeFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || expires > 7*24*3600 {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	if time.Now().After(t.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpiredToken
+	}
+	sr.amzDate = t
+
+	return sr, nil
+}
+
+// parseCredential parses AK/20240101/us-east-1/s3/aws4_request
+func parseCredential(credential string) (*sigV4Request, *s3Error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	return &sigV4Request{
+		accessKey: parts[0],
+		date:      parts[1],
+		region:    parts[2],
+		service:   parts[3],
+	}, nil
+}
+
+// canonicalRequest builds the SigV4 canonical request for r
+func canonicalRequest(r *http.Request, sr *sigV4Request) string {
+	var headers strings.Builder
+	for _, name := range sr.signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		headers.WriteString(name)
+		headers.WriteByte(':')
+		headers.WriteString(strings.Join(strings.Fields(value), " "))
+		headers.WriteByte('\n')
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		headers.String(),
+		strings.Join(sr.signedHeaders, ";"),
+		sr.payloadHash,
+	}, "\n")
+}
+
+// canonicalQuery sorts and encodes the query string, leaving out the
+// signature itself for presigned URLs
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything except unreserved characters, and
+// '/' unless encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func stringToSign(sr *sigV4Request, canonical string) []byte {
+	hash := sha256.Sum256([]byte(canonical))
+	return []byte(strings.Join([]string{
+		sigV4Algorithm,
+		sr.amzDate.Format(sigV4TimeFormat),
+		sr.scope(),
+		hex.EncodeToString(hash[:]),
+	}, "\n"))
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// errPayloadMismatch is returned by body readers when the received payload
+// does not match its declared hash or chunk signature
+var errPayloadMismatch = errors.New("payload does not match signature")
+
+// maxChunkSize bounds one chunk of an aws-chunked body, which is held in
+// memory until its signature is checked. SDKs send 64 KiB to 8 MiB.
+const maxChunkSize = 16 << 20
+
+// hashingReader verifies the body against x-amz-content-sha256 at EOF
+type hashingReader struct {
+	r    io.ReadCloser
+	h    hash.Hash
+	want string
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(hr.h.Sum(nil)) != hr.want {
+		return n, errPayloadMismatch
+	}
+	return n, err
+}
+
+func (hr *hashingReader) Close() error {
+	return hr.r.Close()
+}
+
+// chunkSigner verifies the signature chain of aws-chunked uploads
+type chunkSigner struct {
+	key     []byte
+	request *sigV4Request
+	prev    string
+}
+
+func (cs *chunkSigner) verify(data []byte, signature string) bool {
+	hash := sha256.Sum256(data)
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256-PAYLOAD",
+		cs.request.amzDate.Format(sigV4TimeFormat),
+		cs.request.scope(),
+		cs.prev,
+		emptySHA256,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(cs.key, []byte(toSign)))
+	cs.prev = signature
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// chunkedReader decodes an aws-chunked request body:
+//
+//	<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n ... 0[;chunk-signature=<sig>]\r\n[trailers]\r\n
+//
+// When signer is nil chunk signatures are not checked and any trailing
+// checksum headers are discarded
+type chunkedReader struct {
+	body   io.ReadCloser
+	r      *bufio.Reader
+	signer *chunkSigner
+	chunk  []byte
+	err    error
+}
+
+func newChunkedReader(body io.ReadCloser, signer *chunkSigner) *chunkedReader {
+	return &chunkedReader{body: body, r: bufio.NewReader(body), signer: signer}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		cr.err = cr.nextChunk()
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+func (cr *chunkedReader) nextChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	sizeStr, signature, _ := strings.Cut(line, ";")
+	signature = strings.TrimPrefix(signature, "chunk-signature=")
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errPayloadMismatch
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if cr.signer != nil && !cr.signer.verify(data, signature) {
+		return errPayloadMismatch
+	}
+
+	if size == 0 {
+		// Skip trailing headers up to the final empty line
+		for {
+			line, err := cr.r.ReadString('\n')
+			if err != nil || strings.TrimRight(line, "\r\n") == "" {
+				return io.EOF
+			}
+		}
+	}
+
+	// Each chunk's data is followed by CRLF
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(cr.r, crlf); err != nil || !bytes.Equal(crlf, []byte("\r\n")) {
+		return errPayloadMismatch
+	}
+
+	cr.chunk = data
+	return nil
+}
+
+func (cr *chunkedReader) Close() error {
+	return cr.body.Close()
+}
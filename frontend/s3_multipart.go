@@ -0,0 +1,253 @@
+package frontend
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Multipart uploads are staged inside the composed filesystem, so parts get
+// the same treatment (encryption, compression) as finished objects. The
+// staging directory is not a valid bucket name and never shows up in
+// listings.
+const multipartDir = "/.fscomposer-multipart"
+
+// minPartSize is the smallest allowed size of every part but the last
+const minPartSize = 5 << 20
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+type listPartsResult struct {
+	XMLName  xml.Name `xml:"ListPartsResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+	Parts    []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// uploadDir returns the staging directory of an upload after checking it
+// belongs to bucket/key
+func (s *S3Server) uploadDir(bucket, key, uploadID string) (string, *s3Error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || len(uploadID) != 32 {
+		return "", errNoSuchUpload
+	}
+	dir := path.Join(multipartDir, uploadID)
+
+	owner, err := s.fs.ReadFile(path.Join(dir, "object"))
+	if err != nil || string(owner) != bucket+"/"+key {
+		return "", errNoSuchUpload
+	}
+	return dir, nil
+}
+
+func partName(dir string, partNumber int) string {
+	return path.Join(dir, fmt.Sprintf("part-%05d", partNumber))
+}
+
+func (s *S3Server) createMultipartUpload(w http.ResponseWriter, bucket, key string) *s3Error {
+	uploadID := randomID()
+	dir := path.Join(multipartDir, uploadID)
+
+	if err := s.fs.MkdirAll(dir, 0700); err != nil {
+		return s3InternalError(err)
+	}
+
+	f, err := s.fs.Create(path.Join(dir, "object"))
+	if err != nil {
+		return s3InternalError(err)
+	}
+	_, err = f.WriteString(bucket + "/" + key)
+	f.Close()
+	if err != nil {
+		return s3InternalError(err)
+	}
+
+	return s.writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+func (s *S3Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) *s3Error {
+	dir, serr := s.uploadDir(bucket, key, uploadID)
+	if serr != nil {
+		return serr
+	}
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		return errInvalidArgument
+	}
+
+	sum, serr := s.writeObject(partName(dir, partNumber), r.Body, r.Header.Get("Content-Md5"))
+	if serr != nil {
+		return serr
+	}
+
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *S3Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) *s3Error {
+	dir, serr := s.uploadDir(bucket, key, uploadID)
+	if serr != nil {
+		return serr
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	// Validate the part list before writing anything
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+		info, err := s.fs.Stat(partName(dir, part.PartNumber))
+		if err != nil {
+			return errInvalidPart
+		}
+		if i < len(req.Parts)-1 && info.Size() < minPartSize {
+			return errEntityTooSmall
+		}
+	}
+
+	// The multipart ETag is the MD5 of the concatenated part MD5s
+	etagHash := md5.New()
+	serr = s.storeObject(objectPath(bucket, key), func(out io.Writer) *s3Error {
+		for _, part := range req.Parts {
+			sum, err := s.appendPart(out, partName(dir, part.PartNumber))
+			if err != nil {
+				return s3InternalError(err)
+			}
+			if strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum) {
+				return errInvalidPart
+			}
+			etagHash.Write(sum)
+		}
+		return nil
+	})
+	if serr != nil {
+		return serr
+	}
+
+	s.fs.RemoveAll(dir)
+
+	return s.writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Xmlns:  s3Namespace,
+		Bucket: bucket,
+		Key:    key,
+		ETag:   fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etagHash.Sum(nil)), len(req.Parts)),
+	})
+}
+
+// appendPart copies a staged part to out and returns the part's MD5
+func (s *S3Server) appendPart(out io.Writer, name string) ([]byte, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (s *S3Server) abortMultipartUpload(w http.ResponseWriter, bucket, key, uploadID string) *s3Error {
+	dir, serr := s.uploadDir(bucket, key, uploadID)
+	if serr != nil {
+		return serr
+	}
+	if err := s.fs.RemoveAll(dir); err != nil {
+		return s3InternalError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *S3Server) listParts(w http.ResponseWriter, bucket, key, uploadID string) *s3Error {
+	dir, serr := s.uploadDir(bucket, key, uploadID)
+	if serr != nil {
+		return serr
+	}
+
+	entries, err := s.fs.ReadDir(dir)
+	if err != nil {
+		return s3InternalError(err)
+	}
+
+	result := listPartsResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	}
+	for _, entry := range entries {
+		var partNumber int
+		if _, err := fmt.Sscanf(entry.Name(), "part-%05d", &partNumber); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sum, err := s.appendPart(io.Discard, path.Join(dir, entry.Name()))
+		if err != nil {
+			return s3InternalError(err)
+		}
+		result.Parts = append(result.Parts, s3Part{
+			PartNumber:   partNumber,
+			LastModified: formatS3Time(info.ModTime()),
+			ETag:         `"` + hex.EncodeToString(sum) + `"`,
+			Size:         info.Size(),
+		})
+	}
+	sort.Slice(result.Parts, func(i, j int) bool {
+		return result.Parts[i].PartNumber < result.Parts[j].PartNumber
+	})
+
+	return s.writeXML(w, http.StatusOK, result)
+}
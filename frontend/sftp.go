@@ -0,0 +1,703 @@
+package frontend
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/registry"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultSFTPPort is used when the mount config does not specify a port
+const DefaultSFTPPort = 2022
+
+// DefaultSFTPKeyUser is the identity of users who log in with a key from
+// the global authorized keys file
+const DefaultSFTPKeyUser = "sftp"
+
+// SFTPConfig configures the embedded SSH/SFTP server
+type SFTPConfig struct {
+	Addr               string     // Listen address (host:port)
+	HostKeyFile        string     // Private host key, generated on first start if missing
+	AuthorizedKeysFile string     // Keys accepted for any user name, chrooted to /
+	AuthorizedKeysUser string     // Identity of users logging in with those keys
+	ReadOnly           bool       // Reject all modifying requests
+	Users              []SFTPUser // Accounts allowed to log in
+}
+
+// SFTPUser describes an account allowed to log in to the SFTP server
+type SFTPUser struct {
+	Username           string
+	Password           string // Plain text, or a bcrypt hash
+	AuthorizedKeysFile string // Public keys accepted for this user
+	Root               string // Subpath the user is chrooted into
+}
+
+// SFTPConfigFromMount reads the SFTP server configuration from a mount spec
+//
+//	mount:
+//	  type: sftp
+//	  port: 2022
+//	  root: cache
+//	  options:
+//	    hostKey: /etc/fscomposer/ssh_host_ed25519_key
+//	    authorizedKeys: /etc/fscomposer/authorized_keys
+//	    authorizedKeysUser: ops
+//	    users:
+//	      - username: alice
+//	        passwordEnv: ALICE_PASSWORD
+//	        authorizedKeys: /home/alice/.ssh/authorized_keys
+//	        root: /users/alice
+func SFTPConfigFromMount(mount engine.MountConfig) (*SFTPConfig, error) {
+	opts := mount.Options
+	if opts == nil {
+		opts = map[string]interface{}{}
+	}
+
+	port := mount.Port
+	if port == 0 {
+		port = DefaultSFTPPort
+	}
+	host, err := optString(opts, "host")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &SFTPConfig{Addr: net.JoinHostPort(host, fmt.Sprint(port))}
+
+	if cfg.HostKeyFile, err = optString(opts, "hostKey"); err != nil {
+		return nil, err
+	}
+	if cfg.AuthorizedKeysFile, err = optString(opts, "authorizedKeys"); err != nil {
+		return nil, err
+	}
+	if cfg.AuthorizedKeysUser, err = optString(opts, "authorizedKeysUser"); err != nil {
+		return nil, err
+	}
+	if cfg.ReadOnly, err = optBool(opts, "readOnly", false); err != nil {
+		return nil, err
+	}
+
+	users, err := optList(opts, "users")
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range users {
+		var user SFTPUser
+		if user.Username, err = optString(u, "username"); err != nil {
+			return nil, fmt.Errorf("user %d: %w", i, err)
+		}
+		if user.Username == "" {
+			return nil, fmt.Errorf("user %d: 'username' is required", i)
+		}
+		if user.Password, err = optSecret(u, "password"); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if user.AuthorizedKeysFile, err = optString(u, "authorizedKeys"); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if user.Root, err = optString(u, "root"); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		cfg.Users = append(cfg.Users, user)
+	}
+
+	if len(cfg.Users) == 0 && cfg.AuthorizedKeysFile == "" {
+		return nil, fmt.Errorf("sftp mount requires 'users' or 'authorizedKeys' in options")
+	}
+
+	return cfg, nil
+}
+
+// SFTPServer serves a filesystem over SSH/SFTP
+type SFTPServer struct {
+	fs       absfs.FileSystem
+	config   *SFTPConfig
+	ssh      *ssh.ServerConfig
+	accounts map[string]*sftpAccount
+	anyKeys  map[string]bool // Keys from the global authorized_keys file
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// sftpAccount is a configured user with its parsed public keys
+type sftpAccount struct {
+	SFTPUser
+	keys map[string]bool
+}
+
+// NewSFTPServer creates an SFTP server for the given filesystem
+func NewSFTPServer(fs absfs.FileSystem, config *SFTPConfig) (*SFTPServer, error) {
+	s := &SFTPServer{
+		fs:       fs,
+		config:   config,
+		accounts: make(map[string]*sftpAccount),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	for _, user := range config.Users {
+		if _, dup := s.accounts[user.Username]; dup {
+			return nil, fmt.Errorf("duplicate sftp user: %s", user.Username)
+		}
+		account := &sftpAccount{SFTPUser: user}
+		if user.AuthorizedKeysFile != "" {
+			keys, err := loadAuthorizedKeys(user.AuthorizedKeysFile)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", user.Username, err)
+			}
+			account.keys = keys
+		}
+		s.accounts[user.Username] = account
+	}
+
+	if config.AuthorizedKeysFile != "" {
+		keys, err := loadAuthorizedKeys(config.AuthorizedKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		s.anyKeys = keys
+	}
+
+	hostKey, err := loadHostKey(config.HostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s.ssh = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	s.ssh.AddHostKey(hostKey)
+
+	return s, nil
+}
+
+// ListenAndServe listens on the configured address and serves connections
+func (s *SFTPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts SSH connections on the listener until Close is called
+func (s *SFTPServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Addr returns the address the server is listening on, or nil before Serve
+func (s *SFTPServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the listener and disconnects all sessions
+func (s *SFTPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// checkPassword authenticates a user by password
+func (s *SFTPServer) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	account, ok := s.accounts[meta.User()]
+	if !ok || account.Password == "" {
+		return nil, fmt.Errorf("password rejected for %s", meta.User())
+	}
+
+	if strings.HasPrefix(account.Password, "$2") {
+		if bcrypt.CompareHashAndPassword([]byte(account.Password), password) != nil {
+			return nil, fmt.Errorf("password rejected for %s", meta.User())
+		}
+	} else if subtle.ConstantTimeCompare([]byte(account.Password), password) != 1 {
+		return nil, fmt.Errorf("password rejected for %s", meta.User())
+	}
+
+	return sessionPermissions(account.Username, account.Root), nil
+}
+
+// checkPublicKey authenticates a user by public key
+func (s *SFTPServer) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	fingerprint := string(key.Marshal())
+
+	if account, ok := s.accounts[meta.User()]; ok && account.keys[fingerprint] {
+		return sessionPermissions(account.Username, account.Root), nil
+	}
+	// Global keys accept any user name, so the name the client chose is
+	// not trusted as an identity
+	if s.anyKeys[fingerprint] {
+		user := s.config.AuthorizedKeysUser
+		if user == "" {
+			user = DefaultSFTPKeyUser
+		}
+		return sessionPermissions(user, "/"), nil
+	}
+
+	return nil, fmt.Errorf("public key rejected for %s", meta.User())
+}
+
+// sessionPermissions records the authenticated identity and chroot of a
+// connection
+func sessionPermissions(user, root string) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{"user": user, "root": root}}
+}
+
+// handleConn performs the SSH handshake and serves sftp subsystem requests
+func (s *SFTPServer) handleConn(nc net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		nc.Close()
+		return
+	}
+	s.conns[nc] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+		nc.Close()
+	}()
+
+	nc.SetDeadline(time.Now().Add(30 * time.Second))
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.ssh)
+	if err != nil {
+		log.Printf("sftp: handshake failed from %s: %v", nc.RemoteAddr(), err)
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("sftp: could not accept channel: %v", err)
+			continue
+		}
+
+		go s.handleSession(conn, channel, requests)
+	}
+}
+
+// handleSession waits for the sftp subsystem request on a session channel
+func (s *SFTPServer) handleSession(conn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		// Payload is an SSH string: uint32 length followed by the name
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		handler := &sftpHandler{
+			fs:       s.userFS(conn.Permissions.Extensions["user"]),
+			root:     path.Clean("/" + conn.Permissions.Extensions["root"]),
+			readOnly: s.config.ReadOnly,
+		}
+
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  handler,
+			FilePut:  handler,
+			FileCmd:  handler,
+			FileList: handler,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("sftp: session for %s ended: %v", conn.User(), err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// userFS returns the filesystem as seen by the authenticated user, binding
+// the identity when the mounted root is identity-aware
+func (s *SFTPServer) userFS(user string) absfs.FileSystem {
+	if scoper, ok := s.fs.(registry.UserScoper); ok {
+		return scoper.ForUser(user)
+	}
+	return s.fs
+}
+
+// loadHostKey reads the server's private host key. A missing file is
+// created with a new ed25519 key; an empty path yields an ephemeral key.
+func loadHostKey(filename string) (ssh.Signer, error) {
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err == nil {
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse host key %s: %w", filename, err)
+			}
+			return signer, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read host key: %w", err)
+		}
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate host key: %w", err)
+	}
+
+	if filename == "" {
+		log.Printf("sftp: no hostKey configured, using an ephemeral host key")
+	} else {
+		block, err := ssh.MarshalPrivateKey(key, "fscomposer")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode host key: %w", err)
+		}
+		if err := os.WriteFile(filename, pem.EncodeToMemory(block), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write host key: %w", err)
+		}
+		log.Printf("sftp: generated new host key %s", filename)
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
+
+// loadAuthorizedKeys parses an OpenSSH authorized_keys file
+func loadAuthorizedKeys(filename string) (map[string]bool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized keys: %w", err)
+	}
+
+	keys := make(map[string]bool)
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break // No more keys
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", filename)
+	}
+	return keys, nil
+}
+
+// ============================================================================
+// SFTP request handlers
+// ============================================================================
+
+// sftpHandler maps SFTP requests onto an absfs filesystem, confining all
+// paths, and the targets of symlinks it creates, to root
+type sftpHandler struct {
+	fs       absfs.FileSystem
+	root     string
+	readOnly bool
+}
+
+// contains reports whether p, an absolute path that may hold "..", names
+// root or a path beneath it. Unlike path.Join, ".." at "/" does not stay
+// at "/": the backend may resolve it beyond the filesystem's own root.
+func (h *sftpHandler) contains(p string) bool {
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				return false
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return withinRoot(h.root, "/"+strings.Join(parts, "/"))
+}
+
+// withinRoot reports whether the clean path p is root or beneath it
+func withinRoot(root, p string) bool {
+	return root == "/" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+// resolve maps a client path into the user's root. Cleaning the path as
+// absolute first means ".." can never climb above root.
+func (h *sftpHandler) resolve(p string) string {
+	return path.Join(h.root, path.Clean("/"+p))
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return h.fs.OpenFile(h.resolve(r.Filepath), os.O_RDONLY, 0)
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openFile(r)
+}
+
+func (h *sftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openFile(r)
+}
+
+func (h *sftpHandler) openFile(r *sftp.Request) (absfs.File, error) {
+	if h.readOnly {
+		return nil, os.ErrPermission
+	}
+
+	pflags := r.Pflags()
+	flag := os.O_WRONLY
+	if pflags.Read {
+		flag = os.O_RDWR
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	// O_APPEND is deliberately not passed: clients send explicit offsets
+	// and WriteAt is not permitted on files opened for append
+
+	perm := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+
+	return h.fs.OpenFile(h.resolve(r.Filepath), flag, perm)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if h.readOnly {
+		return os.ErrPermission
+	}
+
+	name := h.resolve(r.Filepath)
+
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(name, r)
+
+	case "Rename":
+		// SFTP v3 renames must not replace an existing target
+		if _, err := h.fs.Stat(h.resolve(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return h.fs.Rename(name, h.resolve(r.Target))
+
+	case "Rmdir":
+		info, err := h.fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", r.Filepath)
+		}
+		return h.fs.Remove(name)
+
+	case "Remove":
+		info, err := h.fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", r.Filepath)
+		}
+		return h.fs.Remove(name)
+
+	case "Mkdir":
+		perm := os.FileMode(0755)
+		if r.AttrFlags().Permissions {
+			perm = r.Attributes().FileMode().Perm()
+		}
+		return h.fs.Mkdir(name, perm)
+
+	case "Symlink":
+		linker, ok := h.fs.(absfs.SymLinker)
+		if !ok {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		// For symlinks Filepath is the link target and Target the new link.
+		// Absolute targets are mapped into root; relative ones are stored
+		// as given, so they must not climb out of it.
+		link := h.resolve(r.Target)
+		target := r.Filepath
+		if path.IsAbs(target) {
+			target = name
+		} else if !h.contains(path.Dir(link) + "/" + target) {
+			return os.ErrPermission
+		}
+		return linker.Symlink(target, link)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename implements the posix-rename@openssh.com extension, which
+// replaces an existing target
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+	if h.readOnly {
+		return os.ErrPermission
+	}
+	return h.fs.Rename(h.resolve(r.Filepath), h.resolve(r.Target))
+}
+
+func (h *sftpHandler) setstat(name string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.Size {
+		if err := h.fs.Truncate(name, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := h.fs.Chmod(name, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := h.fs.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := h.fs.Chown(name, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := h.resolve(r.Filepath)
+
+	switch r.Method {
+	case "List":
+		entries, err := h.fs.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue // Removed while listing
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+
+	case "Stat":
+		info, err := h.fs.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	linker, ok := h.fs.(absfs.SymLinker)
+	if !ok {
+		return h.Filelist(r)
+	}
+	info, err := linker.Lstat(h.resolve(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+func (h *sftpHandler) Readlink(p string) (string, error) {
+	linker, ok := h.fs.(absfs.SymLinker)
+	if !ok {
+		return "", sftp.ErrSSHFxOpUnsupported
+	}
+	target, err := linker.Readlink(h.resolve(p))
+	if err != nil {
+		return "", err
+	}
+	// Present absolute targets relative to the user's root
+	if path.IsAbs(target) && h.root != "/" && withinRoot(h.root, path.Clean(target)) {
+		target = "/" + strings.TrimPrefix(strings.TrimPrefix(path.Clean(target), h.root), "/")
+	}
+	return target, nil
+}
+
+// listerAt serves a fixed slice of file infos to the request server
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(buf []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, l[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
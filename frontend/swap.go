@@ -0,0 +1,223 @@
+package frontend
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/registry"
+)
+
+// SwapFS serves a filesystem stack that can be replaced while mounted. New
+// operations go to the current stack; files opened before a swap keep using
+// the stack they were opened on until they are closed.
+type SwapFS struct {
+	current atomic.Pointer[generation]
+}
+
+// generation is one stack served by a SwapFS and its open file count
+type generation struct {
+	fs      absfs.FileSystem
+	mu      sync.Mutex
+	open    int
+	retired bool
+	drained chan struct{}
+	drain   sync.Once
+}
+
+// NewSwapFS creates a SwapFS serving fs
+func NewSwapFS(fs absfs.FileSystem) *SwapFS {
+	s := &SwapFS{}
+	s.current.Store(newGeneration(fs))
+	return s
+}
+
+func newGeneration(fs absfs.FileSystem) *generation {
+	return &generation{fs: fs, drained: make(chan struct{})}
+}
+
+// Current returns the stack currently being served
+func (s *SwapFS) Current() absfs.FileSystem {
+	return s.current.Load().fs
+}
+
+// Swap atomically replaces the served stack. The returned channel is closed
+// once every file opened on the previous stack has been closed.
+func (s *SwapFS) Swap(fs absfs.FileSystem) <-chan struct{} {
+	old := s.current.Swap(newGeneration(fs))
+
+	old.mu.Lock()
+	old.retired = true
+	if old.open == 0 {
+		old.drain.Do(func() { close(old.drained) })
+	}
+	old.mu.Unlock()
+
+	return old.drained
+}
+
+// OpenFiles returns the number of files open on the current stack
+func (s *SwapFS) OpenFiles() int {
+	gen := s.current.Load()
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	return gen.open
+}
+
+func (g *generation) release() {
+	g.mu.Lock()
+	g.open--
+	if g.retired && g.open == 0 {
+		g.drain.Do(func() { close(g.drained) })
+	}
+	g.mu.Unlock()
+}
+
+// track counts f against the generation it was opened on
+func (g *generation) track(f absfs.File, err error) (absfs.File, error) {
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.open++
+	g.mu.Unlock()
+	return &swapFile{File: f, gen: g}, nil
+}
+
+func (s *SwapFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	gen := s.current.Load()
+	return gen.track(gen.fs.OpenFile(name, flag, perm))
+}
+
+func (s *SwapFS) Open(name string) (absfs.File, error) {
+	gen := s.current.Load()
+	return gen.track(gen.fs.Open(name))
+}
+
+func (s *SwapFS) Create(name string) (absfs.File, error) {
+	gen := s.current.Load()
+	return gen.track(gen.fs.Create(name))
+}
+
+func (s *SwapFS) Mkdir(name string, perm os.FileMode) error {
+	return s.Current().Mkdir(name, perm)
+}
+
+func (s *SwapFS) MkdirAll(name string, perm os.FileMode) error {
+	return s.Current().MkdirAll(name, perm)
+}
+
+func (s *SwapFS) Remove(name string) error {
+	return s.Current().Remove(name)
+}
+
+func (s *SwapFS) RemoveAll(name string) error {
+	return s.Current().RemoveAll(name)
+}
+
+func (s *SwapFS) Rename(oldpath, newpath string) error {
+	return s.Current().Rename(oldpath, newpath)
+}
+
+func (s *SwapFS) Stat(name string) (os.FileInfo, error) {
+	return s.Current().Stat(name)
+}
+
+func (s *SwapFS) Chmod(name string, mode os.FileMode) error {
+	return s.Current().Chmod(name, mode)
+}
+
+func (s *SwapFS) Chtimes(name string, atime, mtime time.Time) error {
+	return s.Current().Chtimes(name, atime, mtime)
+}
+
+func (s *SwapFS) Chown(name string, uid, gid int) error {
+	return s.Current().Chown(name, uid, gid)
+}
+
+func (s *SwapFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return s.Current().ReadDir(name)
+}
+
+func (s *SwapFS) ReadFile(name string) ([]byte, error) {
+	return s.Current().ReadFile(name)
+}
+
+func (s *SwapFS) Sub(dir string) (fs.FS, error) {
+	return s.Current().Sub(dir)
+}
+
+func (s *SwapFS) Chdir(dir string) error {
+	return s.Current().Chdir(dir)
+}
+
+func (s *SwapFS) Getwd() (string, error) {
+	return s.Current().Getwd()
+}
+
+func (s *SwapFS) TempDir() string {
+	return s.Current().TempDir()
+}
+
+func (s *SwapFS) Truncate(name string, size int64) error {
+	return s.Current().Truncate(name, size)
+}
+
+// Symlink operations are passed through when the current stack supports
+// them. Lstat falls back to Stat so frontends can always call it.
+
+func (s *SwapFS) Lstat(name string) (os.FileInfo, error) {
+	current := s.Current()
+	if linker, ok := current.(absfs.SymLinker); ok {
+		return linker.Lstat(name)
+	}
+	return current.Stat(name)
+}
+
+func (s *SwapFS) Lchown(name string, uid, gid int) error {
+	current := s.Current()
+	if linker, ok := current.(absfs.SymLinker); ok {
+		return linker.Lchown(name, uid, gid)
+	}
+	return current.Chown(name, uid, gid)
+}
+
+func (s *SwapFS) Readlink(name string) (string, error) {
+	if linker, ok := s.Current().(absfs.SymLinker); ok {
+		return linker.Readlink(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (s *SwapFS) Symlink(oldname, newname string) error {
+	if linker, ok := s.Current().(absfs.SymLinker); ok {
+		return linker.Symlink(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
+
+// ForUser scopes the current stack to user when it supports identities.
+// Sessions scoped this way stay on the stack they started on.
+func (s *SwapFS) ForUser(user string) absfs.FileSystem {
+	if scoper, ok := s.Current().(registry.UserScoper); ok {
+		return scoper.ForUser(user)
+	}
+	return s
+}
+
+// swapFile releases its generation when closed
+type swapFile struct {
+	absfs.File
+	gen    *generation
+	closed sync.Once
+}
+
+func (f *swapFile) Close() error {
+	err := f.File.Close()
+	f.closed.Do(f.gen.release)
+	return err
+}
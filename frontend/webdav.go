@@ -0,0 +1,225 @@
+package frontend
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/engine"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+)
+
+// DefaultWebDAVPort is used when the mount config does not specify a port
+const DefaultWebDAVPort = 8080
+
+// WebDAVConfig configures the WebDAV server
+type WebDAVConfig struct {
+	Addr     string       // Listen address (host:port)
+	Prefix   string       // URL path the filesystem is served under
+	ReadOnly bool         // Reject all modifying requests
+	Users    []WebDAVUser // Basic auth accounts; none allows anonymous access
+}
+
+// WebDAVUser is a basic auth account allowed to use the WebDAV server
+type WebDAVUser struct {
+	Username string
+	Password string // Plain text, or a bcrypt hash
+}
+
+// WebDAVConfigFromMount reads the WebDAV server configuration from a mount
+// spec. Without users the server only listens on localhost unless a host
+// is given.
+//
+//	mount:
+//	  type: webdav
+//	  port: 8080
+//	  root: cache
+//	  options:
+//	    prefix: /dav
+//	    readOnly: false
+//	    users:
+//	      - username: alice
+//	        passwordEnv: ALICE_PASSWORD
+func WebDAVConfigFromMount(mount engine.MountConfig) (*WebDAVConfig, error) {
+	opts := mount.Options
+	if opts == nil {
+		opts = map[string]interface{}{}
+	}
+
+	port := mount.Port
+	if port == 0 {
+		port = DefaultWebDAVPort
+	}
+	host, err := optString(opts, "host")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &WebDAVConfig{}
+	if cfg.Prefix, err = optString(opts, "prefix"); err != nil {
+		return nil, err
+	}
+	cfg.Prefix = strings.TrimSuffix(cfg.Prefix, "/")
+	if cfg.ReadOnly, err = optBool(opts, "readOnly", false); err != nil {
+		return nil, err
+	}
+
+	users, err := optList(opts, "users")
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range users {
+		var user WebDAVUser
+		if user.Username, err = optString(u, "username"); err != nil {
+			return nil, fmt.Errorf("user %d: %w", i, err)
+		}
+		if user.Username == "" {
+			return nil, fmt.Errorf("user %d: 'username' is required", i)
+		}
+		if user.Password, err = optSecret(u, "password"); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Username, err)
+		}
+		if user.Password == "" {
+			return nil, fmt.Errorf("user %s: 'password' is required", user.Username)
+		}
+		cfg.Users = append(cfg.Users, user)
+	}
+
+	if host == "" && len(cfg.Users) == 0 {
+		host = "localhost"
+	}
+	cfg.Addr = net.JoinHostPort(host, fmt.Sprint(port))
+	return cfg, nil
+}
+
+// WebDAVServer serves a filesystem over WebDAV
+type WebDAVServer struct {
+	config  *WebDAVConfig
+	handler *webdav.Handler
+	users   map[string]string
+	server  *http.Server
+}
+
+// NewWebDAVServer creates a WebDAV server for the given filesystem
+func NewWebDAVServer(fs absfs.FileSystem, config *WebDAVConfig) (*WebDAVServer, error) {
+	s := &WebDAVServer{
+		config: config,
+		users:  make(map[string]string),
+		handler: &webdav.Handler{
+			Prefix:     config.Prefix,
+			FileSystem: webdavFS{fs},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !os.IsNotExist(err) {
+					log.Printf("webdav: %s %s: %v", r.Method, r.URL.Path, err)
+				}
+			},
+		},
+	}
+
+	for _, user := range config.Users {
+		if _, dup := s.users[user.Username]; dup {
+			return nil, fmt.Errorf("duplicate webdav user: %s", user.Username)
+		}
+		s.users[user.Username] = user.Password
+	}
+
+	s.server = &http.Server{
+		Addr:              config.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	return s, nil
+}
+
+// ListenAndServe listens on the configured address and serves requests
+func (s *WebDAVServer) ListenAndServe() error {
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Serve accepts connections on the listener until Close is called
+func (s *WebDAVServer) Serve(l net.Listener) error {
+	if err := s.server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops the server and closes all connections
+func (s *WebDAVServer) Close() error {
+	return s.server.Close()
+}
+
+// ServeHTTP authenticates and serves a WebDAV request
+func (s *WebDAVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.users) > 0 && !s.authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fscomposer"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.config.ReadOnly && !webdavReadOnlyMethods[r.Method] {
+		http.Error(w, "Filesystem is read-only", http.StatusForbidden)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *WebDAVServer) authenticate(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, ok := s.users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(want, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(want), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// webdavReadOnlyMethods are allowed on read-only servers
+var webdavReadOnlyMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// webdavFS adapts an absfs filesystem to webdav.FileSystem; absfs files
+// already implement webdav.File
+type webdavFS struct {
+	fs absfs.FileSystem
+}
+
+func (w webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return w.fs.Mkdir(name, perm)
+}
+
+func (w webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	return w.fs.OpenFile(name, flag, perm)
+}
+
+func (w webdavFS) RemoveAll(ctx context.Context, name string) error {
+	return w.fs.RemoveAll(name)
+}
+
+func (w webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return w.fs.Rename(oldName, newName)
+}
+
+func (w webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return w.fs.Stat(name)
+}
@@ -0,0 +1,211 @@
+// Package graph renders a composition as a diagram: the full node DAG,
+// including the backends multiplexers reference in config, with node
+// types, key config values and the mount.
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/absfs/fscomposer/engine"
+)
+
+// Output formats accepted by Render
+const (
+	FormatASCII   = "ascii"
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+	FormatSVG     = "svg"
+)
+
+// Formats lists the formats Render accepts
+var Formats = []string{FormatASCII, FormatDOT, FormatMermaid, FormatSVG}
+
+// MaxSettings is how many config values are shown per node
+const MaxSettings = 4
+
+// maxValueLen is the longest config value shown before it is shortened
+const maxValueLen = 32
+
+// Graph is a composition prepared for rendering
+type Graph struct {
+	Name  string        `json:"name"`
+	Nodes []Node        `json:"nodes"`
+	Edges []engine.Edge `json:"edges"`
+	Mount Mount         `json:"mount"`
+}
+
+// Node is one node of the graph
+type Node struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Category string    `json:"category"` // backend, wrapper or multiplexer
+	Settings []Setting `json:"settings,omitempty"`
+	Root     bool      `json:"root,omitempty"` // Mounted by the frontend
+	Level    int       `json:"level"`          // Longest path from a node without inputs
+}
+
+// Setting is a config value shown on a node
+type Setting struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Mount describes the frontend serving the root node
+type Mount struct {
+	Type   string `json:"type"`
+	Root   string `json:"root"`
+	Target string `json:"target,omitempty"` // Mountpoint or listen port
+}
+
+// New prepares spec for rendering
+func New(spec *engine.CompositionSpec) *Graph {
+	g := &Graph{
+		Name:  spec.Name,
+		Nodes: make([]Node, 0, len(spec.Nodes)),
+		Edges: spec.Edges(),
+		Mount: Mount{Type: spec.Mount.Type, Root: spec.Mount.Root, Target: spec.Mount.Path},
+	}
+	if g.Mount.Target == "" && spec.Mount.Port != 0 {
+		g.Mount.Target = fmt.Sprintf(":%d", spec.Mount.Port)
+	}
+
+	for _, n := range spec.Nodes {
+		category := "wrapper"
+		switch {
+		case engine.IsBackendNode(n.Type):
+			category = "backend"
+		case engine.IsMultiplexerNode(n.Type):
+			category = "multiplexer"
+		}
+		g.Nodes = append(g.Nodes, Node{
+			ID:       n.ID,
+			Type:     n.Type,
+			Category: category,
+			Settings: settings(n.Type, n.Config),
+			Root:     n.ID == spec.Mount.Root,
+		})
+	}
+
+	// Level each node by its longest input path, guarding against cycles
+	levels := make(map[string]int)
+	visiting := make(map[string]bool)
+	var level func(id string) int
+	level = func(id string) int {
+		if l, ok := levels[id]; ok {
+			return l
+		}
+		if visiting[id] {
+			return 0
+		}
+		visiting[id] = true
+		l := 0
+		for _, in := range g.inputs(id) {
+			if v := level(in.From) + 1; v > l {
+				l = v
+			}
+		}
+		visiting[id] = false
+		levels[id] = l
+		return l
+	}
+	for i := range g.Nodes {
+		g.Nodes[i].Level = level(g.Nodes[i].ID)
+	}
+	return g
+}
+
+// Render draws the graph in one of Formats
+func (g *Graph) Render(format string) (string, error) {
+	switch format {
+	case FormatASCII:
+		return g.ASCII(), nil
+	case FormatDOT:
+		return g.DOT(), nil
+	case FormatMermaid:
+		return g.Mermaid(), nil
+	case FormatSVG:
+		return g.SVG(), nil
+	default:
+		return "", fmt.Errorf("unknown graph format %q (available: %s)", format, strings.Join(Formats, ", "))
+	}
+}
+
+// node returns the node with the given ID, or nil
+func (g *Graph) node(id string) *Node {
+	for i := range g.Nodes {
+		if g.Nodes[i].ID == id {
+			return &g.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// inputs returns the edges into a node, in edge order
+func (g *Graph) inputs(id string) []engine.Edge {
+	var edges []engine.Edge
+	for _, e := range g.Edges {
+		if e.To == id {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
+// outputs returns the edges out of a node, in edge order
+func (g *Graph) outputs(id string) []engine.Edge {
+	var edges []engine.Edge
+	for _, e := range g.Edges {
+		if e.From == id {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
+// mountLabel is the mount type and its mountpoint or port
+func (g *Graph) mountLabel() string {
+	if g.Mount.Target == "" {
+		return g.Mount.Type
+	}
+	return g.Mount.Type + " " + g.Mount.Target
+}
+
+// lines are the text lines drawn for a node: ID, type, then settings
+func (n *Node) lines() []string {
+	lines := []string{n.ID, n.Type}
+	for _, s := range n.Settings {
+		lines = append(lines, s.Key+"="+s.Value)
+	}
+	return lines
+}
+
+// settings picks the scalar config values worth showing, leaving out
+// lists, maps and anything that looks like a secret
+func settings(nodeType string, config map[string]interface{}) []Setting {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out []Setting
+	for _, k := range keys {
+		if len(out) == MaxSettings {
+			break
+		}
+		if engine.IsSecretField(nodeType, k) {
+			continue
+		}
+		switch v := config[k].(type) {
+		case string, bool, int, int64, float64:
+			value := fmt.Sprint(v)
+			if len(value) > maxValueLen {
+				value = value[:maxValueLen-3] + "..."
+			}
+			out = append(out, Setting{Key: k, Value: value})
+		}
+	}
+	return out
+}
@@ -0,0 +1,199 @@
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ASCII draws the graph as a tree hanging from the mount: each node lists
+// the nodes it reads from. A node shared by several parents is drawn once
+// and referred to afterwards; nodes the mount cannot reach follow at the
+// end.
+func (g *Graph) ASCII() string {
+	var b strings.Builder
+	drawn := make(map[string]bool)
+	onPath := make(map[string]bool)
+
+	var draw func(id, label, prefix string, last bool)
+	draw = func(id, label, prefix string, last bool) {
+		branch, indent := "├── ", "│   "
+		if last {
+			branch, indent = "└── ", "    "
+		}
+		if label != "" {
+			label = "[" + label + "] "
+		}
+
+		n := g.node(id)
+		switch {
+		case n == nil:
+			fmt.Fprintf(&b, "%s%s%s%s (missing)\n", prefix, branch, label, id)
+			return
+		case onPath[id]:
+			fmt.Fprintf(&b, "%s%s%s%s (cycle)\n", prefix, branch, label, id)
+			return
+		case drawn[id]:
+			fmt.Fprintf(&b, "%s%s%s%s (see above)\n", prefix, branch, label, id)
+			return
+		}
+
+		fmt.Fprintf(&b, "%s%s%s%s", prefix, branch, label, asciiNode(n))
+		drawn[id] = true
+		onPath[id] = true
+		inputs := g.inputs(id)
+		for i, e := range inputs {
+			draw(e.From, e.Label, prefix+indent, i == len(inputs)-1)
+		}
+		onPath[id] = false
+	}
+
+	fmt.Fprintf(&b, "%s (%s)\n", g.Name, g.mountLabel())
+	draw(g.Mount.Root, "", "", true)
+
+	// Trees the mount does not reach, topmost nodes first so each tree is
+	// drawn whole
+	order := make([]*Node, len(g.Nodes))
+	for i := range g.Nodes {
+		order[i] = &g.Nodes[i]
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].Level > order[j].Level })
+	header := false
+	for _, n := range order {
+		if drawn[n.ID] {
+			continue
+		}
+		if !header {
+			b.WriteString("\nNot reachable from the mount root:\n")
+			header = true
+		}
+		draw(n.ID, "", "", true)
+	}
+	return b.String()
+}
+
+func asciiNode(n *Node) string {
+	s := fmt.Sprintf("%s (%s)", n.ID, n.Type)
+	for _, set := range n.Settings {
+		s += " " + set.Key + "=" + set.Value
+	}
+	return s + "\n"
+}
+
+// DOT renders the graph for Graphviz. Data flows upwards from the
+// backends to the mount; config references are dashed.
+func (g *Graph) DOT() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(g.Name))
+	b.WriteString("  rankdir=BT;\n")
+	b.WriteString("  node [shape=box, style=\"rounded,filled\", fillcolor=white, fontname=\"Helvetica\"];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=10];\n\n")
+
+	for _, n := range g.Nodes {
+		attrs := []string{"label=" + dotQuote(strings.Join(n.lines(), "\n"))}
+		switch n.Category {
+		case "backend":
+			attrs = append(attrs, "shape=cylinder", "fillcolor=\"#e8f0fe\"")
+		case "multiplexer":
+			attrs = append(attrs, "shape=diamond", "fillcolor=\"#fef7e0\"")
+		}
+		if n.Root {
+			attrs = append(attrs, "penwidth=2")
+		}
+		fmt.Fprintf(&b, "  %s [%s];\n", dotQuote(n.ID), strings.Join(attrs, ", "))
+	}
+	fmt.Fprintf(&b, "  %s [label=%s, shape=note, fillcolor=\"#e6f4ea\"];\n\n", dotQuote(mountID), dotQuote(g.mountLabel()))
+
+	for _, e := range g.Edges {
+		var attrs []string
+		if e.Config {
+			attrs = append(attrs, "style=dashed")
+		}
+		if e.Label != "" {
+			attrs = append(attrs, "label="+dotQuote(e.Label))
+		}
+		fmt.Fprintf(&b, "  %s -> %s", dotQuote(e.From), dotQuote(e.To))
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	if g.Mount.Root != "" {
+		fmt.Fprintf(&b, "  %s -> %s [style=bold];\n", dotQuote(g.Mount.Root), dotQuote(mountID))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// mountID names the mount in DOT output; node IDs cannot contain spaces
+// in practice, so it never collides
+const mountID = "mount point"
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+// Mermaid renders the graph as a Mermaid flowchart
+func (g *Graph) Mermaid() string {
+	ids := make(map[string]string, len(g.Nodes))
+	for i, n := range g.Nodes {
+		ids[n.ID] = fmt.Sprintf("n%d", i)
+	}
+	ref := func(id string) string {
+		if v, ok := ids[id]; ok {
+			return v
+		}
+		v := fmt.Sprintf("n%d", len(ids))
+		ids[id] = v
+		return v
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart BT\n")
+	for _, n := range g.Nodes {
+		lines := n.lines()
+		lines[0] = "<b>" + mermaidEscape(lines[0]) + "</b>"
+		for i := 1; i < len(lines); i++ {
+			lines[i] = mermaidEscape(lines[i])
+		}
+		label := `"` + strings.Join(lines, "<br/>") + `"`
+		switch n.Category {
+		case "backend":
+			fmt.Fprintf(&b, "  %s[(%s)]\n", ids[n.ID], label)
+		case "multiplexer":
+			fmt.Fprintf(&b, "  %s{{%s}}\n", ids[n.ID], label)
+		default:
+			fmt.Fprintf(&b, "  %s[%s]\n", ids[n.ID], label)
+		}
+	}
+	fmt.Fprintf(&b, "  mount([\"%s\"])\n", mermaidEscape(g.mountLabel()))
+
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Config {
+			arrow = "-.->"
+		}
+		if e.Label != "" {
+			arrow += `|"` + mermaidEscape(e.Label) + `"|`
+		}
+		fmt.Fprintf(&b, "  %s %s %s\n", ref(e.From), arrow, ref(e.To))
+	}
+	if g.Mount.Root != "" {
+		fmt.Fprintf(&b, "  %s ==> mount\n", ref(g.Mount.Root))
+	}
+
+	b.WriteString("  classDef root stroke-width:3px\n")
+	if g.Mount.Root != "" {
+		fmt.Fprintf(&b, "  class %s root\n", ref(g.Mount.Root))
+	}
+	return b.String()
+}
+
+// mermaidEscape replaces the characters Mermaid treats as syntax inside
+// quoted labels with entity codes
+func mermaidEscape(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
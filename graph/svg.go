@@ -0,0 +1,211 @@
+package graph
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/absfs/fscomposer/engine"
+)
+
+// SVG layout constants, in pixels
+const (
+	svgCharWidth  = 7.2 // Monospace advance at svgFontSize
+	svgFontSize   = 12
+	svgLineHeight = 16
+	svgPadX       = 12
+	svgPadY       = 8
+	svgGapX       = 40
+	svgGapY       = 60
+	svgMargin     = 20
+)
+
+type svgBox struct {
+	lines []string
+	x, y  float64 // Top left
+	w, h  float64
+	node  *Node // Nil for the mount
+}
+
+func (b *svgBox) top() (float64, float64)    { return b.x + b.w/2, b.y }
+func (b *svgBox) bottom() (float64, float64) { return b.x + b.w/2, b.y + b.h }
+
+// SVG draws the graph as a standalone image without external tools. Nodes
+// are laid out in rows by level with the backends at the bottom and the
+// mount at the top; within a row, nodes sit near the nodes they read from.
+func (g *Graph) SVG() string {
+	maxLevel := 0
+	for _, n := range g.Nodes {
+		if n.Level > maxLevel {
+			maxLevel = n.Level
+		}
+	}
+
+	// Rows from the top: the mount, then levels from highest to lowest
+	rows := make([][]*svgBox, maxLevel+2)
+	boxes := make(map[string]*svgBox)
+	mount := newSVGBox([]string{"mount", g.mountLabel()}, nil)
+	rows[0] = []*svgBox{mount}
+	for i := range g.Nodes {
+		n := &g.Nodes[i]
+		box := newSVGBox(n.lines(), n)
+		boxes[n.ID] = box
+		row := maxLevel - n.Level + 1
+		rows[row] = append(rows[row], box)
+	}
+
+	// Order each row above the lowest by the average position of its inputs
+	position := make(map[string]float64)
+	for i, box := range rows[len(rows)-1] {
+		position[box.node.ID] = float64(i)
+	}
+	for r := len(rows) - 2; r >= 1; r-- {
+		for i, box := range rows[r] {
+			sum, count := 0.0, 0
+			for _, e := range g.inputs(box.node.ID) {
+				if p, ok := position[e.From]; ok {
+					sum += p
+					count++
+				}
+			}
+			if count > 0 {
+				position[box.node.ID] = sum / float64(count)
+			} else {
+				position[box.node.ID] = float64(i)
+			}
+		}
+		row := rows[r]
+		sort.SliceStable(row, func(i, j int) bool { return position[row[i].node.ID] < position[row[j].node.ID] })
+		for i, box := range row {
+			position[box.node.ID] = float64(i)
+		}
+	}
+
+	// Place rows, centring each on the widest
+	width := 0.0
+	for _, row := range rows {
+		if w := rowWidth(row); w > width {
+			width = w
+		}
+	}
+	y := float64(svgMargin)
+	for _, row := range rows {
+		x := svgMargin + (width-rowWidth(row))/2
+		height := 0.0
+		for _, box := range row {
+			box.x, box.y = x, y
+			x += box.w + svgGapX
+			if box.h > height {
+				height = box.h
+			}
+		}
+		y += height + svgGapY
+	}
+	totalW := width + 2*svgMargin
+	totalH := y - svgGapY + svgMargin
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="monospace" font-size="%d">`+"\n",
+		totalW, totalH, totalW, totalH, svgFontSize)
+	fmt.Fprintf(&b, "  <title>%s</title>\n", html.EscapeString(g.Name))
+	b.WriteString(`  <defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z" fill="#555"/></marker></defs>` + "\n")
+
+	// Edges first so boxes are drawn over them. Parallel edges, such as a
+	// route and the default to the same backend, share one line.
+	var edges []engine.Edge
+	merged := make(map[[2]string]int)
+	for _, e := range g.Edges {
+		key := [2]string{e.From, e.To}
+		if i, ok := merged[key]; ok {
+			if e.Label != "" {
+				edges[i].Label = strings.TrimPrefix(edges[i].Label+", "+e.Label, ", ")
+			}
+			edges[i].Config = edges[i].Config && e.Config
+			continue
+		}
+		merged[key] = len(edges)
+		edges = append(edges, e)
+	}
+	for _, e := range edges {
+		from, to := boxes[e.From], boxes[e.To]
+		if from == nil || to == nil {
+			continue
+		}
+		x1, y1 := from.top()
+		x2, y2 := to.bottom()
+		dash := ""
+		if e.Config {
+			dash = ` stroke-dasharray="5,4"`
+		}
+		fmt.Fprintf(&b, `  <line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555"%s marker-end="url(#arrow)"/>`+"\n", x1, y1, x2, y2, dash)
+		if e.Label != "" {
+			fmt.Fprintf(&b, `  <text x="%.1f" y="%.1f" text-anchor="middle" font-size="10" fill="#555" stroke="#fff" stroke-width="3" paint-order="stroke">%s</text>`+"\n",
+				(x1+x2)/2, (y1+y2)/2, html.EscapeString(e.Label))
+		}
+	}
+	if root := boxes[g.Mount.Root]; root != nil {
+		x1, y1 := root.top()
+		x2, y2 := mount.bottom()
+		fmt.Fprintf(&b, `  <line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555" stroke-width="2" marker-end="url(#arrow)"/>`+"\n", x1, y1, x2, y2)
+	}
+
+	for _, row := range rows {
+		for _, box := range row {
+			writeSVGBox(&b, box)
+		}
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+func newSVGBox(lines []string, n *Node) *svgBox {
+	longest := 0
+	for _, l := range lines {
+		if len(l) > longest {
+			longest = len(l)
+		}
+	}
+	return &svgBox{
+		lines: lines,
+		w:     float64(longest)*svgCharWidth + 2*svgPadX,
+		h:     float64(len(lines)*svgLineHeight) + 2*svgPadY,
+		node:  n,
+	}
+}
+
+func rowWidth(row []*svgBox) float64 {
+	w := 0.0
+	for i, box := range row {
+		if i > 0 {
+			w += svgGapX
+		}
+		w += box.w
+	}
+	return w
+}
+
+func writeSVGBox(b *strings.Builder, box *svgBox) {
+	fill, stroke, width, radius := "#ffffff", "#555", 1, 6
+	switch {
+	case box.node == nil:
+		fill, radius = "#e6f4ea", 16
+	case box.node.Category == "backend":
+		fill = "#e8f0fe"
+	case box.node.Category == "multiplexer":
+		fill = "#fef7e0"
+	}
+	if box.node != nil && box.node.Root {
+		width = 2
+	}
+	fmt.Fprintf(b, `  <rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" rx="%d" fill="%s" stroke="%s" stroke-width="%d"/>`+"\n",
+		box.x, box.y, box.w, box.h, radius, fill, stroke, width)
+	for i, line := range box.lines {
+		weight := ""
+		if i == 0 {
+			weight = ` font-weight="bold"`
+		}
+		fmt.Fprintf(b, `  <text x="%.1f" y="%.1f" text-anchor="middle"%s>%s</text>`+"\n",
+			box.x+box.w/2, box.y+svgPadY+float64(i+1)*svgLineHeight-4, weight, html.EscapeString(line))
+	}
+}
@@ -0,0 +1,292 @@
+// Package instance tracks the compositions running on this host
+//
+// Every running mount writes a JSON record and a pidfile to the state
+// directory so other fscomposer processes can list, inspect and stop it.
+// A lock file claims the name first, before anything is mounted.
+package instance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/absfs/fscomposer/internal/atomicfile"
+)
+
+// Record describes a running composition
+type Record struct {
+	Name      string    `json:"name"`
+	PID       int       `json:"pid"`
+	SpecFile  string    `json:"specFile"`
+	MountType string    `json:"mountType"`
+	Target    string    `json:"target"` // Mountpoint or listen address
+	LogFile   string    `json:"logFile,omitempty"`
+	PIDFile   string    `json:"pidFile"`
+	Control   string    `json:"controlSocket,omitempty"` // Unix socket of the control API
+	Started   time.Time `json:"started"`
+}
+
+// Uptime returns how long the composition has been running
+func (r *Record) Uptime() time.Duration {
+	return time.Since(r.Started).Round(time.Second)
+}
+
+// validName matches the names instances may have. Names become file names
+// in the state directory, so they cannot contain separators.
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidName checks that name can name an instance
+func ValidName(name string) error {
+	if !validName.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid instance name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// Dir returns the state directory, creating it if needed. It is taken from
+// FSCOMPOSER_STATE_DIR, then $XDG_RUNTIME_DIR/fscomposer, then
+// ~/.fscomposer/run.
+func Dir() (string, error) {
+	dir := os.Getenv("FSCOMPOSER_STATE_DIR")
+	if dir == "" {
+		if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+			dir = filepath.Join(runtimeDir, "fscomposer")
+		} else {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("failed to locate state directory: %w", err)
+			}
+			dir = filepath.Join(home, ".fscomposer", "run")
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return dir, nil
+}
+
+// path returns the file of an instance in the state directory with the
+// given extension
+func path(name, ext string) (string, error) {
+	if err := ValidName(name); err != nil {
+		return "", err
+	}
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+ext), nil
+}
+
+// DefaultPIDFile returns the pidfile path used when none is configured
+func DefaultPIDFile(name string) (string, error) {
+	return path(name, ".pid")
+}
+
+// DefaultLogFile returns the log file path used for daemons when none is
+// configured
+func DefaultLogFile(name string) (string, error) {
+	return path(name, ".log")
+}
+
+// ControlSocket returns the control socket path for an instance
+func ControlSocket(name string) (string, error) {
+	return path(name, ".sock")
+}
+
+// Claim reserves a name for the process pid by creating its lock file, so
+// two processes cannot both start an instance with that name. A lock left
+// by a process that has died is taken over. Claiming a name pid already
+// holds succeeds.
+func Claim(name string, pid int) error {
+	lock, err := path(name, ".lock")
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(pid) + "\n")
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lock)
+				return fmt.Errorf("failed to write lock file: %w", err)
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		owner, err := readPID(lock)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && attempt < 3:
+			// Released since; try again
+		case err != nil:
+			// Created by a process that has not written its pid yet
+			return fmt.Errorf("composition %s is already starting", name)
+		case owner == pid:
+			return nil
+		case ProcessAlive(owner):
+			return fmt.Errorf("composition %s is already running (pid %d)", name, owner)
+		case attempt < 3:
+			// Left by a process that died; take it over
+			os.Remove(lock)
+		default:
+			return fmt.Errorf("failed to claim %s: lock file %s keeps changing", name, lock)
+		}
+	}
+}
+
+// Owner returns the pid of the live process holding the named lock
+func Owner(name string) (int, bool) {
+	lock, err := path(name, ".lock")
+	if err != nil {
+		return 0, false
+	}
+	pid, err := readPID(lock)
+	if err != nil || !ProcessAlive(pid) {
+		return 0, false
+	}
+	return pid, true
+}
+
+// Release removes the lock on a name if pid holds it
+func Release(name string, pid int) {
+	lock, err := path(name, ".lock")
+	if err != nil {
+		return
+	}
+	if owner, err := readPID(lock); err == nil && owner == pid {
+		os.Remove(lock)
+	}
+}
+
+// readPID reads the pid a lock file or pidfile holds
+func readPID(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Register claims the record's name for its pid, if it is not claimed
+// already, and writes the record and its pidfile. It fails if another live
+// process holds the name.
+func Register(rec *Record) error {
+	file, err := path(rec.Name, ".json")
+	if err != nil {
+		return err
+	}
+	if err := Claim(rec.Name, rec.PID); err != nil {
+		return err
+	}
+
+	if rec.PIDFile == "" {
+		if rec.PIDFile, err = DefaultPIDFile(rec.Name); err != nil {
+			return err
+		}
+	}
+	if err := atomicfile.WriteFile(rec.PIDFile, []byte(strconv.Itoa(rec.PID)+"\n")); err != nil {
+		return fmt.Errorf("failed to write pidfile: %w", err)
+	}
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(file, data); err != nil {
+		return fmt.Errorf("failed to write instance record: %w", err)
+	}
+	return nil
+}
+
+// Unregister removes the record and pidfile of an instance and releases
+// its name
+func Unregister(rec *Record) error {
+	file, err := path(rec.Name, ".json")
+	if err != nil {
+		return err
+	}
+	if rec.PIDFile != "" {
+		os.Remove(rec.PIDFile)
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	Release(rec.Name, rec.PID)
+	return nil
+}
+
+// Get returns the record of the named instance
+func Get(name string) (*Record, error) {
+	file, err := path(name, ".json")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no running composition named %s", name)
+		}
+		return nil, err
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("corrupt instance record %s: %w", name, err)
+	}
+	return &rec, nil
+}
+
+// List returns all recorded instances sorted by name, including ones whose
+// process has died without cleaning up
+func List() ([]*Record, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, match := range matches {
+		rec, err := Get(strings.TrimSuffix(filepath.Base(match), ".json"))
+		if err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// Find looks up an instance by name or by its mountpoint or listen address
+func Find(nameOrTarget string) (*Record, error) {
+	if rec, err := Get(nameOrTarget); err == nil {
+		return rec, nil
+	}
+
+	records, err := List()
+	if err != nil {
+		return nil, err
+	}
+	abs, _ := filepath.Abs(nameOrTarget)
+	for _, rec := range records {
+		if rec.Target == nameOrTarget || rec.Target == abs {
+			return rec, nil
+		}
+	}
+	return nil, fmt.Errorf("no running composition named or mounted at %s", nameOrTarget)
+}
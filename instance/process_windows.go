@@ -0,0 +1,30 @@
+//go:build windows
+
+package instance
+
+import (
+	"os"
+)
+
+// ProcessAlive reports whether a process with the given pid exists
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Terminate stops a process. Windows has no SIGTERM, so the process is
+// killed without a graceful shutdown.
+func Terminate(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -2,13 +2,53 @@ package fscomposer_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
+	iofs "io/fs"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 
+	"github.com/absfs/absfs"
+	"github.com/absfs/fscomposer/api"
+	"github.com/absfs/fscomposer/api/client"
+	"github.com/absfs/fscomposer/bench"
+	"github.com/absfs/fscomposer/conformance"
+	"github.com/absfs/fscomposer/control"
 	"github.com/absfs/fscomposer/engine"
+	"github.com/absfs/fscomposer/frontend"
+	"github.com/absfs/fscomposer/graph"
+	"github.com/absfs/fscomposer/instance"
 	"github.com/absfs/fscomposer/registry"
+	"github.com/absfs/fscomposer/transfer"
+	"github.com/absfs/fscomposer/web"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 )
 
 // TestNodeTypes verifies all registered node types are available
@@ -432,6 +472,55 @@ func TestInvalidNodeType(t *testing.T) {
 	t.Logf("✓ Invalid node type detected: %v", err)
 }
 
+// TestValidationDiagnostics verifies Diagnose reports every failed check,
+// not only the first
+func TestValidationDiagnostics(t *testing.T) {
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-diagnostics",
+		Nodes: []engine.Node{
+			{ID: "node1", Type: "cachefs", Config: map[string]interface{}{"policy": "FIFO"}},
+			{ID: "node2", Type: "cachefs"},
+		},
+		Connections: []engine.Connection{
+			{From: "node1", To: "node2"},
+			{From: "node2", To: "node1"},
+		},
+		Mount: engine.MountConfig{
+			Type: "api",
+			Root: "node1",
+		},
+	}
+
+	diags := engine.NewValidator(spec).Diagnose()
+	checks := make(map[string]string)
+	for _, d := range diags {
+		checks[d.Check] = d.Message
+	}
+	if _, ok := checks["cycles"]; !ok {
+		t.Errorf("expected a cycles diagnostic, got %+v", diags)
+	}
+	if msg, ok := checks["config"]; !ok || !strings.Contains(msg, "policy") {
+		t.Errorf("expected a config diagnostic about the policy, got %+v", diags)
+	}
+
+	// A well-formed spec has no diagnostics
+	spec.Connections = spec.Connections[:1]
+	spec.Nodes[0].Config = nil
+	if diags := engine.NewValidator(spec).Diagnose(); len(diags) != 0 {
+		t.Errorf("expected no diagnostics, got %+v", diags)
+	}
+
+	// Basic spec errors stop the other checks
+	spec.Mount.Root = "missing"
+	diags = engine.NewValidator(spec).Diagnose()
+	if len(diags) != 1 || diags[0].Check != "spec" {
+		t.Errorf("expected a single spec diagnostic, got %+v", diags)
+	}
+
+	t.Logf("✓ Diagnostics reported per check")
+}
+
 // TestParseYAML tests parsing YAML composition specs
 func TestParseYAML(t *testing.T) {
 	tmpfile, err := os.CreateTemp("", "test-spec-*.yaml")
@@ -488,6 +577,465 @@ mount:
 	t.Log("✓ YAML parsing successful")
 }
 
+// TestSFTPMount serves a composition over SFTP and checks chrooted access
+func TestSFTPMount(t *testing.T) {
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-sftp",
+		Nodes: []engine.Node{
+			{ID: "backend", Type: "memfs"},
+		},
+		Mount: engine.MountConfig{
+			Type: engine.MountTypeSFTP,
+			Root: "backend",
+			Options: map[string]interface{}{
+				"host": "127.0.0.1",
+				"users": []interface{}{
+					map[string]interface{}{
+						"username": "alice",
+						"password": "secret",
+						"root":     "/home/alice",
+					},
+				},
+			},
+		},
+	}
+
+	fs, err := engine.NewBuilder(spec).Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if err := fs.MkdirAll("/home/alice", 0755); err != nil {
+		t.Fatalf("failed to create home directory: %v", err)
+	}
+
+	cfg, err := frontend.SFTPConfigFromMount(spec.Mount)
+	if err != nil {
+		t.Fatalf("failed to read sftp config: %v", err)
+	}
+	server, err := frontend.NewSFTPServer(fs, cfg)
+	if err != nil {
+		t.Fatalf("failed to create sftp server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	dial := func(password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+
+	if _, err := dial("wrong"); err == nil {
+		t.Fatal("expected login with wrong password to fail")
+	}
+
+	conn, err := dial("secret")
+	if err != nil {
+		t.Fatalf("ssh login failed: %v", err)
+	}
+	defer conn.Close()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp session failed: %v", err)
+	}
+	defer client.Close()
+
+	testData := []byte("Hello over SFTP!")
+	f, err := client.Create("/../../hello.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if _, err := f.Write(testData); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	f.Close()
+
+	// The write must land inside the user's root despite the ".." segments
+	data, err := fs.ReadFile("/home/alice/hello.txt")
+	if err != nil {
+		t.Fatalf("file not found in user root: %v", err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Errorf("data mismatch: got %q, want %q", data, testData)
+	}
+
+	entries, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatalf("failed to list root: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "hello.txt" {
+		t.Errorf("unexpected root listing: %v", entries)
+	}
+
+	t.Log("✓ SFTP mount working")
+}
+
+// TestSFTPSymlinkEscape checks that symlinks created over SFTP cannot
+// point outside the user's root, or the backend's
+func TestSFTPSymlinkEscape(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "data", "home", "alice"), 0755)
+	os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+	os.WriteFile(filepath.Join(dir, "outside", "secret.txt"), []byte("secret"), 0644)
+
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-sftp-symlink",
+		Nodes: []engine.Node{
+			{ID: "disk", Type: "osfs", Config: map[string]interface{}{"root": filepath.Join(dir, "data")}},
+		},
+		Mount: engine.MountConfig{
+			Type: engine.MountTypeSFTP,
+			Root: "disk",
+			Options: map[string]interface{}{
+				"host": "127.0.0.1",
+				"users": []interface{}{
+					map[string]interface{}{"username": "alice", "password": "secret", "root": "/home/alice"},
+				},
+			},
+		},
+	}
+	fs, err := engine.NewBuilder(spec).Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	cfg, err := frontend.SFTPConfigFromMount(spec.Mount)
+	if err != nil {
+		t.Fatalf("failed to read sftp config: %v", err)
+	}
+	server, err := frontend.NewSFTPServer(fs, cfg)
+	if err != nil {
+		t.Fatalf("failed to create sftp server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("ssh login failed: %v", err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp session failed: %v", err)
+	}
+	defer client.Close()
+
+	// Relative targets that climb out of the chroot, or out of the osfs
+	// root, are refused
+	for _, target := range []string{"../../../outside/secret.txt", "../other", "sub/../../x"} {
+		if err := client.Symlink(target, "/link"); err == nil {
+			t.Errorf("symlink to %s was allowed", target)
+			client.Remove("/link")
+		}
+	}
+	readFile := func(name string) (string, error) {
+		f, err := client.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		return string(data), err
+	}
+	if _, err := readFile("/link"); err == nil {
+		t.Error("read through an escaping symlink")
+	}
+
+	// Targets inside the chroot still work
+	f, err := client.Create("/hello.txt")
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	f.Write([]byte("hi"))
+	f.Close()
+	client.Mkdir("/sub")
+	if err := client.Symlink("../hello.txt", "/sub/link"); err != nil {
+		t.Fatalf("relative symlink inside the root failed: %v", err)
+	}
+	if data, err := readFile("/sub/link"); err != nil || data != "hi" {
+		t.Errorf("read through symlink: %q, %v", data, err)
+	}
+
+	// A target in a sibling whose name starts with the root is not shown
+	// as if it were inside the root
+	linker := fs.(absfs.SymLinker)
+	if err := linker.Symlink("/home/alicefoo/x", "/home/alice/sibling"); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	if target, err := client.ReadLink("/sibling"); err != nil || target == "/foo/x" {
+		t.Errorf("readlink sibling = %q, %v", target, err)
+	}
+}
+
+// identityFS records the identities frontends scope it to
+type identityFS struct {
+	absfs.FileSystem
+	users chan string
+}
+
+func (f *identityFS) ForUser(user string) absfs.FileSystem {
+	f.users <- user
+	return f.FileSystem
+}
+
+// TestSFTPKeyIdentity checks that a global authorized key does not let the
+// client pick the identity passed to identity-aware nodes
+func TestSFTPKeyIdentity(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	os.WriteFile(keysFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+
+	newMemFS, _ := registry.Get("memfs")
+	mem, err := newMemFS(nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create memfs: %v", err)
+	}
+	fs := &identityFS{FileSystem: mem, users: make(chan string, 1)}
+	server, err := frontend.NewSFTPServer(fs, &frontend.SFTPConfig{
+		AuthorizedKeysFile: keysFile,
+		AuthorizedKeysUser: "ops",
+	})
+	if err != nil {
+		t.Fatalf("failed to create sftp server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("ssh login failed: %v", err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp session failed: %v", err)
+	}
+	defer client.Close()
+
+	if user := <-fs.users; user != "ops" {
+		t.Errorf("global key scoped to %q, want ops", user)
+	}
+}
+
+// TestS3Gateway exercises the S3 gateway with SigV4-signed requests
+func TestS3Gateway(t *testing.T) {
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-s3",
+		Nodes: []engine.Node{
+			{ID: "backend", Type: "memfs"},
+		},
+		Mount: engine.MountConfig{
+			Type: engine.MountTypeS3,
+			Root: "backend",
+			Options: map[string]interface{}{
+				"credentials": []interface{}{
+					map[string]interface{}{"accessKey": "AKTEST", "secretKey": "s3cret"},
+				},
+			},
+		},
+	}
+
+	fs, err := engine.NewBuilder(spec).Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	cfg, err := frontend.S3ConfigFromMount(spec.Mount)
+	if err != nil {
+		t.Fatalf("failed to read s3 config: %v", err)
+	}
+	server, err := frontend.NewS3Server(fs, cfg)
+	if err != nil {
+		t.Fatalf("failed to create s3 gateway: %v", err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	do := func(method, target string, body []byte, secret string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+target, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("bad request: %v", err)
+		}
+		signS3Request(req, body, "AKTEST", secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, target, err)
+		}
+		return resp
+	}
+	expect := func(resp *http.Response, status int) []byte {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: expected status %d, got %d: %s",
+				resp.Request.Method, resp.Request.URL.Path, status, resp.StatusCode, data)
+		}
+		return data
+	}
+
+	expect(do("PUT", "/photos", nil, "wrong"), http.StatusForbidden)
+	expect(do("PUT", "/photos", nil, "s3cret"), http.StatusOK)
+
+	testData := []byte("Hello over S3!")
+	expect(do("PUT", "/photos/2024/beach.jpg", testData, "s3cret"), http.StatusOK)
+	expect(do("PUT", "/photos/index.txt", []byte("index"), "s3cret"), http.StatusOK)
+
+	if data := expect(do("GET", "/photos/2024/beach.jpg", nil, "s3cret"), http.StatusOK); !bytes.Equal(data, testData) {
+		t.Errorf("data mismatch: got %q, want %q", data, testData)
+	}
+	if data, err := fs.ReadFile("/photos/2024/beach.jpg"); err != nil || !bytes.Equal(data, testData) {
+		t.Errorf("object not stored at bucket path: %q, %v", data, err)
+	}
+
+	listing := string(expect(do("GET", "/photos?list-type=2&delimiter=%2F", nil, "s3cret"), http.StatusOK))
+	if !strings.Contains(listing, "<Key>index.txt</Key>") || !strings.Contains(listing, "<Prefix>2024/</Prefix>") {
+		t.Errorf("unexpected listing: %s", listing)
+	}
+
+	// Multipart upload with a single (final) part
+	initiated := string(expect(do("POST", "/photos/big.bin?uploads", nil, "s3cret"), http.StatusOK))
+	start := strings.Index(initiated, "<UploadId>") + len("<UploadId>")
+	uploadID := initiated[start : start+32]
+
+	part := bytes.Repeat([]byte("x"), 1024)
+	resp := do("PUT", "/photos/big.bin?partNumber=1&uploadId="+uploadID, part, "s3cret")
+	etag := resp.Header.Get("ETag")
+	expect(resp, http.StatusOK)
+
+	complete := []byte("<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>" + etag +
+		"</ETag></Part></CompleteMultipartUpload>")
+	expect(do("POST", "/photos/big.bin?uploadId="+uploadID, complete, "s3cret"), http.StatusOK)
+	if data := expect(do("GET", "/photos/big.bin", nil, "s3cret"), http.StatusOK); !bytes.Equal(data, part) {
+		t.Errorf("multipart object has %d bytes, want %d", len(data), len(part))
+	}
+
+	// A PUT that fails verification leaves the stored object intact
+	req, _ := http.NewRequest("PUT", ts.URL+"/photos/index.txt", strings.NewReader("corrupt"))
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	signS3Request(req, []byte("corrupt"), "AKTEST", "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("bad digest PUT failed: %v", err)
+	}
+	expect(resp, http.StatusBadRequest)
+	if data := expect(do("GET", "/photos/index.txt", nil, "s3cret"), http.StatusOK); string(data) != "index" {
+		t.Errorf("object after failed PUT = %q, want %q", data, "index")
+	}
+
+	// Oversized aws-chunked chunks are refused before they are buffered
+	chunked := []byte("7fffffffffffffff\r\n")
+	req, _ = http.NewRequest("PUT", ts.URL+"/photos/index.txt", bytes.NewReader(chunked))
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+	signS3Request(req, chunked, "AKTEST", "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("chunked PUT failed: %v", err)
+	}
+	if resp.Body.Close(); resp.StatusCode < 400 {
+		t.Errorf("oversized chunk accepted with status %d", resp.StatusCode)
+	}
+
+	listing = string(expect(do("GET", "/photos?list-type=2", nil, "s3cret"), http.StatusOK))
+	if strings.Contains(listing, ".fscomposer-upload-") {
+		t.Errorf("temporary upload file listed: %s", listing)
+	}
+	entries, _ := fs.ReadDir("/photos")
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".fscomposer-upload-") {
+			t.Errorf("temporary upload file left behind: %s", entry.Name())
+		}
+	}
+
+	expect(do("DELETE", "/photos/2024/beach.jpg", nil, "s3cret"), http.StatusNoContent)
+	expect(do("HEAD", "/photos/2024/beach.jpg", nil, "s3cret"), http.StatusNotFound)
+	if _, err := fs.Stat("/photos/2024"); err == nil {
+		t.Error("empty prefix directory was not pruned")
+	}
+
+	t.Log("✓ S3 gateway working")
+}
+
+// signS3Request signs a request with AWS Signature Version 4
+func signS3Request(req *http.Request, body []byte, accessKey, secret string) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, url.QueryEscape(k)+"="+url.QueryEscape(query.Get(k)))
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(pairs, "&"),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256") +
+			"\nx-amz-date:" + req.Header.Get("X-Amz-Date") + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	scope := date + "/us-east-1/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := mac(mac(mac(mac([]byte("AWS4"+secret), date), "us-east-1"), "s3"), "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		accessKey, scope, hex.EncodeToString(mac(key, toSign))))
+}
+
 // BenchmarkSimpleStack benchmarks a simple filesystem stack
 func BenchmarkSimpleStack(b *testing.B) {
 	spec := &engine.CompositionSpec{
@@ -612,3 +1160,2945 @@ func BenchmarkEncryptedStack(b *testing.B) {
 		fs.Remove(filename)
 	}
 }
+
+// TestInstanceRecords verifies running compositions can be registered,
+// found by name or target, and removed
+func TestInstanceRecords(t *testing.T) {
+	t.Setenv("FSCOMPOSER_STATE_DIR", t.TempDir())
+
+	rec := &instance.Record{
+		Name:      "test-mount",
+		PID:       os.Getpid(),
+		SpecFile:  "/tmp/test.yaml",
+		MountType: engine.MountTypeFUSE,
+		Target:    "/mnt/test",
+		Started:   time.Now(),
+	}
+	if err := instance.Register(rec); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	pid, err := os.ReadFile(rec.PIDFile)
+	if err != nil {
+		t.Fatalf("pidfile not written: %v", err)
+	}
+	if strings.TrimSpace(string(pid)) != fmt.Sprint(os.Getpid()) {
+		t.Errorf("pidfile contains %q", pid)
+	}
+
+	// A second live instance with the same name is rejected
+	clash := *rec
+	clash.PID = os.Getpid() + 1
+	if err := instance.Register(&clash); err == nil {
+		t.Error("expected duplicate name to be rejected")
+	}
+
+	for _, key := range []string{"test-mount", "/mnt/test"} {
+		found, err := instance.Find(key)
+		if err != nil {
+			t.Fatalf("Find(%s) failed: %v", key, err)
+		}
+		if found.Name != rec.Name || found.SpecFile != rec.SpecFile {
+			t.Errorf("Find(%s) returned %+v", key, found)
+		}
+	}
+
+	records, err := instance.List()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("List returned %d records, err %v", len(records), err)
+	}
+
+	if err := instance.Unregister(rec); err != nil {
+		t.Fatalf("Unregister failed: %v", err)
+	}
+	if _, err := instance.Find("test-mount"); err == nil {
+		t.Error("instance still listed after Unregister")
+	}
+	if _, err := os.Stat(rec.PIDFile); !os.IsNotExist(err) {
+		t.Error("pidfile not removed")
+	}
+
+	// Names become file names in the state directory
+	for _, name := range []string{"../../x", "a/b", "..", ".", "", "x y"} {
+		bad := *rec
+		bad.Name = name
+		if err := instance.Register(&bad); err == nil {
+			t.Errorf("Register accepted the name %q", name)
+		}
+		if _, err := instance.ControlSocket(name); err == nil {
+			t.Errorf("ControlSocket accepted the name %q", name)
+		}
+	}
+
+	// A claim stops a second process before it mounts, until released
+	if err := instance.Claim("claimed", os.Getpid()); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if err := instance.Claim("claimed", os.Getppid()); err == nil {
+		t.Error("a second live process claimed the same name")
+	}
+	if pid, ok := instance.Owner("claimed"); !ok || pid != os.Getpid() {
+		t.Errorf("Owner returned %d, %v", pid, ok)
+	}
+	instance.Release("claimed", os.Getpid())
+	if err := instance.Claim("claimed", os.Getppid()); err != nil {
+		t.Errorf("Claim after Release failed: %v", err)
+	}
+
+	// A lock left by a process that died is taken over
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skipf("cannot run a short-lived process: %v", err)
+	}
+	os.WriteFile(filepath.Join(os.Getenv("FSCOMPOSER_STATE_DIR"), "stale.lock"), []byte(fmt.Sprintln(dead.Process.Pid)), 0600)
+	if err := instance.Claim("stale", os.Getpid()); err != nil {
+		t.Errorf("Claim did not take over a stale lock: %v", err)
+	}
+}
+
+// TestHotReload verifies a rebuild reuses unchanged nodes and that files
+// opened before a swap drain on the old stack
+func TestHotReload(t *testing.T) {
+	newSpec := func(maxBytes int) *engine.CompositionSpec {
+		return &engine.CompositionSpec{
+			Version: "1.0",
+			Name:    "test-reload",
+			Nodes: []engine.Node{
+				{ID: "backend", Type: "memfs"},
+				{ID: "cache", Type: "cachefs", Config: map[string]interface{}{"maxBytes": maxBytes}},
+			},
+			Connections: []engine.Connection{{From: "backend", To: "cache"}},
+			Mount:       engine.MountConfig{Type: "api", Root: "cache"},
+		}
+	}
+
+	builder := engine.NewBuilder(newSpec(1048576))
+	fs, err := builder.Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	root := frontend.NewSwapFS(fs)
+
+	f, err := root.Create("/kept.txt")
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	f.WriteString("survives reload")
+
+	// Unchanged spec: nothing is rebuilt
+	same := engine.NewBuilderFrom(newSpec(1048576), builder)
+	if _, err := same.Build(); err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if rebuilt := same.Rebuilt(); len(rebuilt) != 0 {
+		t.Errorf("unchanged spec rebuilt %v", rebuilt)
+	}
+
+	// Changed cache config: only the cache is rebuilt
+	next := engine.NewBuilderFrom(newSpec(2097152), same)
+	newFS, err := next.Build()
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if rebuilt := next.Rebuilt(); len(rebuilt) != 1 || rebuilt[0] != "cache" {
+		t.Errorf("expected only cache to be rebuilt, got %v", rebuilt)
+	}
+	if reused := next.Reused(); len(reused) != 1 || reused[0] != "backend" {
+		t.Errorf("expected backend to be reused, got %v", reused)
+	}
+
+	drained := root.Swap(newFS)
+	select {
+	case <-drained:
+		t.Fatal("old stack drained while a file is still open")
+	default:
+	}
+
+	// The open handle still works, and the data is visible through the
+	// new stack because the backend was reused
+	if _, err := f.WriteString("!"); err != nil {
+		t.Errorf("write on old handle failed: %v", err)
+	}
+	f.Close()
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("old stack did not drain after closing its files")
+	}
+
+	data, err := root.ReadFile("/kept.txt")
+	if err != nil {
+		t.Fatalf("read through new stack failed: %v", err)
+	}
+	if string(data) != "survives reload!" {
+		t.Errorf("got %q after reload", data)
+	}
+
+	// A failing build leaves the served stack untouched
+	broken := newSpec(1048576)
+	broken.Nodes[1].Config["policy"] = "bogus"
+	if _, err := engine.NewBuilderFrom(broken, next).Build(); err == nil {
+		t.Error("expected invalid config to fail the rebuild")
+	}
+	if _, err := root.Stat("/kept.txt"); err != nil {
+		t.Errorf("served stack affected by failed rebuild: %v", err)
+	}
+}
+
+// closeTracker is a pass-through node that records when it is closed,
+// and counts its directory reads and file opens under "<label> readdir"
+// and "<label> openfile"
+type closeTracker struct {
+	absfs.FileSystem
+	label  string
+	closes *closeCounts
+}
+
+func (c *closeTracker) Close() error {
+	c.closes.mu.Lock()
+	defer c.closes.mu.Unlock()
+	c.closes.counts[c.label]++
+	return nil
+}
+
+func (c *closeTracker) ReadDir(name string) ([]iofs.DirEntry, error) {
+	c.closes.mu.Lock()
+	c.closes.counts[c.label+" readdir"]++
+	c.closes.mu.Unlock()
+	return c.FileSystem.ReadDir(name)
+}
+
+func (c *closeTracker) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	c.closes.mu.Lock()
+	c.closes.counts[c.label+" openfile"]++
+	c.closes.mu.Unlock()
+	return c.FileSystem.OpenFile(name, flag, perm)
+}
+
+// closeCounts counts the closes of closeTracker nodes by label
+type closeCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *closeCounts) get(label string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[label]
+}
+
+// trackCloses makes metricsfs nodes closeTrackers, labelled by their
+// "label" config, for the rest of the test. It stands in for a new
+// wrapper type since specs only accept known types.
+func trackCloses(t *testing.T) (string, *closeCounts) {
+	t.Helper()
+	const tracked = engine.NodeTypeMetricsFS
+	constructor, err := registry.Get(tracked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, _ := registry.GetSchema(tracked)
+	t.Cleanup(func() { registry.Register(tracked, constructor, schema) })
+
+	closes := &closeCounts{counts: make(map[string]int)}
+	registry.Register(tracked, func(config map[string]interface{}, underlying absfs.FileSystem) (absfs.FileSystem, error) {
+		label, _ := config["label"].(string)
+		if config["fail"] == true {
+			return nil, fmt.Errorf("failing on purpose")
+		}
+		return &closeTracker{FileSystem: underlying, label: label, closes: closes}, nil
+	}, schema)
+	return tracked, closes
+}
+
+func TestBuilderRetire(t *testing.T) {
+	tracked, closes := trackCloses(t)
+
+	newSpec := func(top map[string]interface{}) *engine.CompositionSpec {
+		return &engine.CompositionSpec{
+			Version: "1.0",
+			Name:    "test-retire",
+			Nodes: []engine.Node{
+				{ID: "disk", Type: "memfs"},
+				{ID: "lower", Type: tracked, Config: map[string]interface{}{"label": "lower"}},
+				{ID: "upper", Type: tracked, Config: top},
+			},
+			Connections: []engine.Connection{{From: "disk", To: "lower"}, {From: "lower", To: "upper"}},
+			Mount:       engine.MountConfig{Type: "api", Root: "upper"},
+		}
+	}
+
+	first := engine.NewBuilder(newSpec(map[string]interface{}{"label": "upper-1"}))
+	if _, err := first.Build(); err != nil {
+		t.Fatal(err)
+	}
+	next := engine.NewBuilderFrom(newSpec(map[string]interface{}{"label": "upper-2"}), first)
+	if _, err := next.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the replaced node is closed, and only once the caller says so
+	closeReplaced := first.Retire(next)
+	if closes.get("upper-1") != 0 {
+		t.Error("replaced node closed before the old stack drained")
+	}
+	if err := closeReplaced(); err != nil {
+		t.Fatal(err)
+	}
+	if closes.get("upper-1") != 1 || closes.get("lower") != 0 {
+		t.Errorf("after retiring: %v", closes.counts)
+	}
+
+	// The reused node now belongs to the new build
+	first.Close()
+	if closes.get("lower") != 0 {
+		t.Errorf("retired builder closed a reused node: %v", closes.counts)
+	}
+	next.Close()
+	if closes.get("lower") != 1 || closes.get("upper-2") != 1 {
+		t.Errorf("after closing the new build: %v", closes.counts)
+	}
+
+	// A failed build closes what it constructed before failing
+	failed := engine.NewBuilder(newSpec(map[string]interface{}{"label": "broken", "fail": true}))
+	if _, err := failed.Build(); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+	failed.Close()
+	if closes.get("lower") != 2 {
+		t.Errorf("failed build leaked its nodes: %v", closes.counts)
+	}
+}
+
+func TestInstanceClosesNodes(t *testing.T) {
+	tracked, closes := trackCloses(t)
+	srv := api.NewServer(api.NewMemoryStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	defer srv.StopInstances()
+	c := client.New(ts.URL)
+
+	newSpec := func(name, mountType string) *engine.CompositionSpec {
+		return &engine.CompositionSpec{
+			Version:     "1.0",
+			Name:        name,
+			Nodes:       []engine.Node{{ID: "disk", Type: "memfs"}, {ID: "track", Type: tracked, Config: map[string]interface{}{"label": name}}},
+			Connections: []engine.Connection{{From: "disk", To: "track"}},
+			Mount:       engine.MountConfig{Type: mountType, Root: "track"},
+		}
+	}
+
+	// Stopping an instance closes its nodes
+	if _, err := c.Create(newSpec("stopped", engine.MountTypeAPI)); err != nil {
+		t.Fatal(err)
+	}
+	in, err := c.Start("stopped", api.StartRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closes.get("stopped") != 0 {
+		t.Error("running instance's nodes closed")
+	}
+	if _, err := c.Stop("stopped", in.ID); err != nil {
+		t.Fatal(err)
+	}
+	if closes.get("stopped") != 1 {
+		t.Errorf("stopped instance's nodes closed %d times", closes.get("stopped"))
+	}
+
+	// Mount types without a frontend are refused, not mounted with FUSE,
+	// and the stack built for them is closed
+	if _, err := c.Create(newSpec("unknown", engine.MountTypeNFS)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Start("unknown", api.StartRequest{}); err == nil || !strings.Contains(err.Error(), `unsupported mount type "nfs"`) {
+		t.Errorf("nfs mount: expected an unsupported mount type error, got %v", err)
+	}
+	if closes.get("unknown") != 1 {
+		t.Errorf("failed start left its nodes open: %d closes", closes.get("unknown"))
+	}
+
+	// So does the sandboxed stack of a test build
+	if _, err := c.Build("stopped", "files"); err != nil {
+		t.Fatal(err)
+	}
+	if closes.get("stopped") != 2 {
+		t.Errorf("test build left its nodes open: %d closes", closes.get("stopped"))
+	}
+}
+
+// controlTarget is a minimal running composition for the control server
+type controlTarget struct {
+	spec    *engine.CompositionSpec
+	builder *engine.Builder
+	reloads int
+}
+
+func (c *controlTarget) Spec() *engine.CompositionSpec { return c.spec }
+
+func (c *controlTarget) Node(id string) (absfs.FileSystem, bool) { return c.builder.GetBuiltNode(id) }
+
+func (c *controlTarget) Reload() error {
+	c.reloads++
+	return nil
+}
+
+// TestControlSocket verifies the control API of a running composition
+func TestControlSocket(t *testing.T) {
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-control",
+		Nodes: []engine.Node{
+			{ID: "backend", Type: "memfs"},
+			{ID: "cache", Type: "cachefs"},
+			{ID: "metrics", Type: "metricsfs"},
+		},
+		Connections: []engine.Connection{
+			{From: "backend", To: "cache"},
+			{From: "cache", To: "metrics"},
+		},
+		Mount: engine.MountConfig{Type: "api", Root: "metrics"},
+	}
+	builder := engine.NewBuilder(spec)
+	fs, err := builder.Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	f, err := fs.Create("/a.txt")
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	f.WriteString("data")
+	f.Close()
+	fs.ReadFile("/a.txt")
+
+	target := &controlTarget{spec: spec, builder: builder}
+	level := new(slog.LevelVar)
+	socket := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := control.Listen(socket, target, level, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer server.Close()
+
+	client := control.NewClient(socket)
+
+	graph, err := client.Graph()
+	if err != nil {
+		t.Fatalf("Graph failed: %v", err)
+	}
+	if len(graph.Nodes) != 3 || graph.Root != "metrics" {
+		t.Errorf("unexpected graph: %+v", graph)
+	}
+	if graph.Nodes[1].Config["policy"] != "LRU" {
+		t.Errorf("cache config not resolved with defaults: %v", graph.Nodes[1].Config)
+	}
+
+	stats, err := client.Stats("")
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected stats from cache and metrics, got %+v", stats)
+	}
+	if _, err := client.Stats("backend"); err == nil {
+		t.Error("expected error for a node without statistics")
+	}
+
+	result, err := client.Invalidate("", "")
+	if err != nil || len(result.Nodes) != 1 || result.Nodes[0] != "cache" {
+		t.Errorf("Invalidate returned %+v, %v", result, err)
+	}
+	if _, err := client.Flush("cache"); err != nil {
+		t.Errorf("Flush failed: %v", err)
+	}
+	if _, err := client.Flush("metrics"); err == nil {
+		t.Error("expected error flushing a node without a cache")
+	}
+
+	if lvl, err := client.SetLogLevel("debug"); err != nil || lvl != "debug" || level.Level() != slog.LevelDebug {
+		t.Errorf("SetLogLevel returned %q, %v (level %v)", lvl, err, level.Level())
+	}
+	if _, err := client.SetLogLevel("loud"); err == nil {
+		t.Error("expected invalid log level to fail")
+	}
+
+	if _, err := client.Reload(); err != nil || target.reloads != 1 {
+		t.Errorf("Reload returned %v after %d reloads", err, target.reloads)
+	}
+}
+
+// TestOSFSRoot checks that an osfs node maps every path, absolute or
+// climbing with "..", into its root, and that the root must exist
+func TestOSFSRoot(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+
+	build := func(root string) (absfs.FileSystem, error) {
+		return engine.NewBuilder(&engine.CompositionSpec{
+			Version: "1.0",
+			Name:    "test-osfs-root",
+			Nodes: []engine.Node{
+				{ID: "disk", Type: "osfs", Config: map[string]interface{}{"root": root}},
+			},
+			Mount: engine.MountConfig{Type: "api", Root: "disk"},
+		}).Build()
+	}
+	fs, err := build(root)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	for _, name := range []string{filepath.ToSlash(filepath.Join(outside, "secret.txt")), "../outside/secret.txt", "/../../outside/secret.txt"} {
+		if data, err := fs.ReadFile(name); err == nil {
+			t.Errorf("read %s outside the root: %q", name, data)
+		}
+	}
+	for _, name := range []string{"/../up.txt", "../../up.txt"} {
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("create %s failed: %v", name, err)
+		}
+		f.Close()
+	}
+	if _, err := os.Stat(filepath.Join(root, "up.txt")); err != nil {
+		t.Errorf("file written above the root did not land in it: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "up.txt")); err == nil {
+		t.Error("file written outside the root")
+	}
+
+	if _, err := build(filepath.Join(dir, "missing")); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("expected a missing root to fail the build, got %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+	if _, err := build(filepath.Join(dir, "file")); err == nil {
+		t.Error("expected a root that is a file to fail the build")
+	}
+}
+
+// TestOSFSSymlinkConfinement checks that symlinks, new or already on the
+// host, cannot lead an osfs node outside its root
+func TestOSFSSymlinkConfinement(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(root, "inside.txt"), []byte("inside"), 0644)
+
+	// Links placed on the host directly
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(outside, "new.txt"), filepath.Join(root, "dangling"))
+
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-osfs-symlinks",
+		Nodes: []engine.Node{
+			{ID: "disk", Type: "osfs", Config: map[string]interface{}{"root": root}},
+		},
+		Mount: engine.MountConfig{Type: "api", Root: "disk"},
+	}
+	fs, err := engine.NewBuilder(spec).Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	if _, err := fs.ReadFile("/escape/secret.txt"); err == nil {
+		t.Error("read through a host symlink leading outside the root")
+	}
+	if f, err := fs.OpenFile("/dangling", os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		f.Close()
+		t.Error("created a file through a dangling symlink leading outside the root")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); err == nil {
+		t.Error("file created outside the root")
+	}
+	// The links themselves can still be listed and removed
+	if _, err := fs.(absfs.SymLinker).Lstat("/escape"); err != nil {
+		t.Errorf("lstat of host symlink failed: %v", err)
+	}
+	if err := fs.Remove("/escape"); err != nil {
+		t.Errorf("remove of host symlink failed: %v", err)
+	}
+
+	linker := fs.(absfs.SymLinker)
+	for _, target := range []string{"../outside/secret.txt", "sub/../../outside", "../root/../outside"} {
+		if err := linker.Symlink(target, "/link"); err == nil {
+			t.Errorf("symlink to %s was allowed", target)
+			fs.Remove("/link")
+		}
+	}
+	if err := linker.Symlink("/inside.txt", "/abs"); err != nil {
+		t.Fatalf("absolute symlink failed: %v", err)
+	}
+	if err := linker.Symlink("inside.txt", "/rel"); err != nil {
+		t.Fatalf("relative symlink failed: %v", err)
+	}
+	for _, name := range []string{"/abs", "/rel"} {
+		if data, err := fs.ReadFile(name); err != nil || string(data) != "inside" {
+			t.Errorf("read %s = %q, %v", name, data, err)
+		}
+	}
+	if target, err := linker.Readlink("/abs"); err != nil || target != "/inside.txt" {
+		t.Errorf("readlink /abs = %q, %v", target, err)
+	}
+}
+
+func TestTransferSync(t *testing.T) {
+	build := func(name, root string) absfs.FileSystem {
+		spec := &engine.CompositionSpec{
+			Version: "1.0",
+			Name:    name,
+			Nodes: []engine.Node{
+				{ID: "disk", Type: "osfs", Config: map[string]interface{}{"root": root}},
+			},
+			Mount: engine.MountConfig{Type: "api", Root: "disk"},
+		}
+		fs, err := engine.NewBuilder(spec).Build()
+		if err != nil {
+			t.Fatalf("build %s failed: %v", name, err)
+		}
+		return fs
+	}
+
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src, dst := build("src", srcDir), build("dst", dstDir)
+
+	os.MkdirAll(filepath.Join(srcDir, "docs"), 0755)
+	os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(srcDir, "docs", "b.txt"), []byte("bravo"), 0644)
+	os.WriteFile(filepath.Join(dstDir, "stale.txt"), []byte("old"), 0644)
+
+	// The osfs root confines paths that try to climb out of it
+	if _, err := dst.Stat("/../../" + filepath.Base(srcDir)); err == nil {
+		t.Error("osfs path escaped its root")
+	}
+
+	// A dry run reports work without writing anything
+	stats, err := transfer.Run(src, "/", dst, "/", transfer.Options{SkipUnchanged: true, Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if stats.Copied != 2 || stats.Deleted != 1 {
+		t.Errorf("dry run stats: %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "a.txt")); !os.IsNotExist(err) {
+		t.Error("dry run wrote to the destination")
+	}
+
+	stats, err = transfer.Run(src, "/", dst, "/", transfer.Options{SkipUnchanged: true, Delete: true})
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if stats.Copied != 2 || stats.Dirs != 1 || stats.Deleted != 1 {
+		t.Errorf("sync stats: %+v", stats)
+	}
+	data, err := os.ReadFile(filepath.Join(dstDir, "docs", "b.txt"))
+	if err != nil || string(data) != "bravo" {
+		t.Errorf("docs/b.txt = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "stale.txt")); !os.IsNotExist(err) {
+		t.Error("extraneous file not deleted")
+	}
+	t.Log("✓ Tree synced")
+
+	// A second sync copies nothing, by mtime and by checksum
+	for _, checksum := range []bool{false, true} {
+		stats, err = transfer.Run(src, "/", dst, "/", transfer.Options{SkipUnchanged: true, Checksum: checksum})
+		if err != nil {
+			t.Fatalf("resync failed: %v", err)
+		}
+		if stats.Copied != 0 || stats.Skipped != 2 {
+			t.Errorf("resync (checksum=%v) stats: %+v", checksum, stats)
+		}
+	}
+
+	// A changed file is picked up
+	os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("alpha two"), 0644)
+	stats, err = transfer.Run(src, "/", dst, "/", transfer.Options{SkipUnchanged: true})
+	if err != nil || stats.Copied != 1 {
+		t.Errorf("changed file sync: %+v, %v", stats, err)
+	}
+	t.Log("✓ Unchanged files skipped")
+
+	// A destination that cannot be checksummed is an error, not a copy
+	unreadable := &failingFS{FileSystem: dst, open: errors.New("device offline")}
+	stats, err = transfer.Run(src, "/", unreadable, "/", transfer.Options{SkipUnchanged: true, Checksum: true})
+	if err == nil || !strings.Contains(err.Error(), "device offline") || stats.Errors != 2 || stats.Copied != 0 {
+		t.Errorf("sync to an unreadable destination: %+v, %v", stats, err)
+	}
+
+	// A copy whose mtime cannot be kept is reported, or every later sync
+	// would copy it again
+	os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("alpha three"), 0644)
+	stubborn := &failingFS{FileSystem: dst, chtimes: errors.New("read-only metadata")}
+	stats, err = transfer.Run(src, "/", stubborn, "/", transfer.Options{SkipUnchanged: true})
+	if err == nil || !strings.Contains(err.Error(), "modification time") || stats.Copied != 1 || stats.Errors != 1 {
+		t.Errorf("sync without mtimes: %+v, %v", stats, err)
+	}
+}
+
+// failingFS fails Open or Chtimes on an otherwise working filesystem
+type failingFS struct {
+	absfs.FileSystem
+	open, chtimes error
+}
+
+func (f *failingFS) Open(name string) (absfs.File, error) {
+	if f.open != nil {
+		return nil, f.open
+	}
+	return f.FileSystem.Open(name)
+}
+
+func (f *failingFS) Chtimes(name string, atime, mtime time.Time) error {
+	if f.chtimes != nil {
+		return f.chtimes
+	}
+	return f.FileSystem.Chtimes(name, atime, mtime)
+}
+
+func TestConformanceSuite(t *testing.T) {
+	root := t.TempDir()
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-conformance",
+		Nodes: []engine.Node{
+			{ID: "disk", Type: "osfs", Config: map[string]interface{}{"root": root}},
+		},
+		Mount: engine.MountConfig{Type: "api", Root: "disk"},
+	}
+	fs, err := engine.NewBuilder(spec).Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	report, err := conformance.Run(fs, conformance.Options{LargeFileSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("conformance run failed: %v", err)
+	}
+	for _, res := range report.Results {
+		if res.Status != conformance.StatusPass {
+			t.Errorf("%s/%s: %s %s", res.Category, res.Name, res.Status, res.Error)
+		}
+	}
+	if len(report.Summary()) != len(conformance.Categories) {
+		t.Errorf("summary covers %d categories, want %d", len(report.Summary()), len(conformance.Categories))
+	}
+	t.Logf("✓ osfs passed %d checks", report.Passed)
+
+	// The scratch directory is removed afterwards
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 || report.Leftover != "" {
+		t.Errorf("scratch data left behind: %d entries, leftover %q", len(entries), report.Leftover)
+	}
+
+	// Categories can be selected, and unknown ones are rejected
+	report, err = conformance.Run(fs, conformance.Options{Categories: []string{"seek"}})
+	if err != nil {
+		t.Fatalf("seek run failed: %v", err)
+	}
+	if summary := report.Summary(); len(summary) != 1 || summary[0].Category != "seek" || !summary[0].Supported() {
+		t.Errorf("seek summary: %+v", summary)
+	}
+	if _, err := conformance.Run(fs, conformance.Options{Categories: []string{"bogus"}}); err == nil {
+		t.Error("expected unknown category to be rejected")
+	}
+}
+
+func TestSandboxBuild(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs", "old"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", "old", "b.txt"), []byte("bravo"), 0644)
+	os.WriteFile(filepath.Join(root, "keep.txt"), []byte("keep"), 0644)
+
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-sandbox",
+		Nodes: []engine.Node{
+			{ID: "disk", Type: "osfs", Config: map[string]interface{}{"root": root}},
+			{ID: "cache", Type: "cachefs"},
+		},
+		Connections: []engine.Connection{{From: "disk", To: "cache"}},
+		Mount:       engine.MountConfig{Type: "api", Root: "cache"},
+	}
+	fs, err := engine.NewSandboxBuilder(spec).Build()
+	if err != nil {
+		t.Fatalf("sandbox build failed: %v", err)
+	}
+
+	// Existing data is visible
+	data, err := fs.ReadFile("/docs/a.txt")
+	if err != nil || string(data) != "alpha" {
+		t.Fatalf("read through sandbox: %q, %v", data, err)
+	}
+
+	// Writes, deletes and renames only change the sandbox
+	f, err := fs.OpenFile("/docs/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open for append failed: %v", err)
+	}
+	f.Write([]byte(" two"))
+	f.Close()
+	if err := fs.Remove("/keep.txt"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := fs.Rename("/docs/old", "/docs/new"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if err := fs.Mkdir("/docs/old", 0755); err != nil {
+		t.Fatalf("recreating renamed directory failed: %v", err)
+	}
+	if f, err = fs.Create("/test.txt"); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	f.WriteString("scratch")
+	f.Close()
+
+	if data, _ := fs.ReadFile("/docs/a.txt"); string(data) != "alpha two" {
+		t.Errorf("sandbox a.txt = %q", data)
+	}
+	if data, _ := fs.ReadFile("/docs/new/b.txt"); string(data) != "bravo" {
+		t.Errorf("sandbox new/b.txt = %q", data)
+	}
+	if _, err := fs.Stat("/keep.txt"); !os.IsNotExist(err) {
+		t.Errorf("removed file still visible: %v", err)
+	}
+	if entries, err := fs.ReadDir("/docs/old"); err != nil || len(entries) != 0 {
+		t.Errorf("recreated directory shows %d entries, %v", len(entries), err)
+	}
+
+	// The real directory is untouched
+	for name, want := range map[string]string{
+		"docs/a.txt":     "alpha",
+		"docs/old/b.txt": "bravo",
+		"keep.txt":       "keep",
+	} {
+		if data, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(data) != want {
+			t.Errorf("backend %s = %q, %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"test.txt", "docs/new"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("sandbox wrote %s to the backend", name)
+		}
+	}
+	t.Log("✓ Backend untouched by sandboxed writes")
+
+	// The conformance suite passes inside the sandbox apart from symlinks
+	report, err := conformance.Run(fs, conformance.Options{LargeFileSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("conformance run failed: %v", err)
+	}
+	for _, res := range report.Results {
+		if res.Status == conformance.StatusFail {
+			t.Errorf("%s/%s: %s", res.Category, res.Name, res.Error)
+		}
+	}
+}
+
+func TestBenchmarkWorkloads(t *testing.T) {
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "test-bench",
+		Nodes: []engine.Node{
+			{ID: "backend", Type: "memfs"},
+			{ID: "cache", Type: "cachefs"},
+		},
+		Connections: []engine.Connection{{From: "backend", To: "cache"}},
+		Mount:       engine.MountConfig{Type: "api", Root: "cache"},
+	}
+
+	probe := bench.NewProbe(spec)
+	builder := engine.NewBuilder(spec)
+	builder.Instrument(probe.Wrap)
+	fs, err := builder.Build()
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+
+	results, err := bench.Run(fs, bench.Options{
+		Duration:    50 * time.Millisecond,
+		Concurrency: 2,
+		FileSize:    256 << 10,
+		BlockSize:   4096,
+		Probe:       probe,
+	})
+	if err != nil {
+		t.Fatalf("bench failed: %v", err)
+	}
+	if len(results) != len(bench.Workloads) {
+		t.Fatalf("got %d results, want %d", len(results), len(bench.Workloads))
+	}
+
+	for _, r := range results {
+		if r.Ops == 0 || r.Errors != 0 {
+			t.Errorf("%s: %d ops, %d errors (%s)", r.Workload, r.Ops, r.Errors, r.FirstError)
+		}
+		if r.P50 > r.P99 || r.P99 > r.Max {
+			t.Errorf("%s: latency percentiles out of order: %v %v %v", r.Workload, r.P50, r.P99, r.Max)
+		}
+		if len(r.Layers) != 2 || r.Layers[0].Node != "cache" {
+			t.Errorf("%s: layers %+v", r.Workload, r.Layers)
+			continue
+		}
+		if r.Layers[0].Calls == 0 {
+			t.Errorf("%s: no calls recorded for the root", r.Workload)
+		}
+		var share float64
+		for _, l := range r.Layers {
+			share += l.Percent
+		}
+		if share < 99 || share > 101 {
+			t.Errorf("%s: layer shares add up to %.1f%%", r.Workload, share)
+		}
+	}
+	t.Logf("✓ %d workloads measured", len(results))
+
+	if entries, _ := fs.ReadDir("/"); len(entries) != 0 {
+		t.Errorf("scratch directory left behind: %d entries", len(entries))
+	}
+
+	if _, err := bench.Run(fs, bench.Options{Workloads: []string{"bogus"}}); err == nil {
+		t.Error("expected unknown workload to be rejected")
+	}
+}
+
+// TestGraphRender verifies graphs include config-referenced edges and
+// render in every format
+func TestGraphRender(t *testing.T) {
+	spec, err := engine.ParseFile("examples/tiered-storage.yaml")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	spec.Nodes = append(spec.Nodes, engine.Node{
+		ID: "vault", Type: "encryptfs", Config: map[string]interface{}{"password": "hunter2", "cipher": "AES-256-GCM"},
+	})
+
+	g := graph.New(spec)
+	var config int
+	for _, e := range g.Edges {
+		if e.Config && e.To == "router" {
+			config++
+		}
+	}
+	if config != 4 {
+		t.Errorf("expected 4 config edges into router (3 routes and a default), got %d", config)
+	}
+	levels := map[string]int{}
+	for _, n := range g.Nodes {
+		levels[n.ID] = n.Level
+	}
+	if levels["cold-storage"] != 0 || levels["router"] != 1 || levels["metrics"] != 2 {
+		t.Errorf("unexpected levels %v", levels)
+	}
+
+	for _, format := range graph.Formats {
+		out, err := g.Render(format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if strings.Contains(out, "hunter2") {
+			t.Errorf("%s: password shown in graph", format)
+		}
+		for _, want := range []string{"cold-storage", "s3fs", "/hot/**", "webdav :8080"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: missing %q", format, want)
+			}
+		}
+	}
+
+	ascii := g.ASCII()
+	if !strings.Contains(ascii, "[/warm/**] warm-storage (osfs) root=/mnt/ssd/warm") ||
+		!strings.Contains(ascii, "[default] warm-storage (see above)") {
+		t.Errorf("unexpected tree:\n%s", ascii)
+	}
+	if !strings.Contains(ascii, "Not reachable from the mount root") || !strings.Contains(ascii, "cipher=AES-256-GCM") {
+		t.Errorf("unconnected node missing from tree:\n%s", ascii)
+	}
+
+	dec := xml.NewDecoder(strings.NewReader(g.SVG()))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("svg is not well-formed: %v", err)
+		}
+	}
+
+	if _, err := g.Render("png"); err == nil {
+		t.Error("expected unknown format to be rejected")
+	}
+	t.Logf("✓ Rendered %d formats", len(graph.Formats))
+}
+
+func TestSpecDiff(t *testing.T) {
+	parse := func(src string) *engine.CompositionSpec {
+		t.Helper()
+		spec, err := engine.Parse([]byte(src))
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		return spec
+	}
+	old := parse(`
+version: "1.0"
+name: vault
+nodes:
+  - id: storage
+    type: osfs
+    config: {root: /data}
+  - id: encrypt
+    type: encryptfs
+    config: {password: hunter2}
+  - id: cache
+    type: cachefs
+connections:
+  - {from: storage, to: encrypt}
+  - {from: encrypt, to: cache}
+mount: {type: sftp, port: 2222, root: cache}
+`)
+
+	// Spelling out defaults is not a change
+	same := parse(`
+version: "1.0"
+name: vault
+nodes:
+  - id: storage
+    type: osfs
+    config: {root: /data}
+  - id: encrypt
+    type: encryptfs
+    config: {password: hunter2, cipher: AES-256-GCM}
+  - id: cache
+    type: cachefs
+    config: {policy: LRU}
+connections:
+  - {from: storage, to: encrypt}
+  - {from: encrypt, to: cache}
+mount: {type: sftp, port: 2222, root: cache}
+`)
+	if plan := engine.Diff(old, same); !plan.Empty() {
+		t.Errorf("expected no changes, got %v", plan.Changes)
+	}
+
+	cipher := parse(`
+version: "1.0"
+name: vault
+nodes:
+  - id: storage
+    type: osfs
+    config: {root: /data}
+  - id: encrypt
+    type: encryptfs
+    config: {password: hunter2, cipher: ChaCha20-Poly1305}
+  - id: cache
+    type: cachefs
+connections:
+  - {from: storage, to: encrypt}
+  - {from: encrypt, to: cache}
+mount: {type: sftp, port: 2223, root: cache}
+`)
+	plan := engine.Diff(old, cipher)
+	if plan.Risk != engine.RiskDestructive || len(plan.Destructive()) != 1 || plan.Destructive()[0].Field != "cipher" {
+		t.Errorf("expected the cipher change to be destructive, got %v", plan.Changes)
+	}
+	var port bool
+	for _, c := range plan.Changes {
+		if c.Target == "mount" && c.Field == "port" && c.Risk == engine.RiskRemount {
+			port = true
+		}
+	}
+	if !port {
+		t.Errorf("expected a mount port change needing a remount, got %v", plan.Changes)
+	}
+	if strings.Join(plan.Rebuilt, ",") != "encrypt,cache" || strings.Join(plan.Reused, ",") != "storage" {
+		t.Errorf("unexpected rebuilt %v and reused %v", plan.Rebuilt, plan.Reused)
+	}
+
+	// Removing the encryption layer exposes ciphertext as plain files
+	bare := parse(`
+version: "1.0"
+name: vault
+nodes:
+  - id: storage
+    type: osfs
+    config: {root: /data}
+  - id: cache
+    type: cachefs
+connections:
+  - {from: storage, to: cache}
+mount: {type: sftp, port: 2222, root: cache}
+`)
+	plan = engine.Diff(old, bare)
+	if len(plan.Destructive()) != 1 || plan.Destructive()[0].Node != "encrypt" {
+		t.Errorf("expected removing encrypt to be destructive, got %v", plan.Changes)
+	}
+	for _, c := range plan.Changes {
+		if strings.Contains(fmt.Sprint(c.Old, c.New), "hunter2") {
+			t.Errorf("password shown in change %s", c)
+		}
+	}
+	t.Logf("✓ Diffed %d changes", len(plan.Changes))
+}
+
+func TestCompositionStore(t *testing.T) {
+	spec, err := engine.ParseFile("examples/tiered-storage.yaml")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	for _, tc := range []struct{ storeType, path string }{
+		{api.StoreDir, filepath.Join(dir, "specs")},
+		{api.StoreBolt, filepath.Join(dir, "db", "compositions.db")},
+	} {
+		store, err := api.OpenStore(tc.storeType, tc.path)
+		if err != nil {
+			t.Fatalf("%s: open failed: %v", tc.storeType, err)
+		}
+		if _, err := store.Put(spec.Name, &api.Revision{Spec: spec}, api.AnyRevision); err != nil {
+			t.Fatalf("%s: put failed: %v", tc.storeType, err)
+		}
+		if _, err := store.Put("gone", &api.Revision{Spec: spec}, api.AnyRevision); err != nil {
+			t.Fatalf("%s: put failed: %v", tc.storeType, err)
+		}
+		if err := store.Delete("gone"); err != nil {
+			t.Fatalf("%s: delete failed: %v", tc.storeType, err)
+		}
+		if _, err := store.Put("../escape", &api.Revision{Spec: spec}, api.AnyRevision); err == nil {
+			t.Errorf("%s: expected ID with a path separator to be rejected", tc.storeType)
+		}
+		store.Close()
+
+		// Compositions survive reopening the store
+		store, err = api.OpenStore(tc.storeType, tc.path)
+		if err != nil {
+			t.Fatalf("%s: reopen failed: %v", tc.storeType, err)
+		}
+		ids, _ := store.List()
+		if strings.Join(ids, ",") != spec.Name {
+			t.Errorf("%s: expected only %s after reopening, got %v", tc.storeType, spec.Name, ids)
+		}
+		rev, err := store.Get(spec.Name)
+		if err != nil {
+			t.Fatalf("%s: get failed: %v", tc.storeType, err)
+		}
+		got := rev.Spec
+		if len(got.Nodes) != len(spec.Nodes) || got.Mount.Root != spec.Mount.Root {
+			t.Errorf("%s: composition changed on reload", tc.storeType)
+		}
+		if plan := engine.Diff(spec, got); !plan.Empty() {
+			t.Errorf("%s: composition changed on reload: %v", tc.storeType, plan.Changes)
+		}
+		if _, err := store.Get("gone"); err != api.ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound for a deleted composition, got %v", tc.storeType, err)
+		}
+		store.Close()
+	}
+
+	if _, err := engine.ParseFile(filepath.Join(dir, "specs", spec.Name+".yaml")); err != nil {
+		t.Errorf("dir store did not write a parseable spec: %v", err)
+	}
+	t.Logf("✓ Reloaded compositions from dir and bolt stores")
+}
+
+func TestCompositionRevisions(t *testing.T) {
+	srv := httptest.NewServer(api.NewServer(api.NewMemoryStore()).Handler())
+	defer srv.Close()
+	base := srv.URL + "/api/compositions"
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	send := func(method, url, author, ifMatch, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("X-Author", author)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	spec := func(cacheSize int) string {
+		return fmt.Sprintf(`{"version":"1.0","name":"docs","nodes":[{"id":"disk","type":"memfs"},{"id":"cache","type":"cachefs","config":{"maxBytes":%d}}],`+
+			`"connections":[{"from":"disk","to":"cache"}],"mount":{"type":"webdav","port":8080,"root":"cache"}}`, cacheSize)
+	}
+
+	if resp := send("POST", base, "alice", "", spec(1024)); resp.StatusCode != http.StatusCreated || resp.Header.Get("ETag") != `"1"` {
+		t.Fatalf("create: got %d with ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp := send("PUT", base+"/docs", "bob", `"1"`, spec(2048)); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("update: got %d with ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	// A second editor still holding revision 1 must not overwrite bob
+	if resp := send("PUT", base+"/docs", "carol", `"1"`, spec(4096)); resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get("ETag") != `"2"` {
+		t.Errorf("stale update: expected 412 with the latest ETag, got %d with %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	var msg struct {
+		Type string
+		Data struct {
+			Revision api.Revision
+		}
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for msg.Type != "composition_updated" {
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("no websocket notification: %v", err)
+		}
+	}
+	if msg.Data.Revision.Number != 2 || msg.Data.Revision.Author != "bob" {
+		t.Errorf("unexpected notification %+v", msg.Data.Revision)
+	}
+
+	var diff struct {
+		Plan engine.Plan
+	}
+	if err := getJSON(base+"/docs/diff?from=1&to=2", &diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Plan.Changes) != 1 || diff.Plan.Changes[0].Field != "maxBytes" {
+		t.Errorf("expected a maxBytes change, got %v", diff.Plan.Changes)
+	}
+
+	if resp := send("POST", base+"/docs/rollback?revision=1", "dave", `"2"`, ""); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"3"` {
+		t.Fatalf("rollback: got %d with ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	var revs []api.Revision
+	if err := getJSON(base+"/docs/revisions", &revs); err != nil {
+		t.Fatal(err)
+	}
+	var authors []string
+	for _, rev := range revs {
+		authors = append(authors, rev.Author)
+	}
+	if strings.Join(authors, ",") != "alice,bob,dave" || revs[2].Message != "Rollback to revision 1" {
+		t.Errorf("unexpected history %+v", revs)
+	}
+	var current engine.CompositionSpec
+	if err := getJSON(base+"/docs", &current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Nodes[1].Config["maxBytes"] != float64(1024) {
+		t.Errorf("rollback did not restore revision 1: %v", current.Nodes[1].Config)
+	}
+	t.Logf("✓ Recorded %d revisions", len(revs))
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func TestLiveInstances(t *testing.T) {
+	srv := api.NewServer(api.NewMemoryStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	defer srv.StopInstances()
+	base := ts.URL + "/api/compositions"
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/ws", nil)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	// Find a free port for the WebDAV frontend
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	spec := fmt.Sprintf(`{"version":"1.0","name":"share","nodes":[{"id":"disk","type":"memfs"}],"mount":{"type":"webdav","port":%d,"root":"disk"}}`, port)
+	resp, err := http.Post(base, "application/json", strings.NewReader(spec))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create failed: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Post(base+"/share/instances", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var started api.Instance
+	json.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || started.State != api.StateRunning || started.Health != "healthy" {
+		t.Fatalf("start: got %s with %+v", resp.Status, started)
+	}
+
+	// The composition is served over WebDAV
+	davURL := fmt.Sprintf("http://127.0.0.1:%d/hello.txt", port)
+	req, _ := http.NewRequest("PUT", davURL, strings.NewReader("hello"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("webdav put failed: %v", err)
+	}
+	if resp, err := http.Get(davURL); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("webdav get failed: %v", err)
+	} else {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != "hello" {
+			t.Errorf("webdav get returned %q", data)
+		}
+	}
+
+	var listed []api.Instance
+	if err := getJSON(ts.URL+"/api/instances", &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != started.ID || listed[0].Uptime == "" {
+		t.Errorf("unexpected instances %+v", listed)
+	}
+
+	req, _ = http.NewRequest("DELETE", base+"/share/instances/"+started.ID, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second); err == nil {
+		t.Error("webdav server still listening after stop")
+	}
+
+	var states []string
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(states) == 0 || states[len(states)-1] != api.StateStopped {
+		var msg struct {
+			Type string
+			Data json.RawMessage
+		}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("missing state changes, got %v: %v", states, err)
+		}
+		var in api.Instance
+		if msg.Type == "instance_state" && json.Unmarshal(msg.Data, &in) == nil {
+			states = append(states, in.State)
+		}
+	}
+	if strings.Join(states, ",") != "starting,running,stopping,stopped" {
+		t.Errorf("unexpected state changes %v", states)
+	}
+	t.Logf("✓ Instance went through %s", strings.Join(states, " → "))
+}
+
+func TestFileBrowser(t *testing.T) {
+	srv := api.NewServer(api.NewMemoryStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	base := ts.URL + "/api/compositions"
+
+	spec := `{"version":"1.0","name":"files","nodes":[{"id":"disk","type":"memfs"}],"mount":{"type":"api","root":"disk"}}`
+	resp, err := http.Post(base, "application/json", strings.NewReader(spec))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create failed: %v", err)
+	}
+	resp.Body.Close()
+
+	do := func(method, url, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, url, err)
+		}
+		return resp
+	}
+
+	// Uploads create missing directories and persist between requests
+	if resp := do("PUT", base+"/files/fs/docs/readme.txt", "hello world"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: %s", resp.Status)
+	}
+	for i := 0; i < 5; i++ {
+		do("PUT", fmt.Sprintf("%s/files/fs/docs/%d.txt", base, i), "x").Body.Close()
+	}
+	if resp := do("PUT", base+"/files/fs/docs/empty/", ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("mkdir: %s", resp.Status)
+	}
+
+	req, _ := http.NewRequest("GET", base+"/files/fs/docs/readme.txt", nil)
+	req.Header.Set("Range", "bytes=6-")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(data) != "world" {
+		t.Errorf("range download: %s %q", resp.Status, data)
+	}
+
+	// Listings are paged in name order
+	var names []string
+	next := ""
+	for pages := 0; ; pages++ {
+		var listing api.DirListing
+		if err := getJSON(base+"/files/fs/docs?limit=3&after="+next, &listing); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range listing.Entries {
+			names = append(names, e.Name)
+		}
+		if next = listing.Next; next == "" {
+			if pages != 2 {
+				t.Errorf("expected 3 pages, got %d", pages+1)
+			}
+			break
+		}
+	}
+	if strings.Join(names, ",") != "0.txt,1.txt,2.txt,3.txt,4.txt,empty,readme.txt" {
+		t.Errorf("unexpected listing %v", names)
+	}
+
+	// An upload that fails part way leaves the previous file intact
+	rec := httptest.NewRecorder()
+	failed := httptest.NewRequest("PUT", "/api/compositions/files/fs/docs/readme.txt",
+		io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset"))))
+	srv.Handler().ServeHTTP(rec, failed)
+	if rec.Code < 400 {
+		t.Errorf("failed upload answered %d", rec.Code)
+	}
+	resp = do("GET", base+"/files/fs/docs/readme.txt", "")
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hello world" {
+		t.Errorf("file after failed upload = %q", data)
+	}
+
+	var entry api.FileEntry
+	if err := getJSON(base+"/files/fs/docs/readme.txt?stat", &entry); err != nil || entry.Size != 11 || entry.Dir {
+		t.Errorf("stat: %+v %v", entry, err)
+	}
+
+	if resp := do("DELETE", base+"/files/fs/docs", ""); resp.StatusCode == http.StatusOK {
+		t.Error("deleted a non-empty directory without ?recursive")
+	}
+	if resp := do("DELETE", base+"/files/fs/docs?recursive", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("recursive delete: %s", resp.Status)
+	}
+	if resp := do("GET", base+"/files/fs/docs/readme.txt", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted file still served: %s", resp.Status)
+	}
+	t.Logf("✓ Browsed %d entries in pages of 3", len(names))
+}
+
+// TestFileBrowserStacks checks that paging reads a directory once, and
+// that a stack replaced by a new revision stays open for the requests
+// still using it
+func TestFileBrowserStacks(t *testing.T) {
+	tracked, closes := trackCloses(t)
+	srv := api.NewServer(api.NewMemoryStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	defer srv.Close()
+	base := ts.URL + "/api/compositions"
+
+	spec := func(description string) string {
+		return `{"version":"1.0","name":"paged","description":"` + description + `","nodes":[{"id":"disk","type":"memfs"},` +
+			`{"id":"top","type":"` + tracked + `","config":{"label":"top"}}],"connections":[{"from":"disk","to":"top"}],"mount":{"type":"api","root":"top"}}`
+	}
+	do := func(method, url string, body io.Reader) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, url, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := do("POST", base, strings.NewReader(spec("v1"))); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %s", resp.Status)
+	}
+	for i := 0; i < 7; i++ {
+		do("PUT", fmt.Sprintf("%s/paged/fs/%d.txt", base, i), strings.NewReader("x"))
+	}
+
+	list := func() []string {
+		t.Helper()
+		var names []string
+		next := ""
+		for {
+			var listing api.DirListing
+			if err := getJSON(base+"/paged/fs/?limit=3&after="+next, &listing); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range listing.Entries {
+				names = append(names, e.Name)
+			}
+			if next = listing.Next; next == "" {
+				return names
+			}
+		}
+	}
+	reads := closes.get("top readdir")
+	if names := list(); len(names) != 7 {
+		t.Errorf("listed %v", names)
+	}
+	if n := closes.get("top readdir") - reads; n != 1 {
+		t.Errorf("three pages read the directory %d times, want once", n)
+	}
+	do("PUT", base+"/paged/fs/new.txt", strings.NewReader("x"))
+	if names := list(); len(names) != 8 || names[7] != "new.txt" {
+		t.Errorf("listing after an upload: %v", names)
+	}
+
+	// An upload in flight keeps the stack it started on open across an
+	// update, and the stack closes when it finishes
+	body, writer := io.Pipe()
+	uploaded := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("PUT", base+"/paged/fs/slow.txt", body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			uploaded <- 0
+			return
+		}
+		resp.Body.Close()
+		uploaded <- resp.StatusCode
+	}()
+	// Opening the temporary file shows the handler is copying the body
+	opens := closes.get("top openfile")
+	writer.Write([]byte("first half, "))
+	for deadline := time.Now().Add(2 * time.Second); closes.get("top openfile") == opens; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("upload did not start")
+		}
+	}
+
+	if resp := do("PUT", base+"/paged", strings.NewReader(spec("v2"))); resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: %s", resp.Status)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := closes.get("top"); n != 0 {
+		t.Errorf("stack closed %d times while an upload was using it", n)
+	}
+	writer.Write([]byte("second half"))
+	writer.Close()
+	if status := <-uploaded; status != http.StatusCreated {
+		t.Errorf("upload across an update: %d", status)
+	}
+	for deadline := time.Now().Add(2 * time.Second); closes.get("top") != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("replaced stack closed %d times after the upload, want once", closes.get("top"))
+		}
+	}
+	t.Log("✓ Replaced stack closed after its last request")
+}
+
+func TestAPIAuth(t *testing.T) {
+	dir := t.TempDir()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	os.WriteFile(filepath.Join(dir, "users.txt"), []byte("# name:hash:role\nalice:"+string(hash)+":editor\n"), 0600)
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"k1","x":%q}]}`, b64.EncodeToString(pub))
+	os.WriteFile(filepath.Join(dir, "jwks.json"), []byte(jwks), 0600)
+	signJWT := func(claims string) string {
+		signed := b64.EncodeToString([]byte(`{"alg":"EdDSA","kid":"k1"}`)) + "." + b64.EncodeToString([]byte(claims))
+		return signed + "." + b64.EncodeToString(ed25519.Sign(priv, []byte(signed)))
+	}
+
+	config := `
+origins: [https://studio.example.com]
+tokens:
+  - name: ci
+    token: op-token
+    role: operator
+  - name: dashboard
+    token: view-token
+    role: viewer
+usersFile: users.txt
+jwt:
+  jwks: jwks.json
+  audience: fscomposer
+  roleClaim: realm_access.roles
+permissions:
+  private:
+    ci: operator
+    jwt:carol: viewer
+`
+	os.WriteFile(filepath.Join(dir, "auth.yaml"), []byte(config), 0600)
+	cfg, err := api.LoadAuthConfig(filepath.Join(dir, "auth.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := api.NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := api.NewServer(api.NewMemoryStore())
+	srv.SetAuth(auth)
+	srv.SetAllowedOrigins(cfg.Origins)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	base := ts.URL + "/api/compositions"
+
+	call := func(method, url, body string, auth func(*http.Request)) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	alice := func(r *http.Request) { r.SetBasicAuth("alice", "s3cret") }
+
+	spec := func(name string) string {
+		return `{"version":"1.0","name":"` + name + `","nodes":[{"id":"disk","type":"memfs"}],"mount":{"type":"api","root":"disk"}}`
+	}
+	future := time.Now().Add(time.Hour).Unix()
+	steps := []struct {
+		name         string
+		method, path string
+		body         string
+		auth         func(*http.Request)
+		want         int
+	}{
+		{"anonymous", "GET", "", "", nil, http.StatusUnauthorized},
+		{"wrong password", "GET", "", "", func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, http.StatusUnauthorized},
+		{"viewer cannot create", "POST", "", spec("shared"), bearer("view-token"), http.StatusForbidden},
+		{"editor creates", "POST", "", spec("shared"), alice, http.StatusCreated},
+		{"viewer reads", "GET", "/shared", "", bearer("view-token"), http.StatusOK},
+		{"editor cannot start", "POST", "/shared/instances", "", alice, http.StatusForbidden},
+		{"operator starts", "POST", "/shared/instances", "", bearer("op-token"), http.StatusCreated},
+		{"editor cannot create private", "POST", "", spec("private"), alice, http.StatusForbidden},
+		{"permitted operator creates private", "POST", "", spec("private"), bearer("op-token"), http.StatusCreated},
+		{"viewer cannot read private", "GET", "/private", "", bearer("view-token"), http.StatusForbidden},
+		{"jwt editor updates", "PUT", "/shared", spec("shared"),
+			bearer(signJWT(fmt.Sprintf(`{"sub":"bob","aud":"fscomposer","exp":%d,"realm_access":{"roles":["editor"]}}`, future))), http.StatusOK},
+		{"jwt for another audience", "GET", "/shared", "",
+			bearer(signJWT(fmt.Sprintf(`{"sub":"bob","aud":"other","exp":%d,"realm_access":{"roles":["editor"]}}`, future))), http.StatusUnauthorized},
+		{"expired jwt", "GET", "/shared", "",
+			bearer(signJWT(`{"sub":"bob","aud":"fscomposer","exp":1000,"realm_access":{"roles":["editor"]}}`)), http.StatusUnauthorized},
+		{"jwt without expiry", "GET", "/shared", "",
+			bearer(signJWT(`{"sub":"bob","aud":"fscomposer","realm_access":{"roles":["editor"]}}`)), http.StatusUnauthorized},
+		{"jwt named like a token gets none of its grants", "GET", "/private", "",
+			bearer(signJWT(fmt.Sprintf(`{"sub":"ci","aud":"fscomposer","exp":%d,"realm_access":{"roles":["operator"]}}`, future))), http.StatusForbidden},
+		{"jwt granted by its prefixed name", "GET", "/private", "",
+			bearer(signJWT(fmt.Sprintf(`{"sub":"carol","aud":"fscomposer","exp":%d}`, future))), http.StatusOK},
+	}
+	for _, step := range steps {
+		if got := call(step.method, base+step.path, step.body, step.auth); got != step.want {
+			t.Errorf("%s: got %d, want %d", step.name, got, step.want)
+		}
+	}
+
+	// Listings only show what the caller may view, and authors are the
+	// authenticated principals
+	var listed []map[string]interface{}
+	req, _ := http.NewRequest("GET", base, nil)
+	bearer("view-token")(req)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		json.NewDecoder(resp.Body).Decode(&listed)
+		resp.Body.Close()
+	}
+	if len(listed) != 1 || listed[0]["id"] != "shared" || listed[0]["author"] != "jwt:bob" {
+		t.Errorf("viewer listing: %v", listed)
+	}
+
+	// Without exp checks, JWTs may omit it; a token cannot share a user's
+	// name
+	cfg.JWT.AllowNoExpiry = true
+	lenient, err := api.NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenientSrv := api.NewServer(api.NewMemoryStore())
+	lenientSrv.SetAuth(lenient)
+	lenientTS := httptest.NewServer(lenientSrv.Handler())
+	defer lenientTS.Close()
+	if got := call("GET", lenientTS.URL+"/api/compositions", "", bearer(signJWT(`{"sub":"bob","aud":"fscomposer","realm_access":{"roles":["editor"]}}`))); got != http.StatusOK {
+		t.Errorf("jwt without expiry when allowed: got %d", got)
+	}
+	cfg.Tokens = append(cfg.Tokens, api.TokenConfig{Name: "alice", Token: "t", Role: api.RoleViewer})
+	if _, err := api.NewAuthenticator(cfg); err == nil {
+		t.Error("accepted a token with a user's name")
+	}
+
+	// Only allowed origins may call from browsers
+	for origin, want := range map[string]string{
+		"https://studio.example.com": "https://studio.example.com",
+		"https://evil.example.com":   "",
+	} {
+		req, _ := http.NewRequest("OPTIONS", base, nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %s: allowed %q, want %q", origin, got, want)
+		}
+	}
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws?access_token=view-token"
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.com"}}); err == nil {
+		t.Error("websocket accepted a disallowed origin")
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://studio.example.com"}})
+	if err != nil {
+		t.Fatalf("websocket with token failed: %v", err)
+	}
+	ws.Close()
+	t.Logf("✓ Checked %d authorization cases", len(steps))
+}
+
+func TestSecretFields(t *testing.T) {
+	dir := t.TempDir()
+	store, err := api.NewDirStore(filepath.Join(dir, "compositions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := api.LoadSecretKey(filepath.Join(dir, "secret.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsFile := filepath.Join(dir, "compositions", ".secrets")
+	secrets, err := api.OpenSecretStore(secretsFile, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := api.NewServer(store)
+	srv.SetSecrets(secrets)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	base := ts.URL + "/api/compositions"
+
+	spec := `{"version":"1.0","name":"vault","nodes":[{"id":"disk","type":"memfs"},{"id":"encrypt","type":"encryptfs","config":{"password":"hunter2","kdfMemory":1024,"kdfIterations":1}}],"connections":[{"from":"disk","to":"encrypt"}],"mount":{"type":"api","root":"encrypt"}}`
+	resp, err := http.Post(base, "application/json", strings.NewReader(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || strings.Contains(string(body), "hunter2") {
+		t.Fatalf("create: %s %s", resp.Status, body)
+	}
+
+	// Responses are redacted, and neither the stored spec nor the secret
+	// file holds the password in the clear
+	var got engine.CompositionSpec
+	if err := getJSON(base+"/vault", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Nodes[1].Config["password"] != engine.Redacted {
+		t.Errorf("password not redacted: %v", got.Nodes[1].Config["password"])
+	}
+	for _, file := range []string{filepath.Join(dir, "compositions", "vault.yaml"), secretsFile} {
+		if data, _ := os.ReadFile(file); bytes.Contains(data, []byte("hunter2")) || len(data) == 0 {
+			t.Errorf("%s holds the password or is empty", file)
+		}
+	}
+
+	// Sending the redacted spec back keeps the password, which the builder
+	// still resolves
+	got.Description = "renamed"
+	data, _ := json.Marshal(got)
+	req, _ := http.NewRequest("PUT", base+"/vault", bytes.NewReader(data))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("update with redacted password failed: %v", err)
+	}
+	resp, err = http.Post(base+"/vault/instances", "application/json", nil)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("start failed: %v", err)
+	}
+	resp.Body.Close()
+	req, _ = http.NewRequest("PUT", base+"/vault/fs/note.txt", strings.NewReader("classified"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("write through encryptfs failed: %v", err)
+	}
+	defer srv.StopInstances()
+
+	// Redacted values cannot be invented for new compositions
+	fresh := strings.Replace(strings.Replace(spec, "hunter2", engine.Redacted, 1), `"vault"`, `"other"`, 1)
+	if resp, err := http.Post(base, "application/json", strings.NewReader(fresh)); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("redacted password accepted for a new composition")
+	}
+
+	// Live specs compare equal to the file they came from
+	var plain engine.CompositionSpec
+	json.Unmarshal([]byte(spec), &plain)
+	if plan := engine.Diff(engine.RedactSpec(&plain), &plain); len(plan.Changes) != 0 {
+		t.Errorf("redacted spec differs from its source: %+v", plan.Changes)
+	}
+
+	// Credential-like mount options are sealed too, and resolved when the
+	// frontend starts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	dav := fmt.Sprintf(`{"version":"1.0","name":"dav","nodes":[{"id":"disk","type":"memfs"}],"mount":{"type":"webdav","port":%d,"root":"disk","options":{"users":[{"username":"alice","password":"swordfish"}]}}}`, port)
+	if resp, err := http.Post(base, "application/json", strings.NewReader(dav)); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create with a mount password failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "compositions", "dav.yaml")); bytes.Contains(data, []byte("swordfish")) {
+		t.Errorf("mount password stored in the clear:\n%s", data)
+	}
+	if resp, err := http.Post(base+"/dav/instances", "application/json", nil); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("start with a sealed mount password failed: %v", err)
+	}
+	for password, allowed := range map[string]bool{"swordfish": true, engine.SecretRefPrefix: false} {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/note.txt", port), strings.NewReader("hi"))
+		req.SetBasicAuth("alice", password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if (resp.StatusCode == http.StatusCreated) != allowed {
+			t.Errorf("webdav with password %q: got %s", password, resp.Status)
+		}
+	}
+
+	// Plain secrets written into the store directory by hand are sealed
+	// when the server starts
+	hand := filepath.Join(dir, "compositions", "hand.yaml")
+	os.WriteFile(hand, []byte(strings.NewReplacer(`"vault"`, `"hand"`, "hunter2", "letmein").Replace(spec)), 0644)
+	store, err = api.NewDirStore(filepath.Join(dir, "compositions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := api.NewServer(store)
+	restarted.SetSecrets(secrets)
+	if err := restarted.SealStored(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(hand); bytes.Contains(data, []byte("letmein")) {
+		t.Errorf("hand-written password left in the clear:\n%s", data)
+	}
+	if rev, err := store.Get("hand"); err != nil || rev.Number != 2 {
+		t.Errorf("sealing did not record a revision: %+v %v", rev, err)
+	} else if name, ok := engine.ParseSecretRef(rev.Spec.Nodes[1].Config["password"]); !ok {
+		t.Errorf("password not sealed: %v", rev.Spec.Nodes[1].Config["password"])
+	} else if value, _ := secrets.Get(name); value != "letmein" {
+		t.Errorf("sealed password is %q", value)
+	}
+
+	if _, err := api.OpenSecretStore(secretsFile, make([]byte, 32)); err == nil {
+		t.Error("secret store opened with the wrong key")
+	}
+	t.Log("✓ Password stored encrypted, redacted and resolved by the builder")
+}
+
+func TestFUSEConfig(t *testing.T) {
+	spec := func(options map[string]interface{}) *engine.CompositionSpec {
+		return &engine.CompositionSpec{
+			Version: "1.0",
+			Name:    "fuse-test",
+			Nodes:   []engine.Node{{ID: "disk", Type: "memfs"}},
+			Mount:   engine.MountConfig{Type: engine.MountTypeFUSE, Path: "/mnt/spec", Root: "disk", Options: options},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		check   func(*frontend.FUSEConfig) bool
+		err     string // Expected error substring; empty for success
+	}{
+		{"defaults", nil, func(c *frontend.FUSEConfig) bool {
+			return c.Mountpoint == "/mnt/spec" && c.FSName == "fuse-test" && c.DefaultPermissions && !c.AllowOther && !c.ReadOnly &&
+				c.AttrTimeout == time.Second && c.EntryTimeout == time.Second && c.AttrCacheTTL == 5*time.Second &&
+				c.MaxReadahead == 128*1024 && c.Umask == 0
+		}, ""},
+		{"allowOther and readOnly", map[string]interface{}{"allowOther": true, "readOnly": true}, func(c *frontend.FUSEConfig) bool {
+			return c.AllowOther && c.ReadOnly && !c.AllowRoot
+		}, ""},
+		{"allowOther with allowRoot", map[string]interface{}{"allowOther": true, "allowRoot": true}, nil, "mutually exclusive"},
+		{"non-bool readOnly", map[string]interface{}{"readOnly": "yes"}, nil, "readOnly"},
+		{"durations", map[string]interface{}{"attrTimeout": 5, "entryTimeout": "500ms", "dirCacheTTL": 1.5}, func(c *frontend.FUSEConfig) bool {
+			return c.AttrTimeout == 5*time.Second && c.EntryTimeout == 500*time.Millisecond && c.DirCacheTTL == 1500*time.Millisecond
+		}, ""},
+		{"invalid duration", map[string]interface{}{"attrTimeout": "soon"}, nil, "attrTimeout"},
+		{"duration of the wrong type", map[string]interface{}{"entryTimeout": true}, nil, "number of seconds or a duration"},
+		{"octal umask string", map[string]interface{}{"umask": "0027"}, func(c *frontend.FUSEConfig) bool { return c.Umask == 0o027 }, ""},
+		{"umask read as octal by YAML", map[string]interface{}{"umask": 0o022}, func(c *frontend.FUSEConfig) bool { return c.Umask == 0o022 }, ""},
+		{"non-octal umask", map[string]interface{}{"umask": "0099"}, nil, "octal mask"},
+		{"umask out of range", map[string]interface{}{"umask": "1000"}, nil, "between 0000 and 0777"},
+		{"negative uid", map[string]interface{}{"uid": -1}, nil, "must not be negative"},
+		{"raw options", map[string]interface{}{"options": []interface{}{"noatime"}}, func(c *frontend.FUSEConfig) bool {
+			return len(c.Options) == 1 && c.Options[0] == "noatime"
+		}, ""},
+		{"raw options not a list", map[string]interface{}{"options": "noatime"}, nil, "list of strings"},
+	}
+	for _, tc := range tests {
+		cfg, err := frontend.FUSEConfigFromSpec(spec(tc.options), "")
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case !tc.check(cfg):
+			t.Errorf("%s: unexpected config %+v", tc.name, cfg)
+		}
+	}
+
+	// The mountpoint argument overrides mount.path, which is otherwise
+	// required
+	if cfg, err := frontend.FUSEConfigFromSpec(spec(nil), "/mnt/arg"); err != nil || cfg.Mountpoint != "/mnt/arg" {
+		t.Errorf("mountpoint override: %+v %v", cfg, err)
+	}
+	noPath := spec(nil)
+	noPath.Mount.Path = ""
+	if _, err := frontend.FUSEConfigFromSpec(noPath, ""); err == nil {
+		t.Error("expected an error without a mountpoint")
+	}
+}
+
+func TestUmask(t *testing.T) {
+	newMemFS, err := registry.Get("memfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := newMemFS(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := frontend.WithUmask(mem, 0o027)
+
+	if err := fs.Mkdir("/dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/dir/file", os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	// Modes already stored without the mask are masked when reported
+	if err := mem.Chmod("/dir/file", 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := fs.Stat("/dir/file"); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("stat: %v %v", info.Mode(), err)
+	}
+	entries, err := fs.ReadDir("/dir")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("readdir: %v %v", entries, err)
+	}
+	if info, err := entries[0].Info(); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("readdir entry: %v %v", info.Mode(), err)
+	}
+	dir, err := fs.Open("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if info, err := dir.Stat(); err != nil || info.Mode().Perm() != 0o750 {
+		t.Errorf("directory handle stat: %v %v", info.Mode(), err)
+	}
+	infos, err := dir.Readdir(-1)
+	if err != nil || len(infos) != 1 || infos[0].Mode().Perm() != 0o640 {
+		t.Errorf("directory handle readdir: %v %v", infos, err)
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	assets := fstest.MapFS{
+		"index.html":              {Data: []byte("<html>studio</html>")},
+		"assets/index-4f2a9c.js":  {Data: []byte("console.log('studio')")},
+		"assets/index-4f2a9c.css": {Data: []byte("body{}")},
+	}
+	srv := api.NewServer(api.NewMemoryStore())
+	srv.SetWebUI(web.Handler(assets, false))
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	get := func(path string, header http.Header) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(data)
+	}
+
+	checks := []struct {
+		path, body, cache string
+		status            int
+	}{
+		{"/", "<html>studio</html>", "no-cache", http.StatusOK},
+		{"/compositions/vault", "<html>studio</html>", "no-cache", http.StatusOK}, // Client-side route
+		{"/assets/index-4f2a9c.js", "console.log('studio')", "public, max-age=31536000, immutable", http.StatusOK},
+		{"/assets/missing.js", "", "", http.StatusNotFound},
+	}
+	for _, c := range checks {
+		resp, body := get(c.path, nil)
+		if resp.StatusCode != c.status || (c.body != "" && body != c.body) || resp.Header.Get("Cache-Control") != c.cache {
+			t.Errorf("%s: got %d %q cache %q", c.path, resp.StatusCode, body, resp.Header.Get("Cache-Control"))
+		}
+	}
+
+	resp, _ := get("/", nil)
+	if resp, _ := get("/", http.Header{"If-None-Match": {resp.Header.Get("ETag")}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation: got %d", resp.StatusCode)
+	}
+
+	// The API still answers and unknown API paths are not pages
+	if resp, _ := get("/api/nodes", nil); resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("api behind the UI: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp, _ := get("/api/unknown", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown api path: got %d", resp.StatusCode)
+	}
+
+	// Without assets the server explains how to build the UI
+	bare := httptest.NewServer(web.Handler(nil, false))
+	defer bare.Close()
+	if resp, err := http.Get(bare.URL); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("placeholder page failed: %v", err)
+	} else {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(data), "npm run build") {
+			t.Errorf("placeholder page does not explain the build: %q", data)
+		}
+	}
+	t.Log("✓ UI served with SPA fallback and cache headers")
+}
+
+func TestOpenAPIDrift(t *testing.T) {
+	auth, err := api.NewAuthenticator(&api.AuthConfig{
+		Tokens: []api.TokenConfig{{Name: "ci", Token: "op-token", Role: api.RoleOperator}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := api.NewServer(api.NewMemoryStore())
+	srv.SetAuth(auth)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	defer srv.StopInstances()
+
+	// The document is public
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := getJSON(ts.URL+"/api/openapi.json", &doc); err != nil {
+		t.Fatal(err)
+	}
+	documented := make(map[string]bool)
+	for p, item := range doc.Paths {
+		for method := range item {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+p] = true
+			}
+		}
+	}
+
+	// Every route is documented and every documented operation is routed
+	routed := make(map[string]bool)
+	for _, r := range srv.Routes() {
+		op := r.Method + " " + r.Path
+		routed[op] = true
+		if !documented[op] {
+			t.Errorf("route %s is missing from openapi.yaml", op)
+		}
+	}
+	for op := range documented {
+		if !routed[op] {
+			t.Errorf("openapi.yaml documents %s, which the server does not route", op)
+		}
+	}
+
+	// Every API path the web UI calls is documented
+	pathPattern := regexp.MustCompile("[`'\"](/api/[^`'\"?]*)")
+	templated := regexp.MustCompile(`\$\{[^}]*\}|\{[^}]*\}`)
+	known := make(map[string]bool)
+	for p := range doc.Paths {
+		known[templated.ReplaceAllString(p, "{}")] = true
+	}
+	err = filepath.WalkDir("web/src", func(name string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, ".svelte") && !strings.HasSuffix(name, ".js") {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		for _, m := range pathPattern.FindAllStringSubmatch(string(data), -1) {
+			if p := templated.ReplaceAllString(m[1], "{}"); !known[p] {
+				t.Errorf("%s calls %s, which openapi.yaml does not document", name, m[1])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Go client works against the documented routes
+	if _, err := client.New(ts.URL).Compositions(); err == nil {
+		t.Error("client without credentials was let in")
+	}
+	c := client.New(ts.URL).WithToken("op-token")
+	if p, err := c.WhoAmI(); err != nil || p.Name != "ci" {
+		t.Fatalf("whoami: %+v %v", p, err)
+	}
+	node, err := c.Node("encryptfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secret bool
+	for _, f := range node.Fields {
+		secret = secret || f.Name == "password" && f.Secret
+	}
+	if !secret {
+		t.Errorf("encryptfs fields %+v do not mark the password secret", node.Fields)
+	}
+
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "scripted",
+		Nodes:   []engine.Node{{ID: "disk", Type: "memfs"}},
+		Mount:   engine.MountConfig{Type: "api", Root: "disk"},
+	}
+	created, err := c.Create(spec)
+	if err != nil || created.Revision != 1 {
+		t.Fatalf("create: %+v %v", created, err)
+	}
+	spec.Description = "edited"
+	if _, rev, err := c.Update("scripted", spec, 1); err != nil || rev != 2 {
+		t.Fatalf("update: revision %d %v", rev, err)
+	}
+	// Compositions are stored under their name, so a PUT cannot rename one
+	renamed := *spec
+	renamed.Name = "renamed"
+	if _, _, err := c.Update("scripted", &renamed, 2); err == nil || !strings.Contains(err.Error(), "create a new composition") {
+		t.Errorf("rename through update: expected a refusal, got %v", err)
+	}
+	if _, err := c.Revisions("renamed"); err == nil {
+		t.Error("rename through update created a composition")
+	}
+	if _, _, err := c.Update("scripted", spec, 1); !client.IsConflict(err) {
+		t.Errorf("stale update: expected a conflict, got %v", err)
+	} else if latest := err.(*client.Error).Latest; latest == nil || latest.Number != 2 {
+		t.Errorf("conflict does not carry the latest revision: %+v", latest)
+	}
+	if d, err := c.Diff("scripted", 0, 0); err != nil || d.From.Number != 1 || d.Plan.Empty() {
+		t.Errorf("diff: %+v %v", d, err)
+	}
+	if v, err := c.Validate("scripted"); err != nil || !v.Valid {
+		t.Errorf("validate: %+v %v", v, err)
+	}
+
+	in, err := c.Start("scripted", api.StartRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Upload("scripted", "/docs/readme.txt", strings.NewReader("hello"), client.FileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	listing, err := c.ReadDir("scripted", "/docs", client.FileOptions{Instance: in.ID})
+	if err != nil || len(listing.Entries) != 1 || listing.Entries[0].Size != 5 {
+		t.Fatalf("readdir: %+v %v", listing, err)
+	}
+	f, err := c.Open("scripted", "/docs/readme.txt", client.FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "hello" {
+		t.Errorf("download returned %q", data)
+	}
+	if err := c.Remove("scripted", "/docs", true, client.FileOptions{}); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Stat("scripted", "/docs", client.FileOptions{}); !client.IsNotFound(err) {
+		t.Errorf("stat after remove: expected not found, got %v", err)
+	}
+	if stopped, err := c.Stop("scripted", in.ID); err != nil || stopped.State != api.StateStopped {
+		t.Errorf("stop: %+v %v", stopped, err)
+	}
+	if err := c.Delete("scripted"); err != nil {
+		t.Error(err)
+	}
+	t.Logf("✓ %d routes match openapi.yaml", len(routed))
+}
+
+func TestYAMLImportExport(t *testing.T) {
+	srv := api.NewServer(api.NewMemoryStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	base := ts.URL + "/api/compositions"
+
+	// Specs created from JSON hold numbers as float64
+	spec := `{"version":"1.0","name":"cached","nodes":[{"id":"disk","type":"memfs"},{"id":"cache","type":"cachefs","config":{"maxBytes":1073741824,"policy":"LRU"}},{"id":"encrypt","type":"encryptfs","config":{"password":"hunter2","kdfMemory":1024,"kdfIterations":1}}],"connections":[{"from":"disk","to":"encrypt"},{"from":"encrypt","to":"cache"}],"mount":{"type":"api","root":"cache"}}`
+	if resp, err := http.Post(base, "application/json", strings.NewReader(spec)); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	// The export is a spec file the CLI reads, with secrets redacted
+	c := client.New(ts.URL)
+	exported, err := c.Export("cached", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(exported, []byte("maxBytes: 1073741824\n")) || bytes.Contains(exported, []byte("hunter2")) {
+		t.Errorf("unexpected export:\n%s", exported)
+	}
+	file := filepath.Join(t.TempDir(), "cached.yaml")
+	os.WriteFile(file, exported, 0644)
+	parsed, err := engine.ParseFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.NewValidator(parsed).AllowRedacted().ValidateAll(); err != nil {
+		t.Errorf("exported spec does not validate: %v", err)
+	}
+
+	// Unchanged, it cannot be mounted with "********" as the password
+	diags := engine.NewValidator(parsed).Diagnose()
+	if len(diags) != 1 || diags[0].Check != "secrets" || !strings.Contains(diags[0].Message, "node encrypt: password") {
+		t.Errorf("redacted password not diagnosed: %+v", diags)
+	}
+	if _, err := engine.NewBuilder(parsed).Build(); err == nil || !strings.Contains(err.Error(), "redacted") {
+		t.Errorf("exported spec built with a redacted password: %v", err)
+	}
+	var plain engine.CompositionSpec
+	json.Unmarshal([]byte(spec), &plain)
+	if plan := engine.Diff(parsed, engine.RedactSpec(&plain)); !plan.Empty() {
+		t.Errorf("exported spec differs from the stored one: %+v", plan.Changes)
+	}
+
+	// Importing the export back keeps the redacted password
+	created, err := c.Import(bytes.NewReader(exported))
+	if err != nil || created.Revision != 2 {
+		t.Fatalf("import of the export: %+v %v", created, err)
+	}
+	if rev, err := c.Revision("cached", 2); err != nil || rev.Spec.Nodes[2].Config["password"] != engine.Redacted {
+		t.Errorf("reimported revision: %+v %v", rev, err)
+	}
+
+	// A broken file is rejected with every problem found
+	broken := strings.NewReplacer("policy: LRU", "policy: FIFO", "connections:\n", "connections:\n  - from: cache\n    to: encrypt\n").Replace(string(exported))
+	_, err = c.Import(strings.NewReader(broken))
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("broken import: expected 422, got %v", err)
+	}
+	checks := make(map[string]bool)
+	for _, d := range apiErr.Diagnostics {
+		checks[d.Check] = true
+	}
+	if !checks["cycles"] || !checks["config"] {
+		t.Errorf("missing diagnostics: %+v", apiErr.Diagnostics)
+	}
+	if _, err := c.Import(strings.NewReader("nodes: [")); !errors.As(err, &apiErr) || len(apiErr.Diagnostics) != 1 || apiErr.Diagnostics[0].Check != "parse" {
+		t.Errorf("unparseable import: %v", err)
+	}
+
+	// A multipart upload, as from a browser form
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("file", "copy.yaml")
+	part.Write(bytes.Replace(exported, []byte("name: cached"), []byte("name: copy"), 1))
+	mw.Close()
+	resp, err := http.Post(base+"/import", mw.FormDataContentType(), &form)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("multipart import of a redacted password into a new composition: %v %v", resp.Status, err)
+	}
+
+	// Composition endpoints speak YAML when asked
+	yamlSpec := "version: \"1.0\"\nname: plain\nnodes:\n  - id: disk\n    type: memfs\nmount:\n  type: api\n  root: disk\n"
+	req, _ := http.NewRequest("POST", base, strings.NewReader(yamlSpec))
+	req.Header.Set("Content-Type", "application/yaml")
+	req.Header.Set("Accept", "application/yaml")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/yaml" || !bytes.Contains(body, []byte("id: plain\n")) {
+		t.Errorf("yaml create: %s %s\n%s", resp.Status, resp.Header.Get("Content-Type"), body)
+	}
+	req, _ = http.NewRequest("GET", base+"/plain", nil)
+	req.Header.Set("Accept", "application/json;q=0.5, application/yaml")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, err := engine.Parse(body); err != nil || got.Name != "plain" || got.Nodes[0].ID != "disk" {
+		t.Errorf("yaml get: %v\n%s", err, body)
+	}
+	if specJSON, _, err := c.Composition("plain"); err != nil || specJSON.Mount.Root != "disk" {
+		t.Errorf("json get: %+v %v", specJSON, err)
+	}
+	t.Log("✓ Export round-trips through engine.ParseFile and import")
+}
+
+func TestCollaborativeEditing(t *testing.T) {
+	auth, err := api.NewAuthenticator(&api.AuthConfig{
+		Tokens: []api.TokenConfig{
+			{Name: "alice", Token: "alice-token", Role: api.RoleOperator},
+			{Name: "bob", Token: "bob-token", Role: api.RoleViewer},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := api.NewServer(api.NewMemoryStore())
+	srv.SetAuth(auth)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	defer srv.StopInstances()
+
+	c := client.New(ts.URL).WithToken("alice-token")
+	spec := &engine.CompositionSpec{
+		Version: "1.0",
+		Name:    "shared",
+		Nodes: []engine.Node{
+			{ID: "disk", Type: "memfs"},
+			{ID: "cache", Type: "cachefs", Config: map[string]interface{}{"policy": "LRU"}},
+		},
+		Connections: []engine.Connection{{From: "disk", To: "cache"}},
+		Mount:       engine.MountConfig{Type: "api", Root: "cache"},
+	}
+	if _, err := c.Create(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	type message struct {
+		Type string
+		Data json.RawMessage
+	}
+	dial := func(token string) (*websocket.Conn, api.Hello) {
+		t.Helper()
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/ws?access_token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hello api.Hello
+		var msg message
+		if err := ws.ReadJSON(&msg); err != nil || msg.Type != "hello" || json.Unmarshal(msg.Data, &hello) != nil {
+			t.Fatalf("expected hello, got %+v %v", msg, err)
+		}
+		return ws, hello
+	}
+	// next returns the data of the next message of type msgType
+	next := func(ws *websocket.Conn, msgType string, v interface{}) []byte {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg message
+			if err := ws.ReadJSON(&msg); err != nil {
+				t.Fatalf("no %s message: %v", msgType, err)
+			}
+			if msg.Type == msgType {
+				if err := json.Unmarshal(msg.Data, v); err != nil {
+					t.Fatal(err)
+				}
+				return msg.Data
+			}
+		}
+	}
+
+	alice, aliceHello := dial("alice-token")
+	defer alice.Close()
+	bob, bobHello := dial("bob-token")
+	if aliceHello.User != "alice" || bobHello.Client == aliceHello.Client {
+		t.Errorf("unexpected hellos %+v %+v", aliceHello, bobHello)
+	}
+
+	// Presence reaches everyone viewing the composition
+	bob.WriteJSON(api.ClientMessage{Type: "presence", Composition: "shared", Node: "cache"})
+	var presence api.Presence
+	next(alice, "presence", &presence)
+	if len(presence.Editors) != 1 || presence.Editors[0].User != "bob" || presence.Editors[0].Node != "cache" {
+		t.Errorf("unexpected presence %+v", presence)
+	}
+
+	// A patch adds a node, moves a connection and changes a field in one
+	// revision, and is rebroadcast with the password redacted
+	var ops []engine.PatchOp
+	json.Unmarshal([]byte(`[
+		{"op": "add", "path": "/nodes/-", "value": {"id": "encrypt", "type": "encryptfs", "config": {"password": "hunter2", "kdfMemory": 1024, "kdfIterations": 1}}},
+		{"op": "replace", "path": "/connections/0/to", "value": "encrypt"},
+		{"op": "add", "path": "/connections/-", "value": {"from": "encrypt", "to": "cache"}},
+		{"op": "replace", "path": "/nodes/1/config/policy", "value": "LFU"}
+	]`), &ops)
+	alice.WriteJSON(api.ClientMessage{Type: "patch", Ref: "p1", Composition: "shared", Base: 1, Ops: ops})
+	for _, ws := range []*websocket.Conn{alice, bob} {
+		var applied api.PatchApplied
+		raw := next(ws, "composition_patched", &applied)
+		if applied.Base != 1 || applied.Revision.Number != 2 || applied.Client != aliceHello.Client || applied.Ref != "p1" || len(applied.Ops) != 4 {
+			t.Errorf("unexpected patch notification %+v", applied)
+		}
+		if bytes.Contains(raw, []byte("hunter2")) || !bytes.Contains(raw, []byte(engine.Redacted)) {
+			t.Errorf("password not redacted in %s", raw)
+		}
+	}
+	rev, err := c.Revision("shared", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := rev.Spec.GetNode("encrypt"); n == nil || n.Config["password"] != engine.Redacted || rev.Spec.Connections[0].To != "encrypt" || rev.Spec.GetNode("cache").Config["policy"] != "LFU" {
+		t.Errorf("patch not applied: %+v", rev.Spec)
+	}
+
+	// Stale, invalid and unauthorized patches are refused to the sender
+	rejections := []struct {
+		ws  *websocket.Conn
+		msg api.ClientMessage
+	}{
+		{alice, api.ClientMessage{Type: "patch", Ref: "stale", Composition: "shared", Base: 1, Ops: ops[3:]}},
+		{alice, api.ClientMessage{Type: "patch", Ref: "invalid", Composition: "shared", Base: 2, Ops: []engine.PatchOp{{Op: "replace", Path: "/nodes/1/config/policy", Value: "FIFO"}}}},
+		{alice, api.ClientMessage{Type: "patch", Ref: "missing", Composition: "shared", Base: 2, Ops: []engine.PatchOp{{Op: "remove", Path: "/nodes/7"}}}},
+		{bob, api.ClientMessage{Type: "patch", Ref: "viewer", Composition: "shared", Base: 2, Ops: []engine.PatchOp{{Op: "replace", Path: "/description", Value: "mine"}}}},
+		{alice, api.ClientMessage{Type: "patch", Ref: "rename", Composition: "shared", Base: 2, Ops: []engine.PatchOp{{Op: "replace", Path: "/name", Value: "other"}}}},
+	}
+	for _, r := range rejections {
+		r.ws.WriteJSON(r.msg)
+		var rejected api.PatchRejected
+		next(r.ws, "patch_rejected", &rejected)
+		if rejected.Ref != r.msg.Ref {
+			t.Errorf("%s: rejection for %q", r.msg.Ref, rejected.Ref)
+		}
+		switch r.msg.Ref {
+		case "stale":
+			if rejected.Latest != 2 {
+				t.Errorf("stale patch: expected the latest revision, got %+v", rejected)
+			}
+		case "invalid":
+			if len(rejected.Diagnostics) != 1 || rejected.Diagnostics[0].Check != "config" {
+				t.Errorf("invalid patch: expected a config diagnostic, got %+v", rejected)
+			}
+		case "rename":
+			if !strings.Contains(rejected.Error, "create a new composition") {
+				t.Errorf("rename patch: unexpected rejection %+v", rejected)
+			}
+		}
+	}
+
+	// Patches work against the redacted spec and keep the password, which
+	// the builder still resolves
+	alice.WriteJSON(api.ClientMessage{Type: "patch", Ref: "p2", Composition: "shared", Base: 2, Ops: []engine.PatchOp{
+		{Op: "test", Path: "/nodes/2/config/password", Value: engine.Redacted},
+		{Op: "add", Path: "/description", Value: "Encrypted"},
+	}})
+	var applied api.PatchApplied
+	next(alice, "composition_patched", &applied)
+	if applied.Revision.Number != 3 || applied.Revision.Author != "alice" {
+		t.Errorf("unexpected second patch %+v", applied)
+	}
+	if _, err := c.Start("shared", api.StartRequest{}); err != nil {
+		t.Errorf("patched composition does not build: %v", err)
+	}
+
+	// Leaving clears presence
+	bob.Close()
+	next(alice, "presence", &presence)
+	if len(presence.Editors) != 0 {
+		t.Errorf("presence after leaving: %+v", presence)
+	}
+	t.Logf("✓ Patches sequenced into revisions %d..%d", 2, applied.Revision.Number)
+}
+
+func TestWebSocketSlowClient(t *testing.T) {
+	srv := api.NewServer(api.NewMemoryStore())
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+	defer srv.StopInstances()
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hello struct{ Type string }
+		if err := ws.ReadJSON(&hello); err != nil || hello.Type != "hello" {
+			t.Fatalf("expected hello, got %+v %v", hello, err)
+		}
+		return ws
+	}
+
+	// stalled never reads, so once the socket buffers fill every write to
+	// it blocks
+	stalled := dial()
+	defer stalled.Close()
+	watcher := dial()
+	defer watcher.Close()
+
+	// Large presence updates fill the buffers quickly; watcher must keep
+	// getting each one
+	node := strings.Repeat("n", 256<<10)
+	for i := 0; i < 200; i++ {
+		if err := watcher.WriteJSON(api.ClientMessage{Type: "presence", Composition: "shared", Node: fmt.Sprintf("%d%s", i, node)}); err != nil {
+			t.Fatal(err)
+		}
+		watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg struct {
+			Type string
+			Data api.Presence
+		}
+		if err := watcher.ReadJSON(&msg); err != nil {
+			t.Fatalf("presence %d blocked behind the stalled client: %v", i, err)
+		}
+		if msg.Type != "presence" || len(msg.Data.Editors) != 1 || !strings.HasPrefix(msg.Data.Editors[0].Node, fmt.Sprint(i)) {
+			t.Fatalf("presence %d: unexpected %s with %d editors", i, msg.Type, len(msg.Data.Editors))
+		}
+	}
+
+	// The stalled client fell too far behind and was disconnected
+	stalled.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := stalled.ReadMessage(); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				t.Errorf("stalled client was not disconnected")
+			}
+			break
+		}
+	}
+	t.Log("✓ Stalled WebSocket client dropped without delaying others")
+}
+
+// buildCLI builds the fscomposer command for tests that run it
+func buildCLI(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "fscomposer")
+	if out, err := exec.Command("go", "build", "-o", bin, "./cmd/fscomposer").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build fscomposer: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// runCLI runs the fscomposer command in dir and returns its stdout, stderr
+// and exit code
+func runCLI(t *testing.T, bin, dir string, args ...string) (string, string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("failed to run fscomposer %v: %v", args, err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// TestShellCommands runs shell scripts against a memfs composition
+func TestShellCommands(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "spec.yaml"), []byte(`version: "1.0"
+name: shell-test
+nodes:
+  - id: mem
+    type: memfs
+mount: {type: api, root: mem}
+`), 0644)
+	os.WriteFile(filepath.Join(dir, "local.txt"), []byte("hello shell"), 0644)
+
+	script := `mkdir -p "/docs/my dir" /tmp
+put local.txt "/docs/my dir/a.txt"; cd /docs; ls
+cd 'my dir'; pwd; mv a.txt b.txt; ls -l; cat b.txt
+get b.txt out.txt
+mkdir /tmp/with\ space; mv b.txt /tmp # comment; rm /tmp/b.txt
+tree /
+rm -r /docs; ls /`
+	stdout, stderr, code := runCLI(t, bin, dir, "shell", "-c", script, "spec.yaml")
+	if code != 0 {
+		t.Fatalf("shell exited %d: %s", code, stderr)
+	}
+
+	for _, want := range []string{
+		"✓ local.txt → /docs/my dir/a.txt (11 bytes)\n",
+		"my dir/\n/docs/my dir\n",
+		"b.txt\nhello shell✓ /docs/my dir/b.txt → out.txt (11 bytes)\n",
+		"/\n├── docs\n│   └── my dir\n└── tmp\n    ├── b.txt\n    └── with space\n\n4 directories, 1 files\n",
+		"\ntmp/\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout)
+		}
+	}
+	if strings.HasSuffix(stdout, "docs/\ntmp/\n") {
+		t.Errorf("rm -r left /docs:\n%s", stdout)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "out.txt")); err != nil || string(data) != "hello shell" {
+		t.Errorf("get wrote %q, %v", data, err)
+	}
+
+	// A failing command stops the script with its name in the error
+	stdout, stderr, code = runCLI(t, bin, dir, "shell", "-c", "pwd; frobnicate; pwd", "spec.yaml")
+	if code != 1 || stdout != "/\n" || !strings.Contains(stderr, "frobnicate: unknown command") {
+		t.Errorf("unknown command: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	_, stderr, code = runCLI(t, bin, dir, "shell", "-c", "cat /missing", "spec.yaml")
+	if code != 1 || !strings.Contains(stderr, "cat:") {
+		t.Errorf("missing file: exit %d, stderr %q", code, stderr)
+	}
+	_, stderr, code = runCLI(t, bin, dir, "shell", "-c", `cat "unterminated`, "spec.yaml")
+	if code == 0 || !strings.Contains(stderr, "unterminated quote") {
+		t.Errorf("unterminated quote: exit %d, stderr %q", code, stderr)
+	}
+	if stdout, _, code := runCLI(t, bin, dir, "shell", "-c", "pwd; exit; frobnicate", "spec.yaml"); code != 0 || stdout != "/\n" {
+		t.Errorf("exit: exit %d, stdout %q", code, stdout)
+	}
+	if stdout, _, code := runCLI(t, bin, dir, "shell", "-c", "help", "spec.yaml"); code != 0 || !strings.Contains(stdout, "stat <path>...") {
+		t.Errorf("help: exit %d, stdout %q", code, stdout)
+	}
+
+	// Without -c, commands are read from stdin with no prompt when it is
+	// not a terminal. Errors are reported and the session goes on until
+	// exit.
+	var out, errOut bytes.Buffer
+	repl := exec.Command(bin, "shell", "spec.yaml")
+	repl.Dir = dir
+	repl.Stdin = strings.NewReader("mkdir /a\nfrobnicate\nput local.txt /a/l.txt; stat /a/l.txt\ncd /a; ls\nexit\npwd\n")
+	repl.Stdout, repl.Stderr = &out, &errOut
+	if err := repl.Run(); err != nil {
+		t.Fatalf("shell on stdin failed: %v: %s", err, errOut.String())
+	}
+	if !strings.Contains(errOut.String(), "frobnicate: unknown command") {
+		t.Errorf("stdin error not reported: %q", errOut.String())
+	}
+	for _, want := range []string{"  Path:     /a/l.txt\n  Type:     file\n  Size:     11\n", "\nl.txt\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stdin session lacks %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "Built") || strings.HasSuffix(out.String(), "/a\n") {
+		t.Errorf("stdin session prompted or ran past exit:\n%s", out.String())
+	}
+}
+
+// TestInitCommand scaffolds a spec from flags and checks it validates
+func TestInitCommand(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+
+	args := []string{"init", "--name", "demo", "--backend", "memfs", "--wrappers", "cachefs,metricsfs",
+		"--mount", "s3", "--port", "9100", "--set", "cachefs.maxBytes=1024"}
+	if _, stderr, code := runCLI(t, bin, dir, args...); code != 0 {
+		t.Fatalf("init exited %d: %s", code, stderr)
+	}
+
+	file := filepath.Join(dir, "demo.yaml")
+	spec, err := engine.ParseFile(file)
+	if err != nil {
+		t.Fatalf("generated spec does not parse: %v", err)
+	}
+	if err := engine.NewValidator(spec).ValidateAll(); err != nil {
+		t.Errorf("generated spec is invalid: %v", err)
+	}
+	if len(spec.Nodes) != 3 || spec.Nodes[0].Type != "memfs" || spec.Mount.Type != engine.MountTypeS3 || spec.Mount.Port != 9100 {
+		t.Errorf("unexpected spec: %+v", spec)
+	}
+	if spec.Nodes[1].Config["maxBytes"] != 1024 {
+		t.Errorf("--set not applied: %v", spec.Nodes[1].Config)
+	}
+
+	// An existing file is only replaced with --force
+	before, _ := os.ReadFile(file)
+	_, stderr, code := runCLI(t, bin, dir, "init", "--name", "demo", "--backend", "memfs", "--mount", "api")
+	if code == 0 || !strings.Contains(stderr, "already exists") {
+		t.Errorf("overwrite without --force: exit %d, stderr %q", code, stderr)
+	}
+	if after, _ := os.ReadFile(file); !bytes.Equal(before, after) {
+		t.Error("existing file was overwritten without --force")
+	}
+	if _, stderr, code := runCLI(t, bin, dir, "init", "--name", "demo", "--backend", "memfs", "--mount", "api", "--force"); code != 0 {
+		t.Fatalf("init --force exited %d: %s", code, stderr)
+	}
+	if spec, err := engine.ParseFile(file); err != nil || spec.Mount.Type != engine.MountTypeAPI {
+		t.Errorf("--force did not replace the file: %v", err)
+	}
+
+	// -i asks for what the flags leave out, prompting on stderr when the
+	// spec is the structured output. Options are picked by name or number,
+	// and empty answers keep schema defaults out of the spec.
+	answers := strings.Join([]string{
+		"Asked for everything", // Description
+		"cachefs",              // Wrappers
+		"",                     // cachefs maxBytes
+		"100",                  // maxEntries
+		"bogus",                // policy, refused
+		"2",                    // policy by number
+		"",                     // ttl
+		"false",                // metadataCache
+		"webdav",               // Mount type
+		"",                     // Port
+		"carol",                // WebDAV user name
+	}, "\n") + "\n"
+	var out, prompts bytes.Buffer
+	cmd := exec.Command(bin, "--output", "json", "init", "-i", "--name", "asked", "--backend", "memfs", "-")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(answers)
+	cmd.Stdout, cmd.Stderr = &out, &prompts
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("init -i failed: %v\n%s", err, prompts.String())
+	}
+	var asked engine.CompositionSpec
+	if err := json.Unmarshal(out.Bytes(), &asked); err != nil {
+		t.Fatalf("init -i did not print the spec: %v\n%s", err, out.String())
+	}
+	if err := engine.NewValidator(&asked).ValidateAll(); err != nil {
+		t.Errorf("interactive spec is invalid: %v", err)
+	}
+	cache := asked.GetNode("cache")
+	if asked.Description != "Asked for everything" || len(asked.Nodes) != 2 || cache == nil || len(asked.Connections) != 1 || asked.Connections[0].To != "cache" {
+		t.Fatalf("unexpected interactive spec: %+v", asked)
+	}
+	if got := fmt.Sprint(cache.Config); got != "map[maxEntries:100 metadataCache:false policy:LFU]" {
+		t.Errorf("cachefs config from answers: %s", got)
+	}
+	users, _ := asked.Mount.Options["users"].([]interface{})
+	if asked.Mount.Type != engine.MountTypeWebDAV || asked.Mount.Port != frontend.DefaultWebDAVPort || len(users) != 1 ||
+		users[0].(map[string]interface{})["passwordEnv"] != "CAROL_PASSWORD" {
+		t.Errorf("unexpected interactive mount: %+v", asked.Mount)
+	}
+	for _, want := range []string{"cache (cachefs): Caching filesystem wrapper", "  2) LFU", "Please pick one of the listed options"} {
+		if !strings.Contains(prompts.String(), want) {
+			t.Errorf("prompts lack %q:\n%s", want, prompts.String())
+		}
+	}
+
+	// Input that ends early is an error, not a half-answered spec
+	cmd = exec.Command(bin, "init", "-i", "--name", "short", "-")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader("Too short\n")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "input ended before all questions were answered") {
+		t.Errorf("init -i with short input: %v\n%s", err, out)
+	}
+}
+
+// TestOutputFormat checks that commands print a single structured document
+// with --output, including the long-running mount and unmount
+func TestOutputFormat(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	t.Setenv("FSCOMPOSER_STATE_DIR", filepath.Join(dir, "state"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	os.WriteFile(filepath.Join(dir, "spec.yaml"), []byte(fmt.Sprintf(`version: "1.0"
+name: output-test
+nodes:
+  - id: mem
+    type: memfs
+mount:
+  type: webdav
+  port: %d
+  root: mem
+  options: {host: 127.0.0.1}
+`, port)), 0644)
+
+	stdout, stderr, code := runCLI(t, bin, dir, "--output", "json", "validate", "spec.yaml")
+	if code != 0 || !json.Valid([]byte(stdout)) {
+		t.Fatalf("validate: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	_, _, code = runCLI(t, bin, dir, "--output", "json", "validate", "missing.yaml")
+	if code != 3 {
+		t.Errorf("validate of a missing file exited %d, want 3", code)
+	}
+
+	// Mount credentials are redacted, as info shows them
+	os.WriteFile(filepath.Join(dir, "users.yaml"), []byte(`version: "1.0"
+name: users
+nodes:
+  - id: mem
+    type: memfs
+mount:
+  type: webdav
+  root: mem
+  options:
+    users: [{username: alice, password: swordfish}]
+`), 0644)
+	stdout, stderr, code = runCLI(t, bin, dir, "--output", "json", "validate", "users.yaml")
+	if code != 0 || strings.Contains(stdout, "swordfish") || !strings.Contains(stdout, engine.Redacted) {
+		t.Errorf("validate of a spec with credentials: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+
+	// mount writes one document once it is serving, and nothing else
+	var mountOut bytes.Buffer
+	mount := exec.Command(bin, "--output", "json", "mount", "spec.yaml")
+	mount.Dir = dir
+	pipe, err := mount.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mount.Start(); err != nil {
+		t.Fatalf("failed to start mount: %v", err)
+	}
+	defer mount.Process.Kill()
+
+	dec := json.NewDecoder(io.TeeReader(pipe, &mountOut))
+	var rec instance.Record
+	if err := dec.Decode(&rec); err != nil {
+		t.Fatalf("mount did not print a JSON document: %v (%q)", err, mountOut.String())
+	}
+	if rec.Name != "output-test" || rec.MountType != engine.MountTypeWebDAV || rec.PID != mount.Process.Pid {
+		t.Errorf("unexpected mount record: %+v", rec)
+	}
+
+	// Reap the process as soon as it exits, or unmount sees it as alive
+	exited := make(chan string, 1)
+	go func() {
+		rest, _ := io.ReadAll(io.MultiReader(dec.Buffered(), pipe))
+		if err := mount.Wait(); err != nil {
+			t.Errorf("mount exited with %v", err)
+		}
+		exited <- string(rest)
+	}()
+
+	stdout, stderr, code = runCLI(t, bin, dir, "--output", "yaml", "status")
+	if code != 0 || !strings.Contains(stdout, "name: output-test") || strings.Contains(stdout, "NAME") {
+		t.Errorf("status: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+
+	stdout, stderr, code = runCLI(t, bin, dir, "--output", "json", "unmount", "output-test")
+	var unmounted struct {
+		Name  string `json:"name"`
+		Stale bool   `json:"stale"`
+	}
+	if code != 0 || json.Unmarshal([]byte(stdout), &unmounted) != nil || unmounted.Name != "output-test" || unmounted.Stale {
+		t.Errorf("unmount: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+
+	if trailing := strings.TrimSpace(<-exited); trailing != "" {
+		t.Errorf("mount printed more than one document: %q", trailing)
+	}
+}
+
+// TestMountDaemon runs mount --daemon and checks the detached process
+// registers itself, logs to its log file and holds its name until unmounted
+func TestMountDaemon(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	t.Setenv("FSCOMPOSER_STATE_DIR", state)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	os.WriteFile(filepath.Join(dir, "spec.yaml"), []byte(fmt.Sprintf(`version: "1.0"
+name: daemon-test
+nodes:
+  - id: mem
+    type: memfs
+mount:
+  type: webdav
+  port: %d
+  root: mem
+`, port)), 0644)
+
+	// Names cannot reach outside the state directory
+	_, stderr, code := runCLI(t, bin, dir, "mount", "--name", "../../escaped", "spec.yaml")
+	if code != 2 || !strings.Contains(stderr, "invalid instance name") {
+		t.Errorf("mount --name ../../escaped: exit %d, stderr %q", code, stderr)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "..", "..", "escaped*")); len(matches) > 0 {
+		t.Errorf("mount wrote outside the state directory: %v", matches)
+	}
+
+	stdout, stderr, code := runCLI(t, bin, dir, "mount", "--daemon", "--name", "dav", "spec.yaml")
+	if code != 0 {
+		t.Fatalf("mount --daemon: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	rec, err := instance.Get("dav")
+	if err != nil {
+		t.Fatalf("daemon did not register: %v", err)
+	}
+	t.Cleanup(func() {
+		if instance.ProcessAlive(rec.PID) {
+			instance.Terminate(rec.PID)
+		}
+	})
+	if !instance.ProcessAlive(rec.PID) || !strings.HasSuffix(rec.Target, fmt.Sprintf(":%d", port)) {
+		t.Errorf("unexpected daemon record: %+v", rec)
+	}
+	if !strings.Contains(stdout, fmt.Sprint(rec.PID)) {
+		t.Errorf("mount --daemon did not report the daemon's pid: %q", stdout)
+	}
+
+	// The daemon's output goes to its log file, not the terminal
+	if rec.LogFile != filepath.Join(state, "dav.log") {
+		t.Errorf("daemon logs to %q", rec.LogFile)
+	}
+	if log, err := os.ReadFile(rec.LogFile); err != nil || !strings.Contains(string(log), "Spec parsed: daemon-test") {
+		t.Errorf("daemon log %q, err %v", log, err)
+	}
+
+	// A second mount with the name fails before it mounts anything
+	for _, args := range [][]string{{"mount", "--name", "dav", "spec.yaml"}, {"mount", "--daemon", "--name", "dav", "spec.yaml"}} {
+		_, stderr, code = runCLI(t, bin, dir, args...)
+		if code == 0 || !strings.Contains(stderr, "already running") {
+			t.Errorf("%v: exit %d, stderr %q", args, code, stderr)
+		}
+	}
+
+	stdout, stderr, code = runCLI(t, bin, dir, "unmount", "dav")
+	if code != 0 {
+		t.Fatalf("unmount: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if instance.ProcessAlive(rec.PID) {
+		t.Error("daemon still running after unmount")
+	}
+	for _, ext := range []string{".json", ".pid", ".lock"} {
+		if _, err := os.Stat(filepath.Join(state, "dav"+ext)); !os.IsNotExist(err) {
+			t.Errorf("dav%s left behind after unmount", ext)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package registry
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/absfs/absfs"
@@ -10,6 +12,7 @@ import (
 	"github.com/absfs/memfs"
 	"github.com/absfs/metricsfs"
 	"github.com/absfs/osfs"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func init() {
@@ -35,7 +38,7 @@ func registerOSFS() {
 				Type:        "string",
 				Required:    false,
 				Default:     ".",
-				Description: "Root directory path (default: current directory)",
+				Description: "Existing directory every path is confined to, absolute paths included (default: current directory)",
 			},
 		},
 	})
@@ -47,14 +50,24 @@ func newOSFS(config map[string]interface{}, _ absfs.FileSystem) (absfs.FileSyste
 		return nil, fmt.Errorf("failed to create osfs: %w", err)
 	}
 
-	// Handle root directory if specified
-	if root, ok := config["root"].(string); ok && root != "" && root != "." {
-		if err := fs.Chdir(root); err != nil {
-			return nil, fmt.Errorf("failed to change to root directory %s: %w", root, err)
-		}
+	root := "."
+	if r, ok := config["root"].(string); ok && r != "" {
+		root = r
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve root directory %s: %w", root, err)
+	}
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("root directory %s does not exist or is not a directory", root)
 	}
 
-	return fs, nil
+	// Confine every path, absolute or not, to the root directory
+	rooted, err := newRootedFS(fs, abs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve root directory %s: %w", root, err)
+	}
+	return rooted, nil
 }
 
 // ============================================================================
@@ -182,7 +195,36 @@ func newCacheFS(config map[string]interface{}, underlying absfs.FileSystem) (abs
 		opts = append(opts, cachefs.WithMetadataCache(mc))
 	}
 
-	return cachefs.New(underlying, opts...), nil
+	return &cacheNode{cachefs.New(underlying, opts...)}, nil
+}
+
+// cacheNode exposes cachefs statistics and cache control to running mounts
+type cacheNode struct {
+	*cachefs.CacheFS
+}
+
+func (c *cacheNode) NodeStats() map[string]interface{} {
+	stats := c.Stats()
+	return map[string]interface{}{
+		"hits":      stats.Hits(),
+		"misses":    stats.Misses(),
+		"hitRate":   stats.HitRate(),
+		"evictions": stats.Evictions(),
+		"bytesUsed": stats.BytesUsed(),
+		"entries":   stats.Entries(),
+	}
+}
+
+func (c *cacheNode) FlushCache() error {
+	return c.Flush()
+}
+
+func (c *cacheNode) InvalidateCache(prefix string) {
+	if prefix == "" || prefix == "/" {
+		c.Clear()
+		return
+	}
+	c.InvalidatePrefix(prefix)
 }
 
 // ============================================================================
@@ -206,6 +248,7 @@ func registerEncryptFS() {
 				Name:        "password",
 				Type:        "string",
 				Required:    true,
+				Secret:      true,
 				Description: "Encryption password (use env var for production)",
 			},
 			{
@@ -307,5 +350,41 @@ func newMetricsFS(config map[string]interface{}, underlying absfs.FileSystem) (a
 
 	// Wrap the metricsfs with ExtendFiler to get full FileSystem interface
 	mfs := metricsfs.New(underlying)
-	return absfs.ExtendFiler(mfs), nil
+	return &metricsNode{FileSystem: absfs.ExtendFiler(mfs), metrics: mfs}, nil
+}
+
+// metricsNode exposes the collected metrics to running mounts
+type metricsNode struct {
+	absfs.FileSystem
+	metrics *metricsfs.MetricsFS
+}
+
+// NodeStats reports each metric family summed over its labels. Histograms
+// report their sample count.
+func (m *metricsNode) NodeStats() map[string]interface{} {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(m.metrics.Collector()); err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+
+	stats := make(map[string]interface{}, len(families))
+	for _, family := range families {
+		var total float64
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.Counter != nil:
+				total += metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				total += metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				total += float64(metric.Histogram.GetSampleCount())
+			}
+		}
+		stats[family.GetName()] = total
+	}
+	return stats
 }
@@ -27,12 +27,38 @@ type NodeSchema struct {
 
 // SchemaField describes a configuration field
 type SchemaField struct {
-	Name        string
-	Type        string // "string", "int", "bool", "select"
-	Required    bool
-	Default     interface{}
-	Description string
-	Options     []string // For "select" type
+	Name        string      `json:"name"`
+	Type        string      `json:"type"` // "string", "int", "bool", "select"
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Options     []string    `json:"options,omitempty"` // For "select" type
+	Secret      bool        `json:"secret,omitempty"`  // Write-only: kept out of stored specs and redacted in output
+}
+
+// UserScoper is implemented by identity-aware filesystems (permfs, quotafs)
+// Frontends that authenticate users call ForUser to get a view of the
+// filesystem bound to the authenticated user name
+type UserScoper interface {
+	ForUser(user string) absfs.FileSystem
+}
+
+// StatsReporter is implemented by nodes that expose runtime statistics
+type StatsReporter interface {
+	NodeStats() map[string]interface{}
+}
+
+// CacheController is implemented by nodes holding a cache that can be
+// flushed to the underlying filesystem or invalidated at runtime
+type CacheController interface {
+	FlushCache() error
+	InvalidateCache(prefix string)
+}
+
+// LogLeveler is implemented by nodes whose log verbosity can be changed
+// while mounted
+type LogLeveler interface {
+	SetLogLevel(level string) error
 }
 
 // New creates a new empty registry
@@ -67,6 +93,36 @@ func (r *Registry) GetSchema(nodeType string) (NodeSchema, error) {
 	return schema, nil
 }
 
+// ResolveConfig returns config with schema defaults filled in for fields
+// that are not set
+func (r *Registry) ResolveConfig(nodeType string, config map[string]interface{}) (map[string]interface{}, error) {
+	schema, err := r.GetSchema(nodeType)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]interface{}, len(config))
+	for _, field := range schema.Fields {
+		if field.Default != nil {
+			resolved[field.Name] = field.Default
+		}
+	}
+	for k, v := range config {
+		resolved[k] = v
+	}
+	return resolved, nil
+}
+
+// IsSecret reports whether a node type's schema marks a field secret
+func (r *Registry) IsSecret(nodeType, field string) bool {
+	for _, f := range r.schemas[nodeType].Fields {
+		if f.Name == field {
+			return f.Secret
+		}
+	}
+	return false
+}
+
 // IsRegistered returns true if the node type is registered
 func (r *Registry) IsRegistered(nodeType string) bool {
 	_, ok := r.constructors[nodeType]
@@ -100,6 +156,16 @@ func GetSchema(nodeType string) (NodeSchema, error) {
 	return DefaultRegistry.GetSchema(nodeType)
 }
 
+// ResolveConfig fills in defaults using the default registry
+func ResolveConfig(nodeType string, config map[string]interface{}) (map[string]interface{}, error) {
+	return DefaultRegistry.ResolveConfig(nodeType, config)
+}
+
+// IsSecret checks the default registry
+func IsSecret(nodeType, field string) bool {
+	return DefaultRegistry.IsSecret(nodeType, field)
+}
+
 // IsRegistered checks the default registry
 func IsRegistered(nodeType string) bool {
 	return DefaultRegistry.IsRegistered(nodeType)
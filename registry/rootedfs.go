@@ -0,0 +1,261 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/osfs"
+)
+
+// maxLinkHops bounds how many dangling symlinks are followed when checking
+// a path
+const maxLinkHops = 40
+
+// rootedFS maps paths of the composition onto a directory of the host
+// filesystem. Cleaning a path as absolute before joining only stops ".."
+// in the path itself; the host also follows symlinks, including ones
+// created outside fscomposer. So every host path is checked again with
+// those symlinks resolved, and new symlinks may only point inside root.
+type rootedFS struct {
+	fs   *osfs.FileSystem
+	root string // In osfs form
+	real string // Native, with the root's own symlinks resolved
+}
+
+// newRootedFS confines fs to the native directory dir
+func newRootedFS(fs *osfs.FileSystem, dir string) (absfs.SymlinkFileSystem, error) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	return absfs.ExtendSymlinkFiler(&rootedFS{fs: fs, root: osfs.FromNative(dir), real: real}), nil
+}
+
+// path maps name to its host path and checks it stays under root. With
+// follow set, a symlink in the last element is resolved too, as the host
+// does for calls that follow links; otherwise only the directory is.
+func (r *rootedFS) path(name string, follow bool) (string, error) {
+	p := path.Join(r.root, path.Clean("/"+name))
+	check := osfs.ToNative(p)
+	if !follow && p != r.root {
+		check = filepath.Dir(check)
+	}
+	if err := r.contain(check); err != nil {
+		return "", &os.PathError{Op: "resolve", Path: name, Err: err}
+	}
+	return p, nil
+}
+
+// contain resolves the symlinks in the native path p and checks the result
+// is inside root. A p that does not exist yet is checked through its
+// nearest existing ancestor, following dangling links, since creating p
+// would create their targets.
+func (r *rootedFS) contain(p string) error {
+	for hops := 0; ; {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			rel, err := filepath.Rel(r.real, resolved)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return os.ErrPermission
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			parent := filepath.Dir(p)
+			if parent == p {
+				return err
+			}
+			p = parent
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil // Appeared since EvalSymlinks looked
+		}
+		if hops++; hops > maxLinkHops {
+			return fmt.Errorf("too many levels of symbolic links")
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		p = target
+	}
+}
+
+func (r *rootedFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	p, err := r.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.OpenFile(p, flag, perm)
+}
+
+func (r *rootedFS) Mkdir(name string, perm os.FileMode) error {
+	p, err := r.path(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Mkdir(p, perm)
+}
+
+func (r *rootedFS) Remove(name string) error {
+	p, err := r.path(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Remove(p)
+}
+
+func (r *rootedFS) Rename(oldpath, newpath string) error {
+	from, err := r.path(oldpath, false)
+	if err != nil {
+		return err
+	}
+	to, err := r.path(newpath, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Rename(from, to)
+}
+
+func (r *rootedFS) RemoveAll(name string) error {
+	p, err := r.path(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.RemoveAll(p)
+}
+
+func (r *rootedFS) Truncate(name string, size int64) error {
+	p, err := r.path(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.Truncate(p, size)
+}
+
+func (r *rootedFS) Stat(name string) (os.FileInfo, error) {
+	p, err := r.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Stat(p)
+}
+
+func (r *rootedFS) Chmod(name string, mode os.FileMode) error {
+	p, err := r.path(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chmod(p, mode)
+}
+
+func (r *rootedFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	p, err := r.path(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chtimes(p, atime, mtime)
+}
+
+func (r *rootedFS) Chown(name string, uid, gid int) error {
+	p, err := r.path(name, true)
+	if err != nil {
+		return err
+	}
+	return r.fs.Chown(p, uid, gid)
+}
+
+func (r *rootedFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	p, err := r.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.ReadDir(p)
+}
+
+func (r *rootedFS) ReadFile(name string) ([]byte, error) {
+	p, err := r.path(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.ReadFile(p)
+}
+
+func (r *rootedFS) Sub(dir string) (iofs.FS, error) {
+	p, err := r.path(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Sub(p)
+}
+
+func (r *rootedFS) Lstat(name string) (os.FileInfo, error) {
+	p, err := r.path(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Lstat(p)
+}
+
+func (r *rootedFS) Lchown(name string, uid, gid int) error {
+	p, err := r.path(name, false)
+	if err != nil {
+		return err
+	}
+	return r.fs.Lchown(p, uid, gid)
+}
+
+// Absolute link targets are stored relative to the host filesystem so the
+// links also resolve there, and reported relative to the root again
+func (r *rootedFS) Readlink(name string) (string, error) {
+	p, err := r.path(name, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := r.fs.Readlink(p)
+	if err != nil {
+		return "", err
+	}
+	if rel, ok := strings.CutPrefix(target, r.root); ok && (rel == "" || rel[0] == '/') {
+		return path.Clean("/" + rel), nil
+	}
+	return target, nil
+}
+
+// Symlink refuses targets that resolve outside root on the host, whether
+// through ".." in a relative target or through links already there
+func (r *rootedFS) Symlink(oldname, newname string) error {
+	link, err := r.path(newname, false)
+	if err != nil {
+		return err
+	}
+	target := oldname
+	if path.IsAbs(target) {
+		target = path.Join(r.root, path.Clean(target))
+	} else {
+		target = path.Join(path.Dir(link), target)
+	}
+	if err := r.contain(osfs.ToNative(target)); err != nil {
+		return &os.PathError{Op: "symlink", Path: oldname, Err: err}
+	}
+	if path.IsAbs(oldname) {
+		oldname = target
+	}
+	return r.fs.Symlink(oldname, link)
+}
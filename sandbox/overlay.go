@@ -0,0 +1,450 @@
+// Package sandbox keeps test builds from writing to real backends by layering
+// a copy-on-write memory overlay over them
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// Overlay serves a base filesystem read-only and keeps every change in
+// memory. Reads fall through to the base until a path is modified, at which
+// point it is copied into the overlay; deletions hide base entries without
+// touching them. Discarding the overlay discards all changes.
+//
+// Directories are copied up without their contents, which keep coming from
+// the base. Symlinks are not supported.
+type Overlay struct {
+	base  absfs.FileSystem
+	upper absfs.FileSystem
+
+	mu        sync.Mutex
+	whiteouts map[string]bool // Base paths deleted in the overlay
+	opaque    map[string]bool // Paths recreated after deletion; base entries below them stay hidden
+}
+
+// New creates an overlay over base
+func New(base absfs.FileSystem) (absfs.FileSystem, error) {
+	upper, err := memfs.NewFS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create overlay: %w", err)
+	}
+	o := &Overlay{
+		base:      base,
+		upper:     upper,
+		whiteouts: make(map[string]bool),
+		opaque:    make(map[string]bool),
+	}
+	return absfs.ExtendFiler(o), nil
+}
+
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// baseVisible reports whether p may be looked up in the base
+func (o *Overlay) baseVisible(p string) bool {
+	if o.whiteouts[p] {
+		return false
+	}
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if o.whiteouts[dir] || o.opaque[dir] {
+			return false
+		}
+		if dir == "/" {
+			return true
+		}
+	}
+}
+
+func (o *Overlay) inUpper(p string) (os.FileInfo, bool) {
+	info, err := o.upper.Stat(p)
+	return info, err == nil
+}
+
+// stat looks p up in the overlay first, then in the base
+func (o *Overlay) stat(p string) (os.FileInfo, error) {
+	if info, ok := o.inUpper(p); ok {
+		return info, nil
+	}
+	if !o.baseVisible(p) {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return o.base.Stat(p)
+}
+
+// created clears the deletion marker of a path that now exists in the
+// overlay. Whatever the base had below the deleted path stays hidden.
+func (o *Overlay) created(p string) {
+	if o.whiteouts[p] {
+		delete(o.whiteouts, p)
+		o.opaque[p] = true
+	}
+}
+
+// copyUpDir makes sure dir and its parents exist in the overlay
+func (o *Overlay) copyUpDir(dir string) error {
+	if dir == "/" {
+		return nil
+	}
+	if info, ok := o.inUpper(dir); ok {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	info, err := o.stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	if err := o.copyUpDir(path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := o.upper.Mkdir(dir, info.Mode().Perm()); err != nil {
+		return err
+	}
+	o.upper.Chtimes(dir, info.ModTime(), info.ModTime())
+	return nil
+}
+
+// copyUp copies p into the overlay so it can be modified. Contents are not
+// copied when they are about to be truncated anyway.
+func (o *Overlay) copyUp(p string, withContents bool) error {
+	if _, ok := o.inUpper(p); ok {
+		return nil
+	}
+	info, err := o.stat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return o.copyUpDir(p)
+	}
+	if err := o.copyUpDir(path.Dir(p)); err != nil {
+		return err
+	}
+
+	dst, err := o.upper.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if withContents {
+		src, err := o.base.Open(p)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	o.upper.Chmod(p, info.Mode().Perm())
+	o.upper.Chtimes(p, info.ModTime(), info.ModTime())
+	return nil
+}
+
+// copyUpTree copies a whole directory tree into the overlay, used before
+// renaming a directory
+func (o *Overlay) copyUpTree(p string) error {
+	if err := o.copyUp(p, true); err != nil {
+		return err
+	}
+	info, err := o.stat(p)
+	if err != nil || !info.IsDir() {
+		return err
+	}
+	entries, err := o.readDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := o.copyUpTree(path.Join(p, e.Name())); err != nil {
+			return err
+		}
+	}
+	// Everything is in the overlay now; the base contents are no longer needed
+	o.opaque[p] = true
+	return nil
+}
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+func (o *Overlay) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	p := clean(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if flag&writeFlags == 0 {
+		if _, ok := o.inUpper(p); ok {
+			return o.upper.OpenFile(p, flag, perm)
+		}
+		if !o.baseVisible(p) {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+		return o.base.OpenFile(p, os.O_RDONLY, 0)
+	}
+
+	info, err := o.stat(p)
+	switch {
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	case err == nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+	case err == nil:
+		if err := o.copyUp(p, flag&os.O_TRUNC == 0); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE != 0:
+		if err := o.copyUpDir(path.Dir(p)); err != nil {
+			return nil, &os.PathError{Op: "open", Path: p, Err: err}
+		}
+		o.created(p)
+	default:
+		return nil, err
+	}
+	return o.upper.OpenFile(p, flag, perm)
+}
+
+func (o *Overlay) Mkdir(name string, perm os.FileMode) error {
+	p := clean(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.stat(p); err == nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	if err := o.copyUpDir(path.Dir(p)); err != nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	if err := o.upper.Mkdir(p, perm); err != nil {
+		return err
+	}
+	o.created(p)
+	return nil
+}
+
+func (o *Overlay) MkdirAll(name string, perm os.FileMode) error {
+	p := clean(name)
+	if p == "/" {
+		return nil
+	}
+	if err := o.MkdirAll(path.Dir(p), perm); err != nil {
+		return err
+	}
+	err := o.Mkdir(p, perm)
+	if errors.Is(err, os.ErrExist) {
+		if info, serr := o.Stat(p); serr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// remove deletes p from the overlay and hides it in the base
+func (o *Overlay) remove(p string) error {
+	if _, ok := o.inUpper(p); ok {
+		if err := o.upper.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	if o.baseVisible(p) {
+		if _, err := o.base.Stat(p); err == nil {
+			o.whiteouts[p] = true
+		}
+	}
+	delete(o.opaque, p)
+	return nil
+}
+
+func (o *Overlay) Remove(name string) error {
+	p := clean(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	info, err := o.stat(p)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	if info.IsDir() {
+		entries, err := o.readDir(p)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return o.remove(p)
+}
+
+func (o *Overlay) RemoveAll(name string) error {
+	p := clean(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.stat(p); err != nil {
+		return nil
+	}
+	return o.remove(p)
+}
+
+func (o *Overlay) Rename(oldpath, newpath string) error {
+	oldp, newp := clean(oldpath), clean(newpath)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	info, err := o.stat(oldp)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldp, New: newp, Err: os.ErrNotExist}
+	}
+	if oldp == newp {
+		return nil
+	}
+	if target, err := o.stat(newp); err == nil {
+		if target.IsDir() != info.IsDir() {
+			return &os.LinkError{Op: "rename", Old: oldp, New: newp, Err: os.ErrExist}
+		}
+		if target.IsDir() {
+			if entries, _ := o.readDir(newp); len(entries) > 0 {
+				return &os.LinkError{Op: "rename", Old: oldp, New: newp, Err: syscall.ENOTEMPTY}
+			}
+		}
+		if err := o.remove(newp); err != nil {
+			return err
+		}
+	}
+
+	if err := o.copyUpTree(oldp); err != nil {
+		return err
+	}
+	if err := o.copyUpDir(path.Dir(newp)); err != nil {
+		return err
+	}
+	if err := o.upper.Rename(oldp, newp); err != nil {
+		return err
+	}
+	if o.baseVisible(oldp) {
+		if _, err := o.base.Stat(oldp); err == nil {
+			o.whiteouts[oldp] = true
+		}
+	}
+	delete(o.opaque, oldp)
+	o.created(newp)
+	if info.IsDir() {
+		o.opaque[newp] = true
+	}
+	return nil
+}
+
+func (o *Overlay) Stat(name string) (os.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stat(clean(name))
+}
+
+// modify copies p up and applies fn to the overlay copy
+func (o *Overlay) modify(name string, withContents bool, fn func(p string) error) error {
+	p := clean(name)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.copyUp(p, withContents); err != nil {
+		return err
+	}
+	return fn(p)
+}
+
+func (o *Overlay) Chmod(name string, mode os.FileMode) error {
+	return o.modify(name, true, func(p string) error { return o.upper.Chmod(p, mode) })
+}
+
+func (o *Overlay) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return o.modify(name, true, func(p string) error { return o.upper.Chtimes(p, atime, mtime) })
+}
+
+func (o *Overlay) Chown(name string, uid, gid int) error {
+	return o.modify(name, true, func(p string) error { return o.upper.Chown(p, uid, gid) })
+}
+
+func (o *Overlay) Truncate(name string, size int64) error {
+	return o.modify(name, size > 0, func(p string) error { return o.upper.Truncate(p, size) })
+}
+
+// readDir merges the overlay and base entries of a directory
+func (o *Overlay) readDir(p string) ([]iofs.DirEntry, error) {
+	merged := make(map[string]iofs.DirEntry)
+	found := false
+
+	if info, ok := o.inUpper(p); ok && info.IsDir() {
+		entries, err := o.upper.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			merged[e.Name()] = e
+		}
+		found = true
+	}
+	if o.baseVisible(p) && !o.opaque[p] {
+		entries, err := o.base.ReadDir(p)
+		if err == nil {
+			for _, e := range entries {
+				if _, ok := merged[e.Name()]; !ok && !o.whiteouts[path.Join(p, e.Name())] {
+					merged[e.Name()] = e
+				}
+			}
+			found = true
+		} else if !found {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: os.ErrNotExist}
+	}
+
+	entries := make([]iofs.DirEntry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (o *Overlay) ReadDir(name string) ([]iofs.DirEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readDir(clean(name))
+}
+
+func (o *Overlay) ReadFile(name string) ([]byte, error) {
+	f, err := o.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (o *Overlay) Sub(dir string) (iofs.FS, error) {
+	return absfs.FilerToFS(o, strings.TrimPrefix(clean(dir), "/"))
+}
@@ -0,0 +1,337 @@
+// Package transfer copies and synchronizes file trees between composed
+// filesystems
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// DefaultWorkers is the number of parallel file copies when none is set
+const DefaultWorkers = 4
+
+// Options controls a transfer. Stacks that report stored rather than content
+// sizes (encryptfs) never match on size, so sync them with Checksum.
+type Options struct {
+	SkipUnchanged bool // Skip files that already match (sync)
+	Checksum      bool // Compare contents instead of size and mtime
+	Delete        bool // Remove destination entries missing from the source
+	DryRun        bool // Report what would change without writing
+	Workers       int
+	Progress      func(Event) // Called for every action; may be nil
+}
+
+// Action is what a transfer did with a path
+type Action string
+
+const (
+	ActionCopy   Action = "copy"
+	ActionSkip   Action = "skip"
+	ActionMkdir  Action = "mkdir"
+	ActionDelete Action = "delete"
+	ActionError  Action = "error"
+)
+
+// Event reports progress of a transfer
+type Event struct {
+	Action Action
+	Path   string // Destination path
+	Bytes  int64
+	Err    error
+}
+
+// Stats summarizes a transfer
+type Stats struct {
+	Copied   int           `json:"copied"`
+	Skipped  int           `json:"skipped"`
+	Dirs     int           `json:"dirs"`
+	Deleted  int           `json:"deleted"`
+	Errors   int           `json:"errors"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Run copies src:srcPath to dst:dstPath. A directory's contents are copied
+// into dstPath; a file is copied to dstPath, or into it if it is an existing
+// directory. Errors on individual files are counted and reported through
+// Progress; the first one is also returned once the transfer finishes.
+func Run(src absfs.FileSystem, srcPath string, dst absfs.FileSystem, dstPath string, opts Options) (*Stats, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	srcPath, dstPath = clean(srcPath), clean(dstPath)
+
+	t := &transfer{src: src, dst: dst, opts: opts, stats: &Stats{}}
+	start := time.Now()
+	defer func() { t.stats.Duration = time.Since(start) }()
+
+	info, err := src.Stat(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+
+	if !info.IsDir() {
+		if dstInfo, err := dst.Stat(dstPath); err == nil && dstInfo.IsDir() {
+			dstPath = path.Join(dstPath, path.Base(srcPath))
+		}
+		t.copyFile(job{src: srcPath, dst: dstPath, info: info})
+		return t.stats, t.firstErr
+	}
+
+	// Directories are created in walk order so workers only write files
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				t.copyFile(j)
+			}
+		}()
+	}
+
+	seen := make(map[string]bool)
+	t.walk(srcPath, dstPath, info, seen, jobs)
+	close(jobs)
+	wg.Wait()
+
+	if opts.Delete {
+		t.prune(dstPath, seen)
+	}
+
+	return t.stats, t.firstErr
+}
+
+type job struct {
+	src, dst string
+	info     os.FileInfo
+}
+
+type transfer struct {
+	src, dst absfs.FileSystem
+	opts     Options
+
+	mu       sync.Mutex
+	stats    *Stats
+	firstErr error
+}
+
+// report updates the stats and forwards the event
+func (t *transfer) report(ev Event) {
+	t.mu.Lock()
+	switch ev.Action {
+	case ActionCopy:
+		t.stats.Copied++
+		t.stats.Bytes += ev.Bytes
+	case ActionSkip:
+		t.stats.Skipped++
+	case ActionMkdir:
+		t.stats.Dirs++
+	case ActionDelete:
+		t.stats.Deleted++
+	case ActionError:
+		t.stats.Errors++
+		if t.firstErr == nil {
+			t.firstErr = fmt.Errorf("%s: %w", ev.Path, ev.Err)
+		}
+	}
+	progress := t.opts.Progress
+	t.mu.Unlock()
+
+	if progress != nil {
+		progress(ev)
+	}
+}
+
+func (t *transfer) fail(p string, err error) {
+	t.report(Event{Action: ActionError, Path: p, Err: err})
+}
+
+// walk creates destination directories and queues files
+func (t *transfer) walk(srcDir, dstDir string, info os.FileInfo, seen map[string]bool, jobs chan<- job) {
+	seen[dstDir] = true
+
+	if dstInfo, err := t.dst.Stat(dstDir); err != nil || !dstInfo.IsDir() {
+		if err == nil && !t.opts.DryRun {
+			// A file is in the way of the directory
+			if err := t.dst.Remove(dstDir); err != nil {
+				t.fail(dstDir, err)
+				return
+			}
+		}
+		if !t.opts.DryRun {
+			if err := t.dst.MkdirAll(dstDir, info.Mode().Perm()|0700); err != nil {
+				t.fail(dstDir, err)
+				return
+			}
+		}
+		t.report(Event{Action: ActionMkdir, Path: dstDir})
+	}
+
+	entries, err := t.src.ReadDir(srcDir)
+	if err != nil {
+		t.fail(srcDir, err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		srcPath := path.Join(srcDir, entry.Name())
+		dstPath := path.Join(dstDir, entry.Name())
+
+		info, err := t.src.Stat(srcPath)
+		if err != nil {
+			t.fail(srcPath, err)
+			continue
+		}
+		if info.IsDir() {
+			t.walk(srcPath, dstPath, info, seen, jobs)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		seen[dstPath] = true
+		jobs <- job{src: srcPath, dst: dstPath, info: info}
+	}
+}
+
+// copyFile copies one file unless it is unchanged
+func (t *transfer) copyFile(j job) {
+	if t.opts.SkipUnchanged {
+		same, err := t.unchanged(j)
+		if err != nil {
+			t.fail(j.dst, err)
+			return
+		}
+		if same {
+			t.report(Event{Action: ActionSkip, Path: j.dst, Bytes: j.info.Size()})
+			return
+		}
+	}
+
+	if t.opts.DryRun {
+		t.report(Event{Action: ActionCopy, Path: j.dst, Bytes: j.info.Size()})
+		return
+	}
+
+	n, err := t.copyContents(j)
+	if err != nil {
+		t.fail(j.dst, err)
+		return
+	}
+
+	// Carry the mtime over so later syncs see the file as unchanged. The
+	// copy itself succeeded, so it is reported before the error.
+	t.report(Event{Action: ActionCopy, Path: j.dst, Bytes: n})
+	if err := t.dst.Chtimes(j.dst, j.info.ModTime(), j.info.ModTime()); err != nil {
+		t.fail(j.dst, fmt.Errorf("failed to set the modification time: %w", err))
+	}
+}
+
+func (t *transfer) copyContents(j job) (int64, error) {
+	in, err := t.src.Open(j.src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := t.dst.OpenFile(j.dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, j.info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// unchanged reports whether the destination already matches the source. A
+// missing destination differs; one that cannot be read is an error.
+func (t *transfer) unchanged(j job) (bool, error) {
+	dstInfo, err := t.dst.Stat(j.dst)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if dstInfo.IsDir() {
+		return false, nil
+	}
+	if !t.opts.Checksum {
+		// Some backends store mtimes at second precision
+		return dstInfo.Size() == j.info.Size() &&
+			dstInfo.ModTime().Truncate(time.Second).Equal(j.info.ModTime().Truncate(time.Second)), nil
+	}
+
+	// Sizes are not compared here: wrappers such as encryptfs report the
+	// stored size, which differs from the content size
+	srcSum, err := checksum(t.src, j.src)
+	if err != nil {
+		return false, fmt.Errorf("source checksum: %w", err)
+	}
+	dstSum, err := checksum(t.dst, j.dst)
+	if err != nil {
+		return false, fmt.Errorf("destination checksum: %w", err)
+	}
+	return bytes.Equal(srcSum, dstSum), nil
+}
+
+func checksum(fs absfs.FileSystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// prune removes destination entries that were not part of the source tree
+func (t *transfer) prune(dir string, seen map[string]bool) {
+	entries, err := t.dst.ReadDir(dir)
+	if err != nil {
+		t.fail(dir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if !seen[p] {
+			if !t.opts.DryRun {
+				if err := t.dst.RemoveAll(p); err != nil {
+					t.fail(p, err)
+					continue
+				}
+			}
+			t.report(Event{Action: ActionDelete, Path: p})
+			continue
+		}
+		if entry.IsDir() {
+			t.prune(p, seen)
+		}
+	}
+}
+
+func clean(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return path.Clean("/" + p)
+}
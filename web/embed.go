@@ -0,0 +1,22 @@
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// dist holds whatever `npm run build` left in web/dist when the server was
+// compiled; before the UI is built that is only .gitkeep
+//
+//go:embed all:dist
+var dist embed.FS
+
+func init() {
+	assets, err := fs.Sub(dist, "dist")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := fs.Stat(assets, "index.html"); err == nil {
+		embedded = assets
+	}
+}
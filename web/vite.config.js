@@ -4,4 +4,14 @@ import { svelte } from '@sveltejs/vite-plugin-svelte'
 // https://vite.dev/config/
 export default defineConfig({
   plugins: [svelte()],
+  server: {
+    // The UI calls the API on its own origin; in development, forward
+    // those calls to fscomposer-server
+    proxy: {
+      '/api': {
+        target: 'http://localhost:8080',
+        ws: true,
+      },
+    },
+  },
 })
@@ -0,0 +1,140 @@
+// Package web serves the studio's web UI. The server embeds the assets
+// `npm run build` left in web/dist when it was compiled; it can also serve
+// them from a directory while the UI is being developed.
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// embedded holds the built UI when web/dist had one at compile time
+var embedded fs.FS
+
+// Embedded returns the UI compiled into the binary, or nil when it was
+// compiled before the UI was built
+func Embedded() fs.FS {
+	return embedded
+}
+
+// Handler serves the UI in assets. Vite's content-hashed files under
+// /assets/ are cached for a year; everything else, including index.html,
+// is revalidated on each load. Paths that match no file and look like
+// client-side routes get index.html. With dev set nothing is cached, so
+// a directory being rebuilt is always served fresh.
+func Handler(assets fs.FS, dev bool) http.Handler {
+	if assets == nil {
+		return http.HandlerFunc(serveNotBuilt)
+	}
+	return &handler{assets: assets, dev: dev, etags: make(map[string]string)}
+}
+
+type handler struct {
+	assets fs.FS
+	dev    bool
+
+	mu    sync.Mutex
+	etags map[string]string // Content hashes of files served so far
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Unknown API paths are errors, not pages
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	data, err := fs.ReadFile(h.assets, name)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		// Client-side routes have no extension; missing assets stay 404
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		name = "index.html"
+		data, err = fs.ReadFile(h.assets, name)
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			serveNotBuilt(w, r)
+			return
+		}
+		http.Error(w, "Failed to read "+name, http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case h.dev:
+		w.Header().Set("Cache-Control", "no-store")
+	case strings.HasPrefix(name, "assets/"):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", h.etag(name, data))
+
+	// ServeContent sets the content type and answers If-None-Match
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// etag returns a strong ETag for a file's content, hashing each file once
+// unless files may change underneath
+func (h *handler) etag(name string, data []byte) string {
+	if !h.dev {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if tag, ok := h.etags[name]; ok {
+			return tag
+		}
+	}
+	sum := sha256.Sum256(data)
+	tag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	if !h.dev {
+		h.etags[name] = tag
+	}
+	return tag
+}
+
+// notBuiltPage is shown when the binary has no UI and no directory is set
+const notBuiltPage = `<!doctype html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>FS Composer</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto">
+<h1>FS Composer</h1>
+<p>The API is running, but this server was compiled before the web UI was built.</p>
+<p>Build the UI and recompile to embed it:</p>
+<pre>cd web &amp;&amp; npm install &amp;&amp; npm run build &amp;&amp; cd ..
+go build ./cmd/fscomposer-server</pre>
+<p>or serve it from disk with <code>fscomposer-server -web web/dist</code>.</p>
+</body>
+</html>
+`
+
+func serveNotBuilt(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, notBuiltPage)
+}